@@ -21,8 +21,9 @@ import (
 
 // DHParams can be used to store finite-field Diffie-Hellman parameters. At any
 // point in time, it is unlikely that both OurPrivate and TheirPrivate will be
-// non-nil.
+// non-nil. NamedGroup is set when the parameters are an RFC 7919 group.
 type DHParams struct {
+	NamedGroup    TLSCurveID
 	Prime         *big.Int
 	Generator     *big.Int
 	ServerPublic  *big.Int
@@ -30,9 +31,11 @@ type DHParams struct {
 	ClientPublic  *big.Int
 	ClientPrivate *big.Int
 	SessionKey    *big.Int
+	Analysis      *DHAnalysis
 }
 
 type auxDHParams struct {
+	NamedGroup    *TLSCurveID      `json:"named_group,omitempty"`
 	Prime         *cryptoParameter `json:"prime"`
 	Generator     *cryptoParameter `json:"generator"`
 	ServerPublic  *cryptoParameter `json:"server_public,omitempty"`
@@ -40,6 +43,7 @@ type auxDHParams struct {
 	ClientPublic  *cryptoParameter `json:"client_public,omitempty"`
 	ClientPrivate *cryptoParameter `json:"client_private,omitempty"`
 	SessionKey    *cryptoParameter `json:"session_key,omitempty"`
+	Analysis      *DHAnalysis      `json:"analysis,omitempty"`
 }
 
 // MarshalJSON implements the json.Marshal interface
@@ -47,6 +51,10 @@ func (p *DHParams) MarshalJSON() ([]byte, error) {
 	aux := auxDHParams{
 		Prime:     &cryptoParameter{Int: p.Prime},
 		Generator: &cryptoParameter{Int: p.Generator},
+		Analysis:  p.Analysis,
+	}
+	if p.NamedGroup != 0 {
+		aux.NamedGroup = &p.NamedGroup
 	}
 	if p.ServerPublic != nil {
 		aux.ServerPublic = &cryptoParameter{Int: p.ServerPublic}
@@ -66,12 +74,22 @@ func (p *DHParams) MarshalJSON() ([]byte, error) {
 	return json.Marshal(aux)
 }
 
+// Analyze runs AnalyzeDHGroup over the prime and generator and stores the
+// result in p.Analysis, which is then included in the JSON output.
+func (p *DHParams) Analyze() *DHAnalysis {
+	p.Analysis = AnalyzeDHGroup(p.Prime, p.Generator)
+	return p.Analysis
+}
+
 // UnmarshalJSON implement the json.Unmarshaler interface
 func (p *DHParams) UnmarshalJSON(b []byte) error {
 	var aux auxDHParams
 	if err := json.Unmarshal(b, &aux); err != nil {
 		return err
 	}
+	if aux.NamedGroup != nil {
+		p.NamedGroup = *aux.NamedGroup
+	}
 	if aux.Prime != nil {
 		p.Prime = aux.Prime.Int
 	}
@@ -93,6 +111,7 @@ func (p *DHParams) UnmarshalJSON(b []byte) error {
 	if aux.SessionKey != nil {
 		p.SessionKey = aux.SessionKey.Int
 	}
+	p.Analysis = aux.Analysis
 	return nil
 }
 
@@ -0,0 +1,166 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package json
+
+import "math/big"
+
+// DHGeneratorOrder describes the order of the subgroup generated by g.
+type DHGeneratorOrder string
+
+const (
+	// DHGeneratorOrderUnknown is used when the order of g could not be
+	// determined, typically because p-1 could not be factored.
+	DHGeneratorOrderUnknown DHGeneratorOrder = "unknown"
+
+	// DHGeneratorOrderInvalid is used when g is outside of [2, p-2]. Such a
+	// generator yields a subgroup of order 1 or 2.
+	DHGeneratorOrderInvalid DHGeneratorOrder = "invalid"
+
+	// DHGeneratorOrderPrimeSubgroup is used when g generates a subgroup of
+	// large prime order q.
+	DHGeneratorOrderPrimeSubgroup DHGeneratorOrder = "prime_order_subgroup"
+
+	// DHGeneratorOrderFullGroup is used when p is a safe prime and g generates
+	// the entire multiplicative group of order p-1.
+	DHGeneratorOrderFullGroup DHGeneratorOrder = "full_group"
+
+	// DHGeneratorOrderComposite is used when the order of g is divisible by
+	// one or more small primes, leaking bits of the private exponent.
+	DHGeneratorOrderComposite DHGeneratorOrder = "composite"
+)
+
+// dhPrimalityRounds is the number of Miller-Rabin rounds used in addition to
+// the Baillie-PSW test run by big.Int.ProbablyPrime.
+const dhPrimalityRounds = 1
+
+// dhSmallFactorBound is the bound for trial division of p-1.
+const dhSmallFactorBound = 1 << 16
+
+// DHAnalysis records the properties of a finite-field Diffie-Hellman group
+// that are relevant to its security.
+type DHAnalysis struct {
+	KnownGroup        string           `json:"known_group,omitempty"`
+	KnownGroupSource  string           `json:"known_group_source,omitempty"`
+	StandardGenerator bool             `json:"standard_generator,omitempty"`
+	PrimeLength       int              `json:"prime_length"`
+	ExportGrade       bool             `json:"export_grade"`
+	Prime             bool             `json:"prime"`
+	SafePrime         bool             `json:"safe_prime"`
+	GeneratorOrder    DHGeneratorOrder `json:"generator_order"`
+	SubgroupLength    int              `json:"subgroup_order_length,omitempty"`
+	SmallFactors      []uint64         `json:"small_subgroup_factors,omitempty"`
+}
+
+// AnalyzeDHGroup identifies the group (p, g), tests p for primality and
+// safe-primality, and determines the order of the subgroup generated by g.
+// Well-known groups are not re-tested. It returns nil if p is nil.
+func AnalyzeDHGroup(p, g *big.Int) *DHAnalysis {
+	if p == nil {
+		return nil
+	}
+	out := new(DHAnalysis)
+	out.PrimeLength = p.BitLen()
+	out.ExportGrade = out.PrimeLength <= 512
+
+	// q is the (possibly unknown) order of the prime-order subgroup
+	var q *big.Int
+	if known := LookupDHGroup(p); known != nil {
+		out.KnownGroup = known.Name
+		out.KnownGroupSource = known.Source
+		out.StandardGenerator = g != nil && g.Cmp(known.Generator) == 0
+		out.Prime = true
+		out.SafePrime = known.SafePrime
+		q = known.Order
+	} else {
+		out.Prime = p.ProbablyPrime(dhPrimalityRounds)
+		if out.Prime {
+			half := new(big.Int).Rsh(p, 1)
+			if out.SafePrime = half.ProbablyPrime(dhPrimalityRounds); out.SafePrime {
+				q = half
+			}
+		}
+	}
+
+	out.GeneratorOrder = DHGeneratorOrderUnknown
+	pMinusOne := new(big.Int).Sub(p, bigOne)
+	if g == nil || g.Cmp(bigOne) <= 0 || g.Cmp(pMinusOne) >= 0 {
+		out.GeneratorOrder = DHGeneratorOrderInvalid
+		return out
+	}
+	if !out.Prime {
+		return out
+	}
+	if !out.SafePrime {
+		// Factor out the small primes of p-1. If what remains is prime, it is
+		// the order of the largest subgroup.
+		var cofactor *big.Int
+		out.SmallFactors, cofactor = smallFactors(pMinusOne)
+		if q == nil && cofactor.Cmp(bigOne) > 0 && cofactor.ProbablyPrime(dhPrimalityRounds) {
+			q = cofactor
+		}
+	}
+	if q == nil {
+		return out
+	}
+	if new(big.Int).Exp(g, q, p).Cmp(bigOne) == 0 {
+		out.GeneratorOrder = DHGeneratorOrderPrimeSubgroup
+		out.SubgroupLength = q.BitLen()
+	} else if out.SafePrime {
+		out.GeneratorOrder = DHGeneratorOrderFullGroup
+		out.SubgroupLength = pMinusOne.BitLen()
+	} else {
+		out.GeneratorOrder = DHGeneratorOrderComposite
+	}
+	return out
+}
+
+var bigOne = big.NewInt(1)
+
+// smallPrimes holds the odd primes below dhSmallFactorBound.
+var smallPrimes = oddPrimesBelow(dhSmallFactorBound)
+
+func oddPrimesBelow(bound uint64) (primes []uint64) {
+	composite := make([]bool, bound)
+	for i := uint64(3); i < bound; i += 2 {
+		if composite[i] {
+			continue
+		}
+		primes = append(primes, i)
+		for j := i * i; j < bound; j += 2 * i {
+			composite[j] = true
+		}
+	}
+	return
+}
+
+// smallFactors returns the distinct odd prime factors of n below
+// dhSmallFactorBound, and the cofactor left after dividing them out (along
+// with any powers of two).
+func smallFactors(n *big.Int) (factors []uint64, cofactor *big.Int) {
+	cofactor = new(big.Int).Rsh(n, n.TrailingZeroBits())
+	d := new(big.Int)
+	m := new(big.Int)
+	for _, f := range smallPrimes {
+		d.SetUint64(f)
+		if m.Mod(cofactor, d).Sign() != 0 {
+			continue
+		}
+		factors = append(factors, f)
+		for m.Mod(cofactor, d).Sign() == 0 {
+			cofactor.Quo(cofactor, d)
+		}
+	}
+	return
+}
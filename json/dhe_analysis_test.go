@@ -0,0 +1,129 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package json
+
+import (
+	"encoding/json"
+	"math/big"
+
+	. "gopkg.in/check.v1"
+)
+
+type DHAnalysisSuite struct {
+	prime1024 *big.Int
+}
+
+var _ = Suite(&DHAnalysisSuite{})
+
+func (s *DHAnalysisSuite) SetUpTest(c *C) {
+	s.prime1024 = new(big.Int).SetBytes(test1024Prime)
+}
+
+func (s *DHAnalysisSuite) TestKnownGroupsAreConsistent(c *C) {
+	for _, g := range KnownDHGroups() {
+		c.Check(LookupDHGroup(g.Prime), Equals, g)
+		c.Check(g.Order.ProbablyPrime(dhPrimalityRounds), Equals, true, Commentf("%s", g.Name))
+		if !g.SafePrime {
+			y := new(big.Int).Exp(g.Generator, g.Order, g.Prime)
+			c.Check(y.Cmp(bigOne), Equals, 0, Commentf("%s", g.Name))
+		}
+	}
+}
+
+func (s *DHAnalysisSuite) TestFFDHE2048(c *C) {
+	var group *DHGroup
+	for _, g := range KnownDHGroups() {
+		if g.Name == "ffdhe2048" {
+			group = g
+		}
+	}
+	c.Assert(group, NotNil)
+	a := AnalyzeDHGroup(group.Prime, big.NewInt(2))
+	c.Check(a.KnownGroup, Equals, "ffdhe2048")
+	c.Check(a.KnownGroupSource, Equals, "RFC 7919")
+	c.Check(a.StandardGenerator, Equals, true)
+	c.Check(a.PrimeLength, Equals, 2048)
+	c.Check(a.ExportGrade, Equals, false)
+	c.Check(a.SafePrime, Equals, true)
+	c.Check(a.GeneratorOrder, Equals, DHGeneratorOrderPrimeSubgroup)
+	c.Check(a.SubgroupLength, Equals, 2047)
+}
+
+func (s *DHAnalysisSuite) TestRFC5114(c *C) {
+	for _, g := range KnownDHGroups() {
+		if g.SafePrime {
+			continue
+		}
+		a := AnalyzeDHGroup(g.Prime, g.Generator)
+		c.Check(a.SafePrime, Equals, false)
+		c.Check(a.GeneratorOrder, Equals, DHGeneratorOrderPrimeSubgroup)
+		c.Check(a.SubgroupLength, Equals, g.Order.BitLen())
+		c.Check(len(a.SmallFactors) > 0, Equals, true)
+	}
+}
+
+func (s *DHAnalysisSuite) TestUnknownSafePrime(c *C) {
+	a := AnalyzeDHGroup(s.prime1024, big.NewInt(2))
+	c.Check(a.KnownGroup, Equals, "")
+	c.Check(a.Prime, Equals, true)
+	c.Check(a.SafePrime, Equals, true)
+	c.Check(a.PrimeLength, Equals, 1024)
+	c.Check(a.SmallFactors, IsNil)
+	c.Check(a.GeneratorOrder == DHGeneratorOrderPrimeSubgroup || a.GeneratorOrder == DHGeneratorOrderFullGroup, Equals, true)
+}
+
+func (s *DHAnalysisSuite) TestCompositeModulus(c *C) {
+	p := new(big.Int).Mul(s.prime1024, big.NewInt(3))
+	a := AnalyzeDHGroup(p, big.NewInt(2))
+	c.Check(a.Prime, Equals, false)
+	c.Check(a.SafePrime, Equals, false)
+	c.Check(a.GeneratorOrder, Equals, DHGeneratorOrderUnknown)
+}
+
+func (s *DHAnalysisSuite) TestInvalidGenerator(c *C) {
+	for _, g := range []*big.Int{big.NewInt(0), big.NewInt(1), new(big.Int).Sub(s.prime1024, bigOne)} {
+		a := AnalyzeDHGroup(s.prime1024, g)
+		c.Check(a.GeneratorOrder, Equals, DHGeneratorOrderInvalid)
+	}
+}
+
+func (s *DHAnalysisSuite) TestExportGrade(c *C) {
+	for _, g := range KnownDHGroups() {
+		a := AnalyzeDHGroup(g.Prime, g.Generator)
+		c.Check(a.ExportGrade, Equals, g.Prime.BitLen() <= 512, Commentf("%s", g.Name))
+	}
+}
+
+func (s *DHAnalysisSuite) TestEncodeDecodeAnalysis(c *C) {
+	params := &DHParams{
+		Prime:     s.prime1024,
+		Generator: big.NewInt(2),
+	}
+	c.Assert(params.Analyze(), NotNil)
+	b, err := json.Marshal(params)
+	c.Assert(err, IsNil)
+	var dec DHParams
+	err = json.Unmarshal(b, &dec)
+	c.Assert(err, IsNil)
+	c.Check(dec.Analysis, DeepEquals, params.Analysis)
+	c.Check(dec.NamedGroup, Equals, TLSCurveID(0))
+
+	params.NamedGroup = FFDHE2048
+	b, err = json.Marshal(params)
+	c.Assert(err, IsNil)
+	err = json.Unmarshal(b, &dec)
+	c.Assert(err, IsNil)
+	c.Check(dec.NamedGroup, Equals, FFDHE2048)
+}
@@ -45,6 +45,11 @@ const (
 	BrainpoolP256r1 TLSCurveID = 26
 	BrainpoolP384r1 TLSCurveID = 27
 	BrainpoolP512r1 TLSCurveID = 28
+	FFDHE2048       TLSCurveID = 256
+	FFDHE3072       TLSCurveID = 257
+	FFDHE4096       TLSCurveID = 258
+	FFDHE6144       TLSCurveID = 259
+	FFDHE8192       TLSCurveID = 260
 )
 
 var ecIDToName map[TLSCurveID]string
@@ -80,6 +85,11 @@ func init() {
 	ecIDToName[BrainpoolP256r1] = "brainpoolp256r1"
 	ecIDToName[BrainpoolP384r1] = "brainpoolp384r1"
 	ecIDToName[BrainpoolP512r1] = "brainpoolp512r1"
+	ecIDToName[FFDHE2048] = "ffdhe2048"
+	ecIDToName[FFDHE3072] = "ffdhe3072"
+	ecIDToName[FFDHE4096] = "ffdhe4096"
+	ecIDToName[FFDHE6144] = "ffdhe6144"
+	ecIDToName[FFDHE8192] = "ffdhe8192"
 
 	ecNameToID = make(map[string]TLSCurveID, 64)
 	ecNameToID["sect163k1"] = Sect163k1
@@ -110,4 +120,9 @@ func init() {
 	ecNameToID["brainpoolp256r1"] = BrainpoolP256r1
 	ecNameToID["brainpoolp384r1"] = BrainpoolP384r1
 	ecNameToID["brainpoolp512r1"] = BrainpoolP512r1
+	ecNameToID["ffdhe2048"] = FFDHE2048
+	ecNameToID["ffdhe3072"] = FFDHE3072
+	ecNameToID["ffdhe4096"] = FFDHE4096
+	ecNameToID["ffdhe6144"] = FFDHE6144
+	ecNameToID["ffdhe8192"] = FFDHE8192
 }
@@ -24,12 +24,14 @@ import (
 // RSAPublicKey provides JSON methods for the standard rsa.PublicKey.
 type RSAPublicKey struct {
 	*rsa.PublicKey
+	Analysis *RSAAnalysis
 }
 
 type auxRSAPublicKey struct {
-	Exponent int    `json:"exponent"`
-	Modulus  []byte `json:"modulus"`
-	Length   int    `json:"length"`
+	Exponent int          `json:"exponent"`
+	Modulus  []byte       `json:"modulus"`
+	Length   int          `json:"length"`
+	Analysis *RSAAnalysis `json:"analysis,omitempty"`
 }
 
 // RSAClientParams are the TLS key exchange parameters for RSA keys.
@@ -46,9 +48,17 @@ func (rp *RSAPublicKey) MarshalJSON() ([]byte, error) {
 		aux.Modulus = rp.N.Bytes()
 		aux.Length = len(aux.Modulus) * 8
 	}
+	aux.Analysis = rp.Analysis
 	return json.Marshal(&aux)
 }
 
+// Analyze runs AnalyzeRSAKey over the key and stores the result in
+// rp.Analysis, which is then included in the JSON output.
+func (rp *RSAPublicKey) Analyze(opts RSAAnalysisOptions) *RSAAnalysis {
+	rp.Analysis = AnalyzeRSAKey(rp.PublicKey, opts)
+	return rp.Analysis
+}
+
 // UnmarshalJSON implements the json.Unmarshal interface
 func (rp *RSAPublicKey) UnmarshalJSON(b []byte) error {
 	var aux auxRSAPublicKey
@@ -63,5 +73,6 @@ func (rp *RSAPublicKey) UnmarshalJSON(b []byte) error {
 	if len(aux.Modulus)*8 != aux.Length {
 		return fmt.Errorf("mismatched length (got %d, field specified %d)", len(aux.Modulus), aux.Length)
 	}
+	rp.Analysis = aux.Analysis
 	return nil
 }
@@ -0,0 +1,357 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package json
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// RSAExponentClass describes the public exponent of an RSA key.
+type RSAExponentClass string
+
+const (
+	// RSAExponentStandard is used when e = 65537.
+	RSAExponentStandard RSAExponentClass = "standard"
+
+	// RSAExponentSmall is used when e is a valid exponent less than 65537,
+	// such as 3 or 17.
+	RSAExponentSmall RSAExponentClass = "small"
+
+	// RSAExponentLarge is used when e is greater than 65537. Large exponents
+	// are sometimes a sign of a small private exponent.
+	RSAExponentLarge RSAExponentClass = "large"
+
+	// RSAExponentInvalid is used when e is less than 3 or even.
+	RSAExponentInvalid RSAExponentClass = "invalid"
+)
+
+// rsaFermatRounds is the number of steps of Fermat's method tried on each
+// modulus. Moduli whose primes share their top half of bits fall in the first
+// few steps.
+const rsaFermatRounds = 128
+
+// RSAAnalysis records weaknesses found in an RSA public key. Factor is set
+// when the analysis recovered a prime factor of the modulus.
+type RSAAnalysis struct {
+	Length           int
+	ExponentClass    RSAExponentClass
+	ROCA             bool
+	DebianWeakKey    bool
+	DebianChecked    bool
+	SmallFactors     []uint64
+	FermatFactorable bool
+	SharedFactor     bool
+	Factor           *big.Int
+	Weak             bool
+}
+
+type auxRSAAnalysis struct {
+	Length           int              `json:"length"`
+	ExponentClass    RSAExponentClass `json:"exponent_class"`
+	ROCA             bool             `json:"roca"`
+	DebianWeakKey    bool             `json:"debian_weak_key"`
+	DebianChecked    bool             `json:"debian_checked"`
+	SmallFactors     []uint64         `json:"small_factors,omitempty"`
+	FermatFactorable bool             `json:"fermat_factorable"`
+	SharedFactor     bool             `json:"shared_factor"`
+	Factor           *cryptoParameter `json:"factor,omitempty"`
+	Weak             bool             `json:"weak"`
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (a *RSAAnalysis) MarshalJSON() ([]byte, error) {
+	aux := auxRSAAnalysis{
+		Length:           a.Length,
+		ExponentClass:    a.ExponentClass,
+		ROCA:             a.ROCA,
+		DebianWeakKey:    a.DebianWeakKey,
+		DebianChecked:    a.DebianChecked,
+		SmallFactors:     a.SmallFactors,
+		FermatFactorable: a.FermatFactorable,
+		SharedFactor:     a.SharedFactor,
+		Weak:             a.Weak,
+	}
+	if a.Factor != nil {
+		aux.Factor = &cryptoParameter{Int: a.Factor}
+	}
+	return json.Marshal(&aux)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (a *RSAAnalysis) UnmarshalJSON(b []byte) error {
+	var aux auxRSAAnalysis
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	a.Length = aux.Length
+	a.ExponentClass = aux.ExponentClass
+	a.ROCA = aux.ROCA
+	a.DebianWeakKey = aux.DebianWeakKey
+	a.DebianChecked = aux.DebianChecked
+	a.SmallFactors = aux.SmallFactors
+	a.FermatFactorable = aux.FermatFactorable
+	a.SharedFactor = aux.SharedFactor
+	a.Factor = nil
+	if aux.Factor != nil {
+		a.Factor = aux.Factor.Int
+	}
+	a.Weak = aux.Weak
+	return nil
+}
+
+// RSAAnalysisOptions configures AnalyzeRSAKey.
+type RSAAnalysisOptions struct {
+	// DebianWeakKeys, if not nil, is checked for the modulus of the key.
+	DebianWeakKeys *RSABlocklist
+}
+
+// AnalyzeRSAKey checks pub for ROCA-vulnerable moduli, Debian weak keys (if
+// opts.DebianWeakKeys is set), small prime factors, primes close enough to be
+// found by Fermat's method, and unusual public exponents. It returns nil if
+// pub is nil.
+func AnalyzeRSAKey(pub *rsa.PublicKey, opts RSAAnalysisOptions) *RSAAnalysis {
+	if pub == nil || pub.N == nil {
+		return nil
+	}
+	out := new(RSAAnalysis)
+	n := pub.N
+	out.Length = n.BitLen()
+	out.ExponentClass = classifyRSAExponent(pub.E)
+	if n.Cmp(bigOne) <= 0 {
+		out.Weak = true
+		return out
+	}
+
+	out.ROCA = isROCAModulus(n)
+	if opts.DebianWeakKeys != nil {
+		out.DebianChecked = true
+		out.DebianWeakKey = opts.DebianWeakKeys.Contains(pub)
+	}
+	out.SmallFactors = rsaSmallFactors(n)
+	if len(out.SmallFactors) > 0 {
+		out.Factor = new(big.Int).SetUint64(out.SmallFactors[0])
+	} else if p := fermatFactor(n, rsaFermatRounds); p != nil {
+		out.FermatFactorable = true
+		out.Factor = p
+	}
+	out.Weak = out.ROCA || out.DebianWeakKey || out.Factor != nil || out.ExponentClass == RSAExponentInvalid
+	return out
+}
+
+// RecordSharedFactor marks the key as sharing the prime factor p with another
+// key, as found by BatchGCD.
+func (a *RSAAnalysis) RecordSharedFactor(p *big.Int) {
+	a.SharedFactor = true
+	a.Weak = true
+	if a.Factor == nil {
+		a.Factor = new(big.Int).Set(p)
+	}
+}
+
+func classifyRSAExponent(e int) RSAExponentClass {
+	switch {
+	case e < 3 || e%2 == 0:
+		return RSAExponentInvalid
+	case e < 65537:
+		return RSAExponentSmall
+	case e == 65537:
+		return RSAExponentStandard
+	default:
+		return RSAExponentLarge
+	}
+}
+
+// rocaPrimes are the primes used by the fingerprint from "The Return of
+// Coppersmith's Attack" (Nemec et al., CCS 2017). The primes of an affected
+// key are of the form k*M + (65537^a mod M), where M is a primorial, so the
+// modulus mod each of these primes lies in the subgroup generated by 65537.
+var rocaPrimes = []int64{3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71, 73, 79, 83, 89, 97, 101, 103, 107, 109, 113, 127, 131, 137, 139, 149, 151, 157, 163, 167}
+
+// rocaSubgroups[i][r] is true if r is a power of 65537 modulo rocaPrimes[i].
+var rocaSubgroups [][]bool
+
+// rocaPrimorial is the product of rocaPrimes.
+var rocaPrimorial = big.NewInt(1)
+
+func init() {
+	rocaSubgroups = make([][]bool, len(rocaPrimes))
+	for i, p := range rocaPrimes {
+		rocaPrimorial.Mul(rocaPrimorial, big.NewInt(p))
+		subgroup := make([]bool, p)
+		g := 65537 % p
+		for x := int64(1); !subgroup[x]; x = x * g % p {
+			subgroup[x] = true
+		}
+		rocaSubgroups[i] = subgroup
+	}
+}
+
+// isROCAModulus returns true if n has the fingerprint of a key generated by
+// the vulnerable Infineon RSALib.
+func isROCAModulus(n *big.Int) bool {
+	r := new(big.Int).Mod(n, rocaPrimorial)
+	m := new(big.Int)
+	d := new(big.Int)
+	for i, p := range rocaPrimes {
+		d.SetInt64(p)
+		if !rocaSubgroups[i][m.Mod(r, d).Int64()] {
+			return false
+		}
+	}
+	return true
+}
+
+// smallPrimeProducts groups smallPrimes into products that fit in a uint64, so
+// that a modulus can be reduced once per group instead of once per prime.
+// smallPrimeGroups[i] holds the primes whose product is smallPrimeProducts[i].
+var smallPrimeProducts, smallPrimeGroups = groupSmallPrimes()
+
+func groupSmallPrimes() (products []uint64, groups [][]uint64) {
+	var group []uint64
+	product := uint64(1)
+	for _, p := range smallPrimes {
+		if product > ^uint64(0)/p {
+			products = append(products, product)
+			groups = append(groups, group)
+			group, product = nil, 1
+		}
+		group = append(group, p)
+		product *= p
+	}
+	if len(group) > 0 {
+		products = append(products, product)
+		groups = append(groups, group)
+	}
+	return
+}
+
+// rsaSmallFactors returns the distinct prime factors of n below
+// dhSmallFactorBound.
+func rsaSmallFactors(n *big.Int) (factors []uint64) {
+	if n.Bit(0) == 0 {
+		factors = append(factors, 2)
+	}
+	d := new(big.Int)
+	m := new(big.Int)
+	for i, product := range smallPrimeProducts {
+		d.SetUint64(product)
+		r := m.Mod(n, d).Uint64()
+		for _, p := range smallPrimeGroups[i] {
+			if r%p == 0 && n.Cmp(d.SetUint64(p)) != 0 {
+				factors = append(factors, p)
+			}
+		}
+	}
+	return
+}
+
+// fermatFactor runs rounds steps of Fermat's method on n, returning the
+// smaller prime factor if one was found.
+func fermatFactor(n *big.Int, rounds int) *big.Int {
+	if n.Bit(0) == 0 {
+		return nil
+	}
+	a := new(big.Int).Sqrt(n)
+	b2 := new(big.Int)
+	if b2.Mul(a, a).Cmp(n) < 0 {
+		a.Add(a, bigOne)
+	}
+	b := new(big.Int)
+	for i := 0; i < rounds; i++ {
+		b2.Mul(a, a)
+		b2.Sub(b2, n)
+		b.Sqrt(b2)
+		if b.Mul(b, b).Cmp(b2) == 0 {
+			p := new(big.Int).Sub(a, b.Sqrt(b2))
+			if p.Cmp(bigOne) > 0 {
+				return p
+			}
+			return nil
+		}
+		a.Add(a, bigOne)
+	}
+	return nil
+}
+
+// RSABlocklist is a set of known-compromised RSA moduli, such as the lists of
+// keys generated by Debian's OpenSSL between 2006 and 2008 (CVE-2008-0166)
+// shipped in the openssl-blacklist package. Entries are the hex-encoded SHA-1
+// of "Modulus=<N in upper-case hex>\n", or the last 20 characters of it. It
+// is safe for concurrent use.
+type RSABlocklist struct {
+	mu      sync.RWMutex
+	entries map[string]bool
+}
+
+// NewRSABlocklist returns an empty blocklist.
+func NewRSABlocklist() *RSABlocklist {
+	return &RSABlocklist{entries: make(map[string]bool)}
+}
+
+// Load reads entries, one per line, from r. Blank lines and lines starting
+// with '#' are ignored.
+func (b *RSABlocklist) Load(r io.Reader) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if len(entry) == 0 || entry[0] == '#' {
+			continue
+		}
+		if _, err := hex.DecodeString(entry); err != nil || (len(entry) != 20 && len(entry) != 40) {
+			return fmt.Errorf("invalid blocklist entry on line %d", line)
+		}
+		b.entries[entry[len(entry)-20:]] = true
+	}
+	return scanner.Err()
+}
+
+// Add adds the modulus of pub to the blocklist.
+func (b *RSABlocklist) Add(pub *rsa.PublicKey) {
+	key := rsaBlocklistKey(pub.N)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[key] = true
+}
+
+// Len returns the number of entries in the blocklist.
+func (b *RSABlocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.entries)
+}
+
+// Contains returns true if the modulus of pub is in the blocklist.
+func (b *RSABlocklist) Contains(pub *rsa.PublicKey) bool {
+	key := rsaBlocklistKey(pub.N)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.entries[key]
+}
+
+func rsaBlocklistKey(n *big.Int) string {
+	digest := sha1.Sum([]byte(fmt.Sprintf("Modulus=%X\n", n)))
+	return hex.EncodeToString(digest[:])[20:]
+}
@@ -0,0 +1,178 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package json
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"math/big"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type RSAAnalysisSuite struct {
+	key *rsa.PrivateKey
+}
+
+var _ = Suite(&RSAAnalysisSuite{})
+
+func (s *RSAAnalysisSuite) SetUpSuite(c *C) {
+	var err error
+	s.key, err = rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+}
+
+func randomPrime(c *C, bits int) *big.Int {
+	p, err := rand.Prime(rand.Reader, bits)
+	c.Assert(err, IsNil)
+	return p
+}
+
+// rocaPrime returns a prime of the form k*M + (65537^a mod M), as generated by
+// the vulnerable Infineon library.
+func rocaPrime(c *C, bits int) *big.Int {
+	g := big.NewInt(65537)
+	for {
+		k, err := rand.Int(rand.Reader, new(big.Int).Lsh(bigOne, uint(bits-rocaPrimorial.BitLen())))
+		c.Assert(err, IsNil)
+		a, err := rand.Int(rand.Reader, rocaPrimorial)
+		c.Assert(err, IsNil)
+		p := new(big.Int).Mul(k, rocaPrimorial)
+		p.Add(p, new(big.Int).Exp(g, a, rocaPrimorial))
+		if p.ProbablyPrime(20) {
+			return p
+		}
+	}
+}
+
+func (s *RSAAnalysisSuite) TestGoodKey(c *C) {
+	a := AnalyzeRSAKey(&s.key.PublicKey, RSAAnalysisOptions{})
+	c.Assert(a, NotNil)
+	c.Check(a.Length, Equals, 1024)
+	c.Check(a.ExponentClass, Equals, RSAExponentStandard)
+	c.Check(a.ROCA, Equals, false)
+	c.Check(a.SmallFactors, IsNil)
+	c.Check(a.FermatFactorable, Equals, false)
+	c.Check(a.Factor, IsNil)
+	c.Check(a.Weak, Equals, false)
+}
+
+func (s *RSAAnalysisSuite) TestROCA(c *C) {
+	n := new(big.Int).Mul(rocaPrime(c, 512), rocaPrime(c, 512))
+	a := AnalyzeRSAKey(&rsa.PublicKey{N: n, E: 65537}, RSAAnalysisOptions{})
+	c.Check(a.ROCA, Equals, true)
+	c.Check(a.Weak, Equals, true)
+}
+
+func (s *RSAAnalysisSuite) TestSmallFactors(c *C) {
+	n := new(big.Int).Mul(randomPrime(c, 512), big.NewInt(3*65521))
+	a := AnalyzeRSAKey(&rsa.PublicKey{N: n, E: 65537}, RSAAnalysisOptions{})
+	c.Check(a.SmallFactors, DeepEquals, []uint64{3, 65521})
+	c.Check(a.Factor.Int64(), Equals, int64(3))
+	c.Check(a.Weak, Equals, true)
+
+	n.Lsh(n, 1)
+	a = AnalyzeRSAKey(&rsa.PublicKey{N: n, E: 65537}, RSAAnalysisOptions{})
+	c.Check(a.SmallFactors[0], Equals, uint64(2))
+}
+
+func (s *RSAAnalysisSuite) TestFermat(c *C) {
+	p := randomPrime(c, 512)
+	q := new(big.Int).Add(p, big.NewInt(2))
+	for !q.ProbablyPrime(20) {
+		q.Add(q, big.NewInt(2))
+	}
+	a := AnalyzeRSAKey(&rsa.PublicKey{N: new(big.Int).Mul(p, q), E: 65537}, RSAAnalysisOptions{})
+	c.Check(a.FermatFactorable, Equals, true)
+	c.Check(a.Factor, DeepEquals, p)
+	c.Check(a.Weak, Equals, true)
+}
+
+func (s *RSAAnalysisSuite) TestExponents(c *C) {
+	tests := map[int]RSAExponentClass{
+		1:         RSAExponentInvalid,
+		2:         RSAExponentInvalid,
+		3:         RSAExponentSmall,
+		17:        RSAExponentSmall,
+		65537:     RSAExponentStandard,
+		1 << 20:   RSAExponentInvalid,
+		1<<20 + 1: RSAExponentLarge,
+	}
+	for e, class := range tests {
+		a := AnalyzeRSAKey(&rsa.PublicKey{N: s.key.N, E: e}, RSAAnalysisOptions{})
+		c.Check(a.ExponentClass, Equals, class, Commentf("e = %d", e))
+		c.Check(a.Weak, Equals, class == RSAExponentInvalid, Commentf("e = %d", e))
+	}
+}
+
+func (s *RSAAnalysisSuite) TestDebianBlocklist(c *C) {
+	a := AnalyzeRSAKey(&s.key.PublicKey, RSAAnalysisOptions{})
+	c.Check(a.DebianChecked, Equals, false)
+
+	blocklist := NewRSABlocklist()
+	list := "# comment\n\n" + rsaBlocklistKey(s.key.N) + "\n"
+	c.Assert(blocklist.Load(strings.NewReader(list)), IsNil)
+	c.Check(blocklist.Len(), Equals, 1)
+	a = AnalyzeRSAKey(&s.key.PublicKey, RSAAnalysisOptions{DebianWeakKeys: blocklist})
+	c.Check(a.DebianChecked, Equals, true)
+	c.Check(a.DebianWeakKey, Equals, true)
+	c.Check(a.Weak, Equals, true)
+
+	other := &rsa.PublicKey{N: new(big.Int).Add(s.key.N, big.NewInt(2)), E: 65537}
+	c.Check(blocklist.Contains(other), Equals, false)
+	blocklist.Add(other)
+	c.Check(blocklist.Contains(other), Equals, true)
+
+	c.Check(NewRSABlocklist().Load(strings.NewReader("not hex\n")), ErrorMatches, ".*line 1")
+}
+
+func (s *RSAAnalysisSuite) TestBatchGCD(c *C) {
+	p1, p2, p3 := randomPrime(c, 256), randomPrime(c, 256), randomPrime(c, 256)
+	q1, q2 := randomPrime(c, 256), randomPrime(c, 256)
+	moduli := []*big.Int{
+		new(big.Int).Mul(p1, q1),
+		new(big.Int).Mul(p1, q2),
+		new(big.Int).Mul(p2, p3),
+		new(big.Int).Mul(p2, q2),
+		new(big.Int).Mul(p3, q1),
+		new(big.Int).Mul(p1, q1),
+		s.key.N,
+		s.key.N,
+	}
+	factors := BatchGCD(moduli)
+	c.Assert(factors, HasLen, len(moduli))
+	for i, f := range factors[:6] {
+		c.Assert(f, NotNil, Commentf("modulus %d", i))
+		c.Check(new(big.Int).Mod(moduli[i], f).Sign(), Equals, 0)
+		c.Check(f.Cmp(bigOne) > 0 && f.Cmp(moduli[i]) < 0, Equals, true)
+	}
+	c.Check(factors[6], IsNil)
+	c.Check(factors[7], IsNil)
+	c.Check(BatchGCD([]*big.Int{s.key.N}), DeepEquals, []*big.Int{nil})
+}
+
+func (s *RSAAnalysisSuite) TestEncodeDecodeAnalysis(c *C) {
+	key := &RSAPublicKey{PublicKey: &s.key.PublicKey}
+	c.Assert(key.Analyze(RSAAnalysisOptions{}), NotNil)
+	key.Analysis.RecordSharedFactor(s.key.Primes[0])
+	b, err := json.Marshal(key)
+	c.Assert(err, IsNil)
+	var dec RSAPublicKey
+	c.Assert(json.Unmarshal(b, &dec), IsNil)
+	c.Check(dec.Analysis, DeepEquals, key.Analysis)
+	c.Check(dec.Analysis.SharedFactor, Equals, true)
+}
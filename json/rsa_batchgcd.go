@@ -0,0 +1,112 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package json
+
+import "math/big"
+
+// BatchGCD finds moduli that share a prime factor with another modulus in the
+// corpus, using Bernstein's product and remainder trees ("Mining Your Ps and
+// Qs", Heninger et al., USENIX Security 2012). The result has one entry per
+// modulus: a non-trivial factor of that modulus, or nil if none was found.
+// Duplicated moduli are only compared once, and a duplicate is not reported
+// unless it shares a prime with a different modulus. All moduli must be
+// greater than one.
+func BatchGCD(moduli []*big.Int) []*big.Int {
+	// Duplicated keys are common in scan corpora. Build the trees over the
+	// distinct moduli, and index the moduli into them.
+	var distinct []*big.Int
+	index := make([]int, len(moduli))
+	seen := make(map[string]int, len(moduli))
+	for i, n := range moduli {
+		key := string(n.Bytes())
+		j, ok := seen[key]
+		if !ok {
+			j = len(distinct)
+			seen[key] = j
+			distinct = append(distinct, n)
+		}
+		index[i] = j
+	}
+
+	factors := batchGCDDistinct(distinct)
+	out := make([]*big.Int, len(moduli))
+	for i, j := range index {
+		out[i] = factors[j]
+	}
+	return out
+}
+
+// batchGCDDistinct is BatchGCD over moduli that are all distinct.
+func batchGCDDistinct(moduli []*big.Int) []*big.Int {
+	if len(moduli) < 2 {
+		return make([]*big.Int, len(moduli))
+	}
+
+	// The bottom level of the product tree is the moduli themselves, and
+	// the top level is their product.
+	tree := [][]*big.Int{moduli}
+	for level := moduli; len(level) > 1; {
+		next := make([]*big.Int, (len(level)+1)/2)
+		for i := range next {
+			if 2*i+1 < len(level) {
+				next[i] = new(big.Int).Mul(level[2*i], level[2*i+1])
+			} else {
+				next[i] = level[2*i]
+			}
+		}
+		tree = append(tree, next)
+		level = next
+	}
+
+	// Walk back down, reducing the product modulo the square of each node.
+	remainders := tree[len(tree)-1]
+	for l := len(tree) - 2; l >= 0; l-- {
+		level := tree[l]
+		next := make([]*big.Int, len(level))
+		square := new(big.Int)
+		for i, n := range level {
+			square.Mul(n, n)
+			next[i] = new(big.Int).Mod(remainders[i/2], square)
+		}
+		remainders = next
+	}
+
+	out := make([]*big.Int, len(moduli))
+	for i, n := range moduli {
+		// remainders[i] / n is the product of every other modulus, mod n
+		r := new(big.Int).Quo(remainders[i], n)
+		g := r.GCD(nil, nil, r, n)
+		if g.Cmp(bigOne) == 0 {
+			continue
+		}
+		if g.Cmp(n) != 0 {
+			out[i] = g
+			continue
+		}
+		// Every prime of n is shared with other moduli. Fall back to
+		// comparing against each other modulus.
+		for j, m := range moduli {
+			if j == i {
+				continue
+			}
+			g := new(big.Int).GCD(nil, nil, n, m)
+			if g.Cmp(bigOne) != 0 && g.Cmp(n) != 0 {
+				out[i] = g
+				break
+			}
+		}
+	}
+	return out
+}
@@ -5,6 +5,7 @@
 package tls
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -35,6 +36,18 @@ func TestDHECiphersImplemented(t *testing.T) {
 	}
 }
 
+func TestDHECipherSuiteFlag(t *testing.T) {
+	for _, suite := range implementedCipherSuites {
+		name := nameForSuite(suite.id)
+		if want := strings.Contains(name, "_DHE_"); isDHECipherSuite(suite.id) != want {
+			t.Errorf("%s: isDHECipherSuite is %t, want %t", name, !want, want)
+		}
+	}
+	if isDHECipherSuite(TLS_DH_ANON_EXPORT_WITH_RC4_40_MD5) {
+		t.Error("an anonymous suite is DHE")
+	}
+}
+
 /*
 func TestSafariCiphersImplemented(t *testing.T) {
 	for _, cipherID := range SafariCiphers {
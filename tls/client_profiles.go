@@ -0,0 +1,302 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// Indexes of the GREASE values chosen for each connection, following
+// BoringSSL.
+const (
+	greaseCipher = iota
+	greaseGroup
+	greaseExtension1
+	greaseExtension2
+	greaseLastIndex
+)
+
+// ClientHelloProfile is a named, versioned ClientHello sent by a well-known
+// client. Use NewConfiguration to get a ClientFingerprintConfiguration that
+// reproduces it.
+type ClientHelloProfile struct {
+	// Client is the name of the client, such as "chrome".
+	Client string
+
+	// Version is the client version the hello was taken from.
+	Version string
+
+	build func(grease []uint16) *ClientFingerprintConfiguration
+}
+
+// ID returns the profile's name, such as "chrome_58".
+func (p *ClientHelloProfile) ID() string {
+	return p.Client + "_" + p.Version
+}
+
+// NewConfiguration returns a new ClientFingerprintConfiguration for the
+// profile, with GREASE values chosen at random as the client does. The
+// handshake autopopulates extensions in place, so each connection needs its
+// own configuration.
+func (p *ClientHelloProfile) NewConfiguration() (*ClientFingerprintConfiguration, error) {
+	seed := make([]byte, greaseLastIndex)
+	if _, err := io.ReadFull(rand.Reader, seed); err != nil {
+		return nil, errors.New("tls: short read from Rand: " + err.Error())
+	}
+	return p.build(greaseValues(seed)), nil
+}
+
+// greaseValues turns each seed byte into a GREASE value. The two extension
+// values are kept distinct, since a hello may not repeat an extension.
+func greaseValues(seed []byte) []uint16 {
+	values := make([]uint16, len(seed))
+	for i, b := range seed {
+		v := uint16(b&0xf0) | 0x0a
+		values[i] = v<<8 | v
+	}
+	if values[greaseExtension1] == values[greaseExtension2] {
+		values[greaseExtension2] ^= 0x1010
+	}
+	return values
+}
+
+// Client profiles, checked against the hellos recorded in testdata. The
+// browser profiles are of their 2017 releases, and offer at most TLS 1.2.
+//
+// TODO: add a JDK profile, and profiles of current Chrome, Firefox and Safari
+// releases, each with a reference hello recorded from that client.
+var (
+	ProfileChrome58 = &ClientHelloProfile{Client: "chrome", Version: "58", build: chrome58}
+
+	ProfileFirefox55 = &ClientHelloProfile{Client: "firefox", Version: "55", build: firefox55}
+
+	ProfileSafari11 = &ClientHelloProfile{Client: "safari", Version: "11", build: safari11}
+
+	ProfileCurl788 = &ClientHelloProfile{Client: "curl", Version: "7.88", build: curl788}
+)
+
+// ClientHelloProfiles lists every available profile.
+var ClientHelloProfiles = []*ClientHelloProfile{
+	ProfileChrome58,
+	ProfileFirefox55,
+	ProfileSafari11,
+	ProfileCurl788,
+}
+
+// LookupClientHelloProfile returns the profile with the given ID, or nil.
+func LookupClientHelloProfile(id string) *ClientHelloProfile {
+	for _, p := range ClientHelloProfiles {
+		if p.ID() == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func chrome58(grease []uint16) *ClientFingerprintConfiguration {
+	return &ClientFingerprintConfiguration{
+		HandshakeVersion: VersionTLS12,
+		RandomSessionID:  32,
+		CipherSuites: []uint16{
+			grease[greaseCipher],
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_RSA_WITH_AES_128_CBC_SHA,
+			TLS_RSA_WITH_AES_256_CBC_SHA,
+			TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		},
+		CompressionMethods: []uint8{compressionNone},
+		Extensions: []ClientExtension{
+			&GREASEExtension{Value: grease[greaseExtension1]},
+			&SecureRenegotiationExtension{},
+			&SNIExtension{Autopopulate: true},
+			&ExtendedMasterSecretExtension{},
+			&SessionTicketExtension{Autopopulate: true},
+			&SignatureAlgorithmExtension{SignatureAndHashes: []uint16{
+				0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601, 0x0201,
+			}},
+			&StatusRequestExtension{},
+			&SCTExtension{},
+			&ALPNExtension{Protocols: []string{"h2", "http/1.1"}},
+			&ChannelIDExtension{},
+			&PointFormatExtension{Formats: []uint8{pointFormatUncompressed}},
+			&SupportedCurvesExtension{Curves: []CurveID{
+				CurveID(grease[greaseGroup]), Curve25519, CurveP256r1, CurveP384r1,
+			}},
+			&GREASEExtension{Value: grease[greaseExtension2], Body: []byte{0}},
+			&PaddingExtension{Autopopulate: true},
+		},
+	}
+}
+
+func firefox55(grease []uint16) *ClientFingerprintConfiguration {
+	return &ClientFingerprintConfiguration{
+		HandshakeVersion: VersionTLS12,
+		CipherSuites: []uint16{
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_DHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_DHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_RSA_WITH_AES_128_CBC_SHA,
+			TLS_RSA_WITH_AES_256_CBC_SHA,
+			TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		},
+		CompressionMethods: []uint8{compressionNone},
+		Extensions: []ClientExtension{
+			&SNIExtension{Autopopulate: true},
+			&ExtendedMasterSecretExtension{},
+			&SecureRenegotiationExtension{},
+			&SupportedCurvesExtension{Curves: []CurveID{
+				Curve25519, CurveP256r1, CurveP384r1, CurveP521r1,
+			}},
+			&PointFormatExtension{Formats: []uint8{pointFormatUncompressed}},
+			&SessionTicketExtension{Autopopulate: true},
+			&ALPNExtension{Protocols: []string{"h2", "http/1.1"}},
+			&StatusRequestExtension{},
+			&SignatureAlgorithmExtension{SignatureAndHashes: []uint16{
+				0x0403, 0x0503, 0x0603, 0x0804, 0x0805, 0x0806, 0x0401, 0x0501, 0x0601, 0x0203, 0x0201,
+			}},
+			&PaddingExtension{Autopopulate: true},
+		},
+	}
+}
+
+func safari11(grease []uint16) *ClientFingerprintConfiguration {
+	return &ClientFingerprintConfiguration{
+		HandshakeVersion: VersionTLS12,
+		CipherSuites: []uint16{
+			TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA384,
+			TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_RSA_WITH_AES_256_CBC_SHA256,
+			TLS_RSA_WITH_AES_128_CBC_SHA256,
+			TLS_RSA_WITH_AES_256_CBC_SHA,
+			TLS_RSA_WITH_AES_128_CBC_SHA,
+		},
+		CompressionMethods: []uint8{compressionNone},
+		Extensions: []ClientExtension{
+			&SecureRenegotiationExtension{},
+			&SNIExtension{Autopopulate: true},
+			&ExtendedMasterSecretExtension{},
+			&SignatureAlgorithmExtension{SignatureAndHashes: []uint16{
+				0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601, 0x0201,
+			}},
+			&StatusRequestExtension{},
+			&NextProtocolNegotiationExtension{},
+			&SCTExtension{},
+			&ALPNExtension{Protocols: []string{"h2", "h2-16", "h2-15", "h2-14", "spdy/3.1", "spdy/3", "http/1.1"}},
+			&PointFormatExtension{Formats: []uint8{pointFormatUncompressed}},
+			&SupportedCurvesExtension{Curves: []CurveID{
+				Curve25519, CurveP256r1, CurveP384r1, CurveP521r1,
+			}},
+		},
+	}
+}
+
+// curl788 is curl 7.88 built against OpenSSL 3.0. The hello offers TLS 1.3,
+// but the handshake fails if the server selects it.
+func curl788(grease []uint16) *ClientFingerprintConfiguration {
+	return &ClientFingerprintConfiguration{
+		HandshakeVersion: VersionTLS12,
+		RandomSessionID:  32,
+		CipherSuites: []uint16{
+			0x1302, // TLS_AES_256_GCM_SHA384
+			0x1303, // TLS_CHACHA20_POLY1305_SHA256
+			0x1301, // TLS_AES_128_GCM_SHA256
+			TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_DHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_DHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_DHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA384,
+			TLS_DHE_RSA_WITH_AES_256_CBC_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+			TLS_DHE_RSA_WITH_AES_128_CBC_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_DHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_DHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_RSA_WITH_AES_256_CBC_SHA256,
+			TLS_RSA_WITH_AES_128_CBC_SHA256,
+			TLS_RSA_WITH_AES_256_CBC_SHA,
+			TLS_RSA_WITH_AES_128_CBC_SHA,
+			TLS_RENEGO_PROTECTION_REQUEST,
+		},
+		CompressionMethods: []uint8{compressionNone},
+		Extensions: []ClientExtension{
+			&SNIExtension{Autopopulate: true},
+			&PointFormatExtension{Formats: []uint8{
+				pointFormatUncompressed, pointFormatCompressedPrime, pointFormatCompressedChar2,
+			}},
+			&SupportedCurvesExtension{Curves: []CurveID{
+				Curve25519, CurveP256r1, Curve448, CurveP521r1, CurveP384r1,
+				CurveFFDHE2048, CurveFFDHE3072, CurveFFDHE4096, CurveFFDHE6144, CurveFFDHE8192,
+			}},
+			&ALPNExtension{Protocols: []string{"h2", "http/1.1"}},
+			&EncryptThenMACExtension{},
+			&ExtendedMasterSecretExtension{},
+			&PostHandshakeAuthExtension{},
+			&SignatureAlgorithmExtension{SignatureAndHashes: []uint16{
+				0x0403, 0x0503, 0x0603, 0x0807, 0x0808, 0x0809, 0x080a, 0x080b, 0x0804, 0x0805,
+				0x0806, 0x0401, 0x0501, 0x0601, 0x0303, 0x0301, 0x0302, 0x0402, 0x0502, 0x0602,
+			}},
+			&SupportedVersionsExtension{Versions: []uint16{VersionTLS13, VersionTLS12, VersionTLS11, VersionTLS10}},
+			&PSKKeyExchangeModesExtension{Modes: []uint8{1}},
+			&KeyShareExtension{Shares: []KeyShare{{Group: Curve25519}}},
+			&PaddingExtension{Autopopulate: true},
+		},
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// marshalProfile marshals p for serverName with an all-zero client random and
+// the GREASE values BoringSSL derives from an all-zero seed.
+func marshalProfile(p *ClientHelloProfile, serverName string) ([]byte, error) {
+	hello := p.build(greaseValues(make([]byte, greaseLastIndex)))
+	hello.ClientRandom = make([]byte, 32)
+	for _, ext := range hello.Extensions {
+		if ks, ok := ext.(*KeyShareExtension); ok {
+			for i := range ks.Shares {
+				if ks.Shares[i].Data == nil {
+					ks.Shares[i].Data = make([]byte, 32)
+				}
+			}
+		}
+	}
+	config := &Config{ServerName: serverName, ClientFingerprintConfiguration: hello}
+	if err := hello.WriteToConfig(config); err != nil {
+		return nil, err
+	}
+	return hello.marshal(config)
+}
+
+// The reference hellos in testdata were produced by the uTLS parrots of the
+// same clients for "example.com", with the random and session ID cleared. The
+// curl hello was captured from curl 7.88.1 with OpenSSL 3.0, with its x25519
+// key share zeroed as well.
+func TestClientHelloProfiles(t *testing.T) {
+	for _, p := range ClientHelloProfiles {
+		b, err := ioutil.ReadFile(filepath.Join("testdata", "ClientHello-"+p.ID()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := hex.DecodeString(strings.Join(strings.Fields(string(b)), ""))
+		if err != nil {
+			t.Fatalf("%s: %s", p.ID(), err)
+		}
+		got, err := marshalProfile(p, "example.com")
+		if err != nil {
+			t.Errorf("%s: %s", p.ID(), err)
+			continue
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("%s: got hello\n%x\nexpected\n%x", p.ID(), got, expected)
+		}
+		if LookupClientHelloProfile(p.ID()) != p {
+			t.Errorf("could not look up %s", p.ID())
+		}
+	}
+}
+
+func TestClientHelloProfilePadding(t *testing.T) {
+	b, err := marshalProfile(ProfileChrome58, strings.Repeat("a", 80)+".example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 0x200 {
+		t.Errorf("padded hello is %d bytes long", len(b))
+	}
+	b, err = marshalProfile(ProfileChrome58, strings.Repeat("a", 400)+".example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello := new(clientHelloMsg); !hello.unmarshal(b) {
+		t.Fatal("could not parse unpadded hello")
+	}
+	if f, _ := parseHelloFields(b, true); f.extensions[len(f.extensions)-1] == extensionPadding {
+		t.Error("hello longer than 512 bytes was padded")
+	}
+}
+
+func TestGREASEValues(t *testing.T) {
+	values := greaseValues([]byte{0x00, 0x3f, 0xa5, 0xaf})
+	expected := []uint16{0x0a0a, 0x3a3a, 0xaaaa, 0xbaba}
+	for i := range values {
+		if values[i] != expected[i] {
+			t.Errorf("GREASE value %d is %#04x, expected %#04x", i, values[i], expected[i])
+		}
+	}
+	for i := 0; i < 10; i++ {
+		hello, err := ProfileChrome58.NewConfiguration()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := hello.CheckImplementedExtensions(); err != nil {
+			t.Fatal(err)
+		}
+		if !isGREASE(hello.CipherSuites[0]) {
+			t.Errorf("first cipher suite %#04x is not GREASE", hello.CipherSuites[0])
+		}
+	}
+}
+
+func TestClientHelloProfileHandshake(t *testing.T) {
+	for _, p := range ClientHelloProfiles {
+		hello, err := p.NewConfiguration()
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConfig := &Config{
+			InsecureSkipVerify:             true,
+			ClientFingerprintConfiguration: hello,
+		}
+		c, s := net.Pipe()
+		done := make(chan error)
+		go func() {
+			cli := Client(c, clientConfig)
+			err := cli.Handshake()
+			c.Close()
+			done <- err
+		}()
+		server := Server(s, testConfig.Clone())
+		serverErr := server.Handshake()
+		s.Close()
+		if err := <-done; err != nil || serverErr != nil {
+			t.Errorf("%s: handshake failed: client %v, server %v", p.ID(), err, serverErr)
+		}
+	}
+}
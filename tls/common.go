@@ -21,6 +21,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/zmap/zcrypto/verifier"
 	"github.com/zmap/zcrypto/x509"
 )
 
@@ -29,6 +30,17 @@ const (
 	VersionTLS10 = 0x0301
 	VersionTLS11 = 0x0302
 	VersionTLS12 = 0x0303
+
+	// VersionTLS13 may be advertised with SupportedVersionsExtension, but
+	// TLS 1.3 handshakes are not implemented.
+	VersionTLS13 = 0x0304
+
+	// DTLS versions are only used on the wire and in handshake logs. DTLS
+	// connections are configured with, and report in ConnectionState, the
+	// TLS version each is based on: VersionTLS11 for DTLS 1.0, and
+	// VersionTLS12 for DTLS 1.2.
+	VersionDTLS10 = 0xfeff
+	VersionDTLS12 = 0xfefd
 )
 
 const (
@@ -73,7 +85,8 @@ const (
 
 // TLS compression types.
 const (
-	compressionNone uint8 = 0
+	compressionNone    uint8 = 0
+	compressionDeflate uint8 = 1
 )
 
 // TLS extension numbers
@@ -90,6 +103,16 @@ const (
 	extensionRenegotiationInfo    uint16 = 0xff01
 	extensionExtendedRandom       uint16 = 0x0028 // not IANA assigned
 	extensionSCT                  uint16 = 18
+	extensionPadding              uint16 = 21
+	extensionEncryptThenMAC       uint16 = 22
+	extensionCompressCertificate  uint16 = 27
+	extensionRecordSizeLimit      uint16 = 28
+	extensionSupportedVersions    uint16 = 43
+	extensionPSKKeyExchangeModes  uint16 = 45
+	extensionPostHandshakeAuth    uint16 = 49
+	extensionKeyShare             uint16 = 51
+	extensionChannelIDOld         uint16 = 30031 // not IANA assigned
+	extensionChannelID            uint16 = 30032 // not IANA assigned
 )
 
 // TLS signaling cipher suite values
@@ -132,8 +155,21 @@ const (
 	CurveBrainpoolP512r1 CurveID = 28
 	Curve25519           CurveID = 29
 	Curve448             CurveID = 30
+
+	// Finite-field Diffie-Hellman groups, see RFC 7919
+	CurveFFDHE2048 CurveID = 256
+	CurveFFDHE3072 CurveID = 257
+	CurveFFDHE4096 CurveID = 258
+	CurveFFDHE6144 CurveID = 259
+	CurveFFDHE8192 CurveID = 260
 )
 
+// isFFDHE returns true if id is in the range reserved for finite-field
+// Diffie-Hellman groups (RFC 7919, Section 2), whether or not it is known.
+func isFFDHE(id CurveID) bool {
+	return id >= 256 && id <= 511
+}
+
 func (curveID *CurveID) MarshalJSON() ([]byte, error) {
 	buf := make([]byte, 2)
 	buf[0] = byte(*curveID >> 8)
@@ -173,7 +209,9 @@ type PointFormat uint8
 // TLS Elliptic Curve Point Formats
 // http://www.iana.org/assignments/tls-parameters/tls-parameters.xml#tls-parameters-9
 const (
-	pointFormatUncompressed uint8 = 0
+	pointFormatUncompressed    uint8 = 0
+	pointFormatCompressedPrime uint8 = 1
+	pointFormatCompressedChar2 uint8 = 2
 )
 
 func (pFormat *PointFormat) MarshalJSON() ([]byte, error) {
@@ -237,6 +275,10 @@ const (
 	hashSHA256 uint8 = 4
 	hashSHA384 uint8 = 5
 	hashSHA512 uint8 = 6
+
+	// hashIntrinsic is the first byte of the RSASSA-PSS signature schemes
+	// (RFC 8446, section 4.2.3), whose hash is given by the second byte.
+	hashIntrinsic uint8 = 8
 )
 
 // Signature algorithms for TLS 1.2 (See RFC 5246, section A.4.1)
@@ -244,6 +286,17 @@ const (
 	signatureRSA   uint8 = 1
 	signatureDSA   uint8 = 2
 	signatureECDSA uint8 = 3
+
+	// Second bytes of the RSASSA-PSS and EdDSA signature schemes, paired
+	// with hashIntrinsic
+	signatureRSAPSSRSAESHA256 uint8 = 4
+	signatureRSAPSSRSAESHA384 uint8 = 5
+	signatureRSAPSSRSAESHA512 uint8 = 6
+	signatureEd25519          uint8 = 7
+	signatureEd448            uint8 = 8
+	signatureRSAPSSPSSSHA256  uint8 = 9
+	signatureRSAPSSPSSSHA384  uint8 = 10
+	signatureRSAPSSPSSSHA512  uint8 = 11
 )
 
 // signatureAndHash mirrors the TLS 1.2, SignatureAndHashAlgorithm struct. See
@@ -275,6 +328,26 @@ var supportedSKXSignatureAlgorithms = []signatureAndHash{
 	{signatureDSA, hashMD5},
 }
 
+// rsaPSSSignatureAlgorithms contains the RSASSA-PSS signature schemes that
+// can be verified in a TLS 1.2 ServerKeyExchange. They are only advertised
+// when listed in Config.SignatureAndHashes.
+var rsaPSSSignatureAlgorithms = []signatureAndHash{
+	{signatureRSAPSSRSAESHA256, hashIntrinsic},
+	{signatureRSAPSSRSAESHA384, hashIntrinsic},
+	{signatureRSAPSSRSAESHA512, hashIntrinsic},
+	{signatureRSAPSSPSSSHA256, hashIntrinsic},
+	{signatureRSAPSSPSSSHA384, hashIntrinsic},
+	{signatureRSAPSSPSSSHA512, hashIntrinsic},
+}
+
+// eddsaSignatureAlgorithms contains the EdDSA signature schemes. They may be
+// offered in a ClientHello, but a ServerKeyExchange signed with one of them
+// can't be verified.
+var eddsaSignatureAlgorithms = []signatureAndHash{
+	{signatureEd25519, hashIntrinsic},
+	{signatureEd448, hashIntrinsic},
+}
+
 var defaultSKXSignatureAlgorithms = []signatureAndHash{
 	{signatureRSA, hashSHA256},
 	{signatureECDSA, hashSHA256},
@@ -333,6 +406,42 @@ func (authType *ClientAuthType) UnmarshalJSON(b []byte) error {
 	panic("unimplemented")
 }
 
+// ClientCertificateMode declares which certificate a client presents when
+// the server sends a CertificateRequest.
+type ClientCertificateMode int
+
+const (
+	// ClientCertificateMatching presents the first chain in
+	// Config.Certificates whose key type and issuer match the request. If
+	// none match, no certificate is sent.
+	ClientCertificateMatching ClientCertificateMode = 0
+
+	// ClientCertificateConfigured presents Config.Certificates[0] whether
+	// or not it matches the request.
+	ClientCertificateConfigured ClientCertificateMode = 1
+
+	// ClientCertificateThrowaway presents a self-signed certificate
+	// generated for the connection, with an ECDSA key if the request
+	// allows one and an RSA key otherwise.
+	ClientCertificateThrowaway ClientCertificateMode = 2
+)
+
+func (mode ClientCertificateMode) String() string {
+	if name, ok := clientCertificateModeNames[int(mode)]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+func (mode *ClientCertificateMode) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + mode.String() + `"`), nil
+}
+
+func (mode *ClientCertificateMode) UnmarshalJSON(b []byte) error {
+	panic("unimplemented")
+}
+
 // ClientSessionState contains the state needed by clients to resume TLS
 // sessions.
 type ClientSessionState struct {
@@ -475,7 +584,8 @@ type Config struct {
 	// Export RSA Key
 	ExportRSAKey *rsa.PrivateKey
 
-	// HeartbeatEnabled sets whether the heartbeat extension is sent
+	// HeartbeatEnabled sets whether the heartbeat extension is sent by a
+	// client, or accepted by a server
 	HeartbeatEnabled bool
 
 	// ClientDSAEnabled sets whether a TLS client will accept server DSA keys
@@ -527,6 +637,78 @@ type Config struct {
 	// as soon as the server's certificates have been received
 	CertsOnly bool
 
+	// LogFingerprints causes the JA3, JA3S, JA4 and JA4S fingerprints of
+	// the hellos to be included in the handshake log.
+	LogFingerprints bool
+
+	// ClientCertificateMode determines which certificate a client
+	// presents if the server requests one. The default is
+	// ClientCertificateMatching.
+	ClientCertificateMode ClientCertificateMode
+
+	// ROBOTVariant, if set, causes a client using RSA key exchange to
+	// send a malformed ClientKeyExchange and stop the handshake after
+	// recording the server's response. See Enumerator.ROBOT.
+	ROBOTVariant ROBOTVariant
+
+	// ROBOTOmitFinished causes a ROBOT probe to send no ChangeCipherSpec
+	// or Finished after the ClientKeyExchange.
+	ROBOTOmitFinished bool
+
+	// HeartbeatDuringHandshake, if not nil, causes a client to send this
+	// heartbeat request in plaintext after the ServerHelloDone, if the
+	// server negotiated heartbeats. The response is logged like those to
+	// Conn.SendHeartbeat.
+	HeartbeatDuringHandshake *HeartbeatRequest
+
+	// HeartbeatLogOverread causes the bytes a peer returns beyond the
+	// payload of a heartbeat request to be logged, not just their number.
+	HeartbeatLogOverread bool
+
+	// DeflateCompression causes a client to offer DEFLATE record
+	// compression (RFC 3749) ahead of no compression, and a server to
+	// select it if the client offers it. Compression makes connections
+	// vulnerable to CRIME, and is only meant for measurement.
+	DeflateCompression bool
+
+	// EncryptThenMAC causes a client to offer encrypt-then-MAC (RFC 7366),
+	// and a server to accept it when it selects a CBC cipher suite.
+	EncryptThenMAC bool
+
+	// Renegotiation controls whether a client accepts a server's requests
+	// to renegotiate. Servers refuse renegotiations started by the client,
+	// but may start one with Conn.Renegotiate.
+	Renegotiation RenegotiationSupport
+
+	// KeyLogWriter, if not nil, receives the master secret of each
+	// handshake in NSS key log format, which lets programs such as
+	// Wireshark, or DecryptRecords, decrypt the connection. It defeats
+	// the security of the connection, and is meant for debugging.
+	KeyLogWriter io.Writer
+
+	// LogTranscript causes every record sent and received, and the time
+	// each handshake message was sent or received, to be recorded. The
+	// transcript of the handshake is included in the handshake log, and
+	// Conn.Transcript returns the transcript so far. Application data
+	// records are recorded without their payload, unless
+	// LogTranscriptApplicationData is also set.
+	LogTranscript bool
+
+	// LogTranscriptApplicationData causes the transcript to keep the
+	// payload of application data records as well.
+	LogTranscriptApplicationData bool
+
+	// HandshakeHook, if not nil, is passed each handshake message sent
+	// or received, and may change or drop it. It is meant for fuzzing.
+	HandshakeHook HandshakeHook
+
+	// Verifiers names root stores, such as those of verifier.NewNSS, against
+	// which a client verifies the server's certificate, building chains
+	// through the certificates the server sent and checking how they were
+	// sent. The result for each store is recorded in the handshake log under
+	// its name. They have no effect on whether the handshake succeeds.
+	Verifiers map[string]*verifier.Verifier
+
 	// DontBufferHandshakes causes Handshake() to act like older versions of the go crypto library, where each TLS packet is sent in a separate Write.
 	DontBufferHandshakes bool
 
@@ -605,14 +787,26 @@ func (c *Config) Clone() *Config {
 		ExplicitCurvePreferences:       c.ExplicitCurvePreferences,
 		sessionTicketKeys:              sessionTicketKeys,
 		ClientFingerprintConfiguration: c.ClientFingerprintConfiguration,
+		LogFingerprints:                c.LogFingerprints,
+		ClientCertificateMode:          c.ClientCertificateMode,
+		ROBOTVariant:                   c.ROBOTVariant,
+		ROBOTOmitFinished:              c.ROBOTOmitFinished,
+		HeartbeatDuringHandshake:       c.HeartbeatDuringHandshake,
+		HeartbeatLogOverread:           c.HeartbeatLogOverread,
+		DeflateCompression:             c.DeflateCompression,
+		EncryptThenMAC:                 c.EncryptThenMAC,
+		Renegotiation:                  c.Renegotiation,
+		KeyLogWriter:                   c.KeyLogWriter,
+		LogTranscript:                  c.LogTranscript,
+		LogTranscriptApplicationData:   c.LogTranscriptApplicationData,
+		HandshakeHook:                  c.HandshakeHook,
+		Verifiers:                      c.Verifiers,
 		// originalConfig is deliberately not duplicated.
 
 		// Not merged from upstream:
 		// GetCertificate: c.GetCertificate,
 		// DynamicRecordSizingDisabled: c.DynamicRecordSizingDisabled,
 		// VerifyPeerCertificate:    c.VerifyPeerCertificate,
-		// KeyLogWriter:             c.KeyLogWriter,
-		// Renegotiation:            c.Renegotiation,
 	}
 }
 
@@ -711,6 +905,48 @@ func (c *Config) curvePreferences() []CurveID {
 	return c.CurvePreferences
 }
 
+var defaultFFDHEPreferences = []CurveID{CurveFFDHE2048, CurveFFDHE3072, CurveFFDHE4096, CurveFFDHE6144, CurveFFDHE8192}
+
+// ffdhePreferences returns the finite-field groups in curvePreferences(). If
+// there are none, and the preferences are not explicit, the RFC 7919 groups
+// are used.
+func (c *Config) ffdhePreferences() []CurveID {
+	var out []CurveID
+	for _, id := range c.curvePreferences() {
+		if isFFDHE(id) {
+			out = append(out, id)
+		}
+	}
+	if len(out) == 0 && !c.ExplicitCurvePreferences {
+		return defaultFFDHEPreferences
+	}
+	return out
+}
+
+// supportedGroups returns the groups a client sends in the supported_groups
+// extension. The RFC 7919 groups are appended to curvePreferences() when any
+// of cipherSuites is a DHE suite, unless the preferences are explicit or
+// already name a finite-field group.
+func (c *Config) supportedGroups(cipherSuites []uint16) []CurveID {
+	groups := c.curvePreferences()
+	if c.ExplicitCurvePreferences {
+		return groups
+	}
+	for _, id := range groups {
+		if isFFDHE(id) {
+			return groups
+		}
+	}
+	for _, suite := range cipherSuites {
+		if isDHECipherSuite(suite) {
+			out := make([]CurveID, 0, len(groups)+len(defaultFFDHEPreferences))
+			out = append(out, groups...)
+			return append(out, defaultFFDHEPreferences...)
+		}
+	}
+	return groups
+}
+
 // mutualVersion returns the protocol version to use given the advertised
 // version of the peer.
 func (c *Config) mutualVersion(vers uint16) (uint16, bool) {
@@ -1258,6 +1494,17 @@ type ConfigJSON struct {
 	ExternalClientHello            []byte                          `json:"external_client_hello,omitempty"`
 	ClientFingerprintConfiguration *ClientFingerprintConfiguration `json:"client_fingerprint_config,omitempty"`
 	DontBufferHandshakes           bool                            `json:"dont_buffer_handshakes"`
+	LogFingerprints                bool                            `json:"log_fingerprints"`
+	ClientCertificateMode          ClientCertificateMode           `json:"client_certificate_mode"`
+	ROBOTVariant                   ROBOTVariant                    `json:"robot_variant,omitempty"`
+	ROBOTOmitFinished              bool                            `json:"robot_omit_finished,omitempty"`
+	HeartbeatDuringHandshake       *HeartbeatRequest               `json:"heartbeat_during_handshake,omitempty"`
+	HeartbeatLogOverread           bool                            `json:"heartbeat_log_overread,omitempty"`
+	DeflateCompression             bool                            `json:"deflate_compression,omitempty"`
+	EncryptThenMAC                 bool                            `json:"encrypt_then_mac,omitempty"`
+	Renegotiation                  RenegotiationSupport            `json:"renegotiation,omitempty"`
+	LogTranscript                  bool                            `json:"log_transcript,omitempty"`
+	LogTranscriptApplicationData   bool                            `json:"log_transcript_application_data,omitempty"`
 }
 
 func (config *Config) MarshalJSON() ([]byte, error) {
@@ -1297,6 +1544,17 @@ func (config *Config) MarshalJSON() ([]byte, error) {
 	aux.ExternalClientHello = config.ExternalClientHello
 	aux.ClientFingerprintConfiguration = config.ClientFingerprintConfiguration
 	aux.DontBufferHandshakes = config.DontBufferHandshakes
+	aux.LogFingerprints = config.LogFingerprints
+	aux.ClientCertificateMode = config.ClientCertificateMode
+	aux.ROBOTVariant = config.ROBOTVariant
+	aux.ROBOTOmitFinished = config.ROBOTOmitFinished
+	aux.HeartbeatDuringHandshake = config.HeartbeatDuringHandshake
+	aux.HeartbeatLogOverread = config.HeartbeatLogOverread
+	aux.DeflateCompression = config.DeflateCompression
+	aux.EncryptThenMAC = config.EncryptThenMAC
+	aux.Renegotiation = config.Renegotiation
+	aux.LogTranscript = config.LogTranscript
+	aux.LogTranscriptApplicationData = config.LogTranscriptApplicationData
 
 	return json.Marshal(aux)
 }
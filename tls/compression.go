@@ -0,0 +1,142 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// deflateWindowSize is the largest distance a DEFLATE back-reference can
+// span.
+const deflateWindowSize = 32768
+
+// RFC 3749 compresses each direction of a connection as a single zlib
+// stream, which is flushed at the end of every record so that the record can
+// be decompressed on its own. The stream is never closed.
+
+// deflateCompressor compresses the records sent in one direction.
+type deflateCompressor struct {
+	buf bytes.Buffer
+	w   *zlib.Writer
+}
+
+// compress returns the compressed form of a record's data. The result is
+// only valid until the next call.
+func (d *deflateCompressor) compress(data []byte) ([]byte, error) {
+	if d.w == nil {
+		d.w = zlib.NewWriter(&d.buf)
+	}
+	d.buf.Reset()
+	if _, err := d.w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := d.w.Flush(); err != nil {
+		return nil, err
+	}
+	return d.buf.Bytes(), nil
+}
+
+// deflateDecompressor decompresses the records received in one direction.
+// Since compress/flate cannot resume a stream once its input has run out,
+// each record is decompressed by a reset reader that is given the last
+// window of output as its dictionary. Every record ends on a flush, so it
+// starts at a block boundary.
+type deflateDecompressor struct {
+	started bool
+	r       io.ReadCloser
+	window  []byte
+}
+
+// decompress returns the decompressed data of a record. At most
+// maxPlaintext+1 bytes are returned, so that the caller can reject oversized
+// records without decompressing all of them.
+func (d *deflateDecompressor) decompress(data []byte) ([]byte, error) {
+	if !d.started {
+		// The stream starts with a zlib header: DEFLATE with no preset
+		// dictionary, and a checksum over both bytes.
+		if len(data) < 2 || data[0]&0x0f != 8 || data[1]&0x20 != 0 || (int(data[0])<<8|int(data[1]))%31 != 0 {
+			return nil, errors.New("tls: invalid zlib header in compressed record")
+		}
+		data = data[2:]
+		d.started = true
+	}
+	src := bytes.NewReader(data)
+	if d.r == nil {
+		d.r = flate.NewReaderDict(src, d.window)
+	} else if err := d.r.(flate.Resetter).Reset(src, d.window); err != nil {
+		return nil, err
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(d.r, maxPlaintext+1))
+	// Running out of input at the end of the record is expected.
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if src.Len() > 0 && len(out) <= maxPlaintext {
+		return nil, errors.New("tls: compressed record has trailing data")
+	}
+	d.window = append(d.window, out...)
+	if len(d.window) > deflateWindowSize {
+		d.window = append([]byte(nil), d.window[len(d.window)-deflateWindowSize:]...)
+	}
+	return out, nil
+}
+
+// compressionOffered returns true if method is in methods and implemented.
+func compressionOffered(methods []uint8, method uint8) bool {
+	if method != compressionNone && method != compressionDeflate {
+		return false
+	}
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareCompression sets the compression method that a subsequent
+// changeCipherSpec will use.
+func (hc *halfConn) prepareCompression(method uint8) {
+	hc.nextCompression = method
+}
+
+// compress compresses the data of an outgoing record, if compression is in
+// effect.
+func (hc *halfConn) compress(data []byte) ([]byte, error) {
+	if hc.compression != compressionDeflate {
+		return data, nil
+	}
+	if hc.deflater == nil {
+		hc.deflater = new(deflateCompressor)
+	}
+	return hc.deflater.compress(data)
+}
+
+// decompress decompresses the data of an incoming record, if compression is
+// in effect.
+func (hc *halfConn) decompress(data []byte) ([]byte, error) {
+	if hc.compression != compressionDeflate {
+		return data, nil
+	}
+	if hc.inflater == nil {
+		hc.inflater = new(deflateDecompressor)
+	}
+	return hc.inflater.decompress(data)
+}
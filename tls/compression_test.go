@@ -0,0 +1,95 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestDeflateRecords(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	records := [][]byte{
+		random,
+		{},
+		// Compresses to back-references into the first record.
+		random,
+		bytes.Repeat([]byte{0x5a}, maxPlaintext),
+		[]byte("Cookie: secret=1234"),
+	}
+	var compressor deflateCompressor
+	var decompressor deflateDecompressor
+	for i, record := range records {
+		compressed, err := compressor.compress(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 && len(compressed) >= len(record)/8 {
+			t.Errorf("repeated record compressed to %d bytes", len(compressed))
+		}
+		out, err := decompressor.decompress(append([]byte(nil), compressed...))
+		if err != nil {
+			t.Fatalf("record %d: %s", i, err)
+		}
+		if !bytes.Equal(out, record) {
+			t.Errorf("record %d decompressed to %d bytes, want %d", i, len(out), len(record))
+		}
+	}
+
+	if _, err := new(deflateDecompressor).decompress([]byte("GET / HTTP/1.0")); err == nil {
+		t.Error("record without a zlib header was decompressed")
+	}
+}
+
+func TestDeflateConnection(t *testing.T) {
+	for _, serverDeflate := range []bool{false, true} {
+		serverConfig := testConfig.Clone()
+		serverConfig.DeflateCompression = serverDeflate
+		clientConfig := testConfig.Clone()
+		clientConfig.DeflateCompression = true
+
+		conn, err := echoDialer(serverConfig)()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := Client(conn, clientConfig)
+		message := bytes.Repeat([]byte("compress me "), 100)
+		if _, err := client.Write(message); err != nil {
+			t.Fatal(err)
+		}
+		echo := make([]byte, len(message))
+		if _, err := io.ReadFull(client, echo); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if !bytes.Equal(echo, message) {
+			t.Errorf("got echo %q", echo)
+		}
+
+		want := compressionNone
+		if serverDeflate {
+			want = compressionDeflate
+		}
+		if got := client.GetHandshakeLog().ServerHello.CompressionMethod; got != want {
+			t.Errorf("server selected compression method %d, want %d", got, want)
+		}
+		if client.out.compression != want || client.in.compression != want {
+			t.Errorf("record layer uses compression methods %d and %d, want %d", client.out.compression, client.in.compression, want)
+		}
+	}
+}
@@ -26,6 +26,7 @@ type Conn struct {
 	// constant
 	conn     net.Conn
 	isClient bool
+	isDTLS   bool
 
 	// constant after handshake; protected by handshakeMutex
 	handshakeMutex       sync.Mutex // handshakeMutex < in.Mutex, out.Mutex, errMutex
@@ -36,9 +37,14 @@ type Conn struct {
 	handshakeComplete    bool
 	didResume            bool // whether this connection was a session resumption
 	extendedMasterSecret bool // whether this session used an extended master secret
+	handshakes           int  // number of completed handshakes, including renegotiations
+	secureRenegotiation  bool // whether the initial handshake negotiated RFC 5746
 	cipherSuite          uint16
 	ocspResponse         []byte // stapled OCSP response
 	peerCertificates     []*x509.Certificate
+	// clientFinished and serverFinished are the verify data of the last
+	// handshake's Finished messages, for the renegotiation_info extension.
+	clientFinished, serverFinished []byte
 	// verifiedChains contains the certificate chains that we built, as
 	// opposed to the ones presented by the server.
 	verifiedChains []x509.CertificateChain
@@ -48,6 +54,11 @@ type Conn struct {
 	clientProtocol         string
 	clientProtocolFallback bool
 
+	// renegotiating is set while a renegotiation runs, and Write waits on
+	// renegotiated until it is cleared; protected by out.Mutex.
+	renegotiating bool
+	renegotiated  *sync.Cond
+
 	// input/output
 	in, out  halfConn     // in.Mutex < out.Mutex
 	rawInput *block       // raw input, right off the wire
@@ -59,9 +70,18 @@ type Conn struct {
 	tmp [16]byte
 
 	// tls
-	heartbeat     bool
-	handshakeLog  *ServerHandshake
-	heartbleedLog *Heartbleed
+	heartbeat        bool
+	handshakeLog     *ServerHandshake
+	heartbleedLog    *Heartbleed
+	pendingHeartbeat *HeartbeatProbe     // heartbeat request awaiting a response
+	transcript       *transcriptRecorder // nil unless Config.LogTranscript is set
+
+	// clientHandshakeLog is only kept by servers. The alerts of both
+	// logs and handshakeStage are protected by alertLogMutex, since both
+	// halves of the connection record them.
+	clientHandshakeLog *ClientHandshake
+	handshakeStage     string
+	alertLogMutex      sync.Mutex
 
 	// Missing cipher
 	cipherError error
@@ -71,6 +91,10 @@ type Conn struct {
 
 	// Raw client hello
 	clientHelloRaw []byte
+
+	// dtls holds the state of the DTLS record layer and handshake, if
+	// isDTLS is set.
+	dtls *dtlsState
 }
 
 func (c *Conn) ClientHelloRaw() []byte {
@@ -134,12 +158,31 @@ type halfConn struct {
 	version uint16      // protocol version
 	cipher  interface{} // cipher algorithm
 	mac     macFunction
-	seq     [8]byte // 64-bit sequence number
+	seq     [8]byte // 64-bit sequence number, or DTLS epoch and sequence number
 	bfree   *block  // list of free blocks
+	isDTLS  bool    // whether records have DTLS headers
+
+	// prev, in DTLS, is the state of the epoch before the last
+	// changeCipherSpec, for retransmitting the records sent in it.
+	prev *halfConn
 
 	nextCipher interface{} // next encryption state
 	nextMac    macFunction // next MAC algorithm
 
+	// fault, if set, corrupts the next CBC record that is encrypted.
+	fault RecordFault
+
+	// compression is the compression method of records, and
+	// nextCompression the one a subsequent changeCipherSpec will use.
+	compression, nextCompression uint8
+	deflater                     *deflateCompressor
+	inflater                     *deflateDecompressor
+
+	// encryptThenMAC is set if CBC records are encrypted and then MACed
+	// (RFC 7366), and nextEncryptThenMAC if they will be after a
+	// subsequent changeCipherSpec.
+	encryptThenMAC, nextEncryptThenMAC bool
+
 	// used to save allocating a new buffer for each MAC.
 	inDigestBuf, outDigestBuf []byte
 }
@@ -170,19 +213,50 @@ func (hc *halfConn) changeCipherSpec() error {
 	if hc.nextCipher == nil {
 		return alertInternalError
 	}
+	if hc.isDTLS {
+		hc.prev = &halfConn{
+			version:        hc.version,
+			cipher:         hc.cipher,
+			mac:            hc.mac,
+			seq:            hc.seq,
+			isDTLS:         true,
+			compression:    hc.compression,
+			encryptThenMAC: hc.encryptThenMAC,
+		}
+	}
 	hc.cipher = hc.nextCipher
 	hc.mac = hc.nextMac
 	hc.nextCipher = nil
 	hc.nextMac = nil
+	hc.compression = hc.nextCompression
+	hc.nextCompression = compressionNone
+	hc.deflater, hc.inflater = nil, nil
+	hc.encryptThenMAC = hc.nextEncryptThenMAC
+	hc.nextEncryptThenMAC = false
 	for i := range hc.seq {
 		hc.seq[i] = 0
 	}
+	if hc.isDTLS {
+		epoch := hc.prev.epoch() + 1
+		hc.seq[0] = byte(epoch >> 8)
+		hc.seq[1] = byte(epoch)
+	}
 	return nil
 }
 
+// epoch returns the DTLS epoch of hc, which is kept in the first two bytes
+// of its sequence number.
+func (hc *halfConn) epoch() uint16 {
+	return uint16(hc.seq[0])<<8 | uint16(hc.seq[1])
+}
+
 // incSeq increments the sequence number.
 func (hc *halfConn) incSeq(isOutgoing bool) {
 	limit := 0
+	if hc.isDTLS {
+		// The epoch is not part of the sequence number.
+		limit = 2
+	}
 	increment := uint64(1)
 	for i := 7; i >= limit; i-- {
 		increment += uint64(hc.seq[i])
@@ -206,6 +280,9 @@ func (hc *halfConn) resetSeq() {
 }
 
 func (hc *halfConn) recordHeaderLen() int {
+	if hc.isDTLS {
+		return dtlsRecordHeaderLen
+	}
 	return tlsRecordHeaderLen
 }
 
@@ -277,6 +354,10 @@ type cbcMode interface {
 // success boolean, the number of bytes to skip from the start of the record in
 // order to get the application payload, and an optional alert value.
 func (hc *halfConn) decrypt(b *block) (ok bool, prefixLen int, alertValue alert) {
+	if c, isCBC := hc.cipher.(cbcMode); isCBC && hc.encryptThenMAC {
+		return hc.openEncryptThenMAC(b, c)
+	}
+
 	recordHeaderLen := hc.recordHeaderLen()
 
 	// pull out payload
@@ -402,6 +483,10 @@ func padToBlockSize(payload []byte, blockSize int) (prefix, finalBlock []byte) {
 
 // encrypt encrypts and macs the data in b.
 func (hc *halfConn) encrypt(b *block, explicitIVLen int) (bool, alert) {
+	if c, isCBC := hc.cipher.(cbcMode); isCBC && hc.encryptThenMAC {
+		return hc.sealEncryptThenMAC(b, explicitIVLen, c)
+	}
+
 	recordHeaderLen := hc.recordHeaderLen()
 
 	// mac
@@ -412,6 +497,9 @@ func (hc *halfConn) encrypt(b *block, explicitIVLen int) (bool, alert) {
 		b.resize(n + len(mac))
 		copy(b.data[n:], mac)
 		hc.outDigestBuf = mac
+		if hc.fault.corruptsMAC() {
+			b.data[n] ^= 0xff
+		}
 	}
 
 	payload := b.data[recordHeaderLen:]
@@ -444,7 +532,12 @@ func (hc *halfConn) encrypt(b *block, explicitIVLen int) (bool, alert) {
 				c.SetIV(payload[:explicitIVLen])
 				payload = payload[explicitIVLen:]
 			}
-			prefix, finalBlock := padToBlockSize(payload, blockSize)
+			var prefix, finalBlock []byte
+			if hc.fault != RecordFaultNone {
+				prefix, finalBlock = padWithFault(payload, blockSize, hc.fault)
+			} else {
+				prefix, finalBlock = padToBlockSize(payload, blockSize)
+			}
 			b.resize(recordHeaderLen + explicitIVLen + len(prefix) + len(finalBlock))
 			c.CryptBlocks(b.data[recordHeaderLen+explicitIVLen:], prefix)
 			c.CryptBlocks(b.data[recordHeaderLen+explicitIVLen+len(prefix):], finalBlock)
@@ -458,6 +551,7 @@ func (hc *halfConn) encrypt(b *block, explicitIVLen int) (bool, alert) {
 	b.data[recordHeaderLen-2] = byte(n >> 8)
 	b.data[recordHeaderLen-1] = byte(n)
 	hc.incSeq(true)
+	hc.fault = RecordFaultNone
 
 	return true, 0
 }
@@ -566,7 +660,8 @@ func (hc *halfConn) splitBlock(b *block, n int) (*block, *block) {
 func (c *Conn) readRecord(want recordType) error {
 	// Caller must be in sync with connection:
 	// handshake data if handshake not yet completed,
-	// else application data.  (We don't support renegotiation.)
+	// else application data. Clients that allow renegotiation also
+	// accept handshake data, which Read passes to handleRenegotiation.
 	switch want {
 	default:
 		c.sendAlert(alertInternalError)
@@ -584,76 +679,25 @@ func (c *Conn) readRecord(want recordType) error {
 	}
 
 Again:
-	if c.rawInput == nil {
-		c.rawInput = c.in.newBlock()
+	var b *block
+	var err error
+	if c.isDTLS {
+		b, err = c.dtlsReadRecord(want)
+	} else {
+		b, err = c.tlsReadRecord(want)
 	}
-	b := c.rawInput
-	recordHeaderLen := c.in.recordHeaderLen()
-	// Read header, payload.
-	if err := b.readFromUntil(c.conn, recordHeaderLen); err != nil {
-		// RFC suggests that EOF without an alertCloseNotify is
-		// an error, but popular web sites seem to do this,
-		// so we can't make it an error.
-		// if err == io.EOF {
-		// 	err = io.ErrUnexpectedEOF
-		// }
-		if e, ok := err.(net.Error); !ok || !e.Temporary() {
-			c.in.setErrorLocked(err)
-		}
+	if err != nil {
 		return err
 	}
 	typ := recordType(b.data[0])
-
-	// No valid TLS record has a type of 0x80, however SSLv2 handshakes
-	// start with a uint16 length where the MSB is set and the first record
-	// is always < 256 bytes long. Therefore typ == 0x80 strongly suggests
-	// an SSLv2 client.
-	if want == recordTypeHandshake && typ == 0x80 {
-		c.sendAlert(alertProtocolVersion)
-		return c.in.setErrorLocked(errors.New("tls: unsupported SSLv2 handshake received"))
-	}
-
-	vers := uint16(b.data[1])<<8 | uint16(b.data[2])
-	n := int(b.data[3])<<8 | int(b.data[4])
-	if c.haveVers && vers != c.vers {
-		c.sendAlert(alertProtocolVersion)
-		return c.in.setErrorLocked(fmt.Errorf("tls: received record with version %x when expecting version %x", vers, c.vers))
-	}
-	if n > maxCiphertext {
-		c.sendAlert(alertRecordOverflow)
-		return c.in.setErrorLocked(fmt.Errorf("tls: oversized record received with length %d", n))
-	}
-	if !c.haveVers {
-		// First message, be extra suspicious:
-		// this might not be a TLS client.
-		// Bail out before reading a full 'body', if possible.
-		// The current max version is 3.1.
-		// If the version is >= 16.0, it's probably not real.
-		// Similarly, a clientHello message encodes in
-		// well under a kilobyte.  If the length is >= 12 kB,
-		// it's probably not real.
-		if (typ != recordTypeAlert && typ != want) || vers >= 0x1000 || n >= 0x3000 {
-			c.sendAlert(alertUnexpectedMessage)
-			return c.in.setErrorLocked(fmt.Errorf("tls: first record does not look like a TLS handshake"))
-		}
-	}
-	if err := b.readFromUntil(c.conn, recordHeaderLen+n); err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
-		}
-		if e, ok := err.(net.Error); !ok || !e.Temporary() {
-			c.in.setErrorLocked(err)
+	if c.in.err == nil && c.in.compression != compressionNone {
+		decompressed, err := c.in.decompress(b.data[b.off:])
+		if err != nil {
+			c.in.freeBlock(b)
+			return c.in.setErrorLocked(c.sendAlert(alertDecompressionFailure))
 		}
-		return err
+		b.data = append(b.data[:b.off], decompressed...)
 	}
-
-	// Process message.
-	b, c.rawInput = c.in.splitBlock(b, recordHeaderLen+n)
-	ok, off, err := c.in.decrypt(b)
-	if !ok {
-		c.in.setErrorLocked(c.sendAlert(err))
-	}
-	b.off = off
 	data := b.data[b.off:]
 	if len(data) > maxPlaintext {
 		err := c.sendAlert(alertRecordOverflow)
@@ -670,12 +714,19 @@ Again:
 			c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 			break
 		}
+		c.logAlert(false, data[0], alert(data[1]))
 		if alert(data[1]) == alertCloseNotify {
 			c.in.setErrorLocked(io.EOF)
 			break
 		}
 		switch data[0] {
 		case alertLevelWarning:
+			// A server waiting for the ClientHello of a renegotiation
+			// stops if the client refuses it.
+			if want == recordTypeHandshake && alert(data[1]) == alertNoRenegotiation {
+				c.in.setErrorLocked(&net.OpError{Op: "remote error", Err: alert(data[1])})
+				break
+			}
 			// drop on the floor
 			c.in.freeBlock(b)
 			goto Again
@@ -690,10 +741,14 @@ Again:
 			c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 			break
 		}
+		c.setHandshakeStage("change_cipher_spec")
 		err := c.in.changeCipherSpec()
 		if err != nil {
 			c.in.setErrorLocked(c.sendAlert(err.(alert)))
 		}
+		if c.isDTLS {
+			c.dtls.replay = replayWindow{}
+		}
 
 	case recordTypeApplicationData:
 		if typ != want {
@@ -704,18 +759,31 @@ Again:
 		b = nil
 
 	case recordTypeHandshake:
+		if c.isDTLS {
+			if err := c.dtlsHandshakeRecord(data); err != nil {
+				c.in.setErrorLocked(err)
+			} else if want != recordTypeHandshake && c.hand.Len() == 0 {
+				// Fragments of retransmitted messages are
+				// dropped, and not what the caller wants.
+				c.in.freeBlock(b)
+				goto Again
+			}
+			break
+		}
 		// TODO(rsc): Should at least pick off connection close.
-		if typ != want {
+		if typ != want && !(c.isClient && c.config.Renegotiation != RenegotiateNever) {
 			return c.in.setErrorLocked(c.sendAlert(alertNoRenegotiation))
 		}
 		c.hand.Write(data)
 	case recordTypeHeartbeat:
+		if err := c.handleHeartbeat(data); err != nil {
+			c.in.setErrorLocked(err)
+			break
+		}
 		if want != recordTypeHeartbeat {
-			return c.sendAlert(alertUnexpectedMessage)
+			c.in.freeBlock(b)
+			goto Again
 		}
-		c.heartbleedLog.Vulnerable = true
-		c.input = b
-		b = nil
 	}
 
 	if b != nil {
@@ -724,6 +792,85 @@ Again:
 	return c.in.err
 }
 
+// tlsReadRecord reads the next TLS record from the connection and decrypts
+// it. A record that cannot be decrypted is returned with c.in.err set.
+// c.in.Mutex <= L.
+func (c *Conn) tlsReadRecord(want recordType) (*block, error) {
+	if c.rawInput == nil {
+		c.rawInput = c.in.newBlock()
+	}
+	b := c.rawInput
+	recordHeaderLen := c.in.recordHeaderLen()
+	// Read header, payload.
+	if err := b.readFromUntil(c.conn, recordHeaderLen); err != nil {
+		// RFC suggests that EOF without an alertCloseNotify is
+		// an error, but popular web sites seem to do this,
+		// so we can't make it an error.
+		// if err == io.EOF {
+		// 	err = io.ErrUnexpectedEOF
+		// }
+		if e, ok := err.(net.Error); !ok || !e.Temporary() {
+			c.in.setErrorLocked(err)
+		}
+		return nil, err
+	}
+	typ := recordType(b.data[0])
+
+	// No valid TLS record has a type of 0x80, however SSLv2 handshakes
+	// start with a uint16 length where the MSB is set and the first record
+	// is always < 256 bytes long. Therefore typ == 0x80 strongly suggests
+	// an SSLv2 client.
+	if want == recordTypeHandshake && typ == 0x80 {
+		c.sendAlert(alertProtocolVersion)
+		return nil, c.in.setErrorLocked(errSSLv2Handshake)
+	}
+
+	vers := uint16(b.data[1])<<8 | uint16(b.data[2])
+	n := int(b.data[3])<<8 | int(b.data[4])
+	if c.haveVers && vers != c.vers {
+		c.sendAlert(alertProtocolVersion)
+		return nil, c.in.setErrorLocked(fmt.Errorf("tls: received record with version %x when expecting version %x", vers, c.vers))
+	}
+	if !c.haveVers {
+		// First message, be extra suspicious:
+		// this might not be a TLS client.
+		// Bail out before reading a full 'body', if possible.
+		// The current max version is 3.1.
+		// If the version is >= 16.0, it's probably not real.
+		// Similarly, a clientHello message encodes in
+		// well under a kilobyte.  If the length is >= 12 kB,
+		// it's probably not real. This is checked before the
+		// record size so that non-TLS peers are reported as such.
+		if (typ != recordTypeAlert && typ != want) || vers >= 0x1000 || n >= 0x3000 {
+			c.sendAlert(alertUnexpectedMessage)
+			return nil, c.in.setErrorLocked(errNotTLSRecord)
+		}
+	}
+	if n > maxCiphertext {
+		c.sendAlert(alertRecordOverflow)
+		return nil, c.in.setErrorLocked(fmt.Errorf("tls: oversized record received with length %d", n))
+	}
+	if err := b.readFromUntil(c.conn, recordHeaderLen+n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if e, ok := err.(net.Error); !ok || !e.Temporary() {
+			c.in.setErrorLocked(err)
+		}
+		return nil, err
+	}
+	c.transcript.recordReceived(b.data[:recordHeaderLen+n])
+
+	// Process message.
+	b, c.rawInput = c.in.splitBlock(b, recordHeaderLen+n)
+	ok, off, err := c.in.decrypt(b)
+	if !ok {
+		c.in.setErrorLocked(c.sendAlert(err))
+	}
+	b.off = off
+	return b, nil
+}
+
 // sendAlert sends a TLS alert message.
 // c.out.Mutex <= L.
 func (c *Conn) sendAlertLocked(err alert) error {
@@ -735,6 +882,7 @@ func (c *Conn) sendAlertLocked(err alert) error {
 	}
 	c.tmp[1] = byte(err)
 	c.writeRecord(recordTypeAlert, c.tmp[0:2])
+	c.logAlert(true, c.tmp[0], err)
 	// closeNotify is a special case in that it isn't an error:
 	if err != alertCloseNotify {
 		return c.out.setErrorLocked(&net.OpError{Op: "local error", Err: err})
@@ -742,6 +890,21 @@ func (c *Conn) sendAlertLocked(err alert) error {
 	return nil
 }
 
+// logAlert records an alert sent or received, along with the handshake
+// stage it occurred at.
+func (c *Conn) logAlert(sent bool, level uint8, err alert) {
+	c.alertLogMutex.Lock()
+	defer c.alertLogMutex.Unlock()
+	a := makeAlertLog(sent, level, err)
+	a.Stage = c.handshakeStage
+	if c.handshakeLog != nil {
+		c.handshakeLog.Alerts = append(c.handshakeLog.Alerts, a)
+	}
+	if c.clientHandshakeLog != nil {
+		c.clientHandshakeLog.Alerts = append(c.clientHandshakeLog.Alerts, a)
+	}
+}
+
 // sendAlert sends a TLS alert message.
 // L < c.out.Mutex.
 func (c *Conn) sendAlert(err alert) error {
@@ -758,6 +921,7 @@ func (c *Conn) write(data []byte) (int, error) {
 	}
 
 	n, err := c.conn.Write(data)
+	c.transcript.recordSent(data[:n])
 	return n, err
 }
 
@@ -766,7 +930,14 @@ func (c *Conn) flush() (int, error) {
 		return 0, nil
 	}
 
-	n, err := c.conn.Write(c.sendBuf)
+	var n int
+	var err error
+	if c.isDTLS {
+		n, err = c.dtlsWriteDatagrams(c.sendBuf)
+	} else {
+		n, err = c.conn.Write(c.sendBuf)
+		c.transcript.recordSent(c.sendBuf[:n])
+	}
 	c.sendBuf = nil
 	c.buffering = false
 	return n, err
@@ -776,63 +947,59 @@ func (c *Conn) flush() (int, error) {
 // to the connection and updates the record layer state.
 // c.out.Mutex <= L.
 func (c *Conn) writeRecord(typ recordType, data []byte) (n int, err error) {
+	if typ == recordTypeHandshake && data == nil {
+		// A HandshakeHook dropped the message.
+		return 0, nil
+	}
+
+	switch {
+	case typ == recordTypeHandshake && len(data) > 0:
+		c.setHandshakeStage(nameForHandshakeMessageType(data[0]))
+		c.transcript.message(true, data[0])
+	case typ == recordTypeChangeCipherSpec:
+		c.setHandshakeStage("change_cipher_spec")
+	}
+
+	if c.isDTLS {
+		n, err = c.dtlsWriteRecord(typ, data)
+	} else {
+		n, err = c.tlsWriteRecord(typ, data)
+	}
 
-	recordHeaderLen := tlsRecordHeaderLen
+	if typ == recordTypeChangeCipherSpec {
+		err = c.out.changeCipherSpec()
+		if err != nil {
+			// Cannot call sendAlert directly,
+			// because we already hold c.out.Mutex.
+			c.tmp[0] = alertLevelError
+			c.tmp[1] = byte(err.(alert))
+			c.writeRecord(recordTypeAlert, c.tmp[0:2])
+			c.logAlert(true, c.tmp[0], err.(alert))
+			return n, c.out.setErrorLocked(&net.OpError{Op: "local error", Err: err})
+		}
+	}
+	return
+}
+
+// tlsWriteRecord writes data as TLS records of type typ.
+// c.out.Mutex <= L.
+func (c *Conn) tlsWriteRecord(typ recordType, data []byte) (n int, err error) {
 	b := c.out.newBlock()
 	first := true
-	//isClientHello := typ == recordTypeHandshake && len(data) > 0 && data[0] == typeClientHello
 	for len(data) > 0 || first {
 		m := len(data)
 		if m > maxPlaintext {
 			m = maxPlaintext
 		}
-		explicitIVLen := 0
-		explicitIVIsSeq := false
 		first = false
 
-		var cbc cbcMode
-		if c.out.version >= VersionTLS11 {
-			var ok bool
-			if cbc, ok = c.out.cipher.(cbcMode); ok {
-				explicitIVLen = cbc.BlockSize()
-			}
-		}
-		if explicitIVLen == 0 {
-			if aead, ok := c.out.cipher.(*tlsAead); ok && aead.explicitNonce {
-				explicitIVLen = 8
-				// The AES-GCM construction in TLS has an
-				// explicit nonce so that the nonce can be
-				// random. However, the nonce is only 8 bytes
-				// which is too small for a secure, random
-				// nonce. Therefore we use the sequence number
-				// as the nonce.
-				explicitIVIsSeq = true
-			}
-		}
-		b.resize(recordHeaderLen + explicitIVLen + m)
-		b.data[0] = byte(typ)
-		vers := c.vers
-		if vers == 0 {
-			// Some TLS servers fail if the record version is
-			// greater than TLS 1.0 for the initial ClientHello.
-			vers = VersionTLS10
+		var payload []byte
+		if payload, err = c.out.compress(data[:m]); err != nil {
+			break
 		}
-		b.data[1] = byte(vers >> 8)
-		b.data[2] = byte(vers)
-		b.data[3] = byte(m >> 8)
-		b.data[4] = byte(m)
-		if explicitIVLen > 0 {
-			explicitIV := b.data[recordHeaderLen : recordHeaderLen+explicitIVLen]
-			if explicitIVIsSeq {
-				copy(explicitIV, c.out.seq[:])
-			} else {
-				if _, err = io.ReadFull(c.config.rand(), explicitIV); err != nil {
-					break
-				}
-			}
+		if err = c.sealRecord(&c.out, b, typ, payload); err != nil {
+			break
 		}
-		copy(b.data[recordHeaderLen+explicitIVLen:], data)
-		c.out.encrypt(b, explicitIVLen)
 		_, err = c.write(b.data)
 		if err != nil {
 			break
@@ -841,93 +1008,161 @@ func (c *Conn) writeRecord(typ recordType, data []byte) (n int, err error) {
 		data = data[m:]
 	}
 	c.out.freeBlock(b)
+	return
+}
 
-	if typ == recordTypeChangeCipherSpec {
-		err = c.out.changeCipherSpec()
-		if err != nil {
-			// Cannot call sendAlert directly,
-			// because we already hold c.out.Mutex.
-			c.tmp[0] = alertLevelError
-			c.tmp[1] = byte(err.(alert))
-			c.writeRecord(recordTypeAlert, c.tmp[0:2])
-			return n, c.out.setErrorLocked(&net.OpError{Op: "local error", Err: err})
+// sealRecord fills b with a record of type typ carrying payload, protected
+// by the state of hc.
+func (c *Conn) sealRecord(hc *halfConn, b *block, typ recordType, payload []byte) error {
+	recordHeaderLen := hc.recordHeaderLen()
+	explicitIVLen := 0
+	explicitIVIsSeq := false
+
+	var cbc cbcMode
+	if hc.version >= VersionTLS11 {
+		var ok bool
+		if cbc, ok = hc.cipher.(cbcMode); ok {
+			explicitIVLen = cbc.BlockSize()
 		}
 	}
-	return
+	if explicitIVLen == 0 {
+		if aead, ok := hc.cipher.(*tlsAead); ok && aead.explicitNonce {
+			explicitIVLen = 8
+			// The AES-GCM construction in TLS has an
+			// explicit nonce so that the nonce can be
+			// random. However, the nonce is only 8 bytes
+			// which is too small for a secure, random
+			// nonce. Therefore we use the sequence number
+			// as the nonce.
+			explicitIVIsSeq = true
+		}
+	}
+	b.resize(recordHeaderLen + explicitIVLen + len(payload))
+	b.data[0] = byte(typ)
+	vers := c.vers
+	if hc.isDTLS {
+		vers = versionToWire(vers)
+		copy(b.data[3:11], hc.seq[:])
+	} else if vers == 0 {
+		// Some TLS servers fail if the record version is
+		// greater than TLS 1.0 for the initial ClientHello.
+		vers = VersionTLS10
+	}
+	b.data[1] = byte(vers >> 8)
+	b.data[2] = byte(vers)
+	b.data[recordHeaderLen-2] = byte(len(payload) >> 8)
+	b.data[recordHeaderLen-1] = byte(len(payload))
+	if explicitIVLen > 0 {
+		explicitIV := b.data[recordHeaderLen : recordHeaderLen+explicitIVLen]
+		if explicitIVIsSeq {
+			copy(explicitIV, hc.seq[:])
+		} else {
+			if _, err := io.ReadFull(c.config.rand(), explicitIV); err != nil {
+				return err
+			}
+		}
+	}
+	copy(b.data[recordHeaderLen+explicitIVLen:], payload)
+	hc.encrypt(b, explicitIVLen)
+	return nil
 }
 
 // readHandshake reads the next handshake message from
 // the record layer.
 // c.in.Mutex < L; c.out.Mutex < L.
 func (c *Conn) readHandshake() (interface{}, error) {
-	for c.hand.Len() < 4 {
-		if err := c.in.err; err != nil {
-			return nil, err
-		}
-		if err := c.readRecord(recordTypeHandshake); err != nil {
-			return nil, err
+	// Read messages until one is not dropped by the HandshakeHook.
+	var data []byte
+	for data == nil {
+		for c.hand.Len() < 4 {
+			if err := c.in.err; err != nil {
+				return nil, err
+			}
+			if err := c.readRecord(recordTypeHandshake); err != nil {
+				return nil, err
+			}
 		}
-	}
 
-	data := c.hand.Bytes()
-	n := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
-	if n > maxHandshake {
-		return nil, c.in.setErrorLocked(c.sendAlert(alertInternalError))
-	}
-	for c.hand.Len() < 4+n {
-		if err := c.in.err; err != nil {
-			return nil, err
+		data = c.hand.Bytes()
+		n := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		if n > maxHandshake {
+			return nil, c.in.setErrorLocked(c.sendAlert(alertInternalError))
 		}
-		if err := c.readRecord(recordTypeHandshake); err != nil {
-			return nil, err
+		for c.hand.Len() < 4+n {
+			if err := c.in.err; err != nil {
+				return nil, err
+			}
+			if err := c.readRecord(recordTypeHandshake); err != nil {
+				return nil, err
+			}
+		}
+		data = c.hand.Next(4 + n)
+		c.setHandshakeStage(nameForHandshakeMessageType(data[0]))
+		c.transcript.message(false, data[0])
+		if c.config.HandshakeHook != nil {
+			var err error
+			if data, err = c.hookReceivedHandshake(data); err != nil {
+				return nil, c.in.setErrorLocked(err)
+			}
 		}
 	}
-	data = c.hand.Next(4 + n)
-	var m handshakeMessage
-	switch data[0] {
+	if len(data) < 4 {
+		return nil, c.in.setErrorLocked(c.sendAlert(alertDecodeError))
+	}
+	m := newHandshakeMessage(data[0], c.vers)
+	if m == nil {
+		return nil, c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
+	}
+
+	// The handshake message unmarshallers
+	// expect to be able to keep references to data,
+	// so pass in a fresh copy that won't be overwritten.
+	data = append([]byte(nil), data...)
+
+	if !m.unmarshal(data) {
+		return nil, c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
+	}
+	return m, nil
+}
+
+// newHandshakeMessage returns an empty message of type typ, to unmarshal
+// a message sent at version vers into, or nil if typ is unknown.
+func newHandshakeMessage(typ uint8, vers uint16) handshakeMessage {
+	switch typ {
 	case typeHelloRequest:
-		m = new(helloRequestMsg)
+		return new(helloRequestMsg)
 	case typeClientHello:
-		m = new(clientHelloMsg)
+		return new(clientHelloMsg)
+	case typeHelloVerifyRequest:
+		return new(helloVerifyRequestMsg)
 	case typeServerHello:
-		m = new(serverHelloMsg)
+		return new(serverHelloMsg)
 	case typeNewSessionTicket:
-		m = new(newSessionTicketMsg)
+		return new(newSessionTicketMsg)
 	case typeCertificate:
-		m = new(certificateMsg)
+		return new(certificateMsg)
 	case typeCertificateRequest:
-		m = &certificateRequestMsg{
-			hasSignatureAndHash: c.vers >= VersionTLS12,
+		return &certificateRequestMsg{
+			hasSignatureAndHash: vers >= VersionTLS12,
 		}
 	case typeCertificateStatus:
-		m = new(certificateStatusMsg)
+		return new(certificateStatusMsg)
 	case typeServerKeyExchange:
-		m = new(serverKeyExchangeMsg)
+		return new(serverKeyExchangeMsg)
 	case typeServerHelloDone:
-		m = new(serverHelloDoneMsg)
+		return new(serverHelloDoneMsg)
 	case typeClientKeyExchange:
-		m = new(clientKeyExchangeMsg)
+		return new(clientKeyExchangeMsg)
 	case typeCertificateVerify:
-		m = &certificateVerifyMsg{
-			hasSignatureAndHash: c.vers >= VersionTLS12,
+		return &certificateVerifyMsg{
+			hasSignatureAndHash: vers >= VersionTLS12,
 		}
 	case typeNextProtocol:
-		m = new(nextProtoMsg)
+		return new(nextProtoMsg)
 	case typeFinished:
-		m = new(finishedMsg)
-	default:
-		return nil, c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
-	}
-
-	// The handshake message unmarshallers
-	// expect to be able to keep references to data,
-	// so pass in a fresh copy that won't be overwritten.
-	data = append([]byte(nil), data...)
-
-	if !m.unmarshal(data) {
-		return nil, c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
+		return new(finishedMsg)
 	}
-	return m, nil
+	return nil
 }
 
 // Write writes data to the connection.
@@ -939,6 +1174,9 @@ func (c *Conn) Write(b []byte) (int, error) {
 	c.out.Lock()
 	defer c.out.Unlock()
 
+	// Application data is never written in the middle of a renegotiation.
+	c.waitRenegotiation()
+
 	if err := c.out.err; err != nil {
 		return 0, err
 	}
@@ -995,6 +1233,16 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 				// Soft error, like EAGAIN
 				return 0, err
 			}
+			for c.hand.Len() > 0 {
+				// handleRenegotiation takes handshakeMutex, which
+				// must be taken before c.in.
+				c.in.Unlock()
+				err := c.handleRenegotiation()
+				c.in.Lock()
+				if err != nil {
+					return 0, err
+				}
+			}
 		}
 		if err := c.in.err; err != nil {
 			return 0, err
@@ -1068,9 +1316,44 @@ func (c *Conn) Handshake() error {
 	} else {
 		c.handshakeErr = c.serverHandshake()
 	}
+	if c.handshakeErr == nil {
+		c.handshakes++
+	}
+	c.finishHandshakeLog()
 	return c.handshakeErr
 }
 
+// finishHandshakeLog adds the fingerprints and any error of the handshake
+// that just ran to its log.
+func (c *Conn) finishHandshakeLog() {
+	if c.transcript != nil && c.handshakeLog != nil {
+		c.handshakeLog.Transcript = c.transcript.snapshot()
+	}
+	if c.config.LogFingerprints && c.handshakeLog != nil {
+		c.handshakeLog.Fingerprints = ComputeFingerprints(c.handshakeLog.ClientHello, c.handshakeLog.ServerHello)
+		if c.clientHandshakeLog != nil {
+			c.clientHandshakeLog.Fingerprints = c.handshakeLog.Fingerprints
+		}
+	}
+	if c.handshakeErr != nil {
+		c.alertLogMutex.Lock()
+		var alerts []Alert
+		if c.handshakeLog != nil {
+			alerts = c.handshakeLog.Alerts
+		} else if c.clientHandshakeLog != nil {
+			alerts = c.clientHandshakeLog.Alerts
+		}
+		c.alertLogMutex.Unlock()
+		he := c.makeHandshakeError(c.handshakeErr, alerts)
+		if c.handshakeLog != nil {
+			c.handshakeLog.Error = he
+		}
+		if c.clientHandshakeLog != nil {
+			c.clientHandshakeLog.Error = he
+		}
+	}
+}
+
 // ConnectionState returns basic TLS details about the connection.
 func (c *Conn) ConnectionState() ConnectionState {
 	c.handshakeMutex.Lock()
@@ -0,0 +1,170 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CapturedRecord is one TLS record of a recorded connection, header
+// included.
+type CapturedRecord struct {
+	FromClient bool   `json:"from_client"`
+	Data       []byte `json:"data"`
+}
+
+// DecryptedRecord is the plaintext of an encrypted CapturedRecord. Type is
+// the record's content type, such as 23 for application data.
+type DecryptedRecord struct {
+	FromClient bool   `json:"from_client"`
+	Type       uint8  `json:"type"`
+	Data       []byte `json:"data"`
+}
+
+// recordDecryptor follows the handshakes of a recorded connection to
+// decrypt its records.
+type recordDecryptor struct {
+	keyLog         KeyLog
+	clientRandom   []byte
+	serverHello    *serverHelloMsg
+	client, server halfConn
+	clientHand     []byte
+	serverHand     []byte
+}
+
+// DecryptRecords decrypts the records of a connection, which must be in
+// the order they were sent. The version, cipher suite and randoms are read
+// from the hello messages in the transcript, and the master secret of each
+// handshake, renegotiations included, is looked up in keyLog. Any
+// implemented cipher suite, compression and encrypt-then-MAC are supported.
+// Only the records that were encrypted are returned; on error, those
+// decrypted so far are returned as well.
+func DecryptRecords(records []CapturedRecord, keyLog KeyLog) ([]DecryptedRecord, error) {
+	d := &recordDecryptor{keyLog: keyLog}
+	var decrypted []DecryptedRecord
+	for i, record := range records {
+		if len(record.Data) < tlsRecordHeaderLen {
+			return decrypted, fmt.Errorf("tls: record %d is too short", i)
+		}
+		typ := recordType(record.Data[0])
+		hc, hand := &d.server, &d.serverHand
+		if record.FromClient {
+			hc, hand = &d.client, &d.clientHand
+		}
+
+		data := record.Data[tlsRecordHeaderLen:]
+		if hc.cipher != nil {
+			var err error
+			if data, err = hc.openRecord(record.Data); err != nil {
+				return decrypted, fmt.Errorf("tls: record %d %s", i, err)
+			}
+			decrypted = append(decrypted, DecryptedRecord{FromClient: record.FromClient, Type: uint8(typ), Data: data})
+		}
+
+		var err error
+		switch typ {
+		case recordTypeHandshake:
+			err = d.readHandshake(hand, data)
+		case recordTypeChangeCipherSpec:
+			err = d.changeCipherSpec(hc, record.FromClient)
+		}
+		if err != nil {
+			return decrypted, fmt.Errorf("tls: record %d: %s", i, err)
+		}
+	}
+	return decrypted, nil
+}
+
+// openRecord decrypts and decompresses a captured record, header included,
+// and returns its plaintext.
+func (hc *halfConn) openRecord(record []byte) ([]byte, error) {
+	b := &block{data: append([]byte(nil), record...)}
+	ok, off, _ := hc.decrypt(b)
+	if !ok {
+		return nil, errors.New("failed to decrypt")
+	}
+	data, err := hc.decompress(b.data[off:])
+	if err != nil {
+		return nil, errors.New("failed to decompress: " + err.Error())
+	}
+	return data, nil
+}
+
+// readHandshake adds the handshake data of a record to hand, and keeps the
+// random and the ServerHello of any complete hello messages.
+func (d *recordDecryptor) readHandshake(hand *[]byte, data []byte) error {
+	*hand = append(*hand, data...)
+	for len(*hand) >= 4 {
+		n := int((*hand)[1])<<16 | int((*hand)[2])<<8 | int((*hand)[3])
+		if len(*hand) < 4+n {
+			break
+		}
+		msg := append([]byte(nil), (*hand)[:4+n]...)
+		*hand = (*hand)[4+n:]
+
+		switch msg[0] {
+		case typeClientHello:
+			hello := new(clientHelloMsg)
+			if !hello.unmarshal(msg) {
+				return errors.New("malformed ClientHello")
+			}
+			d.clientRandom = hello.random
+		case typeServerHello:
+			hello := new(serverHelloMsg)
+			if !hello.unmarshal(msg) {
+				return errors.New("malformed ServerHello")
+			}
+			d.serverHello = hello
+		}
+	}
+	return nil
+}
+
+// changeCipherSpec derives the keys of the last handshake for the records
+// of one side that follow its ChangeCipherSpec.
+func (d *recordDecryptor) changeCipherSpec(hc *halfConn, fromClient bool) error {
+	if d.clientRandom == nil || d.serverHello == nil {
+		return errors.New("ChangeCipherSpec before the hello messages")
+	}
+	suite := mutualCipherSuite([]uint16{d.serverHello.cipherSuite}, d.serverHello.cipherSuite)
+	if suite == nil {
+		return fmt.Errorf("unimplemented cipher suite %s", CipherSuite(d.serverHello.cipherSuite))
+	}
+	masterSecret := d.keyLog.MasterSecret(d.clientRandom)
+	if masterSecret == nil {
+		return fmt.Errorf("no master secret for client random %x", d.clientRandom)
+	}
+
+	vers := d.serverHello.vers
+	clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV := keysFromMasterSecret(vers, suite, masterSecret, d.clientRandom, d.serverHello.random, suite.macLen, suite.keyLen, suite.ivLen)
+	macKey, key, iv := serverMAC, serverKey, serverIV
+	if fromClient {
+		macKey, key, iv = clientMAC, clientKey, clientIV
+	}
+	var cipher interface{}
+	var mac macFunction
+	if suite.cipher != nil {
+		cipher = suite.cipher(key, iv, true /* for reading */)
+		mac = suite.mac(vers, macKey)
+	} else {
+		cipher = suite.aead(key, iv)
+	}
+
+	hc.prepareCipherSpec(vers, cipher, mac)
+	hc.prepareCompression(d.serverHello.compressionMethod)
+	hc.prepareEncryptThenMAC(d.serverHello.encryptThenMAC)
+	return hc.changeCipherSpec()
+}
@@ -0,0 +1,168 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// capturingConn captures the records a client writes and reads.
+type capturingConn struct {
+	net.Conn
+	sync.Mutex
+	records []CapturedRecord
+	out, in []byte
+}
+
+func (r *capturingConn) Write(b []byte) (int, error) {
+	r.out = r.capture(r.out, b, true)
+	return r.Conn.Write(b)
+}
+
+func (r *capturingConn) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.in = r.capture(r.in, b[:n], false)
+	return n, err
+}
+
+func (r *capturingConn) capture(buf, data []byte, fromClient bool) []byte {
+	r.Lock()
+	defer r.Unlock()
+	buf = append(buf, data...)
+	for len(buf) >= tlsRecordHeaderLen {
+		n := tlsRecordHeaderLen + (int(buf[3])<<8 | int(buf[4]))
+		if len(buf) < n {
+			break
+		}
+		r.records = append(r.records, CapturedRecord{FromClient: fromClient, Data: append([]byte(nil), buf[:n]...)})
+		buf = buf[n:]
+	}
+	return buf
+}
+
+func TestKeyLogWriter(t *testing.T) {
+	var keyLog bytes.Buffer
+	clientConfig := testConfig.Clone()
+	clientConfig.KeyLogWriter = &keyLog
+
+	conn, err := enumerationDialer(testConfig)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client(conn, clientConfig)
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	log := client.GetHandshakeLog()
+	want := "CLIENT_RANDOM " + hex.EncodeToString(log.ClientHello.Random) + " " + hex.EncodeToString(log.KeyMaterial.MasterSecret.Value) + "\n"
+	if keyLog.String() != want {
+		t.Errorf("got key log %q, want %q", keyLog.String(), want)
+	}
+
+	parsed, err := ReadKeyLog(io.MultiReader(bytes.NewBufferString("# comment\nCLIENT_HANDSHAKE_TRAFFIC_SECRET 00 00\n"), &keyLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 1 || !bytes.Equal(parsed.MasterSecret(log.ClientHello.Random), log.KeyMaterial.MasterSecret.Value) {
+		t.Errorf("got key log %x", parsed)
+	}
+	if _, err := ReadKeyLog(bytes.NewBufferString("CLIENT_RANDOM 0011 2233\n")); err == nil {
+		t.Error("malformed key log was read")
+	}
+}
+
+func TestDecryptRecords(t *testing.T) {
+	tests := []struct {
+		version     uint16
+		suite       uint16
+		compression bool
+	}{
+		{VersionTLS10, TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, false},
+		{VersionTLS12, TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, true},
+		{VersionTLS12, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, false},
+		{VersionTLS12, TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, false},
+		{VersionTLS11, TLS_ECDHE_RSA_WITH_RC4_128_SHA, false},
+	}
+	for _, test := range tests {
+		serverConfig := testConfig.Clone()
+		serverConfig.DeflateCompression = test.compression
+		serverConfig.EncryptThenMAC = true
+		serverConfig.CipherSuites = []uint16{test.suite}
+		clientConfig := serverConfig.Clone()
+		clientConfig.MaxVersion = test.version
+
+		conn, err := echoDialer(serverConfig)()
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := &capturingConn{Conn: conn}
+		client := Client(recorder, clientConfig)
+		message := []byte("GET / HTTP/1.0\r\n\r\n")
+		// The server may echo the first record of a split write before
+		// the client sends the second.
+		writeErr := make(chan error, 1)
+		go func() {
+			_, err := client.Write(message)
+			writeErr <- err
+		}()
+		if _, err := io.ReadFull(client, make([]byte, len(message))); err != nil {
+			t.Fatalf("%s: %s", CipherSuite(test.suite), err)
+		}
+		if err := <-writeErr; err != nil {
+			t.Fatalf("%s: %s", CipherSuite(test.suite), err)
+		}
+		conn.Close()
+
+		keyLog := make(KeyLog)
+		keyLog.AddHandshakeLog(client.GetHandshakeLog())
+		records, err := DecryptRecords(recorder.records, keyLog)
+		if err != nil {
+			t.Fatalf("%s: %s", CipherSuite(test.suite), err)
+		}
+		var fromClient, fromServer []byte
+		var finished int
+		for _, r := range records {
+			switch recordType(r.Type) {
+			case recordTypeApplicationData:
+				if r.FromClient {
+					fromClient = append(fromClient, r.Data...)
+				} else {
+					fromServer = append(fromServer, r.Data...)
+				}
+			case recordTypeHandshake:
+				if len(r.Data) > 0 && r.Data[0] == typeFinished {
+					finished++
+				}
+			}
+		}
+		if !bytes.Equal(fromClient, message) || !bytes.Equal(fromServer, message) {
+			t.Errorf("%s: decrypted %q from the client and %q from the server", CipherSuite(test.suite), fromClient, fromServer)
+		}
+		if finished != 2 {
+			t.Errorf("%s: decrypted %d Finished messages", CipherSuite(test.suite), finished)
+		}
+	}
+
+	if _, err := DecryptRecords([]CapturedRecord{{FromClient: true, Data: []byte{20, 3, 3, 0, 1, 1}}}, nil); err == nil {
+		t.Error("ChangeCipherSpec without hello messages was accepted")
+	}
+}
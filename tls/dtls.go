@@ -0,0 +1,751 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// dtlsMTU is the largest datagram sent during a DTLS handshake.
+	dtlsMTU = 1200
+
+	// dtlsFragmentHeaderLen is the length of the header of a DTLS
+	// handshake fragment, which adds message_seq, fragment_offset and
+	// fragment_length to the TLS handshake header.
+	dtlsFragmentHeaderLen = 12
+
+	// dtlsMaxFragment is the longest handshake fragment sent, which leaves
+	// room in dtlsMTU for the record header and the cipher's overhead.
+	dtlsMaxFragment = dtlsMTU - dtlsRecordHeaderLen - dtlsFragmentHeaderLen - 64
+
+	// A flight is retransmitted when no reply arrives within the timeout,
+	// which starts at dtlsInitialTimeout and doubles on each
+	// retransmission, up to dtlsMaxRetransmits times (RFC 6347, section
+	// 4.2.4.1).
+	dtlsInitialTimeout = time.Second
+	dtlsMaxTimeout     = 60 * time.Second
+	dtlsMaxRetransmits = 6
+
+	// dtlsMaxPendingMessages bounds how far past the next expected
+	// handshake message fragments are kept.
+	dtlsMaxPendingMessages = 16
+)
+
+// isDTLSVersion returns whether vers is a DTLS version.
+func isDTLSVersion(vers uint16) bool {
+	return vers>>8 == 0xfe
+}
+
+// versionToWire returns the DTLS version that is based on the TLS version
+// vers. Before a version is negotiated, DTLS 1.0 is used.
+func versionToWire(vers uint16) uint16 {
+	if vers >= VersionTLS12 {
+		return VersionDTLS12
+	}
+	return VersionDTLS10
+}
+
+// wireToVersion returns the TLS version that the DTLS version vers is based
+// on. Versions after DTLS 1.2 map to VersionTLS13, and versions that are
+// not DTLS to zero.
+func wireToVersion(vers uint16) uint16 {
+	switch {
+	case !isDTLSVersion(vers):
+		return 0
+	case vers >= 0xfefe:
+		// DTLS 1.0, and the 0xfefe that was skipped to match TLS 1.1.
+		return VersionTLS11
+	case vers == VersionDTLS12:
+		return VersionTLS12
+	}
+	return VersionTLS13
+}
+
+// toWireVersion returns the version vers as it is sent in hello messages.
+func (c *Conn) toWireVersion(vers uint16) uint16 {
+	if c.isDTLS {
+		return versionToWire(vers)
+	}
+	return vers
+}
+
+// fromWireVersion returns the version vers of a hello message as it is
+// negotiated and configured.
+func (c *Conn) fromWireVersion(vers uint16) uint16 {
+	if c.isDTLS {
+		return wireToVersion(vers)
+	}
+	return vers
+}
+
+// mutualVersion returns the version to use with a peer that sent the
+// version vers in its hello message, as Config.mutualVersion does.
+func (c *Conn) mutualVersion(vers uint16) (uint16, bool) {
+	vers, ok := c.config.mutualVersion(c.fromWireVersion(vers))
+	if c.isDTLS && vers < VersionTLS11 {
+		return 0, false
+	}
+	return vers, ok
+}
+
+// DTLSClient returns a new DTLS client side connection to addr, which
+// exchanges datagrams over conn. Datagrams from other addresses are dropped,
+// so conn should not be shared with other connections. Closing the Conn
+// closes conn. The config is used as for Client, with the versions of DTLS
+// configured as the TLS versions they are based on.
+func DTLSClient(conn net.PacketConn, addr net.Addr, config *Config) *Conn {
+	c := newDTLSConn(conn, addr, config)
+	c.isClient = true
+	return c
+}
+
+// DTLSServer returns a new DTLS server side connection to the client at addr,
+// which exchanges datagrams over conn as for DTLSClient. The server always
+// asks the client to prove its address with a HelloVerifyRequest.
+func DTLSServer(conn net.PacketConn, addr net.Addr, config *Config) *Conn {
+	return newDTLSConn(conn, addr, config)
+}
+
+func newDTLSConn(conn net.PacketConn, addr net.Addr, config *Config) *Conn {
+	dc := &dtlsConn{PacketConn: conn, addr: addr}
+	c := &Conn{
+		conn:       dc,
+		config:     config,
+		isDTLS:     true,
+		transcript: newTranscriptRecorder(config),
+		dtls: &dtlsState{
+			conn:    dc,
+			buf:     make([]byte, 1<<16),
+			pending: make(map[uint16]*dtlsMessage),
+			seqs:    make(map[string]uint16),
+			timeout: dtlsInitialTimeout,
+		},
+	}
+	c.in.isDTLS = true
+	c.out.isDTLS = true
+	if c.transcript != nil {
+		c.transcript.headerLen = dtlsRecordHeaderLen
+	}
+	return c
+}
+
+// dtlsConn adapts a net.PacketConn to the net.Conn of a Conn, exchanging
+// datagrams with the peer at addr. It keeps the read deadline set through
+// it, so that the retransmission timer can be set in its place.
+type dtlsConn struct {
+	net.PacketConn
+	addr net.Addr
+
+	mutex        sync.Mutex
+	readDeadline time.Time
+}
+
+// Read reads the next datagram from the peer.
+func (d *dtlsConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := d.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+		if addr.String() == d.addr.String() {
+			return n, nil
+		}
+	}
+}
+
+// Write sends b to the peer as one datagram.
+func (d *dtlsConn) Write(b []byte) (int, error) {
+	return d.WriteTo(b, d.addr)
+}
+
+func (d *dtlsConn) RemoteAddr() net.Addr {
+	return d.addr
+}
+
+func (d *dtlsConn) SetDeadline(t time.Time) error {
+	d.setReadDeadline(t)
+	return d.PacketConn.SetDeadline(t)
+}
+
+func (d *dtlsConn) SetReadDeadline(t time.Time) error {
+	d.setReadDeadline(t)
+	return d.PacketConn.SetReadDeadline(t)
+}
+
+func (d *dtlsConn) setReadDeadline(t time.Time) {
+	d.mutex.Lock()
+	d.readDeadline = t
+	d.mutex.Unlock()
+}
+
+func (d *dtlsConn) deadline() time.Time {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.readDeadline
+}
+
+// dtlsState is the state of the record layer and handshake of a DTLS
+// connection that TLS connections do not have.
+type dtlsState struct {
+	conn *dtlsConn
+
+	// datagram holds the records of the last datagram read, in buf, that
+	// have not been processed yet. replay is the replay window of the
+	// epoch being read.
+	buf      []byte
+	datagram []byte
+	replay   replayWindow
+
+	// sendSeq and receiveSeq are the message_seq of the next handshake
+	// message to send and to pass on to readHandshake. Fragments of later
+	// messages are kept in pending until their turn.
+	sendSeq, receiveSeq uint16
+	pending             map[uint16]*dtlsMessage
+
+	// seqs holds the message_seq of each handshake message sent or
+	// received, by its contents, for messageSeq.
+	seqs map[string]uint16
+
+	// flight holds the handshake and ChangeCipherSpec records of the last
+	// flight sent, for retransmission. flightDone is set once a handshake
+	// message is received in reply, so that the next record sent starts a
+	// new flight.
+	flight      []dtlsRecord
+	flightDone  bool
+	timeout     time.Duration
+	retransmits int
+
+	// cookieKey is the key of the cookies of a server.
+	cookieKey []byte
+}
+
+// dtlsRecord is a record of a flight, and the epoch it was sent in.
+type dtlsRecord struct {
+	typ   recordType
+	data  []byte
+	epoch uint16
+}
+
+// dtlsMessage is a handshake message being reassembled from its fragments.
+type dtlsMessage struct {
+	data    []byte // the message, with a TLS handshake header
+	have    []bool // which bytes of the body have arrived
+	missing int
+}
+
+func newDTLSMessage(typ uint8, length int) *dtlsMessage {
+	m := &dtlsMessage{
+		data:    make([]byte, 4+length),
+		have:    make([]bool, length),
+		missing: length,
+	}
+	m.data[0] = typ
+	m.data[1] = uint8(length >> 16)
+	m.data[2] = uint8(length >> 8)
+	m.data[3] = uint8(length)
+	return m
+}
+
+// add adds the fragment of the body at offset, which may overlap those that
+// have already arrived.
+func (m *dtlsMessage) add(offset int, fragment []byte) {
+	copy(m.data[4+offset:], fragment)
+	for i := range fragment {
+		if !m.have[offset+i] {
+			m.have[offset+i] = true
+			m.missing--
+		}
+	}
+}
+
+// replayWindow records which of the last 64 sequence numbers of an epoch
+// have been received (RFC 6347, section 4.1.2.6).
+type replayWindow struct {
+	next uint64 // one past the highest sequence number received
+	bits uint64 // bit i is set if next-1-i has been received
+}
+
+// seen returns whether seq has already been received, or is too old to
+// tell.
+func (w *replayWindow) seen(seq uint64) bool {
+	if seq >= w.next {
+		return false
+	}
+	age := w.next - 1 - seq
+	return age >= 64 || w.bits&(1<<age) != 0
+}
+
+// mark records that seq has been received.
+func (w *replayWindow) mark(seq uint64) {
+	if seq < w.next {
+		w.bits |= 1 << (w.next - 1 - seq)
+		return
+	}
+	if shift := seq + 1 - w.next; shift < 64 {
+		w.bits <<= shift
+	} else {
+		w.bits = 0
+	}
+	w.bits |= 1
+	w.next = seq + 1
+}
+
+// messageSeq returns the message_seq of the handshake message msg, for
+// finishedHash. A message that has not been sent or received yet is the
+// next one to be sent, since messages are hashed before they are written.
+func (d *dtlsState) messageSeq(msg []byte) uint16 {
+	if seq, ok := d.seqs[string(msg)]; ok {
+		return seq
+	}
+	return d.sendSeq
+}
+
+// dtlsHashedMessage returns the handshake message msg as it is hashed for
+// the Finished messages in DTLS: with the header of a single fragment
+// holding all of it.
+func dtlsHashedMessage(msg []byte, seq uint16) []byte {
+	out := make([]byte, 0, len(msg)+dtlsFragmentHeaderLen-4)
+	out = append(out, msg[:4]...)
+	out = append(out, byte(seq>>8), byte(seq), 0, 0, 0)
+	out = append(out, msg[1:4]...)
+	return append(out, msg[4:]...)
+}
+
+// dtlsReadRecord returns the next record from the peer that is in the epoch
+// being read, has not been received before and can be decrypted. Other
+// records are dropped, as DTLS requires (RFC 6347, section 4.1.2.7).
+// c.in.Mutex <= L.
+func (c *Conn) dtlsReadRecord(want recordType) (*block, error) {
+	d := c.dtls
+	for {
+		if len(d.datagram) == 0 {
+			if err := c.dtlsReadDatagram(); err != nil {
+				if e, ok := err.(net.Error); !ok || !e.Temporary() {
+					c.in.setErrorLocked(err)
+				}
+				return nil, err
+			}
+		}
+		data := d.datagram
+		n := 0
+		if len(data) >= dtlsRecordHeaderLen {
+			n = int(data[11])<<8 | int(data[12])
+		}
+		if !c.haveVers {
+			// As in TLS, the first records are checked to tell
+			// peers that do not speak DTLS.
+			if len(data) < dtlsRecordHeaderLen || (recordType(data[0]) != recordTypeAlert && recordType(data[0]) != want) || !isDTLSVersion(uint16(data[1])<<8|uint16(data[2])) {
+				c.sendAlert(alertUnexpectedMessage)
+				return nil, c.in.setErrorLocked(errNotTLSRecord)
+			}
+		}
+		if len(data) < dtlsRecordHeaderLen+n || n > maxCiphertext {
+			// The rest of the datagram is not a record.
+			d.datagram = nil
+			continue
+		}
+		record := data[:dtlsRecordHeaderLen+n]
+		d.datagram = data[len(record):]
+		c.transcript.recordReceived(record)
+
+		epoch := uint16(record[3])<<8 | uint16(record[4])
+		seq := uint64(record[5])<<40 | uint64(record[6])<<32 | uint64(record[7])<<24 |
+			uint64(record[8])<<16 | uint64(record[9])<<8 | uint64(record[10])
+		if epoch != c.in.epoch() || d.replay.seen(seq) {
+			continue
+		}
+		b := c.in.newBlock()
+		b.resize(len(record))
+		copy(b.data, record)
+		copy(c.in.seq[:], record[3:11])
+		ok, off, _ := c.in.decrypt(b)
+		if !ok {
+			c.in.freeBlock(b)
+			continue
+		}
+		d.replay.mark(seq)
+		b.off = off
+		return b, nil
+	}
+}
+
+// dtlsReadDatagram reads the next datagram from the peer. While a flight of
+// the handshake awaits its reply, it is retransmitted whenever the timer
+// expires before the read deadline.
+// c.in.Mutex <= L.
+func (c *Conn) dtlsReadDatagram() error {
+	d := c.dtls
+	for {
+		timer := false
+		if !c.handshakeComplete && len(d.flight) > 0 {
+			t := time.Now().Add(d.timeout)
+			if deadline := d.conn.deadline(); deadline.IsZero() || t.Before(deadline) {
+				timer = true
+				d.conn.PacketConn.SetReadDeadline(t)
+			}
+		}
+		n, err := d.conn.Read(d.buf)
+		if timer {
+			d.conn.PacketConn.SetReadDeadline(d.conn.deadline())
+		}
+		if err == nil {
+			d.datagram = d.buf[:n]
+			return nil
+		}
+		if e, ok := err.(net.Error); !timer || !ok || !e.Timeout() || d.retransmits >= dtlsMaxRetransmits {
+			return err
+		}
+		if err := c.dtlsRetransmit(); err != nil {
+			return err
+		}
+		d.retransmits++
+		if d.timeout *= 2; d.timeout > dtlsMaxTimeout {
+			d.timeout = dtlsMaxTimeout
+		}
+	}
+}
+
+// dtlsHandshakeRecord reassembles the handshake fragments in data, and
+// passes complete messages on to readHandshake in order. Fragments of the
+// last message received mean that the peer is retransmitting its flight,
+// because ours was lost, so ours is retransmitted too. Messages after the
+// handshake are dropped, since renegotiation is not supported.
+// c.in.Mutex <= L.
+func (c *Conn) dtlsHandshakeRecord(data []byte) error {
+	d := c.dtls
+	retransmit := false
+	for len(data) > 0 {
+		if len(data) < dtlsFragmentHeaderLen {
+			return c.sendAlert(alertDecodeError)
+		}
+		typ := data[0]
+		length := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		seq := uint16(data[4])<<8 | uint16(data[5])
+		offset := int(data[6])<<16 | int(data[7])<<8 | int(data[8])
+		n := int(data[9])<<16 | int(data[10])<<8 | int(data[11])
+		if length > maxHandshake || offset+n > length || len(data) < dtlsFragmentHeaderLen+n {
+			return c.sendAlert(alertDecodeError)
+		}
+		fragment := data[dtlsFragmentHeaderLen : dtlsFragmentHeaderLen+n]
+		data = data[dtlsFragmentHeaderLen+n:]
+
+		if seq < d.receiveSeq {
+			retransmit = retransmit || seq == d.receiveSeq-1
+			continue
+		}
+		if c.handshakeComplete || seq >= d.receiveSeq+dtlsMaxPendingMessages {
+			continue
+		}
+		m := d.pending[seq]
+		if m == nil {
+			m = newDTLSMessage(typ, length)
+			d.pending[seq] = m
+		}
+		if m.data[0] != typ || len(m.data) != 4+length {
+			return c.sendAlert(alertDecodeError)
+		}
+		m.add(offset, fragment)
+	}
+
+	for m := d.pending[d.receiveSeq]; m != nil && m.missing == 0; m = d.pending[d.receiveSeq] {
+		delete(d.pending, d.receiveSeq)
+		d.seqs[string(m.data)] = d.receiveSeq
+		c.hand.Write(m.data)
+		d.receiveSeq++
+		d.flightDone = true
+	}
+
+	if retransmit {
+		return c.dtlsRetransmit()
+	}
+	return nil
+}
+
+// dtlsWriteRecord writes data as DTLS records of type typ. Handshake
+// messages are split into fragments that fit in a datagram, and handshake
+// and ChangeCipherSpec records are kept in the flight for retransmission.
+// c.out.Mutex <= L.
+func (c *Conn) dtlsWriteRecord(typ recordType, data []byte) (n int, err error) {
+	d := c.dtls
+	if (typ == recordTypeHandshake || typ == recordTypeChangeCipherSpec) && d.flightDone {
+		d.flight = nil
+		d.flightDone = false
+		d.timeout = dtlsInitialTimeout
+		d.retransmits = 0
+	}
+
+	switch typ {
+	case recordTypeHandshake:
+		for len(data) >= 4 {
+			length := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+			if len(data) < 4+length {
+				return n, alertInternalError
+			}
+			msg := data[:4+length]
+			data = data[4+length:]
+			d.seqs[string(msg)] = d.sendSeq
+			for _, fragment := range dtlsFragments(msg, d.sendSeq) {
+				d.flight = append(d.flight, dtlsRecord{typ, fragment, c.out.epoch()})
+				if err = c.dtlsSendRecord(typ, fragment); err != nil {
+					return
+				}
+			}
+			d.sendSeq++
+			n += len(msg)
+		}
+		return
+	case recordTypeChangeCipherSpec:
+		d.flight = append(d.flight, dtlsRecord{typ, append([]byte(nil), data...), c.out.epoch()})
+	}
+
+	first := true
+	for len(data) > 0 || first {
+		m := len(data)
+		if m > maxPlaintext {
+			m = maxPlaintext
+		}
+		first = false
+		if err = c.dtlsSendRecord(typ, data[:m]); err != nil {
+			return
+		}
+		n += m
+		data = data[m:]
+	}
+	return
+}
+
+// dtlsFragments splits the handshake message msg into fragments of at most
+// dtlsMaxFragment bytes, each with a DTLS fragment header.
+func dtlsFragments(msg []byte, seq uint16) [][]byte {
+	body := msg[4:]
+	var fragments [][]byte
+	for offset := 0; offset < len(body) || offset == 0; {
+		n := len(body) - offset
+		if n > dtlsMaxFragment {
+			n = dtlsMaxFragment
+		}
+		fragment := make([]byte, dtlsFragmentHeaderLen+n)
+		copy(fragment, msg[:4])
+		fragment[4] = byte(seq >> 8)
+		fragment[5] = byte(seq)
+		fragment[6] = byte(offset >> 16)
+		fragment[7] = byte(offset >> 8)
+		fragment[8] = byte(offset)
+		fragment[9] = byte(n >> 16)
+		fragment[10] = byte(n >> 8)
+		fragment[11] = byte(n)
+		copy(fragment[dtlsFragmentHeaderLen:], body[offset:offset+n])
+		fragments = append(fragments, fragment)
+		if offset += n; n == 0 {
+			break
+		}
+	}
+	return fragments
+}
+
+// dtlsSendRecord writes a record of type typ carrying payload in the
+// current epoch.
+// c.out.Mutex <= L.
+func (c *Conn) dtlsSendRecord(typ recordType, payload []byte) error {
+	b := c.out.newBlock()
+	defer c.out.freeBlock(b)
+	if err := c.sealRecord(&c.out, b, typ, payload); err != nil {
+		return err
+	}
+	_, err := c.write(b.data)
+	return err
+}
+
+// dtlsWriteDatagrams writes the records in data, packing as many into each
+// datagram as fit in dtlsMTU.
+// c.out.Mutex <= L.
+func (c *Conn) dtlsWriteDatagrams(data []byte) (int, error) {
+	n := 0
+	for len(data) > 0 {
+		size := 0
+		for size < len(data) {
+			next := size + dtlsRecordHeaderLen + (int(data[size+11])<<8 | int(data[size+12]))
+			if size > 0 && next > dtlsMTU {
+				break
+			}
+			size = next
+		}
+		m, err := c.conn.Write(data[:size])
+		c.transcript.recordSent(data[:m])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		data = data[size:]
+	}
+	return n, nil
+}
+
+// dtlsRetransmit sends the records of the last flight again, each in the
+// epoch it was first sent in, with new sequence numbers.
+// L < c.out.Mutex.
+func (c *Conn) dtlsRetransmit() error {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	var records []byte
+	b := c.out.newBlock()
+	defer c.out.freeBlock(b)
+	for _, r := range c.dtls.flight {
+		hc := &c.out
+		if r.epoch != hc.epoch() {
+			hc = hc.prev
+		}
+		if hc == nil || r.epoch != hc.epoch() {
+			continue
+		}
+		if err := c.sealRecord(hc, b, r.typ, r.data); err != nil {
+			return err
+		}
+		records = append(records, b.data...)
+	}
+	_, err := c.dtlsWriteDatagrams(records)
+	return err
+}
+
+// dtlsCookie returns the cookie that the client must return in its
+// ClientHello: a MAC of its address and random, which proves that the
+// client receives datagrams at its address (RFC 6347, section 4.2.1).
+func (c *Conn) dtlsCookie(hello *clientHelloMsg) ([]byte, error) {
+	d := c.dtls
+	if d.cookieKey == nil {
+		d.cookieKey = make([]byte, 32)
+		if _, err := io.ReadFull(c.config.rand(), d.cookieKey); err != nil {
+			d.cookieKey = nil
+			return nil, err
+		}
+	}
+	mac := hmac.New(sha256.New, d.cookieKey)
+	mac.Write([]byte(c.conn.RemoteAddr().String()))
+	mac.Write(hello.random)
+	return mac.Sum(nil), nil
+}
+
+// dtlsVerifyClient sends the client a HelloVerifyRequest, unless hello
+// already carries the right cookie, and returns the ClientHello that does.
+func (c *Conn) dtlsVerifyClient(hello *clientHelloMsg) (*clientHelloMsg, error) {
+	cookie, err := c.dtlsCookie(hello)
+	if err != nil {
+		c.sendAlert(alertInternalError)
+		return nil, err
+	}
+	if !hmac.Equal(cookie, hello.cookie) {
+		hvr := &helloVerifyRequestMsg{vers: VersionDTLS10, cookie: cookie}
+		hvrBytes, err := c.marshalHandshake(hvr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.writeRecord(recordTypeHandshake, hvrBytes); err != nil {
+			return nil, err
+		}
+		c.handshakeLog.HelloVerifyRequest = hvr.MakeLog()
+
+		msg, err := c.readHandshake()
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if hello, ok = msg.(*clientHelloMsg); !ok {
+			c.sendAlert(alertUnexpectedMessage)
+			return nil, unexpectedMessageError(hello, msg)
+		}
+		// The cookie covers the client random, which must not
+		// change.
+		if cookie, err = c.dtlsCookie(hello); err != nil {
+			c.sendAlert(alertInternalError)
+			return nil, err
+		}
+		if !hmac.Equal(cookie, hello.cookie) {
+			c.sendAlert(alertHandshakeFailure)
+			return nil, errors.New("tls: client did not return the DTLS cookie")
+		}
+	}
+	// The ServerHello takes the message_seq of the ClientHello it
+	// replies to.
+	c.dtls.sendSeq = c.dtls.seqs[string(hello.marshal())]
+	return hello, nil
+}
+
+// dtlsResendHello replies to a HelloVerifyRequest by sending hello again
+// with its cookie, and returns the ClientHello as it was sent and the next
+// message from the server. The cookie is spliced into the hello as it was
+// first marshaled, so that a hello made by a ClientFingerprintConfiguration
+// keeps its exact bytes.
+func (c *Conn) dtlsResendHello(hello *clientHelloMsg, hvr *helloVerifyRequestMsg) ([]byte, interface{}, error) {
+	c.handshakeLog.HelloVerifyRequest = hvr.MakeLog()
+	if !hello.unmarshal(spliceHelloCookie(hello.marshal(), hvr.cookie, true)) {
+		return nil, nil, errors.New("tls: could not add the cookie to the ClientHello")
+	}
+	helloBytes, err := c.marshalHandshake(hello)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := c.writeRecord(recordTypeHandshake, helloBytes); err != nil {
+		return nil, nil, err
+	}
+	c.handshakeLog.ClientHello = hello.MakeLog()
+	msg, err := c.readHandshake()
+	return helloBytes, msg, err
+}
+
+// dtlsHelloFromTLS returns raw, a ClientHello marshaled for TLS, as a DTLS
+// ClientHello with version vers and an empty cookie.
+func dtlsHelloFromTLS(raw []byte, vers uint16) []byte {
+	raw = spliceHelloCookie(raw, nil, false)
+	if len(raw) >= 6 {
+		raw[4], raw[5] = uint8(vers>>8), uint8(vers)
+	}
+	return raw
+}
+
+// spliceHelloCookie returns a copy of raw, a marshaled ClientHello, with its
+// cookie replaced by cookie. If hasCookie is false, raw has no cookie, and
+// one is inserted after the session ID. raw is returned unchanged if it is
+// too short to hold a cookie.
+func spliceHelloCookie(raw, cookie []byte, hasCookie bool) []byte {
+	// The session ID follows the header, version and random.
+	start := 4 + 2 + 32
+	if len(raw) <= start || len(raw) <= start+1+int(raw[start]) {
+		return raw
+	}
+	start += 1 + int(raw[start])
+	end := start
+	if hasCookie {
+		end += 1 + int(raw[start])
+		if len(raw) < end {
+			return raw
+		}
+	}
+	out := make([]byte, 0, len(raw)-(end-start)+1+len(cookie))
+	out = append(out, raw[:start]...)
+	out = append(out, uint8(len(cookie)))
+	out = append(out, cookie...)
+	out = append(out, raw[end:]...)
+	n := len(out) - 4
+	out[1], out[2], out[3] = uint8(n>>16), uint8(n>>8), uint8(n)
+	return out
+}
@@ -0,0 +1,285 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn drops the datagrams written to it whose numbers are in
+// drop, counting from zero.
+type lossyPacketConn struct {
+	net.PacketConn
+	mutex   sync.Mutex
+	written int
+	drop    map[int]bool
+}
+
+func (l *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	l.mutex.Lock()
+	n := l.written
+	l.written++
+	l.mutex.Unlock()
+	if l.drop[n] {
+		return len(b), nil
+	}
+	return l.PacketConn.WriteTo(b, addr)
+}
+
+// dtlsPair returns a client and a server connected over UDP on the loopback
+// interface, each writing through the PacketConn returned by wrap.
+func dtlsPair(t *testing.T, clientConfig, serverConfig *Config, wrap func(net.PacketConn) net.PacketConn) (client, server *Conn) {
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = DTLSClient(wrap(clientConn), serverConn.LocalAddr(), clientConfig)
+	server = DTLSServer(wrap(serverConn), clientConn.LocalAddr(), serverConfig)
+	deadline := time.Now().Add(30 * time.Second)
+	client.SetDeadline(deadline)
+	server.SetDeadline(deadline)
+	return client, server
+}
+
+func noWrap(conn net.PacketConn) net.PacketConn {
+	return conn
+}
+
+// dtlsEcho runs the handshake, and checks that a message written by the
+// client is echoed back by the server.
+func dtlsEcho(t *testing.T, client, server *Conn) {
+	serverErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 100)
+		n, err := server.Read(buf)
+		if err == nil {
+			_, err = server.Write(buf[:n])
+		}
+		serverErr <- err
+	}()
+
+	msg := []byte("hello over DTLS")
+	if _, err := client.Write(msg); err != nil {
+		t.Fatalf("client: %s", err)
+	}
+	buf := make([]byte, 100)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("client: %s", err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Errorf("got %q back, want %q", buf[:n], msg)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server: %s", err)
+	}
+}
+
+func TestDTLSHandshake(t *testing.T) {
+	tests := []struct {
+		version, wire uint16
+		suite         uint16
+	}{
+		{VersionTLS12, VersionDTLS12, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		{VersionTLS12, VersionDTLS12, TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
+		{VersionTLS11, VersionDTLS10, TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
+		{VersionTLS12, VersionDTLS12, TLS_RSA_WITH_AES_128_CBC_SHA},
+	}
+	for _, test := range tests {
+		serverConfig := testConfig.Clone()
+		serverConfig.MaxVersion = test.version
+		serverConfig.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_RC4_128_SHA, test.suite}
+		client, server := dtlsPair(t, serverConfig.Clone(), serverConfig, noWrap)
+		dtlsEcho(t, client, server)
+
+		state := client.ConnectionState()
+		if state.Version != test.version || state.CipherSuite != test.suite {
+			t.Errorf("%x: got version %x and suite %x", test.wire, state.Version, state.CipherSuite)
+		}
+		log := client.GetHandshakeLog()
+		if log.ServerHello == nil || uint16(log.ServerHello.Version) != test.wire {
+			t.Errorf("%x: got ServerHello %v", test.wire, log.ServerHello)
+		}
+		if log.HelloVerifyRequest == nil || len(log.HelloVerifyRequest.Cookie) == 0 {
+			t.Errorf("%x: got HelloVerifyRequest %v", test.wire, log.HelloVerifyRequest)
+		} else if !bytes.Equal(log.ClientHello.Cookie, log.HelloVerifyRequest.Cookie) {
+			t.Errorf("%x: the ClientHello did not return the cookie", test.wire)
+		}
+		if log.ServerFinished == nil || log.ClientFinished == nil {
+			t.Errorf("%x: Finished messages are missing from the log", test.wire)
+		}
+		if server.GetHandshakeLog().HelloVerifyRequest == nil {
+			t.Errorf("%x: the server did not log its HelloVerifyRequest", test.wire)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestDTLSRetransmission(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for retransmission timers")
+	}
+	serverConfig := testConfig.Clone()
+	serverConfig.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	// The client loses its first ClientHello, and the server its first
+	// flight after the HelloVerifyRequest.
+	lossy := []*lossyPacketConn{}
+	wrap := func(conn net.PacketConn) net.PacketConn {
+		l := &lossyPacketConn{PacketConn: conn, drop: map[int]bool{0: true}}
+		if len(lossy) == 1 {
+			l.drop = map[int]bool{1: true}
+		}
+		lossy = append(lossy, l)
+		return l
+	}
+	client, server := dtlsPair(t, serverConfig.Clone(), serverConfig, wrap)
+	defer client.Close()
+	defer server.Close()
+	dtlsEcho(t, client, server)
+	for i, l := range lossy {
+		if l.written <= 2 {
+			t.Errorf("conn %d: nothing was retransmitted", i)
+		}
+	}
+}
+
+func TestDTLSNotDTLS(t *testing.T) {
+	client, server := dtlsPair(t, testConfig.Clone(), testConfig, noWrap)
+	defer client.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		server.conn.Read(buf)
+		server.conn.Write([]byte("HTTP/1.0 400 Bad Request\r\n\r\n"))
+	}()
+	if err := client.Handshake(); err != errNotTLSRecord {
+		t.Errorf("got %v, want %v", err, errNotTLSRecord)
+	}
+}
+
+func TestDTLSReassembly(t *testing.T) {
+	c := newDTLSConn(nil, nil, testConfig)
+	body := make([]byte, 3*dtlsMaxFragment+10)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	msg := append([]byte{typeCertificate, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+	fragments := dtlsFragments(msg, 0)
+	if len(fragments) != 4 {
+		t.Fatalf("got %d fragments, want 4", len(fragments))
+	}
+
+	// Fragments arrive out of order and duplicated, along with a
+	// fragment of the next message.
+	next := dtlsFragments([]byte{typeServerHelloDone, 0, 0, 0}, 1)
+	for _, f := range [][]byte{fragments[2], next[0], fragments[0], fragments[2], fragments[3]} {
+		if err := c.dtlsHandshakeRecord(f); err != nil {
+			t.Fatal(err)
+		}
+		if c.hand.Len() != 0 {
+			t.Fatal("message passed on before it was complete")
+		}
+	}
+	if err := c.dtlsHandshakeRecord(fragments[1]); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte(nil), msg...), typeServerHelloDone, 0, 0, 0)
+	if !bytes.Equal(c.hand.Bytes(), want) {
+		t.Error("reassembled messages differ")
+	}
+	if c.dtls.receiveSeq != 2 || len(c.dtls.pending) != 0 {
+		t.Errorf("got receiveSeq %d with %d pending", c.dtls.receiveSeq, len(c.dtls.pending))
+	}
+	if seq, ok := c.dtls.seqs[string(msg)]; !ok || seq != 0 {
+		t.Error("message_seq not recorded for the finished hash")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, seq := range []uint64{0, 1, 5, 3, 100, 40} {
+		if w.seen(seq) {
+			t.Errorf("%d seen before it was received", seq)
+		}
+		w.mark(seq)
+		if !w.seen(seq) {
+			t.Errorf("%d not seen after it was received", seq)
+		}
+	}
+	for seq, want := range map[uint64]bool{0: true, 5: true, 36: true, 37: false, 40: true, 99: false, 101: false} {
+		if w.seen(seq) != want {
+			t.Errorf("seen(%d) = %t, want %t", seq, !want, want)
+		}
+	}
+}
+
+func TestDTLSVersions(t *testing.T) {
+	for wire, vers := range map[uint16]uint16{
+		VersionDTLS10: VersionTLS11,
+		VersionDTLS12: VersionTLS12,
+		0xfefc:        VersionTLS13,
+		VersionTLS12:  0,
+	} {
+		if got := wireToVersion(wire); got != vers {
+			t.Errorf("wireToVersion(%x) = %x, want %x", wire, got, vers)
+		}
+		if vers == VersionTLS11 || vers == VersionTLS12 {
+			if got := versionToWire(vers); got != wire {
+				t.Errorf("versionToWire(%x) = %x, want %x", vers, got, wire)
+			}
+		}
+	}
+}
+
+func TestDTLSFingerprint(t *testing.T) {
+	fingerprint, err := ProfileChrome58.NewConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hellos [][]byte
+	clientConfig := testConfig.Clone()
+	clientConfig.ClientFingerprintConfiguration = fingerprint
+	clientConfig.HandshakeHook = &recordingHook{
+		send: func(m *HandshakeMessage) error {
+			if m.Type == typeClientHello {
+				hellos = append(hellos, append([]byte(nil), m.Raw...))
+			}
+			return nil
+		},
+	}
+	client, server := dtlsPair(t, clientConfig, testConfig.Clone(), noWrap)
+	dtlsEcho(t, client, server)
+	client.Close()
+	server.Close()
+
+	if len(hellos) != 2 {
+		t.Fatalf("sent %d ClientHellos", len(hellos))
+	}
+	cookie := client.GetHandshakeLog().HelloVerifyRequest.Cookie
+	if want := spliceHelloCookie(hellos[0], cookie, true); !bytes.Equal(hellos[1], want) {
+		t.Errorf("resent ClientHello is not the first with the cookie:\n%x\nwant\n%x", hellos[1], want)
+	}
+	if v := uint16(hellos[0][4])<<8 | uint16(hellos[0][5]); v != VersionDTLS12 {
+		t.Errorf("got ClientHello version %x", v)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import "crypto/subtle"
+
+// isCBC returns true if suite uses a CBC cipher, the only kind that
+// encrypt-then-MAC applies to.
+func (suite *cipherSuite) isCBC() bool {
+	return suite.cipher != nil && suite.ivLen > 0
+}
+
+// prepareEncryptThenMAC sets whether a subsequent changeCipherSpec switches
+// CBC records to encrypt-then-MAC (RFC 7366).
+func (hc *halfConn) prepareEncryptThenMAC(enabled bool) {
+	hc.nextEncryptThenMAC = enabled
+}
+
+// sealEncryptThenMAC pads and encrypts the data in b, then appends a MAC of
+// the record header, any explicit IV and the ciphertext.
+func (hc *halfConn) sealEncryptThenMAC(b *block, explicitIVLen int, c cbcMode) (bool, alert) {
+	recordHeaderLen := hc.recordHeaderLen()
+
+	payload := b.data[recordHeaderLen:]
+	if explicitIVLen > 0 {
+		c.SetIV(payload[:explicitIVLen])
+		payload = payload[explicitIVLen:]
+	}
+	prefix, finalBlock := padWithFault(payload, c.BlockSize(), hc.fault)
+	b.resize(recordHeaderLen + explicitIVLen + len(prefix) + len(finalBlock))
+	c.CryptBlocks(b.data[recordHeaderLen+explicitIVLen:], prefix)
+	c.CryptBlocks(b.data[recordHeaderLen+explicitIVLen+len(prefix):], finalBlock)
+
+	// The MAC covers the length of the IV and ciphertext, not the length
+	// of the record.
+	n := len(b.data) - recordHeaderLen
+	b.data[recordHeaderLen-2] = byte(n >> 8)
+	b.data[recordHeaderLen-1] = byte(n)
+	mac := hc.mac.MAC(hc.outDigestBuf, hc.seq[0:], b.data[:3], b.data[recordHeaderLen-2:recordHeaderLen], b.data[recordHeaderLen:])
+
+	m := len(b.data)
+	b.resize(m + len(mac))
+	copy(b.data[m:], mac)
+	hc.outDigestBuf = mac
+	if hc.fault.corruptsMAC() {
+		b.data[m] ^= 0xff
+	}
+
+	n = len(b.data) - recordHeaderLen
+	b.data[recordHeaderLen-2] = byte(n >> 8)
+	b.data[recordHeaderLen-1] = byte(n)
+	hc.incSeq(true)
+	hc.fault = RecordFaultNone
+
+	return true, 0
+}
+
+// openEncryptThenMAC checks the MAC of the encrypt-then-MAC record in b
+// before decrypting it and stripping the padding. Its results are as for
+// decrypt. Since the MAC is checked first, a bad padding is not a padding
+// oracle.
+func (hc *halfConn) openEncryptThenMAC(b *block, c cbcMode) (ok bool, prefixLen int, alertValue alert) {
+	recordHeaderLen := hc.recordHeaderLen()
+
+	payload := b.data[recordHeaderLen:]
+	macSize := hc.mac.Size()
+	blockSize := c.BlockSize()
+	explicitIVLen := 0
+	if hc.version >= VersionTLS11 {
+		explicitIVLen = blockSize
+	}
+
+	if len(payload) < macSize {
+		return false, 0, alertBadRecordMAC
+	}
+	n := len(payload) - macSize
+	if n%blockSize != 0 || n < explicitIVLen+blockSize {
+		return false, 0, alertBadRecordMAC
+	}
+
+	b.data[recordHeaderLen-2] = byte(n >> 8)
+	b.data[recordHeaderLen-1] = byte(n)
+	remoteMAC := payload[n:]
+	localMAC := hc.mac.MAC(hc.inDigestBuf, hc.seq[0:], b.data[:3], b.data[recordHeaderLen-2:recordHeaderLen], payload[:n])
+	if subtle.ConstantTimeCompare(localMAC, remoteMAC) != 1 {
+		return false, 0, alertBadRecordMAC
+	}
+	hc.inDigestBuf = localMAC
+
+	payload = payload[:n]
+	if explicitIVLen > 0 {
+		c.SetIV(payload[:explicitIVLen])
+		payload = payload[explicitIVLen:]
+	}
+	c.CryptBlocks(payload, payload)
+	payload, paddingGood := removePadding(payload)
+	if paddingGood != 255 {
+		return false, 0, alertBadRecordMAC
+	}
+
+	b.resize(recordHeaderLen + explicitIVLen + len(payload))
+	b.data[recordHeaderLen-2] = byte(len(payload) >> 8)
+	b.data[recordHeaderLen-1] = byte(len(payload))
+	hc.incSeq(false)
+
+	return true, recordHeaderLen + explicitIVLen, 0
+}
+
+// acceptEncryptThenMAC returns true if the server should answer the client's
+// encrypt_then_mac extension, which only applies to CBC cipher suites.
+func (hs *serverHandshakeState) acceptEncryptThenMAC() bool {
+	c := hs.c
+	return hs.clientHello.encryptThenMAC && c.config.EncryptThenMAC && c.vers >= VersionTLS10 && hs.suite.isCBC()
+}
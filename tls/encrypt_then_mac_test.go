@@ -0,0 +1,129 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// encryptThenMACPair returns an outgoing and an incoming halfConn that use
+// encrypt-then-MAC with AES-128-CBC and HMAC-SHA1.
+func encryptThenMACPair(version uint16) (out, in *halfConn) {
+	key, iv, macKey := make([]byte, 16), make([]byte, 16), make([]byte, 20)
+	out, in = new(halfConn), new(halfConn)
+	out.prepareCipherSpec(version, cipherAES(key, iv, false), macSHA1(version, macKey))
+	in.prepareCipherSpec(version, cipherAES(key, iv, true), macSHA1(version, macKey))
+	out.prepareEncryptThenMAC(true)
+	in.prepareEncryptThenMAC(true)
+	out.changeCipherSpec()
+	in.changeCipherSpec()
+	return
+}
+
+// sealRecord encrypts data as an application data record, as writeRecord
+// does.
+func sealRecord(hc *halfConn, data []byte) []byte {
+	explicitIVLen := 0
+	if hc.version >= VersionTLS11 {
+		explicitIVLen = 16
+	}
+	b := hc.newBlock()
+	b.resize(tlsRecordHeaderLen + explicitIVLen + len(data))
+	b.data[0] = byte(recordTypeApplicationData)
+	b.data[1], b.data[2] = byte(hc.version>>8), byte(hc.version)
+	n := explicitIVLen + len(data)
+	b.data[3], b.data[4] = byte(n>>8), byte(n)
+	copy(b.data[tlsRecordHeaderLen+explicitIVLen:], data)
+	hc.encrypt(b, explicitIVLen)
+	return b.data
+}
+
+func TestEncryptThenMACRecords(t *testing.T) {
+	for _, version := range []uint16{VersionTLS10, VersionTLS12} {
+		out, in := encryptThenMACPair(version)
+		for _, data := range [][]byte{{}, []byte("hello"), bytes.Repeat([]byte{1}, 1000)} {
+			record := sealRecord(out, data)
+			// The MAC follows the ciphertext, so the record is not a
+			// multiple of the block size.
+			if (len(record)-tlsRecordHeaderLen)%16 == 0 {
+				t.Errorf("%x: record of %d bytes has no trailing MAC", version, len(record))
+			}
+			b := &block{data: record}
+			ok, off, _ := in.decrypt(b)
+			if !ok {
+				t.Fatalf("%x: record with %d bytes of data was rejected", version, len(data))
+			}
+			if !bytes.Equal(b.data[off:], data) {
+				t.Errorf("%x: got %x, want %x", version, b.data[off:], data)
+			}
+		}
+
+		out.fault = RecordFaultInvalidMAC
+		b := &block{data: sealRecord(out, []byte("hello"))}
+		if ok, _, alertValue := in.decrypt(b); ok || alertValue != alertBadRecordMAC {
+			t.Errorf("%x: record with an invalid MAC got %v, %v", version, ok, alertValue)
+		}
+	}
+}
+
+func TestEncryptThenMACConnection(t *testing.T) {
+	tests := []struct {
+		suite  uint16
+		server bool
+		want   bool
+	}{
+		{TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, true, true},
+		{TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, false, false},
+		{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, true, false},
+	}
+	for _, test := range tests {
+		serverConfig := testConfig.Clone()
+		serverConfig.EncryptThenMAC = test.server
+		clientConfig := testConfig.Clone()
+		clientConfig.EncryptThenMAC = true
+		clientConfig.CipherSuites = []uint16{test.suite}
+
+		conn, err := echoDialer(serverConfig)()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := Client(conn, clientConfig)
+		message := []byte("encrypt then MAC")
+		if _, err := client.Write(message); err != nil {
+			t.Fatal(err)
+		}
+		echo := make([]byte, len(message))
+		if _, err := io.ReadFull(client, echo); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if !bytes.Equal(echo, message) {
+			t.Errorf("got echo %q", echo)
+		}
+
+		log := client.GetHandshakeLog()
+		if !log.ClientHello.EncryptThenMAC {
+			t.Errorf("%s: client did not offer encrypt_then_mac", CipherSuite(test.suite))
+		}
+		if log.ServerHello.EncryptThenMAC != test.want {
+			t.Errorf("%s: server accepted encrypt_then_mac: %v, want %v", CipherSuite(test.suite), log.ServerHello.EncryptThenMAC, test.want)
+		}
+		if client.out.encryptThenMAC != test.want || client.in.encryptThenMAC != test.want {
+			t.Errorf("%s: record layer uses encrypt-then-MAC: %v and %v, want %v", CipherSuite(test.suite), client.out.encryptThenMAC, client.in.encryptThenMAC, test.want)
+		}
+	}
+}
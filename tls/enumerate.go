@@ -0,0 +1,426 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+// Enumerator determines the protocol versions, cipher suites, curves,
+// signature algorithms and compression methods supported by a server. Each
+// probe is a separate handshake, and its outcome is read from the handshake
+// log, so suites and curves this package does not implement are found as
+// long as the server answers with a ServerHello or ServerKeyExchange.
+type Enumerator struct {
+	// Dial returns a new connection to the server. It is called once for
+	// every probe.
+	Dial func() (net.Conn, error)
+
+	// Config, if not nil, is the base configuration for every probe, for
+	// example to set ServerName. The fields controlling the ClientHello
+	// are overridden.
+	Config *Config
+
+	// Timeout, if not zero, limits the duration of each probe.
+	Timeout time.Duration
+}
+
+// EnumeratedCipherSuites holds the cipher suites a server accepts for a
+// protocol version. If ServerPreference is true, CipherSuites is in the
+// server's order of preference. Otherwise it is in numerical order, and the
+// server picks the client's most preferred suite.
+type EnumeratedCipherSuites struct {
+	Version          TLSVersion    `json:"version"`
+	CipherSuites     []CipherSuite `json:"cipher_suites"`
+	ServerPreference bool          `json:"server_preference"`
+}
+
+// EnumerationReport is the result of Enumerator.Enumerate. Cipher suites are
+// not enumerated for TLS 1.3, which this package only detects. Curves are
+// tested with ECDHE suites at the highest version below TLS 1.3, and
+// signature algorithms in TLS 1.2 ServerKeyExchange messages.
+type EnumerationReport struct {
+	Versions           []TLSVersion             `json:"versions,omitempty"`
+	CipherSuites       []EnumeratedCipherSuites `json:"cipher_suites,omitempty"`
+	Curves             []CurveID                `json:"curves,omitempty"`
+	SignatureAndHashes []SignatureAndHash       `json:"signature_and_hashes,omitempty"`
+	CompressionMethods []CompressionMethod      `json:"compression_methods,omitempty"`
+}
+
+// enumerationVersions are the versions whose cipher suites are enumerated.
+var enumerationVersions = []uint16{VersionSSL30, VersionTLS10, VersionTLS11, VersionTLS12}
+
+// enumerationChunkSize is the most cipher suites offered in one ClientHello.
+// Some servers reject a hello listing every named suite.
+const enumerationChunkSize = 64
+
+// enumerationCipherSuites returns every named cipher suite, except for the
+// signaling values, in numerical order.
+func enumerationCipherSuites() []uint16 {
+	var ids []int
+	for id := range cipherSuiteNames {
+		if id > 0 && id <= 0xffff && id != TLS_RENEGO_PROTECTION_REQUEST && id != TLS_FALLBACK_SCSV {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	suites := make([]uint16, len(ids))
+	for i, id := range ids {
+		suites[i] = uint16(id)
+	}
+	return suites
+}
+
+// enumerationCurves returns every named elliptic curve in numerical order.
+func enumerationCurves() []CurveID {
+	var ids []int
+	for id := range curveNames {
+		if !isFFDHE(CurveID(id)) && id < 0xff00 {
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+	curves := make([]CurveID, len(ids))
+	for i, id := range ids {
+		curves[i] = CurveID(id)
+	}
+	return curves
+}
+
+// enumerationSignatureAndHashes returns every signature algorithm a client
+// can verify in a ServerKeyExchange.
+func enumerationSignatureAndHashes() []signatureAndHash {
+	return append(append([]signatureAndHash{}, supportedSKXSignatureAlgorithms...), rsaPSSSignatureAlgorithms...)
+}
+
+// Enumerate runs every probe and returns the report. It only returns an
+// error if a connection cannot be made. Handshake failures are expected,
+// and just mean that the server does not support what was offered.
+func (e *Enumerator) Enumerate() (*EnumerationReport, error) {
+	report := new(EnumerationReport)
+	var maxVersion uint16
+	var maxSuites []uint16
+	var tls12Suites []uint16
+	for _, version := range enumerationVersions {
+		suites, serverPreference, err := e.enumerateCipherSuites(version)
+		if err != nil {
+			return nil, err
+		}
+		if len(suites) == 0 {
+			continue
+		}
+		maxVersion, maxSuites = version, suites
+		if version == VersionTLS12 {
+			tls12Suites = suites
+		}
+		report.Versions = append(report.Versions, TLSVersion(version))
+		enumerated := EnumeratedCipherSuites{
+			Version:          TLSVersion(version),
+			CipherSuites:     make([]CipherSuite, len(suites)),
+			ServerPreference: serverPreference,
+		}
+		for i, suite := range suites {
+			enumerated.CipherSuites[i] = CipherSuite(suite)
+		}
+		report.CipherSuites = append(report.CipherSuites, enumerated)
+	}
+	tls13, err := e.supportsTLS13()
+	if err != nil {
+		return nil, err
+	}
+	if tls13 {
+		report.Versions = append(report.Versions, VersionTLS13)
+	}
+	if maxVersion == 0 {
+		return report, nil
+	}
+
+	var ecdheSuites []uint16
+	for _, id := range maxSuites {
+		if suite := mutualCipherSuite([]uint16{id}, id); suite != nil && suite.flags&suiteECDHE != 0 {
+			ecdheSuites = append(ecdheSuites, id)
+		}
+	}
+	if len(ecdheSuites) > 0 {
+		if report.Curves, err = e.enumerateCurves(maxVersion, ecdheSuites); err != nil {
+			return nil, err
+		}
+	}
+
+	var signedSuites []uint16
+	for _, id := range tls12Suites {
+		if suite := mutualCipherSuite([]uint16{id}, id); suite != nil && (suite.flags&suiteECDHE != 0 || isDHECipherSuite(id)) {
+			signedSuites = append(signedSuites, id)
+		}
+	}
+	if len(signedSuites) > 0 {
+		if report.SignatureAndHashes, err = e.enumerateSignatureAndHashes(signedSuites); err != nil {
+			return nil, err
+		}
+	}
+
+	report.CompressionMethods = []CompressionMethod{CompressionMethod(compressionNone)}
+	deflate, err := e.supportsDeflate(maxVersion, maxSuites)
+	if err != nil {
+		return nil, err
+	}
+	if deflate {
+		report.CompressionMethods = append(report.CompressionMethods, CompressionMethod(compressionDeflate))
+	}
+	return report, nil
+}
+
+// baseConfig returns the configuration probes start from. Session resumption
+// is disabled, so that every probe is a full handshake.
+func (e *Enumerator) baseConfig() *Config {
+	config := new(Config)
+	if e.Config != nil {
+		config = e.Config.Clone()
+	}
+	config.InsecureSkipVerify = true
+	config.ForceSuites = true
+	config.SessionTicketsDisabled = true
+	config.ClientSessionCache = nil
+	config.ClientFingerprintConfiguration = nil
+	config.ExternalClientHello = nil
+	return config
+}
+
+// probe makes a handshake with config and returns its log, which is never
+// nil. The handshake itself is expected to fail for many probes.
+func (e *Enumerator) probe(config *Config) (*ServerHandshake, error) {
+	conn, err := e.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if e.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(e.Timeout))
+	}
+	c := Client(conn, config)
+	c.Handshake()
+	if log := c.GetHandshakeLog(); log != nil {
+		return log, nil
+	}
+	return new(ServerHandshake), nil
+}
+
+// selectCipherSuite offers suites at version, and returns the suite the
+// server selects. ok is false if the server does not select one of suites.
+func (e *Enumerator) selectCipherSuite(version uint16, suites []uint16) (suite uint16, ok bool, err error) {
+	config := e.baseConfig()
+	config.MinVersion = version
+	config.MaxVersion = version
+	config.CipherSuites = suites
+	log, err := e.probe(config)
+	if err != nil {
+		return 0, false, err
+	}
+	hello := log.ServerHello
+	if hello == nil || uint16(hello.Version) != version {
+		return 0, false, nil
+	}
+	for _, id := range suites {
+		if id == uint16(hello.CipherSuite) {
+			return id, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// enumerateCipherSuites finds the suites accepted at version. The named
+// suites are offered in chunks of enumerationChunkSize, and the accepted
+// suites of every chunk are then offered together, which puts them in the
+// order the server selects them. Offering the accepted suites in reverse
+// then shows whose preference the server follows.
+func (e *Enumerator) enumerateCipherSuites(version uint16) ([]uint16, bool, error) {
+	var found []uint16
+	all := enumerationCipherSuites()
+	for start := 0; start < len(all); start += enumerationChunkSize {
+		end := start + enumerationChunkSize
+		if end > len(all) {
+			end = len(all)
+		}
+		accepted, err := e.acceptedCipherSuites(version, all[start:end])
+		if err != nil {
+			return nil, false, err
+		}
+		found = append(found, accepted...)
+	}
+	if len(found) < 2 {
+		return found, false, nil
+	}
+	accepted, err := e.acceptedCipherSuites(version, found)
+	if err != nil {
+		return nil, false, err
+	}
+	// Keep any suite the server accepted in its chunk but not alongside the
+	// others.
+	for _, id := range found {
+		if !containsUint16(accepted, id) {
+			accepted = append(accepted, id)
+		}
+	}
+	reversed := make([]uint16, len(accepted))
+	for i, id := range accepted {
+		reversed[len(accepted)-1-i] = id
+	}
+	suite, ok, err := e.selectCipherSuite(version, reversed)
+	if err != nil {
+		return nil, false, err
+	}
+	return accepted, ok && suite == accepted[0], nil
+}
+
+// acceptedCipherSuites offers suites at version, then removes the selected
+// one until the server declines the rest. The accepted suites are returned in
+// the order they were selected.
+func (e *Enumerator) acceptedCipherSuites(version uint16, suites []uint16) ([]uint16, error) {
+	var accepted []uint16
+	offered := append([]uint16{}, suites...)
+	for len(offered) > 0 {
+		suite, ok, err := e.selectCipherSuite(version, offered)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		accepted = append(accepted, suite)
+		remaining := offered[:0]
+		for _, id := range offered {
+			if id != suite {
+				remaining = append(remaining, id)
+			}
+		}
+		offered = remaining
+	}
+	return accepted, nil
+}
+
+func containsUint16(list []uint16, v uint16) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// enumerateCurves offers each curve alone with ecdheSuites, and returns the
+// curves the server uses in its ServerKeyExchange.
+func (e *Enumerator) enumerateCurves(version uint16, ecdheSuites []uint16) ([]CurveID, error) {
+	var curves []CurveID
+	for _, curve := range enumerationCurves() {
+		config := e.baseConfig()
+		config.MinVersion = version
+		config.MaxVersion = version
+		config.CipherSuites = ecdheSuites
+		config.CurvePreferences = []CurveID{curve}
+		config.ExplicitCurvePreferences = true
+		log, err := e.probe(config)
+		if err != nil {
+			return nil, err
+		}
+		if skx := log.ServerKeyExchange; skx != nil && skx.ECDHParams != nil && CurveID(skx.ECDHParams.TLSCurveID) == curve {
+			curves = append(curves, curve)
+		}
+	}
+	return curves, nil
+}
+
+// enumerateSignatureAndHashes offers each signature algorithm alone in a
+// TLS 1.2 handshake with signedSuites, and returns the algorithms the server
+// signs its ServerKeyExchange with.
+func (e *Enumerator) enumerateSignatureAndHashes(signedSuites []uint16) ([]SignatureAndHash, error) {
+	var algorithms []SignatureAndHash
+	for _, sh := range enumerationSignatureAndHashes() {
+		config := e.baseConfig()
+		config.MinVersion = VersionTLS12
+		config.MaxVersion = VersionTLS12
+		config.CipherSuites = signedSuites
+		config.SignatureAndHashes = []signatureAndHash{sh}
+		log, err := e.probe(config)
+		if err != nil {
+			return nil, err
+		}
+		skx := log.ServerKeyExchange
+		if skx == nil || skx.Signature == nil || skx.Signature.SigHashExtension == nil {
+			continue
+		}
+		if signatureAndHash(*skx.Signature.SigHashExtension) == sh {
+			algorithms = append(algorithms, SignatureAndHash(sh))
+		}
+	}
+	return algorithms, nil
+}
+
+// supportsDeflate offers DEFLATE ahead of the null compression method.
+func (e *Enumerator) supportsDeflate(version uint16, suites []uint16) (bool, error) {
+	config := e.baseConfig()
+	hello := &clientHelloMsg{
+		vers:                version,
+		random:              make([]byte, 32),
+		cipherSuites:        suites,
+		compressionMethods:  []uint8{compressionDeflate, compressionNone},
+		serverName:          config.ServerName,
+		supportedCurves:     config.supportedGroups(suites),
+		supportedPoints:     []uint8{pointFormatUncompressed},
+		secureRenegotiation: true,
+	}
+	if version >= VersionTLS12 {
+		hello.signatureAndHashes = config.signatureAndHashesForClient()
+	}
+	if _, err := io.ReadFull(config.rand(), hello.random); err != nil {
+		return false, err
+	}
+	config.MinVersion = version
+	config.ExternalClientHello = hello.marshal()
+	log, err := e.probe(config)
+	if err != nil {
+		return false, err
+	}
+	return log.ServerHello != nil && log.ServerHello.CompressionMethod == compressionDeflate, nil
+}
+
+// supportsTLS13 sends a TLS 1.3 ClientHello. The handshake is aborted once
+// the ServerHello shows whether the server selected TLS 1.3.
+func (e *Enumerator) supportsTLS13() (bool, error) {
+	config := e.baseConfig()
+	config.ClientFingerprintConfiguration = &ClientFingerprintConfiguration{
+		HandshakeVersion:   VersionTLS12,
+		CipherSuites:       []uint16{0x1301, 0x1302, 0x1303},
+		CompressionMethods: []uint8{compressionNone},
+		Extensions: []ClientExtension{
+			&SNIExtension{Autopopulate: true},
+			&SupportedCurvesExtension{Curves: []CurveID{Curve25519, CurveP256r1, CurveP384r1}},
+			&PointFormatExtension{Formats: []uint8{pointFormatUncompressed}},
+			&SignatureAlgorithmExtension{SignatureAndHashes: []uint16{
+				0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601,
+			}},
+			&KeyShareExtension{Shares: []KeyShare{{Group: Curve25519}}},
+			&PSKKeyExchangeModesExtension{Modes: []uint8{1}},
+			&SupportedVersionsExtension{Versions: []uint16{VersionTLS13}},
+		},
+	}
+	log, err := e.probe(config)
+	if err != nil {
+		return false, err
+	}
+	return log.ServerHello != nil && uint16(log.ServerHello.SupportedVersion) == VersionTLS13, nil
+}
@@ -0,0 +1,157 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// enumerationDialer returns a Dial function that runs a Server with config on
+// the other end of each connection.
+func enumerationDialer(config *Config) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		c, s := net.Pipe()
+		go func() {
+			Server(s, config).Handshake()
+			s.Close()
+		}()
+		return c, nil
+	}
+}
+
+func TestEnumerateServerPreference(t *testing.T) {
+	config := testConfig.Clone()
+	config.MinVersion = VersionTLS10
+	config.CipherSuites = []uint16{
+		TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		TLS_RSA_WITH_AES_128_CBC_SHA,
+		TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}
+	config.PreferServerCipherSuites = true
+	config.CurvePreferences = []CurveID{CurveP384r1, Curve25519}
+
+	report, err := (&Enumerator{Dial: enumerationDialer(config)}).Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &EnumerationReport{
+		Versions: []TLSVersion{VersionTLS10, VersionTLS11, VersionTLS12},
+		CipherSuites: []EnumeratedCipherSuites{
+			{VersionTLS10, []CipherSuite{TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA, TLS_RSA_WITH_AES_128_CBC_SHA}, true},
+			{VersionTLS11, []CipherSuite{TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA, TLS_RSA_WITH_AES_128_CBC_SHA}, true},
+			{VersionTLS12, []CipherSuite{TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA, TLS_RSA_WITH_AES_128_CBC_SHA, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, true},
+		},
+		Curves:             []CurveID{CurveP384r1, Curve25519},
+		SignatureAndHashes: []SignatureAndHash{{signatureRSA, hashSHA256}},
+		CompressionMethods: []CompressionMethod{CompressionMethod(compressionNone)},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("got report\n%+v\nexpected\n%+v", report, expected)
+	}
+}
+
+func TestEnumerateClientPreference(t *testing.T) {
+	config := testConfig.Clone()
+	config.MinVersion = VersionTLS10
+	config.MaxVersion = VersionTLS11
+	config.CipherSuites = []uint16{
+		TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		TLS_RSA_WITH_AES_256_CBC_SHA,
+		TLS_RSA_WITH_AES_128_CBC_SHA,
+	}
+
+	report, err := (&Enumerator{Dial: enumerationDialer(config)}).Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	suites := []CipherSuite{TLS_RSA_WITH_AES_128_CBC_SHA, TLS_RSA_WITH_AES_256_CBC_SHA, TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}
+	expected := &EnumerationReport{
+		Versions: []TLSVersion{VersionTLS10, VersionTLS11},
+		CipherSuites: []EnumeratedCipherSuites{
+			{VersionTLS10, suites, false},
+			{VersionTLS11, suites, false},
+		},
+		Curves:             []CurveID{CurveP256r1, CurveP384r1, CurveP521r1},
+		CompressionMethods: []CompressionMethod{CompressionMethod(compressionNone)},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("got report\n%+v\nexpected\n%+v", report, expected)
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"TLSv1.1"`, `"TLS_RSA_WITH_AES_256_CBC_SHA"`, `"secp384r1"`, `"NULL"`} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("JSON report %s does not contain %s", b, s)
+		}
+	}
+}
+
+func TestEnumerateCipherSuiteChunks(t *testing.T) {
+	config := testConfig.Clone()
+	config.MinVersion = VersionTLS12
+	// One suite from each end of the list, so that they are found in
+	// different chunks.
+	config.CipherSuites = []uint16{
+		TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		TLS_RSA_WITH_AES_128_CBC_SHA,
+	}
+	config.PreferServerCipherSuites = true
+	var mu sync.Mutex
+	maxOffered := 0
+	config.GetConfigForClient = func(hello *ClientHelloInfo) (*Config, error) {
+		mu.Lock()
+		if len(hello.CipherSuites) > maxOffered {
+			maxOffered = len(hello.CipherSuites)
+		}
+		mu.Unlock()
+		return nil, nil
+	}
+
+	suites, serverPreference, err := (&Enumerator{Dial: enumerationDialer(config)}).enumerateCipherSuites(VersionTLS12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(suites, config.CipherSuites) || !serverPreference {
+		t.Errorf("got suites %04x, server preference %t", suites, serverPreference)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxOffered == 0 || maxOffered > enumerationChunkSize {
+		t.Errorf("a ClientHello offered %d cipher suites", maxOffered)
+	}
+}
+
+func TestEnumerateTLS13(t *testing.T) {
+	e := &Enumerator{Dial: func() (net.Conn, error) {
+		c, s := net.Pipe()
+		go serveTLS13ServerHello(s)
+		return c, nil
+	}}
+	report, err := e.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Versions, []TLSVersion{VersionTLS13}) || len(report.CipherSuites) != 0 {
+		t.Errorf("got report %+v", report)
+	}
+}
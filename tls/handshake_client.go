@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"crypto/dsa"
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/subtle"
 	"encoding/asn1"
@@ -21,6 +22,7 @@ import (
 	"time"
 
 	"github.com/zmap/zcrypto/x509"
+	"github.com/zmap/zcrypto/x509/pkix"
 )
 
 type clientHandshakeState struct {
@@ -95,6 +97,7 @@ func (c *clientHelloMsg) WriteToConfig(config *Config) error {
 	config.ForceSessionTicketExt = c.ticketSupported
 	config.ExtendedMasterSecret = c.extendedMasterSecret
 	config.SignedCertificateTimestampExt = c.sctEnabled
+	config.EncryptThenMAC = c.encryptThenMAC
 	return nil
 }
 
@@ -109,6 +112,7 @@ func (c *ClientFingerprintConfiguration) WriteToConfig(config *Config) error {
 	config.ForceSessionTicketExt = false
 	config.ExtendedMasterSecret = false
 	config.SignedCertificateTimestampExt = false
+	config.EncryptThenMAC = false
 	for _, ext := range c.Extensions {
 		if err := ext.WriteToConfig(config); err != nil {
 			return err
@@ -117,6 +121,45 @@ func (c *ClientFingerprintConfiguration) WriteToConfig(config *Config) error {
 	return nil
 }
 
+// withRenegotiationInfo returns a copy of c for a renegotiation, whose hello
+// carries info in a renegotiation_info extension instead of the signaling
+// cipher suite (RFC 5746, section 3.5). The extension replaces any
+// SecureRenegotiationExtension, or else goes before an autopopulated padding
+// extension or at the end.
+func (c *ClientFingerprintConfiguration) withRenegotiationInfo(info []byte) *ClientFingerprintConfiguration {
+	renegotiated := *c
+	renegotiated.CipherSuites = nil
+	for _, suite := range c.CipherSuites {
+		if suite != scsvRenegotiation {
+			renegotiated.CipherSuites = append(renegotiated.CipherSuites, suite)
+		}
+	}
+	ext := &SecureRenegotiationExtension{RenegotiatedConnection: info}
+	added := false
+	for _, e := range c.Extensions {
+		if _, ok := e.(*SecureRenegotiationExtension); ok {
+			added = true
+		}
+	}
+	renegotiated.Extensions = make([]ClientExtension, 0, len(c.Extensions)+1)
+	for _, e := range c.Extensions {
+		switch casted := e.(type) {
+		case *SecureRenegotiationExtension:
+			e = ext
+		case *PaddingExtension:
+			if casted.Autopopulate && !added {
+				renegotiated.Extensions = append(renegotiated.Extensions, ext)
+				added = true
+			}
+		}
+		renegotiated.Extensions = append(renegotiated.Extensions, e)
+	}
+	if !added {
+		renegotiated.Extensions = append(renegotiated.Extensions, ext)
+	}
+	return &renegotiated
+}
+
 func currentTimestamp() ([]byte, error) {
 	t := time.Now().Unix()
 	buf := new(bytes.Buffer)
@@ -163,7 +206,7 @@ func (c *ClientFingerprintConfiguration) marshal(config *Config) ([]byte, error)
 	ciphers[0] = uint8(len(c.CipherSuites) >> 7)
 	ciphers[1] = uint8(len(c.CipherSuites) << 1)
 	for i, suite := range c.CipherSuites {
-		if !config.ForceSuites {
+		if !config.ForceSuites && !isGREASE(suite) && !isOfferOnlySuite(suite) {
 			found := false
 			for _, impl := range implementedCipherSuites {
 				if impl.id == suite {
@@ -186,20 +229,30 @@ func (c *ClientFingerprintConfiguration) marshal(config *Config) ([]byte, error)
 	compressions[0] = uint8(len(c.CompressionMethods))
 	if len(c.CompressionMethods) > 0 {
 		copy(compressions[1:], c.CompressionMethods)
-		if c.CompressionMethods[0] != 0 {
-			return nil, errors.New(fmt.Sprintf("tls: unimplemented compression method %d", c.CompressionMethods[0]))
-		}
-		if len(c.CompressionMethods) > 1 {
-			return nil, errors.New(fmt.Sprintf("tls: unimplemented compression method %d", c.CompressionMethods[1]))
+		for _, method := range c.CompressionMethods {
+			if method != compressionNone && method != compressionDeflate {
+				return nil, errors.New(fmt.Sprintf("tls: unimplemented compression method %d", method))
+			}
 		}
 	} else {
 		return nil, errors.New("tls: no compression method")
 	}
 
 	var extensions []byte
+	padIndex := -1
+	var padding *PaddingExtension
 	for _, ext := range c.Extensions {
+		if p, ok := ext.(*PaddingExtension); ok && p.Autopopulate {
+			padIndex, padding = len(extensions), p
+			continue
+		}
 		extensions = append(extensions, ext.Marshal()...)
 	}
+	if padding != nil {
+		unpaddedLen := len(head) + len(sessionID) + len(ciphers) + len(compressions) + 2 + len(extensions)
+		pad := padding.marshalForLength(unpaddedLen)
+		extensions = append(extensions[:padIndex], append(pad, extensions[padIndex:]...)...)
+	}
 	if len(extensions) > 0 {
 		length := make([]byte, 2)
 		length[0] = uint8(len(extensions) >> 8)
@@ -227,11 +280,19 @@ func (c *Conn) clientHandshake() error {
 		c.config = defaultConfig()
 	}
 	var hello *clientHelloMsg
-	var helloBytes []byte
 	var session *ClientSessionState
 	var sessionCache ClientSessionCache
 	var cacheKey string
 
+	if c.isDTLS {
+		if c.config.ExternalClientHello != nil {
+			return errors.New("tls: ExternalClientHello is not supported over DTLS")
+		}
+		if c.config.maxVersion() < VersionTLS11 {
+			return errors.New("tls: DTLS requires a MaxVersion of at least TLS 1.1")
+		}
+	}
+
 	// first, let's check if a ClientFingerprintConfiguration template was provided by the config
 	if c.config.ClientFingerprintConfiguration != nil {
 		if err := c.config.ClientFingerprintConfiguration.WriteToConfig(c.config); err != nil {
@@ -282,13 +343,19 @@ func (c *Conn) clientHandshake() error {
 				}
 			}
 		}
-		var err error
-		helloBytes, err = c.config.ClientFingerprintConfiguration.marshal(c.config)
+		fingerprint := c.config.ClientFingerprintConfiguration
+		if c.handshakes > 0 {
+			fingerprint = fingerprint.withRenegotiationInfo(c.clientFinished)
+		}
+		raw, err := fingerprint.marshal(c.config)
 		if err != nil {
 			return err
 		}
+		if c.isDTLS {
+			raw = dtlsHelloFromTLS(raw, c.toWireVersion(fingerprint.HandshakeVersion))
+		}
 		hello = &clientHelloMsg{}
-		if ok := hello.unmarshal(helloBytes); !ok {
+		if ok := hello.unmarshal(raw); !ok {
 			return errors.New("tls: incompatible ClientFingerprintConfiguration")
 		}
 
@@ -307,9 +374,8 @@ func (c *Conn) clientHandshake() error {
 		// update the SNI with one name, whether or not the extension was already there
 		hello.serverName = c.config.ServerName
 
-		// then we update the 'raw' value of the message
+		// then clear the 'raw' value, so that the message is marshaled again
 		hello.raw = nil
-		helloBytes = hello.marshal()
 
 		session = nil
 		sessionCache = nil
@@ -324,7 +390,6 @@ func (c *Conn) clientHandshake() error {
 			random:               make([]byte, 32),
 			ocspStapling:         true,
 			serverName:           c.config.ServerName,
-			supportedCurves:      c.config.curvePreferences(),
 			supportedPoints:      []uint8{pointFormatUncompressed},
 			nextProtoNeg:         len(c.config.NextProtos) > 0,
 			secureRenegotiation:  true,
@@ -332,6 +397,13 @@ func (c *Conn) clientHandshake() error {
 			extendedMasterSecret: c.config.maxVersion() >= VersionTLS10 && c.config.ExtendedMasterSecret,
 		}
 
+		hello.encryptThenMAC = c.config.maxVersion() >= VersionTLS10 && c.config.EncryptThenMAC
+		if c.handshakes > 0 {
+			hello.renegotiationInfo = c.clientFinished
+		}
+		if c.config.DeflateCompression && !c.isDTLS {
+			hello.compressionMethods = []uint8{compressionDeflate, compressionNone}
+		}
 		if c.config.ForceSessionTicketExt {
 			hello.ticketSupported = true
 		}
@@ -362,11 +434,15 @@ func (c *Conn) clientHandshake() error {
 					if hello.vers < VersionTLS12 && suite.flags&suiteTLS12 != 0 {
 						continue
 					}
+					if c.isDTLS && suite.flags&suiteNoDTLS != 0 {
+						continue
+					}
 					hello.cipherSuites = append(hello.cipherSuites, suiteId)
 					continue NextCipherSuite
 				}
 			}
 		}
+		hello.supportedCurves = c.config.supportedGroups(hello.cipherSuites)
 
 		if len(c.config.ClientRandom) == 32 {
 			copy(hello.random, c.config.ClientRandom)
@@ -433,11 +509,15 @@ func (c *Conn) clientHandshake() error {
 
 		}
 
-		helloBytes = hello.marshal()
+		hello.vers = c.toWireVersion(hello.vers)
 	}
 
 	c.handshakeLog = new(ServerHandshake)
 	c.heartbleedLog = new(Heartbleed)
+	helloBytes, err := c.marshalHandshake(hello)
+	if err != nil {
+		return err
+	}
 	c.writeRecord(recordTypeHandshake, helloBytes)
 	c.handshakeLog.ClientHello = hello.MakeLog()
 
@@ -445,6 +525,11 @@ func (c *Conn) clientHandshake() error {
 	if err != nil {
 		return err
 	}
+	if hvr, ok := msg.(*helloVerifyRequestMsg); ok && c.isDTLS {
+		if helloBytes, msg, err = c.dtlsResendHello(hello, hvr); err != nil {
+			return err
+		}
+	}
 	serverHello, ok := msg.(*serverHelloMsg)
 	if !ok {
 		c.sendAlert(alertUnexpectedMessage)
@@ -457,7 +542,12 @@ func (c *Conn) clientHandshake() error {
 		c.heartbleedLog.HeartbeatEnabled = true
 	}
 
-	vers, ok := c.config.mutualVersion(serverHello.vers)
+	if serverHello.supportedVersion > VersionTLS12 {
+		c.sendAlert(alertProtocolVersion)
+		return fmt.Errorf("tls: server selected unsupported protocol version %x", serverHello.supportedVersion)
+	}
+
+	vers, ok := c.mutualVersion(serverHello.vers)
 	if !ok {
 		c.sendAlert(alertProtocolVersion)
 		return fmt.Errorf("tls: server selected unsupported protocol version %x", serverHello.vers)
@@ -485,6 +575,9 @@ func (c *Conn) clientHandshake() error {
 		finishedHash: newFinishedHash(c.vers, suite),
 		session:      session,
 	}
+	if c.isDTLS {
+		hs.finishedHash.dtls = c.dtls
+	}
 
 	hs.finishedHash.Write(helloBytes)
 	hs.finishedHash.Write(hs.serverHello.marshal())
@@ -524,6 +617,9 @@ func (c *Conn) clientHandshake() error {
 			}
 			return err
 		}
+		if c.config.ROBOTVariant != ROBOTDisabled {
+			return hs.finishROBOTProbe()
+		}
 		if err := hs.establishKeys(); err != nil {
 			return err
 		}
@@ -621,6 +717,7 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 			var validation *x509.Validation
 			c.verifiedChains, validation, err = certs[0].ValidateWithStupidDetail(opts)
 			c.handshakeLog.ServerCertificates.addParsed(certs, validation)
+			c.handshakeLog.ServerCertificates.verify(certs, c.config.Verifiers, c.config.ServerName, opts.CurrentTime)
 
 			// If actually verifying and invalid, reject
 			if !c.config.InsecureSkipVerify {
@@ -636,6 +733,11 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 			return errors.New("tls: failed to parse certificate from server: " + invalidCertErr.Error())
 		}
 
+		if c.handshakes > 0 && len(c.peerCertificates) > 0 && !bytes.Equal(c.peerCertificates[0].Raw, certs[0].Raw) {
+			c.sendAlert(alertBadCertificate)
+			return errors.New("tls: server's identity changed during renegotiation")
+		}
+
 		c.peerCertificates = certs
 
 		if hs.serverHello.ocspStapling {
@@ -725,6 +827,7 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 		// arrangement to the contrary.
 
 		hs.finishedHash.Write(certReq.marshal())
+		c.handshakeLog.CertificateRequest = certReq.MakeLog()
 
 		var rsaAvail, ecdsaAvail bool
 		for _, certType := range certReq.certificateTypes {
@@ -736,45 +839,59 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 			}
 		}
 
-		// We need to search our list of client certs for one
-		// where SignatureAlgorithm is RSA and the Issuer is in
-		// certReq.certificateAuthorities
-	findCert:
-		for i, chain := range c.config.Certificates {
-			if !rsaAvail && !ecdsaAvail {
-				continue
+		switch c.config.ClientCertificateMode {
+		case ClientCertificateConfigured:
+			if len(c.config.Certificates) > 0 {
+				chainToSend = &c.config.Certificates[0]
 			}
-
-			for j, cert := range chain.Certificate {
-				x509Cert := chain.Leaf
-				// parse the certificate if this isn't the leaf
-				// node, or if chain.Leaf was nil
-				if j != 0 || x509Cert == nil {
-					if x509Cert, err = x509.ParseCertificate(cert); err != nil {
-						c.sendAlert(alertInternalError)
-						return errors.New("tls: failed to parse client certificate #" + strconv.Itoa(i) + ": " + err.Error())
-					}
+		case ClientCertificateThrowaway:
+			if rsaAvail || ecdsaAvail {
+				if chainToSend, err = throwawayClientCertificate(c.config, ecdsaAvail); err != nil {
+					c.sendAlert(alertInternalError)
+					return err
 				}
-
-				switch {
-				case rsaAvail && x509Cert.PublicKeyAlgorithm == x509.RSA:
-				case ecdsaAvail && x509Cert.PublicKeyAlgorithm == x509.ECDSA:
-				default:
-					continue findCert
+			}
+		default:
+			// We need to search our list of client certs for one
+			// where SignatureAlgorithm is RSA and the Issuer is in
+			// certReq.certificateAuthorities
+		findCert:
+			for i, chain := range c.config.Certificates {
+				if !rsaAvail && !ecdsaAvail {
+					continue
 				}
 
-				if len(certReq.certificateAuthorities) == 0 {
-					// they gave us an empty list, so just take the
-					// first RSA cert from c.config.Certificates
-					chainToSend = &chain
-					break findCert
-				}
+				for j, cert := range chain.Certificate {
+					x509Cert := chain.Leaf
+					// parse the certificate if this isn't the leaf
+					// node, or if chain.Leaf was nil
+					if j != 0 || x509Cert == nil {
+						if x509Cert, err = x509.ParseCertificate(cert); err != nil {
+							c.sendAlert(alertInternalError)
+							return errors.New("tls: failed to parse client certificate #" + strconv.Itoa(i) + ": " + err.Error())
+						}
+					}
 
-				for _, ca := range certReq.certificateAuthorities {
-					if bytes.Equal(x509Cert.RawIssuer, ca) {
+					switch {
+					case rsaAvail && x509Cert.PublicKeyAlgorithm == x509.RSA:
+					case ecdsaAvail && x509Cert.PublicKeyAlgorithm == x509.ECDSA:
+					default:
+						continue findCert
+					}
+
+					if len(certReq.certificateAuthorities) == 0 {
+						// they gave us an empty list, so just take the
+						// first RSA cert from c.config.Certificates
 						chainToSend = &chain
 						break findCert
 					}
+
+					for _, ca := range certReq.certificateAuthorities {
+						if bytes.Equal(x509Cert.RawIssuer, ca) {
+							chainToSend = &chain
+							break findCert
+						}
+					}
 				}
 			}
 		}
@@ -792,6 +909,12 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 	}
 	hs.finishedHash.Write(shd.marshal())
 
+	if c.config.HeartbeatDuringHandshake != nil && c.heartbeat {
+		if _, err := c.writeHeartbeatRequest(c.config.HeartbeatDuringHandshake, true); err != nil {
+			return err
+		}
+	}
+
 	// If the server requested a certificate then we have to send a
 	// Certificate message, even if it's empty because we don't have a
 	// certificate to send.
@@ -800,8 +923,13 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 		if chainToSend != nil {
 			certMsg.certificates = chainToSend.Certificate
 		}
-		hs.finishedHash.Write(certMsg.marshal())
-		c.writeRecord(recordTypeHandshake, certMsg.marshal())
+		certBytes, err := c.marshalHandshake(certMsg)
+		if err != nil {
+			return err
+		}
+		hs.finishedHash.Write(certBytes)
+		c.writeRecord(recordTypeHandshake, certBytes)
+		c.handshakeLog.ClientCertificates = certMsg.MakeLog()
 	}
 
 	preMasterSecret, ckx, err := keyAgreement.generateClientKeyExchange(c.config, hs.hello, serverCert)
@@ -813,8 +941,12 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 	c.handshakeLog.ClientKeyExchange = ckx.MakeLog(keyAgreement)
 
 	if ckx != nil {
-		hs.finishedHash.Write(ckx.marshal())
-		c.writeRecord(recordTypeHandshake, ckx.marshal())
+		ckxBytes, err := c.marshalHandshake(ckx)
+		if err != nil {
+			return err
+		}
+		hs.finishedHash.Write(ckxBytes)
+		c.writeRecord(recordTypeHandshake, ckxBytes)
 	}
 
 	if chainToSend != nil {
@@ -825,7 +957,7 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 
 		// Determine the hash to sign.
 		var signatureType uint8
-		switch c.config.Certificates[0].PrivateKey.(type) {
+		switch chainToSend.PrivateKey.(type) {
 		case *ecdsa.PrivateKey:
 			signatureType = signatureECDSA
 		case *rsa.PrivateKey:
@@ -845,7 +977,7 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 			return err
 		}
 
-		switch key := c.config.Certificates[0].PrivateKey.(type) {
+		switch key := chainToSend.PrivateKey.(type) {
 		case *ecdsa.PrivateKey:
 			var r, s *big.Int
 			r, s, err = ecdsa.Sign(c.config.rand(), key, digest)
@@ -863,8 +995,12 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 		}
 		certVerify.signature = signed
 
-		hs.writeClientHash(certVerify.marshal())
-		c.writeRecord(recordTypeHandshake, certVerify.marshal())
+		certVerifyBytes, err := c.marshalHandshake(certVerify)
+		if err != nil {
+			return err
+		}
+		hs.writeClientHash(certVerifyBytes)
+		c.writeRecord(recordTypeHandshake, certVerifyBytes)
 	}
 
 	var cr, sr []byte
@@ -902,6 +1038,11 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 func (hs *clientHandshakeState) establishKeys() error {
 	c := hs.c
 
+	if err := c.config.writeKeyLog(hs.hello.random, hs.masterSecret); err != nil {
+		c.sendAlert(alertInternalError)
+		return errors.New("tls: failed to write to key log: " + err.Error())
+	}
+
 	clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV := keysFromMasterSecret(c.vers, hs.suite, hs.masterSecret, hs.hello.random, hs.serverHello.random, hs.suite.macLen, hs.suite.keyLen, hs.suite.ivLen)
 	var clientCipher, serverCipher interface{}
 	var clientHash, serverHash macFunction
@@ -917,6 +1058,10 @@ func (hs *clientHandshakeState) establishKeys() error {
 
 	c.in.prepareCipherSpec(c.vers, serverCipher, serverHash)
 	c.out.prepareCipherSpec(c.vers, clientCipher, clientHash)
+	c.in.prepareCompression(hs.serverHello.compressionMethod)
+	c.out.prepareCompression(hs.serverHello.compressionMethod)
+	c.in.prepareEncryptThenMAC(hs.serverHello.encryptThenMAC)
+	c.out.prepareEncryptThenMAC(hs.serverHello.encryptThenMAC)
 	return nil
 }
 
@@ -930,11 +1075,33 @@ func (hs *clientHandshakeState) serverResumedSession() bool {
 func (hs *clientHandshakeState) processServerHello() (bool, error) {
 	c := hs.c
 
-	if hs.serverHello.compressionMethod != compressionNone {
+	if !compressionOffered(hs.hello.compressionMethods, hs.serverHello.compressionMethod) {
 		c.sendAlert(alertUnexpectedMessage)
 		return false, errors.New("tls: server selected unsupported compression format")
 	}
 
+	if c.handshakes == 0 {
+		if len(hs.serverHello.renegotiationInfo) != 0 {
+			c.sendAlert(alertHandshakeFailure)
+			return false, errors.New("tls: initial handshake had non-empty renegotiation extension")
+		}
+		c.secureRenegotiation = hs.serverHello.secureRenegotiation
+	} else if c.secureRenegotiation && !bytes.Equal(hs.serverHello.renegotiationInfo, c.renegotiationInfo()) {
+		c.sendAlert(alertHandshakeFailure)
+		return false, errors.New("tls: incorrect renegotiation extension contents")
+	}
+
+	if hs.serverHello.encryptThenMAC {
+		if !hs.hello.encryptThenMAC {
+			c.sendAlert(alertUnsupportedExtension)
+			return false, errors.New("tls: server advertised unrequested encrypt_then_mac extension")
+		}
+		if hs.suite != nil && !hs.suite.isCBC() {
+			c.sendAlert(alertIllegalParameter)
+			return false, errors.New("tls: server negotiated encrypt_then_mac with a non-CBC cipher suite")
+		}
+	}
+
 	clientDidNPN := hs.hello.nextProtoNeg
 	clientDidALPN := len(hs.hello.alpnProtocols) > 0
 	serverHasNPN := hs.serverHello.nextProtoNeg
@@ -973,8 +1140,7 @@ func (hs *clientHandshakeState) processServerHello() (bool, error) {
 func (hs *clientHandshakeState) readFinished() error {
 	c := hs.c
 
-	c.readRecord(recordTypeChangeCipherSpec)
-	if err := c.in.error(); err != nil {
+	if err := c.readRecord(recordTypeChangeCipherSpec); err != nil {
 		return err
 	}
 
@@ -995,6 +1161,7 @@ func (hs *clientHandshakeState) readFinished() error {
 		c.sendAlert(alertHandshakeFailure)
 		return errors.New("tls: server's Finished message was incorrect")
 	}
+	c.serverFinished = serverFinished.verifyData
 	hs.finishedHash.Write(serverFinished.marshal())
 	return nil
 }
@@ -1039,17 +1206,26 @@ func (hs *clientHandshakeState) sendFinished() error {
 		c.clientProtocol = proto
 		c.clientProtocolFallback = fallback
 
-		hs.finishedHash.Write(nextProto.marshal())
-		c.writeRecord(recordTypeHandshake, nextProto.marshal())
+		nextProtoBytes, err := c.marshalHandshake(nextProto)
+		if err != nil {
+			return err
+		}
+		hs.finishedHash.Write(nextProtoBytes)
+		c.writeRecord(recordTypeHandshake, nextProtoBytes)
 	}
 
 	finished := new(finishedMsg)
 	finished.verifyData = hs.finishedHash.clientSum(hs.masterSecret)
-	hs.finishedHash.Write(finished.marshal())
+	finishedBytes, err := c.marshalHandshake(finished)
+	if err != nil {
+		return err
+	}
+	hs.finishedHash.Write(finishedBytes)
 
 	c.handshakeLog.ClientFinished = finished.MakeLog()
+	c.clientFinished = finished.verifyData
 
-	c.writeRecord(recordTypeHandshake, finished.marshal())
+	c.writeRecord(recordTypeHandshake, finishedBytes)
 	return nil
 }
 
@@ -1091,3 +1267,46 @@ func mutualProtocol(protos, preferenceProtos []string) (string, bool) {
 
 	return protos[0], true
 }
+
+// throwawayClientCertificate returns a self-signed client certificate with a
+// fresh key, for servers that request a certificate without needing to trust
+// it.
+func throwawayClientCertificate(config *Config, useECDSA bool) (*Certificate, error) {
+	var priv, pub interface{}
+	if useECDSA {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), config.rand())
+		if err != nil {
+			return nil, errors.New("tls: failed to generate throwaway client key: " + err.Error())
+		}
+		priv, pub = key, &key.PublicKey
+	} else {
+		key, err := rsa.GenerateKey(config.rand(), 2048)
+		if err != nil {
+			return nil, errors.New("tls: failed to generate throwaway client key: " + err.Error())
+		}
+		priv, pub = key, &key.PublicKey
+	}
+
+	serial := make([]byte, 8)
+	if _, err := io.ReadFull(config.rand(), serial); err != nil {
+		return nil, errors.New("tls: short read from Rand: " + err.Error())
+	}
+	now := config.time()
+	template := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(config.rand(), template, template, pub, priv)
+	if err != nil {
+		return nil, errors.New("tls: failed to create throwaway client certificate: " + err.Error())
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.New("tls: failed to parse throwaway client certificate: " + err.Error())
+	}
+	return &Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: leaf}, nil
+}
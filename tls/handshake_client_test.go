@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/rsa"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io"
@@ -19,6 +20,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/zmap/zcrypto/verifier"
 	"github.com/zmap/zcrypto/x509"
 )
 
@@ -464,7 +466,7 @@ func TestHandshakeClientCustomHello(t *testing.T) {
 	}
 	hello.CompressionMethods = []uint8{0}
 	sni := SNIExtension{[]string{}, true}
-	ec := SupportedCurvesExtension{[]CurveID{CurveP256, CurveP384, CurveP521}}
+	ec := SupportedCurvesExtension{[]CurveID{CurveP256r1, CurveP384r1, CurveP521r1}}
 	points := PointFormatExtension{[]uint8{0}}
 	st := SessionTicketExtension{[]byte{}, true}
 	alpn := ALPNExtension{[]string{"h2", "http/1.1"}}
@@ -575,3 +577,49 @@ func TestDontBuffer(t *testing.T) {
 		t.Errorf("expected server handshake to complete with only two writes, but saw %d", n)
 	}
 }
+
+func TestClientVerifiers(t *testing.T) {
+	cert, err := x509.ParseCertificate(testRSACertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusting := verifier.NewGraph()
+	trusting.AddRoot(cert)
+	clientConfig := testConfig.Clone()
+	clientConfig.Time = func() time.Time { return cert.NotBefore.Add(time.Hour) }
+	clientConfig.Verifiers = map[string]*verifier.Verifier{
+		"trusting": verifier.NewNSS(trusting),
+		"empty":    verifier.NewNSS(verifier.NewGraph()),
+	}
+
+	c, s := net.Pipe()
+	go func() {
+		Server(s, testConfig).Handshake()
+		s.Close()
+	}()
+	client := Client(c, clientConfig)
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	validations := client.GetHandshakeLog().ServerCertificates.Validations
+	if len(validations) != 2 {
+		t.Fatalf("got %d validations, want 2", len(validations))
+	}
+	if res := validations["trusting"]; !res.HasTrustedChain() {
+		t.Errorf("no trusted chain in the store holding the certificate: %+v", res)
+	} else if res.PresentedChain == nil || !res.PresentedChain.Valid {
+		t.Errorf("presented chain not valid: %+v", res.PresentedChain)
+	}
+	if res := validations["empty"]; res.HasTrustedChain() {
+		t.Errorf("trusted chain in an empty store: %+v", res)
+	}
+	b, err := json.Marshal(client.GetHandshakeLog().ServerCertificates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(`"validations":{`)) {
+		t.Errorf("validations missing from %s", b)
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+)
+
+// HandshakeErrorType classifies the cause of a failed handshake, so that the
+// outcomes of many handshakes can be aggregated without matching on error
+// strings.
+type HandshakeErrorType int
+
+const (
+	// HandshakeErrorUnknown is any failure not covered by another type.
+	HandshakeErrorUnknown HandshakeErrorType = iota
+
+	// HandshakeErrorEOFBeforeServerHello means the server closed the
+	// connection before sending a ServerHello.
+	HandshakeErrorEOFBeforeServerHello
+
+	// HandshakeErrorEOF means the peer closed the connection mid-handshake.
+	HandshakeErrorEOF
+
+	// HandshakeErrorTimeout means a read or write deadline expired.
+	HandshakeErrorTimeout
+
+	// HandshakeErrorConnection is any other error from the underlying
+	// connection, such as a reset.
+	HandshakeErrorConnection
+
+	// HandshakeErrorNotTLS means the peer's first record was not TLS.
+	HandshakeErrorNotTLS
+
+	// HandshakeErrorVersionMismatch means the peers had no version in
+	// common.
+	HandshakeErrorVersionMismatch
+
+	// HandshakeErrorNoSharedCipher means the server rejected the hello,
+	// usually because no cipher suite or curve was acceptable.
+	HandshakeErrorNoSharedCipher
+
+	// HandshakeErrorHandshakeFailure is a handshake_failure alert after the
+	// hellos were exchanged.
+	HandshakeErrorHandshakeFailure
+
+	// HandshakeErrorBadCertificate means a certificate was rejected, either
+	// by the verifier or by a certificate alert.
+	HandshakeErrorBadCertificate
+
+	// HandshakeErrorUnexpectedMessage means a message arrived out of order.
+	HandshakeErrorUnexpectedMessage
+
+	// HandshakeErrorDecodeError means a message could not be parsed or had
+	// an illegal parameter.
+	HandshakeErrorDecodeError
+
+	// HandshakeErrorDecryptError means a signature or Finished message did
+	// not verify.
+	HandshakeErrorDecryptError
+
+	// HandshakeErrorBadRecordMAC means a record failed to decrypt.
+	HandshakeErrorBadRecordMAC
+
+	// HandshakeErrorRemoteAlert is any other fatal alert from the peer.
+	HandshakeErrorRemoteAlert
+
+	// HandshakeErrorLocalAlert is any other fatal alert sent to the peer.
+	HandshakeErrorLocalAlert
+
+	// HandshakeErrorCertsOnly means the handshake was stopped after the
+	// server's certificates because Config.CertsOnly was set.
+	HandshakeErrorCertsOnly
+)
+
+func (t HandshakeErrorType) String() string {
+	if name, ok := handshakeErrorTypeNames[int(t)]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (t HandshakeErrorType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *HandshakeErrorType) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	for value, n := range handshakeErrorTypeNames {
+		if n == name {
+			*t = HandshakeErrorType(value)
+			return nil
+		}
+	}
+	return errors.New("tls: unknown handshake error type " + name)
+}
+
+// HandshakeError records why a handshake failed. Stage is the last handshake
+// message sent or received before the failure, and Alert is the first fatal
+// alert sent or received, if any.
+type HandshakeError struct {
+	Type    HandshakeErrorType `json:"type"`
+	Stage   string             `json:"stage,omitempty"`
+	Alert   *Alert             `json:"alert,omitempty"`
+	Message string             `json:"message"`
+}
+
+// Errors for records that show the peer is not speaking TLS at all.
+var (
+	errSSLv2Handshake = errors.New("tls: unsupported SSLv2 handshake received")
+	errNotTLSRecord   = errors.New("tls: first record does not look like a TLS handshake")
+)
+
+// setHandshakeStage records the last handshake message sent or received.
+func (c *Conn) setHandshakeStage(stage string) {
+	c.alertLogMutex.Lock()
+	c.handshakeStage = stage
+	c.alertLogMutex.Unlock()
+}
+
+// makeHandshakeError classifies err, the error returned by a failed
+// handshake, using the alerts that were logged along the way.
+func (c *Conn) makeHandshakeError(err error, alerts []Alert) *HandshakeError {
+	c.alertLogMutex.Lock()
+	stage := c.handshakeStage
+	c.alertLogMutex.Unlock()
+	sawServerHello := c.handshakeLog != nil && c.handshakeLog.ServerHello != nil
+	return newHandshakeError(err, stage, alerts, c.isClient, sawServerHello)
+}
+
+// newHandshakeError classifies err, the error that ended a handshake at
+// stage, using the alerts that were logged along the way.
+func newHandshakeError(err error, stage string, alerts []Alert, isClient, sawServerHello bool) *HandshakeError {
+	he := &HandshakeError{Stage: stage, Message: err.Error()}
+	for i := range alerts {
+		if alerts[i].Level == "fatal" {
+			a := alerts[i]
+			he.Alert = &a
+			break
+		}
+	}
+	he.Type = classifyHandshakeError(err, he.Alert, isClient, sawServerHello)
+	return he
+}
+
+func classifyHandshakeError(err error, a *Alert, isClient, sawServerHello bool) HandshakeErrorType {
+	switch err {
+	case ErrCertsOnly:
+		return HandshakeErrorCertsOnly
+	case errSSLv2Handshake, errNotTLSRecord:
+		return HandshakeErrorNotTLS
+	case io.EOF, io.ErrUnexpectedEOF:
+		if isClient && !sawServerHello {
+			return HandshakeErrorEOFBeforeServerHello
+		}
+		return HandshakeErrorEOF
+	}
+	if a != nil {
+		switch alert(a.Code) {
+		case alertProtocolVersion:
+			return HandshakeErrorVersionMismatch
+		case alertHandshakeFailure, alertInsufficientSecurity:
+			if !sawServerHello {
+				return HandshakeErrorNoSharedCipher
+			}
+			return HandshakeErrorHandshakeFailure
+		case alertBadCertificate, alertUnsupportedCertificate, alertCertificateRevoked,
+			alertCertificateExpired, alertCertificateUnknown, alertUnknownCA:
+			return HandshakeErrorBadCertificate
+		case alertUnexpectedMessage:
+			return HandshakeErrorUnexpectedMessage
+		case alertDecodeError, alertIllegalParameter:
+			return HandshakeErrorDecodeError
+		case alertDecryptError:
+			return HandshakeErrorDecryptError
+		case alertBadRecordMAC, alertDecryptionFailed:
+			return HandshakeErrorBadRecordMAC
+		}
+		if a.Sent {
+			return HandshakeErrorLocalAlert
+		}
+		return HandshakeErrorRemoteAlert
+	}
+	if netErr, ok := err.(net.Error); ok {
+		if netErr.Timeout() {
+			return HandshakeErrorTimeout
+		}
+		return HandshakeErrorConnection
+	}
+	return HandshakeErrorUnknown
+}
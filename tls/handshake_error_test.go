@@ -0,0 +1,139 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// clientHandshakeError runs a client handshake against serve and returns the
+// client's log.
+func clientHandshakeError(t *testing.T, config *Config, serve func(net.Conn)) *ServerHandshake {
+	c, s := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		serve(s)
+		s.Close()
+		close(done)
+	}()
+	client := Client(c, config)
+	if err := client.Handshake(); err == nil {
+		t.Fatal("handshake succeeded")
+	}
+	c.Close()
+	<-done
+	return client.GetHandshakeLog()
+}
+
+func serveConfig(config *Config) func(net.Conn) {
+	return func(s net.Conn) {
+		Server(s, config).Handshake()
+	}
+}
+
+func TestHandshakeErrorTypes(t *testing.T) {
+	tls12 := testConfig.Clone()
+	tls12.MinVersion = VersionTLS12
+
+	tests := []struct {
+		name   string
+		config *Config
+		serve  func(net.Conn)
+		typ    HandshakeErrorType
+		stage  string
+		alert  alert
+	}{
+		{
+			name:   "version",
+			config: &Config{InsecureSkipVerify: true, MaxVersion: VersionTLS10},
+			serve:  serveConfig(tls12),
+			typ:    HandshakeErrorVersionMismatch,
+			stage:  "client_hello",
+			alert:  alertProtocolVersion,
+		},
+		{
+			name:   "cipher",
+			config: &Config{InsecureSkipVerify: true, CipherSuites: []uint16{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}},
+			serve:  serveConfig(testConfig),
+			typ:    HandshakeErrorNoSharedCipher,
+			stage:  "client_hello",
+			alert:  alertHandshakeFailure,
+		},
+		{
+			name:   "certificate",
+			config: &Config{ServerName: "example.com"},
+			serve:  serveConfig(testConfig),
+			typ:    HandshakeErrorBadCertificate,
+			stage:  "certificate",
+			alert:  alertBadCertificate,
+		},
+		{
+			name:   "eof",
+			config: &Config{InsecureSkipVerify: true},
+			serve:  func(s net.Conn) { s.Read(make([]byte, 1)) },
+			typ:    HandshakeErrorEOFBeforeServerHello,
+			stage:  "client_hello",
+		},
+		{
+			name:   "http",
+			config: &Config{InsecureSkipVerify: true},
+			serve: func(s net.Conn) {
+				go io.Copy(ioutil.Discard, s)
+				s.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			},
+			typ:   HandshakeErrorNotTLS,
+			stage: "client_hello",
+			alert: alertUnexpectedMessage,
+		},
+	}
+	for _, test := range tests {
+		log := clientHandshakeError(t, test.config, test.serve)
+		he := log.Error
+		if he == nil {
+			t.Errorf("%s: error was not logged", test.name)
+			continue
+		}
+		if he.Type != test.typ || he.Stage != test.stage || len(he.Message) == 0 {
+			t.Errorf("%s: got %s at %s, expected %s at %s", test.name, he.Type, he.Stage, test.typ, test.stage)
+		}
+		if test.alert == 0 {
+			if he.Alert != nil {
+				t.Errorf("%s: got unexpected alert %+v", test.name, he.Alert)
+			}
+		} else if he.Alert == nil || he.Alert.Code != uint8(test.alert) || he.Alert.Description != test.alert.String() || he.Alert.Stage != test.stage {
+			t.Errorf("%s: got alert %+v, expected %s", test.name, he.Alert, test.alert)
+		} else if len(log.Alerts) == 0 || log.Alerts[0] != *he.Alert {
+			t.Errorf("%s: got alerts %+v", test.name, log.Alerts)
+		}
+
+		b, err := json.Marshal(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded struct {
+			Error HandshakeError `json:"error"`
+		}
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Error.Type != test.typ {
+			t.Errorf("%s: decoded %s from JSON", test.name, decoded.Error.Type)
+		}
+	}
+}
@@ -116,7 +116,11 @@ func (e *ALPNExtension) Marshal() []byte {
 	return result
 }
 
+// SecureRenegotiationExtension is the RFC 5746 renegotiation_info
+// extension. RenegotiatedConnection is empty in an initial handshake, but may
+// be set to send an arbitrary payload.
 type SecureRenegotiationExtension struct {
+	RenegotiatedConnection []byte
 }
 
 func (e *SecureRenegotiationExtension) WriteToConfig(c *Config) error {
@@ -124,16 +128,20 @@ func (e *SecureRenegotiationExtension) WriteToConfig(c *Config) error {
 }
 
 func (e *SecureRenegotiationExtension) CheckImplemented() error {
+	if len(e.RenegotiatedConnection) > 255 {
+		return errors.New("renegotiation_info payload too long")
+	}
 	return nil
 }
 
 func (e *SecureRenegotiationExtension) Marshal() []byte {
-	result := make([]byte, 5)
+	result := make([]byte, 5+len(e.RenegotiatedConnection))
 	result[0] = byte(extensionRenegotiationInfo >> 8)
 	result[1] = byte(extensionRenegotiationInfo & 0xff)
-	result[2] = 0
-	result[3] = 1
-	result[4] = 0
+	result[2] = uint8((1 + len(e.RenegotiatedConnection)) >> 8)
+	result[3] = uint8(1 + len(e.RenegotiatedConnection))
+	result[4] = uint8(len(e.RenegotiatedConnection))
+	copy(result[5:], e.RenegotiatedConnection)
 	return result
 }
 
@@ -237,11 +245,9 @@ func (e *SupportedCurvesExtension) WriteToConfig(c *Config) error {
 
 func (e *SupportedCurvesExtension) CheckImplemented() error {
 	for _, curve := range e.Curves {
-		found := false
-		for _, supported := range defaultCurvePreferences {
-			if curve == supported {
-				found = true
-			}
+		_, found := ffdheGroupForCurveID(curve)
+		if _, ok := curveForCurveID(curve); ok || isGREASE(uint16(curve)) {
+			found = true
 		}
 		if !found {
 			return fmt.Errorf("Unsupported CurveID %d", curve)
@@ -265,6 +271,9 @@ func (e *SupportedCurvesExtension) Marshal() []byte {
 	return result
 }
 
+// PointFormatExtension lists the EC point formats the client accepts. The
+// compressed formats may be offered alongside the uncompressed one, as
+// OpenSSL does, but only uncompressed points can be parsed.
 type PointFormatExtension struct {
 	Formats []uint8
 }
@@ -274,11 +283,19 @@ func (e *PointFormatExtension) WriteToConfig(c *Config) error {
 }
 
 func (e *PointFormatExtension) CheckImplemented() error {
+	uncompressed := false
 	for _, format := range e.Formats {
-		if format != pointFormatUncompressed {
+		switch format {
+		case pointFormatUncompressed:
+			uncompressed = true
+		case pointFormatCompressedPrime, pointFormatCompressedChar2:
+		default:
 			return fmt.Errorf("Unsupported EC Point Format %d", format)
 		}
 	}
+	if len(e.Formats) > 0 && !uncompressed {
+		return errors.New("EC Point Formats must include uncompressed")
+	}
 	return nil
 }
 
@@ -354,7 +371,7 @@ func (e *SignatureAlgorithmExtension) WriteToConfig(c *Config) error {
 
 func (e *SignatureAlgorithmExtension) CheckImplemented() error {
 	for _, algs := range e.getStructuredAlgorithms() {
-		found := false
+		found := isRSAPSS(algs) || isSupportedSignatureAndHash(algs, eddsaSignatureAlgorithms)
 		for _, supported := range supportedSKXSignatureAlgorithms {
 			if algs.hash == supported.hash && algs.signature == supported.signature {
 				found = true
@@ -391,3 +408,341 @@ func (e *SignatureAlgorithmExtension) Marshal() []byte {
 	}
 	return result
 }
+
+// GREASEExtension is a reserved extension (RFC 8701) that servers must
+// ignore. Value must be one of the GREASE values, such as 0x0a0a.
+type GREASEExtension struct {
+	Value uint16
+	Body  []byte
+}
+
+func (e *GREASEExtension) WriteToConfig(c *Config) error {
+	return nil
+}
+
+func (e *GREASEExtension) CheckImplemented() error {
+	if !isGREASE(e.Value) {
+		return fmt.Errorf("Invalid GREASE value %#04x", e.Value)
+	}
+	return nil
+}
+
+func (e *GREASEExtension) Marshal() []byte {
+	result := make([]byte, 4+len(e.Body))
+	result[0] = byte(e.Value >> 8)
+	result[1] = byte(e.Value & 0xff)
+	result[2] = uint8(len(e.Body) >> 8)
+	result[3] = uint8(len(e.Body))
+	copy(result[4:], e.Body)
+	return result
+}
+
+// PaddingExtension is the RFC 7685 padding extension, holding Length zero
+// bytes. If Autopopulate is set, the length is instead chosen when the
+// ClientHello is marshaled, the way BoringSSL does it: hellos between 256 and
+// 511 bytes long are padded to 512 bytes, and the extension is left out of
+// any other hello.
+type PaddingExtension struct {
+	Length       int
+	Autopopulate bool
+}
+
+func (e *PaddingExtension) WriteToConfig(c *Config) error {
+	return nil
+}
+
+func (e *PaddingExtension) CheckImplemented() error {
+	return nil
+}
+
+func (e *PaddingExtension) Marshal() []byte {
+	result := make([]byte, 4+e.Length)
+	result[0] = byte(extensionPadding >> 8)
+	result[1] = byte(extensionPadding & 0xff)
+	result[2] = uint8(e.Length >> 8)
+	result[3] = uint8(e.Length)
+	return result
+}
+
+// marshalForLength returns the autopopulated extension for a ClientHello of
+// unpaddedLen bytes, including the handshake header.
+func (e *PaddingExtension) marshalForLength(unpaddedLen int) []byte {
+	if unpaddedLen <= 0xff || unpaddedLen >= 0x200 {
+		return nil
+	}
+	padding := &PaddingExtension{Length: 0x200 - unpaddedLen}
+	if padding.Length >= 4+1 {
+		padding.Length -= 4
+	} else {
+		padding.Length = 1
+	}
+	return padding.Marshal()
+}
+
+// ChannelIDExtension advertises support for TLS Channel IDs, as sent by
+// Chrome. The client never sends a Channel ID, so a server that requires one
+// will fail the handshake.
+type ChannelIDExtension struct {
+	OldExtensionID bool
+}
+
+func (e *ChannelIDExtension) WriteToConfig(c *Config) error {
+	return nil
+}
+
+func (e *ChannelIDExtension) CheckImplemented() error {
+	return nil
+}
+
+func (e *ChannelIDExtension) Marshal() []byte {
+	extensionID := extensionChannelID
+	if e.OldExtensionID {
+		extensionID = extensionChannelIDOld
+	}
+	result := make([]byte, 4)
+	result[0] = byte(extensionID >> 8)
+	result[1] = byte(extensionID & 0xff)
+	return result
+}
+
+// SupportedVersionsExtension is the TLS 1.3 supported_versions extension.
+// Versions may include TLS 1.3 and GREASE values, but the handshake fails if
+// the server selects TLS 1.3.
+type SupportedVersionsExtension struct {
+	Versions []uint16
+}
+
+func (e *SupportedVersionsExtension) WriteToConfig(c *Config) error {
+	return nil
+}
+
+func (e *SupportedVersionsExtension) CheckImplemented() error {
+	if len(e.Versions) > 127 {
+		return errors.New("Too many supported versions")
+	}
+	for _, version := range e.Versions {
+		if !isGREASE(version) && (version < VersionSSL30 || version > VersionTLS13) {
+			return fmt.Errorf("Unsupported version %#04x", version)
+		}
+	}
+	return nil
+}
+
+func (e *SupportedVersionsExtension) Marshal() []byte {
+	result := make([]byte, 5+2*len(e.Versions))
+	result[0] = byte(extensionSupportedVersions >> 8)
+	result[1] = byte(extensionSupportedVersions & 0xff)
+	result[2] = uint8((1 + 2*len(e.Versions)) >> 8)
+	result[3] = uint8(1 + 2*len(e.Versions))
+	result[4] = uint8(2 * len(e.Versions))
+	for i, version := range e.Versions {
+		result[5+2*i] = uint8(version >> 8)
+		result[6+2*i] = uint8(version)
+	}
+	return result
+}
+
+// KeyShare is an entry of the key_share extension. If Data is nil, a fresh
+// key for Group is generated from Config.Rand for each handshake. GREASE
+// groups get a single zero byte, as BoringSSL sends.
+type KeyShare struct {
+	Group CurveID
+	Data  []byte
+}
+
+// KeyShareExtension is the TLS 1.3 key_share extension. The private keys
+// are discarded, since the handshake fails if the server selects TLS 1.3.
+type KeyShareExtension struct {
+	Shares []KeyShare
+
+	// generated holds the key made by WriteToConfig for each share
+	// without Data.
+	generated [][]byte
+}
+
+// WriteToConfig generates a key for each share without Data. Marshal leaves
+// out any share that has neither Data nor a generated key.
+func (e *KeyShareExtension) WriteToConfig(c *Config) error {
+	e.generated = make([][]byte, len(e.Shares))
+	for i, share := range e.Shares {
+		if share.Data != nil || isGREASE(uint16(share.Group)) {
+			continue
+		}
+		curve, ok := curveForCurveID(share.Group)
+		if !ok {
+			return fmt.Errorf("Unsupported key share group %d", share.Group)
+		}
+		_, pub, err := curve.GenerateKey(c.rand())
+		if err != nil {
+			return errors.New("tls: failed to generate a key share: " + err.Error())
+		}
+		e.generated[i] = curve.Marshal(pub, false)
+	}
+	return nil
+}
+
+func (e *KeyShareExtension) CheckImplemented() error {
+	for _, share := range e.Shares {
+		if share.Data != nil || isGREASE(uint16(share.Group)) {
+			continue
+		}
+		if _, ok := curveForCurveID(share.Group); !ok {
+			return fmt.Errorf("Unsupported key share group %d", share.Group)
+		}
+	}
+	return nil
+}
+
+func (e *KeyShareExtension) Marshal() []byte {
+	var shares []byte
+	for i, share := range e.Shares {
+		data := share.Data
+		if data == nil && isGREASE(uint16(share.Group)) {
+			data = []byte{0}
+		} else if data == nil && i < len(e.generated) {
+			data = e.generated[i]
+		}
+		if data == nil {
+			continue
+		}
+		shares = append(shares, uint8(share.Group>>8), uint8(share.Group), uint8(len(data)>>8), uint8(len(data)))
+		shares = append(shares, data...)
+	}
+	result := make([]byte, 6, 6+len(shares))
+	result[0] = byte(extensionKeyShare >> 8)
+	result[1] = byte(extensionKeyShare & 0xff)
+	result[2] = uint8((2 + len(shares)) >> 8)
+	result[3] = uint8(2 + len(shares))
+	result[4] = uint8(len(shares) >> 8)
+	result[5] = uint8(len(shares))
+	return append(result, shares...)
+}
+
+// PSKKeyExchangeModesExtension is the TLS 1.3 psk_key_exchange_modes
+// extension. Browsers send the single mode psk_dhe_ke (1).
+type PSKKeyExchangeModesExtension struct {
+	Modes []uint8
+}
+
+func (e *PSKKeyExchangeModesExtension) WriteToConfig(c *Config) error {
+	return nil
+}
+
+func (e *PSKKeyExchangeModesExtension) CheckImplemented() error {
+	if len(e.Modes) > 255 {
+		return errors.New("Too many PSK key exchange modes")
+	}
+	return nil
+}
+
+func (e *PSKKeyExchangeModesExtension) Marshal() []byte {
+	result := make([]byte, 5+len(e.Modes))
+	result[0] = byte(extensionPSKKeyExchangeModes >> 8)
+	result[1] = byte(extensionPSKKeyExchangeModes & 0xff)
+	result[2] = uint8((1 + len(e.Modes)) >> 8)
+	result[3] = uint8(1 + len(e.Modes))
+	result[4] = uint8(len(e.Modes))
+	copy(result[5:], e.Modes)
+	return result
+}
+
+// RecordSizeLimitExtension is the RFC 8449 record_size_limit extension.
+// Records up to the TLS maximum are always accepted, so the limit only
+// changes what the client advertises.
+type RecordSizeLimitExtension struct {
+	Limit uint16
+}
+
+func (e *RecordSizeLimitExtension) WriteToConfig(c *Config) error {
+	return nil
+}
+
+func (e *RecordSizeLimitExtension) CheckImplemented() error {
+	if e.Limit < 64 {
+		return fmt.Errorf("Invalid record size limit %d", e.Limit)
+	}
+	return nil
+}
+
+func (e *RecordSizeLimitExtension) Marshal() []byte {
+	result := make([]byte, 6)
+	result[0] = byte(extensionRecordSizeLimit >> 8)
+	result[1] = byte(extensionRecordSizeLimit & 0xff)
+	result[2] = 0
+	result[3] = 2
+	result[4] = uint8(e.Limit >> 8)
+	result[5] = uint8(e.Limit)
+	return result
+}
+
+// EncryptThenMACExtension is the RFC 7366 encrypt_then_mac extension.
+type EncryptThenMACExtension struct {
+}
+
+func (e *EncryptThenMACExtension) WriteToConfig(c *Config) error {
+	c.EncryptThenMAC = true
+	return nil
+}
+
+func (e *EncryptThenMACExtension) CheckImplemented() error {
+	return nil
+}
+
+func (e *EncryptThenMACExtension) Marshal() []byte {
+	result := make([]byte, 4)
+	result[0] = byte(extensionEncryptThenMAC >> 8)
+	result[1] = byte(extensionEncryptThenMAC & 0xff)
+	return result
+}
+
+// PostHandshakeAuthExtension is the TLS 1.3 post_handshake_auth extension,
+// as sent by OpenSSL. It has no effect on a TLS 1.2 handshake.
+type PostHandshakeAuthExtension struct {
+}
+
+func (e *PostHandshakeAuthExtension) WriteToConfig(c *Config) error {
+	return nil
+}
+
+func (e *PostHandshakeAuthExtension) CheckImplemented() error {
+	return nil
+}
+
+func (e *PostHandshakeAuthExtension) Marshal() []byte {
+	result := make([]byte, 4)
+	result[0] = byte(extensionPostHandshakeAuth >> 8)
+	result[1] = byte(extensionPostHandshakeAuth & 0xff)
+	return result
+}
+
+// CompressCertificateExtension is the RFC 8879 compress_certificate
+// extension, listing compression algorithms such as brotli (2). It only
+// applies to TLS 1.3, so it has no effect on the handshake.
+type CompressCertificateExtension struct {
+	Algorithms []uint16
+}
+
+func (e *CompressCertificateExtension) WriteToConfig(c *Config) error {
+	return nil
+}
+
+func (e *CompressCertificateExtension) CheckImplemented() error {
+	if len(e.Algorithms) > 127 {
+		return errors.New("Too many certificate compression algorithms")
+	}
+	return nil
+}
+
+func (e *CompressCertificateExtension) Marshal() []byte {
+	result := make([]byte, 5+2*len(e.Algorithms))
+	result[0] = byte(extensionCompressCertificate >> 8)
+	result[1] = byte(extensionCompressCertificate & 0xff)
+	result[2] = uint8((1 + 2*len(e.Algorithms)) >> 8)
+	result[3] = uint8(1 + 2*len(e.Algorithms))
+	result[4] = uint8(2 * len(e.Algorithms))
+	for i, alg := range e.Algorithms {
+		result[5+2*i] = uint8(alg >> 8)
+		result[6+2*i] = uint8(alg)
+	}
+	return result
+}
@@ -0,0 +1,189 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestClientExtensionMarshal(t *testing.T) {
+	tests := []struct {
+		ext      ClientExtension
+		expected string
+	}{
+		{&GREASEExtension{Value: 0x1a1a, Body: []byte{0}}, "1a1a000100"},
+		{&PaddingExtension{Length: 3}, "00150003000000"},
+		{&SupportedVersionsExtension{Versions: []uint16{0x3a3a, VersionTLS13, VersionTLS12}}, "002b0007063a3a03040303"},
+		{&KeyShareExtension{Shares: []KeyShare{{Group: 0x2a2a, Data: []byte{0}}, {Group: Curve25519, Data: []byte{1, 2}}}}, "0033000d000b2a2a000100001d00020102"},
+		{&PSKKeyExchangeModesExtension{Modes: []uint8{1}}, "002d00020101"},
+		{&RecordSizeLimitExtension{Limit: 0x4001}, "001c00024001"},
+		{&EncryptThenMACExtension{}, "00160000"},
+		{&PostHandshakeAuthExtension{}, "00310000"},
+		{&PointFormatExtension{Formats: []uint8{0, 1, 2}}, "000b000403000102"},
+		{&CompressCertificateExtension{Algorithms: []uint16{2}}, "001b0003020002"},
+		{&SecureRenegotiationExtension{}, "ff01000100"},
+		{&SecureRenegotiationExtension{RenegotiatedConnection: []byte{0xaa, 0xbb}}, "ff01000302aabb"},
+	}
+	for i, test := range tests {
+		if err := test.ext.CheckImplemented(); err != nil {
+			t.Errorf("#%d: %s", i, err)
+		}
+		if got := hex.EncodeToString(test.ext.Marshal()); got != test.expected {
+			t.Errorf("#%d: got %s, expected %s", i, got, test.expected)
+		}
+	}
+}
+
+func TestClientExtensionCheckImplemented(t *testing.T) {
+	for i, ext := range []ClientExtension{
+		&GREASEExtension{Value: 0x1a2a},
+		&SupportedVersionsExtension{Versions: []uint16{0x0305}},
+		&KeyShareExtension{Shares: []KeyShare{{Group: 0x1234}}},
+		&RecordSizeLimitExtension{Limit: 63},
+		&PointFormatExtension{Formats: []uint8{pointFormatCompressedPrime}},
+		&PointFormatExtension{Formats: []uint8{3}},
+		&SecureRenegotiationExtension{RenegotiatedConnection: make([]byte, 256)},
+	} {
+		if ext.CheckImplemented() == nil {
+			t.Errorf("#%d: invalid extension was accepted", i)
+		}
+	}
+}
+
+func TestKeyShareGeneration(t *testing.T) {
+	ext := &KeyShareExtension{Shares: []KeyShare{{Group: 0x2a2a}, {Group: Curve25519}, {Group: CurveP256r1}}}
+	if got := hex.EncodeToString(ext.Marshal()); got != "0033000700052a2a000100" {
+		t.Errorf("got %s before WriteToConfig, want only the GREASE share", got)
+	}
+
+	marshal := func(seed byte) []byte {
+		config := &Config{Rand: bytes.NewReader(bytes.Repeat([]byte{seed}, 1024))}
+		if err := ext.WriteToConfig(config); err != nil {
+			t.Fatal(err)
+		}
+		return ext.Marshal()
+	}
+	a, b, c := marshal(1), marshal(1), marshal(2)
+	// Three shares of 1, 32 and 65 bytes, each with a four byte header
+	if len(a) != 6+4+1+4+32+4+65 {
+		t.Fatalf("got key_share of %d bytes", len(a))
+	}
+	if !bytes.Equal(a, b) {
+		t.Error("key shares differ under the same Rand")
+	}
+	if bytes.Equal(a, c) {
+		t.Error("key shares were not regenerated")
+	}
+
+	if err := ext.WriteToConfig(&Config{Rand: bytes.NewReader(nil)}); err == nil {
+		t.Error("no error from an empty Rand")
+	}
+}
+
+// modernClientHello returns a hello in the style of a TLS 1.3 browser.
+func modernClientHello() *ClientFingerprintConfiguration {
+	return &ClientFingerprintConfiguration{
+		HandshakeVersion: VersionTLS12,
+		CipherSuites: []uint16{
+			0x4a4a,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_RSA_WITH_AES_128_CBC_SHA,
+		},
+		CompressionMethods: []uint8{compressionNone},
+		Extensions: []ClientExtension{
+			&GREASEExtension{Value: 0x0a0a},
+			&SNIExtension{Autopopulate: true},
+			&ExtendedMasterSecretExtension{},
+			&SecureRenegotiationExtension{},
+			&SupportedCurvesExtension{Curves: []CurveID{0x2a2a, Curve25519, CurveP256r1}},
+			&PointFormatExtension{Formats: []uint8{pointFormatUncompressed}},
+			&EncryptThenMACExtension{},
+			&SignatureAlgorithmExtension{SignatureAndHashes: []uint16{0x0403, 0x0804, 0x0401}},
+			&KeyShareExtension{Shares: []KeyShare{{Group: 0x2a2a, Data: []byte{0}}, {Group: Curve25519}}},
+			&PSKKeyExchangeModesExtension{Modes: []uint8{1}},
+			&SupportedVersionsExtension{Versions: []uint16{0x7a7a, VersionTLS13, VersionTLS12}},
+			&CompressCertificateExtension{Algorithms: []uint16{2}},
+			&RecordSizeLimitExtension{Limit: 0x4001},
+			&GREASEExtension{Value: 0x1a1a, Body: []byte{0}},
+			&PaddingExtension{Autopopulate: true},
+		},
+	}
+}
+
+func TestModernClientHelloHandshake(t *testing.T) {
+	clientConfig := &Config{
+		InsecureSkipVerify:             true,
+		ClientFingerprintConfiguration: modernClientHello(),
+	}
+	c, s := net.Pipe()
+	done := make(chan error)
+	go func() {
+		cli := Client(c, clientConfig)
+		done <- cli.Handshake()
+		c.Close()
+	}()
+	server := Server(s, testConfig.Clone())
+	serverErr := server.Handshake()
+	s.Close()
+	if err := <-done; err != nil || serverErr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", err, serverErr)
+	}
+	if v := server.ConnectionState().Version; v != VersionTLS12 {
+		t.Errorf("negotiated version %x", v)
+	}
+}
+
+// serveTLS13ServerHello reads a ClientHello from s and answers with a
+// ServerHello selecting TLS 1.3, then discards anything else it receives.
+func serveTLS13ServerHello(s net.Conn) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(s, header); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(s, make([]byte, int(header[3])<<8|int(header[4]))); err != nil {
+		return
+	}
+	body := append([]byte{0x03, 0x03}, make([]byte, 32)...)
+	body = append(body, 0x00, 0x13, 0x01, 0x00, 0x00, 0x06, 0x00, 0x2b, 0x00, 0x02, 0x03, 0x04)
+	msg := append([]byte{typeServerHello, 0, 0, byte(len(body))}, body...)
+	s.Write(append([]byte{byte(recordTypeHandshake), 0x03, 0x03, 0, byte(len(msg))}, msg...))
+	io.Copy(ioutil.Discard, s)
+}
+
+// TestClientRefusesTLS13 checks that a ServerHello selecting TLS 1.3 ends the
+// handshake with a clear error.
+func TestClientRefusesTLS13(t *testing.T) {
+	c, s := net.Pipe()
+	go serveTLS13ServerHello(s)
+
+	cli := Client(c, &Config{
+		InsecureSkipVerify:             true,
+		ClientFingerprintConfiguration: modernClientHello(),
+	})
+	err := cli.Handshake()
+	c.Close()
+	if err == nil || !strings.Contains(err.Error(), "unsupported protocol version 304") {
+		t.Errorf("got error %v", err)
+	}
+	if log := cli.GetHandshakeLog(); log.ServerHello == nil || log.ServerHello.SupportedVersion != VersionTLS13 {
+		t.Error("server's selected version was not logged")
+	}
+}
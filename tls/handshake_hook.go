@@ -0,0 +1,131 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import "bytes"
+
+// HandshakeMessage is a handshake message passed to a HandshakeHook.
+type HandshakeMessage struct {
+	// Type is the handshake type of the message as it was built or
+	// received.
+	Type uint8
+
+	// Raw is the message, its four byte header included. A hook may
+	// change it in place or replace it; setting it to nil or empty drops
+	// the message.
+	Raw []byte
+
+	// Message is the message decoded into the form it is logged in: a
+	// *ClientHello, *ServerHello, *Certificates, *ServerKeyExchange,
+	// *CertificateRequest, *ClientKeyExchange, *Finished or
+	// *HelloVerifyRequest. It is nil for other messages, and for received
+	// messages which do not parse. Changes to it are not sent.
+	Message interface{}
+}
+
+// Name returns the name of the message's type, as used in logs.
+func (m *HandshakeMessage) Name() string {
+	return nameForHandshakeMessageType(m.Type)
+}
+
+// A HandshakeHook sees each handshake message of a connection, and may
+// change it, which lets a fuzzer send malformed messages, or probe how a
+// peer reacts to them, without changing the handshake code. Its methods are
+// called from the goroutine running the handshake. If one returns an
+// error, the handshake fails with that error, and no alert is sent.
+type HandshakeHook interface {
+	// SendHandshakeMessage is called with each handshake message before
+	// it is hashed and written. What it leaves in Raw is sent, and
+	// included in the Finished messages, so that the handshake can
+	// complete if the peer accepts the change.
+	SendHandshakeMessage(m *HandshakeMessage) error
+
+	// ReceiveHandshakeMessage is called with each handshake message
+	// read, before it is parsed. What it leaves in Raw is parsed and
+	// hashed as if it had been received.
+	ReceiveHandshakeMessage(m *HandshakeMessage) error
+}
+
+// handshakeMessageLog returns the logged form of m, or nil for messages
+// which are not logged.
+func handshakeMessageLog(m handshakeMessage) interface{} {
+	switch m := m.(type) {
+	case *clientHelloMsg:
+		return m.MakeLog()
+	case *serverHelloMsg:
+		return m.MakeLog()
+	case *certificateMsg:
+		return m.MakeLog()
+	case *serverKeyExchangeMsg:
+		return m.MakeLog(nil)
+	case *certificateRequestMsg:
+		return m.MakeLog()
+	case *clientKeyExchangeMsg:
+		return m.MakeLog(nil)
+	case *finishedMsg:
+		return m.MakeLog()
+	case *helloVerifyRequestMsg:
+		return m.MakeLog()
+	}
+	return nil
+}
+
+// marshalHandshake returns m as it is to be sent: marshaled, and passed
+// through the HandshakeHook if one is configured. It returns nil if the
+// hook dropped the message, which writeRecord then skips.
+func (c *Conn) marshalHandshake(m handshakeMessage) ([]byte, error) {
+	raw := m.marshal()
+	hook := c.config.HandshakeHook
+	if hook == nil {
+		return raw, nil
+	}
+	msg := &HandshakeMessage{
+		Type:    raw[0],
+		Raw:     append([]byte(nil), raw...),
+		Message: handshakeMessageLog(m),
+	}
+	if err := hook.SendHandshakeMessage(msg); err != nil {
+		return nil, err
+	}
+	if len(msg.Raw) == 0 {
+		return nil, nil
+	}
+	return msg.Raw, nil
+}
+
+// hookReceivedHandshake passes data, a handshake message that was read,
+// through the HandshakeHook, and returns what is to be parsed in its place,
+// or nil if the hook dropped it.
+func (c *Conn) hookReceivedHandshake(data []byte) ([]byte, error) {
+	msg := &HandshakeMessage{
+		Type: data[0],
+		Raw:  append([]byte(nil), data...),
+	}
+	if m := newHandshakeMessage(data[0], c.vers); m != nil && m.unmarshal(append([]byte(nil), data...)) {
+		msg.Message = handshakeMessageLog(m)
+	}
+	if err := c.config.HandshakeHook.ReceiveHandshakeMessage(msg); err != nil {
+		return nil, err
+	}
+	if len(msg.Raw) == 0 {
+		return nil, nil
+	}
+	if c.isDTLS && len(msg.Raw) > 0 && !bytes.Equal(msg.Raw, data) {
+		// The message is hashed with the message_seq of what was
+		// received.
+		c.dtls.seqs[string(msg.Raw)] = c.dtls.seqs[string(data)]
+	}
+	return msg.Raw, nil
+}
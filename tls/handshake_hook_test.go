@@ -0,0 +1,184 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingHook records the names of the messages it sees, and passes those
+// sent to send and those received to receive, if they are set.
+type recordingHook struct {
+	sent, received []string
+	send, receive  func(m *HandshakeMessage) error
+}
+
+func (h *recordingHook) SendHandshakeMessage(m *HandshakeMessage) error {
+	h.sent = append(h.sent, m.Name())
+	if h.send != nil {
+		return h.send(m)
+	}
+	return nil
+}
+
+func (h *recordingHook) ReceiveHandshakeMessage(m *HandshakeMessage) error {
+	h.received = append(h.received, m.Name())
+	if h.receive != nil {
+		return h.receive(m)
+	}
+	return nil
+}
+
+// hookedHandshake runs a handshake between a client and a server with the
+// given hooks, returning both connections and their errors.
+func hookedHandshake(clientHook, serverHook HandshakeHook) (client, server *Conn, clientErr, serverErr error) {
+	c, s := net.Pipe()
+	deadline := time.Now().Add(10 * time.Second)
+	c.SetDeadline(deadline)
+	s.SetDeadline(deadline)
+	clientConfig := testConfig.Clone()
+	clientConfig.HandshakeHook = clientHook
+	serverConfig := testConfig.Clone()
+	serverConfig.HandshakeHook = serverHook
+
+	server = Server(s, serverConfig)
+	serverErrs := make(chan error, 1)
+	go func() {
+		err := server.Handshake()
+		s.Close()
+		serverErrs <- err
+	}()
+	client = Client(c, clientConfig)
+	clientErr = client.Handshake()
+	c.Close()
+	return client, server, clientErr, <-serverErrs
+}
+
+func TestHandshakeHookSeesMessages(t *testing.T) {
+	var hello interface{}
+	clientHook := &recordingHook{
+		send: func(m *HandshakeMessage) error {
+			if m.Type == typeClientHello {
+				hello = m.Message
+			}
+			return nil
+		},
+	}
+	serverHook := new(recordingHook)
+	_, _, clientErr, serverErr := hookedHandshake(clientHook, serverHook)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", clientErr, serverErr)
+	}
+	if !reflect.DeepEqual(clientHook.sent, serverHook.received) {
+		t.Errorf("client sent %v, server received %v", clientHook.sent, serverHook.received)
+	}
+	if !reflect.DeepEqual(serverHook.sent, clientHook.received) {
+		t.Errorf("server sent %v, client received %v", serverHook.sent, clientHook.received)
+	}
+	if len(clientHook.sent) == 0 || clientHook.sent[0] != "client_hello" {
+		t.Errorf("client sent %v", clientHook.sent)
+	}
+	if _, ok := hello.(*ClientHello); !ok {
+		t.Errorf("got a %T for the ClientHello", hello)
+	}
+}
+
+func TestHandshakeHookMutation(t *testing.T) {
+	// Replace the last cipher suite offered, which the server does not
+	// select, with a GREASE value. The handshake only completes if both
+	// sides hash the ClientHello as it was sent.
+	clientHook := &recordingHook{
+		send: func(m *HandshakeMessage) error {
+			if m.Type != typeClientHello {
+				return nil
+			}
+			sessionIDLen := int(m.Raw[4+2+32])
+			suites := m.Raw[4+2+32+1+sessionIDLen:]
+			n := int(suites[0])<<8 | int(suites[1])
+			suites[2+n-2], suites[2+n-1] = 0x0a, 0x0a
+			return nil
+		},
+	}
+	_, server, clientErr, serverErr := hookedHandshake(clientHook, nil)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", clientErr, serverErr)
+	}
+	suites := server.GetClientHandshakeLog().ClientHello.CipherSuites
+	if suites[len(suites)-1] != 0x0a0a {
+		t.Errorf("server received cipher suites %v", suites)
+	}
+}
+
+func TestHandshakeHookDrop(t *testing.T) {
+	for _, dropped := range [][]byte{nil, {}} {
+		clientHook := &recordingHook{
+			send: func(m *HandshakeMessage) error {
+				if m.Type == typeClientKeyExchange {
+					m.Raw = dropped
+				}
+				return nil
+			},
+		}
+		serverHook := new(recordingHook)
+		_, _, clientErr, serverErr := hookedHandshake(clientHook, serverHook)
+		if clientErr == nil || serverErr == nil {
+			t.Fatalf("handshake without a ClientKeyExchange (%#v) succeeded", dropped)
+		}
+		for _, name := range serverHook.received {
+			if name == "client_key_exchange" {
+				t.Errorf("server received the dropped ClientKeyExchange (%#v)", dropped)
+			}
+		}
+	}
+}
+
+func TestHandshakeHookDropReceived(t *testing.T) {
+	serverHook := &recordingHook{
+		receive: func(m *HandshakeMessage) error {
+			if m.Type == typeClientKeyExchange {
+				m.Raw = []byte{}
+			}
+			return nil
+		},
+	}
+	_, server, clientErr, serverErr := hookedHandshake(nil, serverHook)
+	if clientErr == nil || serverErr == nil {
+		t.Fatal("handshake without a ClientKeyExchange succeeded")
+	}
+	if log := server.GetHandshakeLog(); log.ClientKeyExchange != nil {
+		t.Error("server parsed the dropped ClientKeyExchange")
+	}
+}
+
+func TestHandshakeHookError(t *testing.T) {
+	hookErr := errors.New("hook failed")
+	clientHook := &recordingHook{
+		send: func(m *HandshakeMessage) error {
+			return hookErr
+		},
+	}
+	serverHook := new(recordingHook)
+	_, _, clientErr, _ := hookedHandshake(clientHook, serverHook)
+	if clientErr != hookErr {
+		t.Errorf("got error %v, want %v", clientErr, hookErr)
+	}
+	if len(serverHook.received) != 0 {
+		t.Errorf("server received %v", serverHook.received)
+	}
+}
@@ -14,6 +14,7 @@ type clientHelloMsg struct {
 	vers                  uint16
 	random                []byte
 	sessionId             []byte
+	cookie                []byte // DTLS only
 	cipherSuites          []uint16
 	compressionMethods    []uint8
 	nextProtoNeg          bool
@@ -26,11 +27,13 @@ type clientHelloMsg struct {
 	sessionTicket         []uint8
 	signatureAndHashes    []signatureAndHash
 	secureRenegotiation   bool
+	renegotiationInfo     []byte
 	heartbeatEnabled      bool
 	heartbeatMode         uint8
 	extendedRandomEnabled bool
 	extendedRandom        []byte
 	extendedMasterSecret  bool
+	encryptThenMAC        bool
 	sctEnabled            bool
 	alpnProtocols         []string
 	unknownExtensions     [][]byte
@@ -46,6 +49,7 @@ func (m *clientHelloMsg) equal(i interface{}) bool {
 		m.vers == m1.vers &&
 		bytes.Equal(m.random, m1.random) &&
 		bytes.Equal(m.sessionId, m1.sessionId) &&
+		bytes.Equal(m.cookie, m1.cookie) &&
 		eqUint16s(m.cipherSuites, m1.cipherSuites) &&
 		bytes.Equal(m.compressionMethods, m1.compressionMethods) &&
 		m.nextProtoNeg == m1.nextProtoNeg &&
@@ -58,11 +62,13 @@ func (m *clientHelloMsg) equal(i interface{}) bool {
 		bytes.Equal(m.sessionTicket, m1.sessionTicket) &&
 		eqSignatureAndHashes(m.signatureAndHashes, m1.signatureAndHashes) &&
 		m.secureRenegotiation == m1.secureRenegotiation &&
+		bytes.Equal(m.renegotiationInfo, m1.renegotiationInfo) &&
 		m.heartbeatEnabled == m1.heartbeatEnabled &&
 		m.heartbeatMode == m1.heartbeatMode &&
 		m.extendedRandomEnabled == m1.extendedRandomEnabled &&
 		bytes.Equal(m.extendedRandom, m1.extendedRandom) &&
 		m.extendedMasterSecret == m1.extendedMasterSecret &&
+		m.encryptThenMAC == m1.encryptThenMAC &&
 		eqStrings(m.alpnProtocols, m1.alpnProtocols) &&
 		reflect.DeepEqual(m.unknownExtensions, m1.unknownExtensions)
 }
@@ -73,6 +79,9 @@ func (m *clientHelloMsg) marshal() []byte {
 	}
 
 	length := 2 + 32 + 1 + len(m.sessionId) + 2 + len(m.cipherSuites)*2 + 1 + len(m.compressionMethods)
+	if isDTLSVersion(m.vers) {
+		length += 1 + len(m.cookie)
+	}
 	numExtensions := 0
 	extensionsLength := 0
 	if m.nextProtoNeg {
@@ -103,7 +112,7 @@ func (m *clientHelloMsg) marshal() []byte {
 		numExtensions++
 	}
 	if m.secureRenegotiation {
-		extensionsLength += 1
+		extensionsLength += 1 + len(m.renegotiationInfo)
 		numExtensions++
 	}
 	if len(m.alpnProtocols) > 0 {
@@ -128,6 +137,9 @@ func (m *clientHelloMsg) marshal() []byte {
 	if m.extendedMasterSecret {
 		numExtensions++
 	}
+	if m.encryptThenMAC {
+		numExtensions++
+	}
 	if m.sctEnabled {
 		numExtensions++
 	}
@@ -154,6 +166,11 @@ func (m *clientHelloMsg) marshal() []byte {
 	x[38] = uint8(len(m.sessionId))
 	copy(x[39:39+len(m.sessionId)], m.sessionId)
 	y := x[39+len(m.sessionId):]
+	if isDTLSVersion(m.vers) {
+		y[0] = uint8(len(m.cookie))
+		copy(y[1:], m.cookie)
+		y = y[1+len(m.cookie):]
+	}
 	// This is a clever way to store the lower 16 bits of 2*len(m.cipherSuites)
 	y[0] = uint8(len(m.cipherSuites) >> 7)
 	y[1] = uint8(len(m.cipherSuites) << 1)
@@ -286,9 +303,11 @@ func (m *clientHelloMsg) marshal() []byte {
 	if m.secureRenegotiation {
 		z[0] = byte(extensionRenegotiationInfo >> 8)
 		z[1] = byte(extensionRenegotiationInfo & 0xff)
-		z[2] = 0
-		z[3] = 1
-		z = z[5:]
+		z[2] = uint8((1 + len(m.renegotiationInfo)) >> 8)
+		z[3] = uint8(1 + len(m.renegotiationInfo))
+		z[4] = uint8(len(m.renegotiationInfo))
+		copy(z[5:], m.renegotiationInfo)
+		z = z[5+len(m.renegotiationInfo):]
 	}
 	if len(m.alpnProtocols) > 0 {
 		z[0] = byte(extensionALPN >> 8)
@@ -339,6 +358,12 @@ func (m *clientHelloMsg) marshal() []byte {
 		z[1] = byte(extensionExtendedMasterSecret & 0xff)
 		z = z[4:]
 	}
+	if m.encryptThenMAC {
+		// https://tools.ietf.org/html/rfc7366
+		z[0] = byte(extensionEncryptThenMAC >> 8)
+		z[1] = byte(extensionEncryptThenMAC & 0xff)
+		z = z[4:]
+	}
 	if m.sctEnabled {
 		// https://tools.ietf.org/html/rfc6962#section-3.3.1
 		z[0] = byte(extensionSCT >> 8)
@@ -371,6 +396,14 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 	}
 	m.sessionId = data[39 : 39+sessionIdLen]
 	data = data[39+sessionIdLen:]
+	m.cookie = nil
+	if isDTLSVersion(m.vers) {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return false
+		}
+		m.cookie = data[1 : 1+int(data[0])]
+		data = data[1+int(data[0]):]
+	}
 	if len(data) < 2 {
 		return false
 	}
@@ -408,6 +441,8 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 	m.signatureAndHashes = nil
 	m.heartbeatEnabled = false
 	m.extendedMasterSecret = false
+	m.encryptThenMAC = false
+	m.renegotiationInfo = nil
 	m.alpnProtocols = nil
 	m.scts = false
 	m.unknownExtensions = [][]byte(nil)
@@ -518,10 +553,11 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 				d = d[2:]
 			}
 		case extensionRenegotiationInfo:
-			if length != 1 || data[0] != 0 {
+			if length < 1 || int(data[0]) != length-1 {
 				return false
 			}
 			m.secureRenegotiation = true
+			m.renegotiationInfo = data[1:length]
 		case extensionALPN:
 			if length < 2 {
 				return false
@@ -571,6 +607,11 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 				return false
 			}
 			m.extendedMasterSecret = true
+		case extensionEncryptThenMAC:
+			if length != 0 {
+				return false
+			}
+			m.encryptThenMAC = true
 		case extensionSCT:
 			m.scts = true
 			if length != 0 {
@@ -599,13 +640,18 @@ type serverHelloMsg struct {
 	scts                  [][]byte
 	ticketSupported       bool
 	secureRenegotiation   bool
+	renegotiationInfo     []byte
 	heartbeatEnabled      bool
 	heartbeatMode         uint8
 	extendedRandomEnabled bool
 	extendedRandom        []byte
 	extendedMasterSecret  bool
+	encryptThenMAC        bool
 	alpnProtocol          string
 	unknownExtensions     [][]byte
+
+	// Parsed but never sent, since TLS 1.3 is not implemented
+	supportedVersion uint16
 }
 
 func (m *serverHelloMsg) equal(i interface{}) bool {
@@ -625,7 +671,9 @@ func (m *serverHelloMsg) equal(i interface{}) bool {
 		m.ocspStapling == m1.ocspStapling &&
 		m.ticketSupported == m1.ticketSupported &&
 		m.secureRenegotiation == m1.secureRenegotiation &&
+		bytes.Equal(m.renegotiationInfo, m1.renegotiationInfo) &&
 		m.extendedMasterSecret == m1.extendedMasterSecret &&
+		m.encryptThenMAC == m1.encryptThenMAC &&
 		m.alpnProtocol == m1.alpnProtocol &&
 		reflect.DeepEqual(m.unknownExtensions, m1.unknownExtensions)
 }
@@ -655,7 +703,7 @@ func (m *serverHelloMsg) marshal() []byte {
 		numExtensions++
 	}
 	if m.secureRenegotiation {
-		extensionsLength += 1
+		extensionsLength += 1 + len(m.renegotiationInfo)
 		numExtensions++
 	}
 	if alpnLen := len(m.alpnProtocol); alpnLen > 0 {
@@ -676,6 +724,9 @@ func (m *serverHelloMsg) marshal() []byte {
 	if m.extendedMasterSecret {
 		numExtensions++
 	}
+	if m.encryptThenMAC {
+		numExtensions++
+	}
 	sctLen := 0
 	if len(m.scts) > 0 {
 		for _, sct := range m.scts {
@@ -747,9 +798,11 @@ func (m *serverHelloMsg) marshal() []byte {
 	if m.secureRenegotiation {
 		z[0] = byte(extensionRenegotiationInfo >> 8)
 		z[1] = byte(extensionRenegotiationInfo & 0xff)
-		z[2] = 0
-		z[3] = 1
-		z = z[5:]
+		z[2] = uint8((1 + len(m.renegotiationInfo)) >> 8)
+		z[3] = uint8(1 + len(m.renegotiationInfo))
+		z[4] = uint8(len(m.renegotiationInfo))
+		copy(z[5:], m.renegotiationInfo)
+		z = z[5+len(m.renegotiationInfo):]
 	}
 	if alpnLen := len(m.alpnProtocol); alpnLen > 0 {
 		z[0] = byte(extensionALPN >> 8)
@@ -791,6 +844,11 @@ func (m *serverHelloMsg) marshal() []byte {
 		z[1] = byte(extensionExtendedMasterSecret & 0xff)
 		z = z[4:]
 	}
+	if m.encryptThenMAC {
+		z[0] = byte(extensionEncryptThenMAC >> 8)
+		z[1] = byte(extensionEncryptThenMAC & 0xff)
+		z = z[4:]
+	}
 	if sctLen > 0 {
 		z[0] = byte(extensionSCT >> 8)
 		z[1] = byte(extensionSCT)
@@ -846,6 +904,8 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 	m.heartbeatEnabled = false
 	m.extendedRandomEnabled = false
 	m.extendedMasterSecret = false
+	m.encryptThenMAC = false
+	m.renegotiationInfo = nil
 	m.alpnProtocol = ""
 	m.unknownExtensions = [][]byte(nil)
 
@@ -899,10 +959,11 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 			}
 			m.ticketSupported = true
 		case extensionRenegotiationInfo:
-			if length != 1 || data[0] != 0 {
+			if length < 1 || int(data[0]) != length-1 {
 				return false
 			}
 			m.secureRenegotiation = true
+			m.renegotiationInfo = data[1:length]
 		case extensionALPN:
 			d := data[:length]
 			if len(d) < 3 {
@@ -946,6 +1007,16 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 				return false
 			}
 			m.extendedMasterSecret = true
+		case extensionSupportedVersions:
+			if length != 2 {
+				return false
+			}
+			m.supportedVersion = uint16(data[0])<<8 | uint16(data[1])
+		case extensionEncryptThenMAC:
+			if length != 0 {
+				return false
+			}
+			m.encryptThenMAC = true
 
 		case extensionSCT:
 			d := data[:length]
@@ -1646,6 +1717,58 @@ func (m *newSessionTicketMsg) unmarshal(data []byte) bool {
 	return true
 }
 
+type helloVerifyRequestMsg struct {
+	raw    []byte
+	vers   uint16
+	cookie []byte
+}
+
+func (m *helloVerifyRequestMsg) equal(i interface{}) bool {
+	m1, ok := i.(*helloVerifyRequestMsg)
+	if !ok {
+		return false
+	}
+
+	return bytes.Equal(m.raw, m1.raw) &&
+		m.vers == m1.vers &&
+		bytes.Equal(m.cookie, m1.cookie)
+}
+
+func (m *helloVerifyRequestMsg) marshal() []byte {
+	if m.raw != nil {
+		return m.raw
+	}
+
+	// See https://tools.ietf.org/html/rfc6347#section-4.2.1
+	length := 2 + 1 + len(m.cookie)
+	x := make([]byte, 4+length)
+	x[0] = typeHelloVerifyRequest
+	x[1] = uint8(length >> 16)
+	x[2] = uint8(length >> 8)
+	x[3] = uint8(length)
+	x[4] = uint8(m.vers >> 8)
+	x[5] = uint8(m.vers)
+	x[6] = uint8(len(m.cookie))
+	copy(x[7:], m.cookie)
+
+	m.raw = x
+	return x
+}
+
+func (m *helloVerifyRequestMsg) unmarshal(data []byte) bool {
+	if len(data) < 7 {
+		return false
+	}
+	m.raw = data
+	m.vers = uint16(data[4])<<8 | uint16(data[5])
+	cookieLen := int(data[6])
+	if len(data) != 7+cookieLen {
+		return false
+	}
+	m.cookie = data[7:]
+	return true
+}
+
 type helloRequestMsg struct {
 }
 
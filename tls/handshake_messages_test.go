@@ -23,6 +23,7 @@ var tests = []interface{}{
 	&clientKeyExchangeMsg{},
 	&nextProtoMsg{},
 	&newSessionTicketMsg{},
+	&helloVerifyRequestMsg{},
 	&sessionState{},
 }
 
@@ -112,6 +113,9 @@ func (*clientHelloMsg) Generate(rand *rand.Rand, size int) reflect.Value {
 	m.vers = uint16(rand.Intn(65536))
 	m.random = randomBytes(32, rand)
 	m.sessionId = randomBytes(rand.Intn(32), rand)
+	if isDTLSVersion(m.vers) {
+		m.cookie = randomBytes(rand.Intn(255), rand)
+	}
 	m.cipherSuites = make([]uint16, rand.Intn(63)+1)
 	for i := 0; i < len(m.cipherSuites); i++ {
 		m.cipherSuites[i] = uint16(rand.Int31())
@@ -237,6 +241,13 @@ func (*newSessionTicketMsg) Generate(rand *rand.Rand, size int) reflect.Value {
 	return reflect.ValueOf(m)
 }
 
+func (*helloVerifyRequestMsg) Generate(rand *rand.Rand, size int) reflect.Value {
+	m := &helloVerifyRequestMsg{}
+	m.vers = uint16(rand.Intn(65536))
+	m.cookie = randomBytes(rand.Intn(255), rand)
+	return reflect.ValueOf(m)
+}
+
 func (*sessionState) Generate(rand *rand.Rand, size int) reflect.Value {
 	s := &sessionState{}
 	s.vers = uint16(rand.Intn(10000))
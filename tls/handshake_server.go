@@ -5,6 +5,7 @@
 package tls
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
@@ -26,6 +27,7 @@ type serverHandshakeState struct {
 	suite                 *cipherSuite
 	ellipticOk            bool
 	ecdsaOk               bool
+	dheOk                 bool
 	sessionState          *sessionState
 	finishedHash          finishedHash
 	masterSecret          []byte
@@ -100,6 +102,9 @@ func (c *Conn) serverHandshake() error {
 	}
 
 	c.handshakeLog.KeyMaterial = hs.MakeLog()
+	if isResume {
+		c.clientHandshakeLog.Resumption.Resumed = true
+	}
 
 	c.handshakeComplete = true
 
@@ -111,6 +116,10 @@ func (c *Conn) serverHandshake() error {
 func (hs *serverHandshakeState) readClientHello() (isResume bool, err error) {
 	c := hs.c
 	c.handshakeLog = new(ServerHandshake)
+	c.heartbleedLog = new(Heartbleed)
+	c.alertLogMutex.Lock()
+	c.clientHandshakeLog = new(ClientHandshake)
+	c.alertLogMutex.Unlock()
 
 	msg, err := c.readHandshake()
 	if err != nil {
@@ -122,9 +131,22 @@ func (hs *serverHandshakeState) readClientHello() (isResume bool, err error) {
 		c.sendAlert(alertUnexpectedMessage)
 		return false, unexpectedMessageError(hs.clientHello, msg)
 	}
+	if c.isDTLS {
+		if hs.clientHello, err = c.dtlsVerifyClient(hs.clientHello); err != nil {
+			return false, err
+		}
+	}
 	c.clientHelloRaw = hs.clientHello.raw
 	c.clientCiphers = hs.clientHello.cipherSuites
 	c.handshakeLog.ClientHello = hs.clientHello.MakeLog()
+	c.clientHandshakeLog.ClientHello = c.handshakeLog.ClientHello
+	c.clientHandshakeLog.RawClientHello = c.handshakeLog.ClientHello.Raw
+	if len(hs.clientHello.sessionTicket) > 0 {
+		c.clientHandshakeLog.Resumption = &Resumption{
+			SessionID:     c.handshakeLog.ClientHello.SessionID,
+			SessionTicket: c.handshakeLog.ClientHello.SessionTicket.Value,
+		}
+	}
 
 	if c.config.GetConfigForClient != nil {
 		if newConfig, err := c.config.GetConfigForClient(hs.clientHelloInfo()); err != nil {
@@ -140,7 +162,7 @@ func (hs *serverHandshakeState) readClientHello() (isResume bool, err error) {
 		}
 	}
 
-	c.vers, ok = c.config.mutualVersion(hs.clientHello.vers)
+	c.vers, ok = c.mutualVersion(hs.clientHello.vers)
 	if !ok {
 		c.sendAlert(alertProtocolVersion)
 		return false, fmt.Errorf("tls: client offered an unsupported, maximum protocol version of %x", hs.clientHello.vers)
@@ -148,6 +170,9 @@ func (hs *serverHandshakeState) readClientHello() (isResume bool, err error) {
 	c.haveVers = true
 
 	hs.finishedHash = newFinishedHash(c.vers, hs.suite)
+	if c.isDTLS {
+		hs.finishedHash.dtls = c.dtls
+	}
 	hs.finishedHash.Write(hs.clientHello.marshal())
 
 	hs.hello = new(serverHelloMsg)
@@ -156,6 +181,9 @@ func (hs *serverHandshakeState) readClientHello() (isResume bool, err error) {
 	preferredCurves := c.config.curvePreferences()
 Curves:
 	for _, curve := range hs.clientHello.supportedCurves {
+		if isFFDHE(curve) {
+			continue
+		}
 		for _, supported := range preferredCurves {
 			if supported == curve {
 				supportedCurve = true
@@ -173,6 +201,10 @@ Curves:
 	}
 	hs.ellipticOk = supportedCurve && supportedPointFormat
 
+	// RFC 7919, Section 4: if the client offered finite-field groups, DHE
+	// suites may only be selected if one of them is mutually supported.
+	hs.dheOk = !offersFFDHE(hs.clientHello.supportedCurves) || mutualFFDHEGroup(c.config, hs.clientHello.supportedCurves) != 0
+
 	foundCompression := false
 	// We only support null compression, so check that the client offered it.
 	for _, compression := range hs.clientHello.compressionMethods {
@@ -187,16 +219,38 @@ Curves:
 		return false, errors.New("tls: client does not support uncompressed connections")
 	}
 
-	hs.hello.vers = c.vers
+	hs.hello.vers = c.toWireVersion(c.vers)
 	hs.hello.random = make([]byte, 32)
 	_, err = io.ReadFull(c.config.rand(), hs.hello.random)
 	if err != nil {
 		c.sendAlert(alertInternalError)
 		return false, err
 	}
+	if c.handshakes == 0 {
+		if len(hs.clientHello.renegotiationInfo) != 0 {
+			c.sendAlert(alertHandshakeFailure)
+			return false, errors.New("tls: initial handshake had non-empty renegotiation extension")
+		}
+		c.secureRenegotiation = hs.clientHello.secureRenegotiation
+	} else if c.secureRenegotiation {
+		if !hs.clientHello.secureRenegotiation || !bytes.Equal(hs.clientHello.renegotiationInfo, c.clientFinished) {
+			c.sendAlert(alertHandshakeFailure)
+			return false, errors.New("tls: incorrect renegotiation extension contents")
+		}
+		hs.hello.renegotiationInfo = c.renegotiationInfo()
+	}
 	hs.hello.secureRenegotiation = hs.clientHello.secureRenegotiation
 	hs.hello.compressionMethod = compressionNone
+	if c.config.DeflateCompression && !c.isDTLS && compressionOffered(hs.clientHello.compressionMethods, compressionDeflate) {
+		hs.hello.compressionMethod = compressionDeflate
+	}
 	hs.hello.extendedMasterSecret = c.vers >= VersionTLS10 && hs.clientHello.extendedMasterSecret && c.config.ExtendedMasterSecret
+	if hs.clientHello.heartbeatEnabled && c.config.HeartbeatEnabled {
+		hs.hello.heartbeatEnabled = true
+		hs.hello.heartbeatMode = heartbeatModePeerAllowed
+		c.heartbeat = true
+		c.heartbleedLog.HeartbeatEnabled = true
+	}
 	if len(hs.clientHello.serverName) > 0 {
 		c.serverName = hs.clientHello.serverName
 	}
@@ -241,7 +295,7 @@ Curves:
 	}
 
 	for _, id := range preferenceList {
-		if hs.suite = c.tryCipherSuite(id, supportedList, c.vers, hs.ellipticOk, hs.ecdsaOk); hs.suite != nil {
+		if hs.suite = c.tryCipherSuite(id, supportedList, c.vers, hs.ellipticOk, hs.ecdsaOk, hs.dheOk); hs.suite != nil {
 			break
 		}
 	}
@@ -259,19 +313,19 @@ func (hs *serverHandshakeState) checkForResumption() bool {
 	c := hs.c
 
 	if c.config.SessionTicketsDisabled {
-		return false
+		return hs.resumptionFailed("session tickets are disabled")
 	}
 
 	var ok bool
 	if hs.sessionState, ok = c.decryptTicket(hs.clientHello.sessionTicket); !ok {
-		return false
+		return hs.resumptionFailed("session ticket could not be decrypted")
 	}
 
-	if hs.sessionState.vers > hs.clientHello.vers {
-		return false
+	if hs.sessionState.vers > c.fromWireVersion(hs.clientHello.vers) {
+		return hs.resumptionFailed("session version is above the client's maximum")
 	}
 	if vers, ok := c.config.mutualVersion(hs.sessionState.vers); !ok || vers != hs.sessionState.vers {
-		return false
+		return hs.resumptionFailed("session version is not supported")
 	}
 
 	cipherSuiteOk := false
@@ -283,37 +337,52 @@ func (hs *serverHandshakeState) checkForResumption() bool {
 		}
 	}
 	if !cipherSuiteOk {
-		return false
+		return hs.resumptionFailed("session cipher suite was not offered")
 	}
 
 	// Check that we also support the ciphersuite from the session.
-	hs.suite = c.tryCipherSuite(hs.sessionState.cipherSuite, c.config.cipherSuites(), hs.sessionState.vers, hs.ellipticOk, hs.ecdsaOk)
+	hs.suite = c.tryCipherSuite(hs.sessionState.cipherSuite, c.config.cipherSuites(), hs.sessionState.vers, hs.ellipticOk, hs.ecdsaOk, hs.dheOk)
 	if hs.suite == nil {
-		return false
+		return hs.resumptionFailed("session cipher suite is not supported")
 	}
 
 	sessionHasClientCerts := len(hs.sessionState.certificates) != 0
 	needClientCerts := c.config.ClientAuth == RequireAnyClientCert || c.config.ClientAuth == RequireAndVerifyClientCert
 	if needClientCerts && !sessionHasClientCerts {
-		return false
+		return hs.resumptionFailed("session has no client certificate")
 	}
 	if sessionHasClientCerts && c.config.ClientAuth == NoClientCert {
-		return false
+		return hs.resumptionFailed("session has a client certificate")
 	}
 
 	return true
 }
 
+// resumptionFailed records why a client's session could not be resumed, and
+// returns false.
+func (hs *serverHandshakeState) resumptionFailed(reason string) bool {
+	if r := hs.c.clientHandshakeLog.Resumption; r != nil {
+		r.Reason = reason
+	}
+	return false
+}
+
 func (hs *serverHandshakeState) doResumeHandshake() error {
 	c := hs.c
 
 	hs.hello.cipherSuite = hs.suite.id
+	hs.hello.encryptThenMAC = hs.acceptEncryptThenMAC()
 	// We echo the client's session ID in the ServerHello to let it know
 	// that we're doing a resumption.
 	hs.hello.sessionId = hs.clientHello.sessionId
-	hs.finishedHash.Write(hs.hello.marshal())
-	c.writeRecord(recordTypeHandshake, hs.hello.marshal())
+	helloBytes, err := c.marshalHandshake(hs.hello)
+	if err != nil {
+		return err
+	}
+	hs.finishedHash.Write(helloBytes)
+	c.writeRecord(recordTypeHandshake, helloBytes)
 	c.handshakeLog.ServerHello = hs.hello.MakeLog()
+	c.clientHandshakeLog.ServerHello = c.handshakeLog.ServerHello
 
 	if len(hs.sessionState.certificates) > 0 {
 		if _, err := hs.processCertsFromClient(hs.sessionState.certificates); err != nil {
@@ -336,23 +405,37 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 
 	hs.hello.ticketSupported = hs.clientHello.ticketSupported && !c.config.SessionTicketsDisabled
 	hs.hello.cipherSuite = hs.suite.id
+	hs.hello.encryptThenMAC = hs.acceptEncryptThenMAC()
 	c.extendedMasterSecret = hs.hello.extendedMasterSecret
-	hs.finishedHash.Write(hs.hello.marshal())
-	c.writeRecord(recordTypeHandshake, hs.hello.marshal())
+	helloBytes, err := c.marshalHandshake(hs.hello)
+	if err != nil {
+		return err
+	}
+	hs.finishedHash.Write(helloBytes)
+	c.writeRecord(recordTypeHandshake, helloBytes)
 	c.handshakeLog.ServerHello = hs.hello.MakeLog()
+	c.clientHandshakeLog.ServerHello = c.handshakeLog.ServerHello
 
 	certMsg := new(certificateMsg)
 	certMsg.certificates = hs.cert.Certificate
-	hs.finishedHash.Write(certMsg.marshal())
-	c.writeRecord(recordTypeHandshake, certMsg.marshal())
+	certMsgBytes, err := c.marshalHandshake(certMsg)
+	if err != nil {
+		return err
+	}
+	hs.finishedHash.Write(certMsgBytes)
+	c.writeRecord(recordTypeHandshake, certMsgBytes)
 	c.handshakeLog.ServerCertificates = certMsg.MakeLog()
 
 	if hs.hello.ocspStapling {
 		certStatus := new(certificateStatusMsg)
 		certStatus.statusType = statusTypeOCSP
 		certStatus.response = hs.cert.OCSPStaple
-		hs.finishedHash.Write(certStatus.marshal())
-		c.writeRecord(recordTypeHandshake, certStatus.marshal())
+		certStatusBytes, err := c.marshalHandshake(certStatus)
+		if err != nil {
+			return err
+		}
+		hs.finishedHash.Write(certStatusBytes)
+		c.writeRecord(recordTypeHandshake, certStatusBytes)
 	}
 
 	keyAgreement := hs.suite.ka(c.vers)
@@ -362,8 +445,12 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 		return err
 	}
 	if skx != nil {
-		hs.finishedHash.Write(skx.marshal())
-		c.writeRecord(recordTypeHandshake, skx.marshal())
+		skxBytes, err := c.marshalHandshake(skx)
+		if err != nil {
+			return err
+		}
+		hs.finishedHash.Write(skxBytes)
+		c.writeRecord(recordTypeHandshake, skxBytes)
 		c.handshakeLog.ServerKeyExchange = skx.MakeLog(keyAgreement)
 	}
 
@@ -387,13 +474,21 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 		if c.config.ClientCAs != nil {
 			certReq.certificateAuthorities = c.config.ClientCAs.Subjects()
 		}
-		hs.finishedHash.Write(certReq.marshal())
-		c.writeRecord(recordTypeHandshake, certReq.marshal())
+		certReqBytes, err := c.marshalHandshake(certReq)
+		if err != nil {
+			return err
+		}
+		hs.finishedHash.Write(certReqBytes)
+		c.writeRecord(recordTypeHandshake, certReqBytes)
 	}
 
 	helloDone := new(serverHelloDoneMsg)
-	hs.finishedHash.Write(helloDone.marshal())
-	c.writeRecord(recordTypeHandshake, helloDone.marshal())
+	helloDoneBytes, err := c.marshalHandshake(helloDone)
+	if err != nil {
+		return err
+	}
+	hs.finishedHash.Write(helloDoneBytes)
+	c.writeRecord(recordTypeHandshake, helloDoneBytes)
 
 	if _, err := c.flush(); err != nil {
 		return err
@@ -450,6 +545,7 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 		return err
 	}
 	c.handshakeLog.ClientKeyExchange = ckx.MakeLog(keyAgreement)
+	c.clientHandshakeLog.ClientKeyExchange = c.handshakeLog.ClientKeyExchange
 
 	hs.preMasterSecret = make([]byte, len(preMasterSecret))
 	copy(hs.preMasterSecret, preMasterSecret)
@@ -568,6 +664,11 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 func (hs *serverHandshakeState) establishKeys() error {
 	c := hs.c
 
+	if err := c.config.writeKeyLog(hs.clientHello.random, hs.masterSecret); err != nil {
+		c.sendAlert(alertInternalError)
+		return errors.New("tls: failed to write to key log: " + err.Error())
+	}
+
 	clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV :=
 		keysFromMasterSecret(c.vers, hs.suite, hs.masterSecret, hs.clientHello.random, hs.hello.random, hs.suite.macLen, hs.suite.keyLen, hs.suite.ivLen)
 
@@ -586,6 +687,10 @@ func (hs *serverHandshakeState) establishKeys() error {
 
 	c.in.prepareCipherSpec(c.vers, clientCipher, clientHash)
 	c.out.prepareCipherSpec(c.vers, serverCipher, serverHash)
+	c.in.prepareCompression(hs.hello.compressionMethod)
+	c.out.prepareCompression(hs.hello.compressionMethod)
+	c.in.prepareEncryptThenMAC(hs.hello.encryptThenMAC)
+	c.out.prepareEncryptThenMAC(hs.hello.encryptThenMAC)
 
 	return nil
 }
@@ -593,8 +698,7 @@ func (hs *serverHandshakeState) establishKeys() error {
 func (hs *serverHandshakeState) readFinished() error {
 	c := hs.c
 
-	c.readRecord(recordTypeChangeCipherSpec)
-	if err := c.in.error(); err != nil {
+	if err := c.readRecord(recordTypeChangeCipherSpec); err != nil {
 		return err
 	}
 
@@ -622,6 +726,7 @@ func (hs *serverHandshakeState) readFinished() error {
 		return unexpectedMessageError(clientFinished, msg)
 	}
 	c.handshakeLog.ClientFinished = clientFinished.MakeLog()
+	c.clientHandshakeLog.ClientFinished = c.handshakeLog.ClientFinished
 
 	verify := hs.finishedHash.clientSum(hs.masterSecret)
 	if len(verify) != len(clientFinished.verifyData) ||
@@ -629,6 +734,7 @@ func (hs *serverHandshakeState) readFinished() error {
 		c.sendAlert(alertHandshakeFailure)
 		return errors.New("tls: client's Finished message is incorrect")
 	}
+	c.clientFinished = clientFinished.verifyData
 
 	hs.finishedHash.Write(clientFinished.marshal())
 	return nil
@@ -654,8 +760,12 @@ func (hs *serverHandshakeState) sendSessionTicket() error {
 		return err
 	}
 
-	hs.finishedHash.Write(m.marshal())
-	c.writeRecord(recordTypeHandshake, m.marshal())
+	ticketBytes, err := c.marshalHandshake(m)
+	if err != nil {
+		return err
+	}
+	hs.finishedHash.Write(ticketBytes)
+	c.writeRecord(recordTypeHandshake, ticketBytes)
 
 	return nil
 }
@@ -667,9 +777,14 @@ func (hs *serverHandshakeState) sendFinished() error {
 
 	finished := new(finishedMsg)
 	finished.verifyData = hs.finishedHash.serverSum(hs.masterSecret)
-	hs.finishedHash.Write(finished.marshal())
-	c.writeRecord(recordTypeHandshake, finished.marshal())
+	finishedBytes, err := c.marshalHandshake(finished)
+	if err != nil {
+		return err
+	}
+	hs.finishedHash.Write(finishedBytes)
+	c.writeRecord(recordTypeHandshake, finishedBytes)
 	c.handshakeLog.ServerFinished = finished.MakeLog()
+	c.serverFinished = finished.verifyData
 
 	c.cipherSuite = hs.suite.id
 
@@ -683,6 +798,7 @@ func (hs *serverHandshakeState) processCertsFromClient(certificates [][]byte) (c
 	c := hs.c
 
 	hs.certsFromClient = certificates
+	c.clientHandshakeLog.ClientCertificates = (&certificateMsg{certificates: certificates}).MakeLog()
 	certs := make([]*x509.Certificate, len(certificates))
 	var err error
 	for i, asn1Data := range certificates {
@@ -691,6 +807,7 @@ func (hs *serverHandshakeState) processCertsFromClient(certificates [][]byte) (c
 			return nil, errors.New("tls: failed to parse client certificate: " + err.Error())
 		}
 	}
+	c.clientHandshakeLog.ClientCertificates.addParsed(certs, nil)
 
 	if c.config.ClientAuth >= VerifyClientCertIfGiven && len(certs) > 0 {
 		opts := x509.VerifyOptions{
@@ -759,7 +876,7 @@ func (hs *serverHandshakeState) writeHash(msg []byte, seqno uint16) {
 
 // tryCipherSuite returns a cipherSuite with the given id if that cipher suite
 // is acceptable to use.
-func (c *Conn) tryCipherSuite(id uint16, supportedCipherSuites []uint16, version uint16, ellipticOk, ecdsaOk bool) *cipherSuite {
+func (c *Conn) tryCipherSuite(id uint16, supportedCipherSuites []uint16, version uint16, ellipticOk, ecdsaOk, dheOk bool) *cipherSuite {
 	for _, supported := range supportedCipherSuites {
 		if id == supported {
 			var candidate *cipherSuite
@@ -781,9 +898,15 @@ func (c *Conn) tryCipherSuite(id uint16, supportedCipherSuites []uint16, version
 			if (candidate.flags&suiteECDSA != 0) != ecdsaOk {
 				continue
 			}
+			if isDHECipherSuite(candidate.id) && !dheOk {
+				continue
+			}
 			if version < VersionTLS12 && candidate.flags&suiteTLS12 != 0 {
 				continue
 			}
+			if c.isDTLS && candidate.flags&suiteNoDTLS != 0 {
+				continue
+			}
 			return candidate
 		}
 	}
@@ -800,10 +923,10 @@ func (hs *serverHandshakeState) clientHelloInfo() *ClientHelloInfo {
 	}
 
 	var supportedVersions []uint16
-	if hs.clientHello.vers > VersionTLS12 {
+	if vers := hs.c.fromWireVersion(hs.clientHello.vers); vers > VersionTLS12 {
 		supportedVersions = suppVersArray[:]
-	} else if hs.clientHello.vers >= VersionSSL30 {
-		supportedVersions = suppVersArray[VersionTLS12-hs.clientHello.vers:]
+	} else if vers >= VersionSSL30 {
+		supportedVersions = suppVersArray[VersionTLS12-vers:]
 	}
 
 	signatureSchemes := make([]SignatureScheme, 0, len(hs.clientHello.signatureAndHashes))
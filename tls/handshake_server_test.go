@@ -23,6 +23,7 @@ import (
 	"testing"
 	"time"
 
+	jsonKeys "github.com/zmap/zcrypto/json"
 	"github.com/zmap/zcrypto/x509"
 )
 
@@ -122,7 +123,7 @@ func TestTLS12OnlyCipherSuites(t *testing.T) {
 			TLS_RSA_WITH_RC4_128_SHA,
 		},
 		compressionMethods: []uint8{compressionNone},
-		supportedCurves:    []CurveID{CurveP256, CurveP384, CurveP521},
+		supportedCurves:    []CurveID{CurveP256r1, CurveP384r1, CurveP521r1},
 		supportedPoints:    []uint8{pointFormatUncompressed},
 	}
 
@@ -242,6 +243,105 @@ func TestCipherSuitePreference(t *testing.T) {
 	}
 }
 
+// testDHEHandshake runs a handshake and returns the DH parameters logged by
+// the client, along with the server's error.
+func testDHEHandshake(clientConfig, serverConfig *Config) (*jsonKeys.DHParams, error) {
+	c, s := net.Pipe()
+	done := make(chan *ServerHandshake)
+	go func() {
+		cli := Client(c, clientConfig)
+		cli.Handshake()
+		c.Close()
+		done <- cli.GetHandshakeLog()
+	}()
+	server := Server(s, serverConfig)
+	err := server.Handshake()
+	s.Close()
+	log := <-done
+	if log == nil || log.ServerKeyExchange == nil {
+		return nil, err
+	}
+	return log.ServerKeyExchange.DHParams, err
+}
+
+func TestDHParamsAnalysisCached(t *testing.T) {
+	ka := &dheKeyAgreement{p: big.NewInt(23), g: big.NewInt(5)}
+	first := ka.DHParams().Analysis
+	if first == nil || !first.SafePrime {
+		t.Fatalf("got analysis %+v", first)
+	}
+	if second := ka.DHParams().Analysis; second != first {
+		t.Error("the group was analyzed again")
+	}
+}
+
+func TestFFDHENegotiation(t *testing.T) {
+	serverConfig := &Config{
+		CipherSuites: []uint16{TLS_DHE_RSA_WITH_AES_128_CBC_SHA},
+		Certificates: testConfig.Certificates,
+	}
+	clientConfig := &Config{
+		CipherSuites:       []uint16{TLS_DHE_RSA_WITH_AES_128_CBC_SHA},
+		InsecureSkipVerify: true,
+	}
+	params, err := testDHEHandshake(clientConfig, serverConfig)
+	if err != nil {
+		t.Fatalf("handshake failed: %s", err)
+	}
+	if params.NamedGroup != jsonKeys.FFDHE2048 {
+		t.Errorf("got group %d, expected ffdhe2048", params.NamedGroup)
+	}
+	if params.Analysis == nil || params.Analysis.KnownGroup != "ffdhe2048" {
+		t.Errorf("parameters were not analyzed as ffdhe2048")
+	}
+
+	clientConfig.CurvePreferences = []CurveID{CurveP256r1, CurveFFDHE3072}
+	params, err = testDHEHandshake(clientConfig, serverConfig)
+	if err != nil {
+		t.Fatalf("handshake failed: %s", err)
+	}
+	if params.NamedGroup != jsonKeys.FFDHE3072 {
+		t.Errorf("got group %d, expected ffdhe3072", params.NamedGroup)
+	}
+
+	// A client that offers no finite-field groups gets the legacy group.
+	clientConfig.CurvePreferences = []CurveID{CurveP256r1}
+	clientConfig.ExplicitCurvePreferences = true
+	params, err = testDHEHandshake(clientConfig, serverConfig)
+	if err != nil {
+		t.Fatalf("handshake failed: %s", err)
+	}
+	if params.NamedGroup != 0 || params.Prime.BitLen() != 2048 {
+		t.Errorf("got group %d, expected unnamed 2048-bit group", params.NamedGroup)
+	}
+
+	// A server that supports none of the client's groups must not pick DHE.
+	clientConfig.CurvePreferences = []CurveID{CurveFFDHE8192}
+	serverConfig.CurvePreferences = []CurveID{CurveP256r1, CurveFFDHE2048}
+	if _, err = testDHEHandshake(clientConfig, serverConfig); err == nil || !strings.Contains(err.Error(), "no cipher suite") {
+		t.Errorf("expected cipher suite negotiation failure, got %v", err)
+	}
+}
+
+func TestFFDHEGroupMismatch(t *testing.T) {
+	group, ok := ffdheGroupForCurveID(CurveFFDHE3072)
+	if !ok {
+		t.Fatal("ffdhe3072 is not known")
+	}
+	ka := &dheKeyAgreement{p: group.Prime, g: group.Generator}
+	hello := &clientHelloMsg{supportedCurves: []CurveID{CurveP256r1, CurveFFDHE2048}}
+	if err := ka.checkGroup(hello); err == nil {
+		t.Error("server's choice of an unoffered group was accepted")
+	}
+	hello.supportedCurves = append(hello.supportedCurves, CurveFFDHE3072)
+	if err := ka.checkGroup(hello); err != nil {
+		t.Errorf("offered group was rejected: %s", err)
+	}
+	if ka.groupID != CurveFFDHE3072 {
+		t.Errorf("got group %d, expected ffdhe3072", ka.groupID)
+	}
+}
+
 // Note: see comment in handshake_test.go for details of how the reference
 // tests work.
 
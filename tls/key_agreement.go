@@ -21,6 +21,7 @@ import (
 	"strings"
 
 	"github.com/zmap/zcrypto/ecdh"
+	jsonKeys "github.com/zmap/zcrypto/json"
 	"github.com/zmap/zcrypto/x509"
 )
 
@@ -177,7 +178,12 @@ func (ka *rsaKeyAgreement) generateClientKeyExchange(config *Config, clientHello
 			return nil, nil, errClientKeyExchange
 		}
 	}
-	encrypted, err := rsa.EncryptPKCS1v15(config.rand(), publicKey, preMasterSecret)
+	var encrypted []byte
+	if config.ROBOTVariant != ROBOTDisabled {
+		encrypted, err = robotEncrypt(config.rand(), publicKey, preMasterSecret, config.ROBOTVariant)
+	} else {
+		encrypted, err = rsa.EncryptPKCS1v15(config.rand(), publicKey, preMasterSecret)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -281,6 +287,16 @@ func hashForServerKeyExchange(sigType, hashFunc uint8, version uint16, slices ..
 			return sha1Hash(slices), crypto.SHA1, nil
 		case hashMD5:
 			return md5Hash(slices), crypto.MD5, nil
+		case hashIntrinsic:
+			switch sigType {
+			case signatureRSAPSSRSAESHA256, signatureRSAPSSPSSSHA256:
+				return sha256Hash(slices), crypto.SHA256, nil
+			case signatureRSAPSSRSAESHA384, signatureRSAPSSPSSSHA384:
+				return sha384Hash(slices), crypto.SHA384, nil
+			case signatureRSAPSSRSAESHA512, signatureRSAPSSPSSSHA512:
+				return sha512Hash(slices), crypto.SHA512, nil
+			}
+			return nil, crypto.Hash(0), errors.New("tls: unknown hash function used by peer")
 		default:
 			return nil, crypto.Hash(0), errors.New("tls: unknown hash function used by peer")
 		}
@@ -314,6 +330,11 @@ func pickTLS12HashForSignature(sigType uint8, clientList, serverList []signature
 	return 0, errors.New("tls: client doesn't support any common hash functions")
 }
 
+// isRSAPSS returns true if sh is one of the RSASSA-PSS signature schemes.
+func isRSAPSS(sh signatureAndHash) bool {
+	return isSupportedSignatureAndHash(sh, rsaPSSSignatureAlgorithms)
+}
+
 func curveForCurveID(id CurveID) (ecdh.Curve, bool) {
 	switch id {
 	case CurveT163k1:
@@ -359,6 +380,64 @@ func curveForCurveID(id CurveID) (ecdh.Curve, bool) {
 	}
 }
 
+// ffdheGroupForCurveID returns the finite-field group named by id.
+func ffdheGroupForCurveID(id CurveID) (*jsonKeys.DHGroup, bool) {
+	if !isFFDHE(id) {
+		return nil, false
+	}
+	name, ok := curveNames[uint16(id)]
+	if !ok {
+		return nil, false
+	}
+	for _, group := range jsonKeys.KnownDHGroups() {
+		if group.Name == name {
+			return group, true
+		}
+	}
+	return nil, false
+}
+
+// ffdheCurveIDForGroup returns the ID of the RFC 7919 group with prime p and
+// generator g, or zero if (p, g) is not a named group.
+func ffdheCurveIDForGroup(p, g *big.Int) CurveID {
+	known := jsonKeys.LookupDHGroup(p)
+	if known == nil || g.Cmp(known.Generator) != 0 {
+		return 0
+	}
+	for _, id := range defaultFFDHEPreferences {
+		if curveNames[uint16(id)] == known.Name {
+			return id
+		}
+	}
+	return 0
+}
+
+// offersFFDHE returns true if any of groups is a finite-field group.
+func offersFFDHE(groups []CurveID) bool {
+	for _, id := range groups {
+		if isFFDHE(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// mutualFFDHEGroup returns the first finite-field group in the server's
+// preferences that is also in groups, or zero if there is none.
+func mutualFFDHEGroup(config *Config, groups []CurveID) CurveID {
+	for _, candidate := range config.ffdhePreferences() {
+		if _, ok := ffdheGroupForCurveID(candidate); !ok {
+			continue
+		}
+		for _, id := range groups {
+			if id == candidate {
+				return id
+			}
+		}
+	}
+	return 0
+}
+
 // keyAgreementAuthentication is a helper interface that specifies how
 // to authenticate the ServerKeyExchange parameters.
 type keyAgreementAuthentication interface {
@@ -457,6 +536,8 @@ func (ka *signedKeyAgreement) verifyParameters(config *Config, clientHello *clie
 	}
 
 	var tls12HashId uint8
+	sigType := ka.sigType
+	pss := false
 	if ka.version >= VersionTLS12 {
 		// handle SignatureAndHashAlgorithm
 		var sigAndHash []uint8
@@ -464,16 +545,18 @@ func (ka *signedKeyAgreement) verifyParameters(config *Config, clientHello *clie
 		tls12HashId = sigAndHash[0]
 		ka.sh.hash = tls12HashId
 		ka.sh.signature = sigAndHash[1]
-		if sigAndHash[1] != ka.sigType {
+		pss = ka.sigType == signatureRSA && isRSAPSS(ka.sh)
+		if sigAndHash[1] != ka.sigType && !pss {
 			return nil, errServerKeyExchange
 		}
 		if len(sig) < 2 {
 			return nil, errServerKeyExchange
 		}
 
-		if !isSupportedSignatureAndHash(signatureAndHash{ka.sigType, tls12HashId}, config.signatureAndHashesForClient()) {
+		if !isSupportedSignatureAndHash(ka.sh, config.signatureAndHashesForClient()) {
 			return nil, errors.New("tls: unsupported hash function for ServerKeyExchange")
 		}
+		sigType = sigAndHash[1]
 	}
 	sigLen := int(sig[0])<<8 | int(sig[1])
 	if sigLen+2 != len(sig) {
@@ -482,7 +565,7 @@ func (ka *signedKeyAgreement) verifyParameters(config *Config, clientHello *clie
 	sig = sig[2:]
 	ka.raw = sig
 
-	digest, hashFunc, err := hashForServerKeyExchange(ka.sigType, tls12HashId, ka.version, clientHello.random, serverHello.random, params)
+	digest, hashFunc, err := hashForServerKeyExchange(sigType, tls12HashId, ka.version, clientHello.random, serverHello.random, params)
 	if err != nil {
 		return nil, err
 	}
@@ -508,7 +591,11 @@ func (ka *signedKeyAgreement) verifyParameters(config *Config, clientHello *clie
 		if !ok {
 			return nil, errors.New("ECDHE RSA requires a RSA server public key")
 		}
-		if err := rsa.VerifyPKCS1v15(pubKey, hashFunc, digest, sig); err != nil {
+		if pss {
+			if err := rsa.VerifyPSS(pubKey, hashFunc, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+				return nil, err
+			}
+		} else if err := rsa.VerifyPKCS1v15(pubKey, hashFunc, digest, sig); err != nil {
 			return nil, err
 		}
 	case signatureDSA:
@@ -557,6 +644,9 @@ func (ka *ecdheKeyAgreement) generateServerKeyExchange(config *Config, cert *Cer
 
 NextCandidate:
 	for _, candidate := range preferredCurves {
+		if isFFDHE(candidate) {
+			continue
+		}
 		for _, c := range clientHello.supportedCurves {
 			if candidate == c {
 				curveid = c
@@ -754,17 +844,30 @@ type dheKeyAgreement struct {
 	xOurs       *big.Int
 	yServer     *big.Int
 	yClient     *big.Int
+	groupID     CurveID
 	verifyError error
+
+	// analysis caches the analysis of (p, g) for DHParams, since testing
+	// an unknown prime is costly.
+	analysis *jsonKeys.DHAnalysis
 }
 
 func (ka *dheKeyAgreement) generateServerKeyExchange(config *Config, cert *Certificate, clientHello *clientHelloMsg, hello *serverHelloMsg) (*serverKeyExchangeMsg, error) {
 	var q *big.Int
-	// 2048-bit MODP Group with 256-bit Prime Order Subgroup (RFC
-	// 5114, Section 2.3)
-	// TODO: Take a prime in the config
-	ka.p, _ = new(big.Int).SetString("87A8E61DB4B6663CFFBBD19C651959998CEEF608660DD0F25D2CEED4435E3B00E00DF8F1D61957D4FAF7DF4561B2AA3016C3D91134096FAA3BF4296D830E9A7C209E0C6497517ABD5A8A9D306BCF67ED91F9E6725B4758C022E0B1EF4275BF7B6C5BFC11D45F9088B941F54EB1E59BB8BC39A0BF12307F5C4FDB70C581B23F76B63ACAE1CAA6B7902D52526735488A0EF13C6D9A51BFA4AB3AD8347796524D8EF6A167B5A41825D967E144E5140564251CCACB83E6B486F6B3CA3F7971506026C0B857F689962856DED4010ABD0BE621C3A3960A54E710C375F26375D7014103A4B54330C198AF126116D2276E11715F693877FAD7EF09CADB094AE91E1A1597", 16)
-	ka.g, _ = new(big.Int).SetString("3FB32C9B73134D0B2E77506660EDBD484CA7B18F21EF205407F4793A1A0BA12510DBC15077BE463FFF4FED4AAC0BB555BE3A6C1B0C6B47B1BC3773BF7E8C6F62901228F8C28CBB18A55AE31341000A650196F931C77A57F2DDF463E5E9EC144B777DE62AAAB8A8628AC376D282D6ED3864E67982428EBC831D14348F6F2F9193B5045AF2767164E1DFC967C1FB3F2E55A4BD1BFFE83B9C80D052B985D182EA0ADB2A3B7313D3FE14C8484B1E052588B9B7D2BBD2DF016199ECD06E1557CD0915B3353BBB64E0EC377FD028370DF92B52C7891428CDC67EB6184B523D1DB246C32F63078490F00EF8D647D148D47954515E2327CFEF98C582664B4C0F6CC41659", 16)
-	q, _ = new(big.Int).SetString("8CF83642A709A097B447997640129DA299B1A47D1EB3750BA308B0FE64F5FBD3", 16)
+	if ka.groupID = mutualFFDHEGroup(config, clientHello.supportedCurves); ka.groupID != 0 {
+		group, _ := ffdheGroupForCurveID(ka.groupID)
+		ka.p, ka.g, q = group.Prime, group.Generator, group.Order
+	} else if offersFFDHE(clientHello.supportedCurves) {
+		// RFC 7919, Section 4: a DHE suite can't be used with a client that
+		// offered finite-field groups, none of which we support.
+		return nil, errors.New("tls: no supported finite-field groups offered")
+	} else {
+		// 2048-bit MODP Group with 256-bit Prime Order Subgroup (RFC
+		// 5114, Section 2.3)
+		ka.p, _ = new(big.Int).SetString("87A8E61DB4B6663CFFBBD19C651959998CEEF608660DD0F25D2CEED4435E3B00E00DF8F1D61957D4FAF7DF4561B2AA3016C3D91134096FAA3BF4296D830E9A7C209E0C6497517ABD5A8A9D306BCF67ED91F9E6725B4758C022E0B1EF4275BF7B6C5BFC11D45F9088B941F54EB1E59BB8BC39A0BF12307F5C4FDB70C581B23F76B63ACAE1CAA6B7902D52526735488A0EF13C6D9A51BFA4AB3AD8347796524D8EF6A167B5A41825D967E144E5140564251CCACB83E6B486F6B3CA3F7971506026C0B857F689962856DED4010ABD0BE621C3A3960A54E710C375F26375D7014103A4B54330C198AF126116D2276E11715F693877FAD7EF09CADB094AE91E1A1597", 16)
+		ka.g, _ = new(big.Int).SetString("3FB32C9B73134D0B2E77506660EDBD484CA7B18F21EF205407F4793A1A0BA12510DBC15077BE463FFF4FED4AAC0BB555BE3A6C1B0C6B47B1BC3773BF7E8C6F62901228F8C28CBB18A55AE31341000A650196F931C77A57F2DDF463E5E9EC144B777DE62AAAB8A8628AC376D282D6ED3864E67982428EBC831D14348F6F2F9193B5045AF2767164E1DFC967C1FB3F2E55A4BD1BFFE83B9C80D052B985D182EA0ADB2A3B7313D3FE14C8484B1E052588B9B7D2BBD2DF016199ECD06E1557CD0915B3353BBB64E0EC377FD028370DF92B52C7891428CDC67EB6184B523D1DB246C32F63078490F00EF8D647D148D47954515E2327CFEF98C582664B4C0F6CC41659", 16)
+		q, _ = new(big.Int).SetString("8CF83642A709A097B447997640129DA299B1A47D1EB3750BA308B0FE64F5FBD3", 16)
+	}
 
 	var err error
 	ka.xOurs, err = rand.Int(config.rand(), q)
@@ -847,6 +950,9 @@ func (ka *dheKeyAgreement) processServerKeyExchange(config *Config, clientHello
 	if ka.yTheirs.Sign() <= 0 || ka.yTheirs.Cmp(ka.p) >= 0 {
 		return errServerKeyExchange
 	}
+	if err := ka.checkGroup(clientHello); err != nil {
+		return err
+	}
 
 	sig := k
 	serverDHParams := skx.key[:len(skx.key)-len(sig)]
@@ -857,6 +963,23 @@ func (ka *dheKeyAgreement) processServerKeyExchange(config *Config, clientHello
 	return ka.verifyError
 }
 
+// checkGroup records the named group the server selected. RFC 7919, Section 4:
+// a server that implements RFC 7919 must pick one of the finite-field groups
+// the client offered. Parameters that match no named group come from a server
+// that predates RFC 7919, and are accepted.
+func (ka *dheKeyAgreement) checkGroup(clientHello *clientHelloMsg) error {
+	ka.groupID = ffdheCurveIDForGroup(ka.p, ka.g)
+	if ka.groupID == 0 || !offersFFDHE(clientHello.supportedCurves) {
+		return nil
+	}
+	for _, id := range clientHello.supportedCurves {
+		if id == ka.groupID {
+			return nil
+		}
+	}
+	return errors.New("tls: server selected a finite-field group that was not offered")
+}
+
 func (ka *dheKeyAgreement) generateClientKeyExchange(config *Config, clientHello *clientHelloMsg, cert *x509.Certificate) ([]byte, *clientKeyExchangeMsg, error) {
 	if ka.p == nil || ka.g == nil || ka.yTheirs == nil {
 		return nil, nil, errors.New("missing ServerKeyExchange message")
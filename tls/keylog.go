@@ -0,0 +1,102 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// keyLogLabelTLS12 labels the master secrets of TLS 1.2 and earlier in an
+// NSS key log.
+const keyLogLabelTLS12 = "CLIENT_RANDOM"
+
+// keyLogMutex serializes writes to all key logs. Key logs are only for
+// debugging, so sharing one mutex is good enough.
+var keyLogMutex sync.Mutex
+
+// writeKeyLog writes the master secret of a handshake to the KeyLogWriter,
+// if there is one.
+func (c *Config) writeKeyLog(clientRandom, masterSecret []byte) error {
+	if c.KeyLogWriter == nil {
+		return nil
+	}
+	line := fmt.Sprintf("%s %x %x\n", keyLogLabelTLS12, clientRandom, masterSecret)
+
+	keyLogMutex.Lock()
+	defer keyLogMutex.Unlock()
+	_, err := io.WriteString(c.KeyLogWriter, line)
+	return err
+}
+
+// KeyLog maps the client random of each handshake to its master secret, as
+// an NSS key log does. It is keyed by the hex encoded client random.
+type KeyLog map[string][]byte
+
+// Add adds the master secret of the handshake with clientRandom.
+func (k KeyLog) Add(clientRandom, masterSecret []byte) {
+	k[hex.EncodeToString(clientRandom)] = masterSecret
+}
+
+// AddHandshakeLog adds the master secret of a logged handshake, and those of
+// its renegotiations. Handshakes without key material are skipped.
+func (k KeyLog) AddHandshakeLog(log *ServerHandshake) {
+	if log.ClientHello != nil && log.KeyMaterial != nil && log.KeyMaterial.MasterSecret != nil {
+		k.Add(log.ClientHello.Random, log.KeyMaterial.MasterSecret.Value)
+	}
+	for _, renegotiation := range log.Renegotiations {
+		k.AddHandshakeLog(renegotiation)
+	}
+}
+
+// MasterSecret returns the master secret of the handshake with
+// clientRandom, or nil if it is not in the log.
+func (k KeyLog) MasterSecret(clientRandom []byte) []byte {
+	return k[hex.EncodeToString(clientRandom)]
+}
+
+// ReadKeyLog reads the CLIENT_RANDOM lines of an NSS key log. Comments and
+// lines with other labels are ignored.
+func ReadKeyLog(r io.Reader) (KeyLog, error) {
+	k := make(KeyLog)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != keyLogLabelTLS12 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, errors.New("tls: malformed key log line: " + scanner.Text())
+		}
+		clientRandom, err := hex.DecodeString(fields[1])
+		if err != nil || len(clientRandom) != tlsRandomLength {
+			return nil, errors.New("tls: malformed client random in key log: " + fields[1])
+		}
+		masterSecret, err := hex.DecodeString(fields[2])
+		if err != nil || len(masterSecret) != masterSecretLength {
+			return nil, errors.New("tls: malformed master secret in key log: " + fields[2])
+		}
+		k.Add(clientRandom, masterSecret)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
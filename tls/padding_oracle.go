@@ -0,0 +1,295 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"time"
+)
+
+// RecordFault describes how WriteFaultyRecord corrupts a CBC record.
+type RecordFault int
+
+const (
+	// RecordFaultNone sends a well-formed record.
+	RecordFaultNone RecordFault = iota
+
+	// RecordFaultInvalidMAC sends valid padding and an invalid MAC.
+	RecordFaultInvalidMAC
+
+	// RecordFaultInvalidPadding sends an invalid MAC and padding whose
+	// first byte does not match the padding length.
+	RecordFaultInvalidPadding
+
+	// RecordFaultPOODLE sends a valid MAC and padding whose first byte does
+	// not match the padding length. Servers that only check the last byte
+	// of the padding, as SSL 3.0 does, accept the record.
+	RecordFaultPOODLE
+
+	// RecordFaultLongPadding sends an invalid MAC and valid padding of
+	// nearly 256 bytes. The server has less data to MAC than with
+	// RecordFaultInvalidMAC, which makes its response faster if the MAC
+	// is not computed in constant time (Lucky Thirteen).
+	RecordFaultLongPadding
+)
+
+// paddingOracleFaults are the faults sent by Enumerator.PaddingOracle.
+var paddingOracleFaults = []RecordFault{
+	RecordFaultInvalidMAC,
+	RecordFaultInvalidPadding,
+	RecordFaultPOODLE,
+	RecordFaultLongPadding,
+}
+
+func (f RecordFault) String() string {
+	if name, ok := recordFaultNames[int(f)]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (f RecordFault) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.String())
+}
+
+func (f *RecordFault) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	for value, n := range recordFaultNames {
+		if n == name {
+			*f = RecordFault(value)
+			return nil
+		}
+	}
+	return errors.New("tls: unknown record fault " + name)
+}
+
+func (f RecordFault) corruptsMAC() bool {
+	return f == RecordFaultInvalidMAC || f == RecordFaultInvalidPadding || f == RecordFaultLongPadding
+}
+
+// padWithFault is like padToBlockSize, but pads payload as fault describes.
+// finalBlock may be longer than one block.
+func padWithFault(payload []byte, blockSize int, fault RecordFault) (prefix, finalBlock []byte) {
+	overrun := len(payload) % blockSize
+	prefix = payload[:len(payload)-overrun]
+
+	paddingLen := blockSize - overrun
+	switch fault {
+	case RecordFaultLongPadding:
+		paddingLen += (256 - paddingLen) / blockSize * blockSize
+	case RecordFaultInvalidPadding, RecordFaultPOODLE:
+		// Leave at least one byte before the length to corrupt.
+		if paddingLen < 2 {
+			paddingLen += blockSize
+		}
+	}
+	finalBlock = make([]byte, overrun+paddingLen)
+	for i := range finalBlock {
+		finalBlock[i] = byte(paddingLen - 1)
+	}
+	copy(finalBlock, payload[len(payload)-overrun:])
+	if fault == RecordFaultInvalidPadding || fault == RecordFaultPOODLE {
+		finalBlock[overrun] ^= 0xff
+	}
+	return
+}
+
+// WriteFaultyRecord sends data in one application data record, corrupted as
+// fault describes. It requires a CBC cipher suite and TLS 1.0 or later, and
+// is meant for probing how servers handle malformed records: the connection
+// should not be written to afterwards.
+func (c *Conn) WriteFaultyRecord(fault RecordFault, data []byte) error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if err := c.out.err; err != nil {
+		return err
+	}
+	if _, ok := c.out.cipher.(cbcMode); !ok || c.vers < VersionTLS10 {
+		return errors.New("tls: faulty records require a CBC cipher suite and TLS 1.0 or later")
+	}
+	c.out.fault = fault
+	_, err := c.writeRecord(recordTypeApplicationData, data)
+	return c.out.setErrorLocked(err)
+}
+
+// PaddingOracleResponse records how a server answered one kind of faulty
+// record. Response is as for ROBOTResponse, or "application_data" if the
+// server accepted the record and replied, or "inconsistent" if the samples
+// did not all get the same response. Median is the median time from sending
+// the record to the response.
+type PaddingOracleResponse struct {
+	Fault    RecordFault   `json:"fault"`
+	Response string        `json:"response"`
+	Alert    *Alert        `json:"alert,omitempty"`
+	Samples  int           `json:"samples"`
+	Median   time.Duration `json:"median_ns"`
+}
+
+// PaddingOracleResult is the result of Enumerator.PaddingOracle.
+//
+// AlertOracle is true if the server answers records with invalid padding
+// differently from records with only an invalid MAC. POODLE is true if the
+// server accepts records with invalid padding and a valid MAC. TimingOracle
+// is true if the median response to invalid or long padding differs from the
+// median response to an invalid MAC by more than 20%; it is only computed
+// with at least 10 samples, and is meaningless over a noisy network.
+type PaddingOracleResult struct {
+	Version      TLSVersion              `json:"version"`
+	CipherSuite  CipherSuite             `json:"cipher_suite"`
+	AlertOracle  bool                    `json:"alert_oracle"`
+	POODLE       bool                    `json:"poodle"`
+	TimingOracle bool                    `json:"timing_oracle"`
+	Responses    []PaddingOracleResponse `json:"responses"`
+}
+
+// paddingOracleTimingSamples is the number of samples needed to compare
+// timings, and paddingOracleTimingThreshold the relative difference that
+// counts as an oracle.
+const (
+	paddingOracleTimingSamples   = 10
+	paddingOracleTimingThreshold = 0.2
+)
+
+// paddingOraclePayload is sent in each faulty record, so that a server that
+// accepts the record has something to answer.
+var paddingOraclePayload = []byte("GET / HTTP/1.0\r\n\r\n")
+
+// cbcCipherSuites returns the implemented suites with a CBC cipher, which
+// are the only non-AEAD suites with an IV.
+func cbcCipherSuites() []uint16 {
+	var suites []uint16
+	for _, suite := range implementedCipherSuites {
+		if suite.isCBC() {
+			suites = append(suites, suite.id)
+		}
+	}
+	return suites
+}
+
+// PaddingOracle probes the server for CBC padding oracles. It completes a
+// handshake with a CBC cipher suite, sends one faulty record of each kind
+// and records the response, samples times for each kind. It returns nil if
+// the server refuses every CBC suite at TLS 1.0 or later, and an error if the
+// first handshake fails for any other reason. Since a server that accepts a
+// record may not reply, Timeout should be set.
+func (e *Enumerator) PaddingOracle(samples int) (*PaddingOracleResult, error) {
+	if samples < 1 {
+		samples = 1
+	}
+	config := e.baseConfig()
+	config.MinVersion = VersionTLS10
+	config.CipherSuites = cbcCipherSuites()
+
+	var result *PaddingOracleResult
+	medians := make(map[RecordFault]time.Duration)
+	for _, fault := range paddingOracleFaults {
+		response := PaddingOracleResponse{Fault: fault, Samples: samples}
+		durations := make([]time.Duration, 0, samples)
+		for i := 0; i < samples; i++ {
+			conn, err := e.Dial()
+			if err != nil {
+				return nil, err
+			}
+			if e.Timeout > 0 {
+				conn.SetDeadline(time.Now().Add(e.Timeout))
+			}
+			c := Client(conn, config)
+			err = c.WriteFaultyRecord(fault, paddingOraclePayload)
+			if err != nil && result == nil {
+				conn.Close()
+				// A server without a CBC suite refuses the hello with a
+				// handshake_failure alert.
+				if opErr, ok := err.(*net.OpError); ok && opErr.Op == "remote error" && opErr.Err == alertHandshakeFailure {
+					return nil, nil
+				}
+				return nil, err
+			}
+			kind, a := "incomplete", (*Alert)(nil)
+			if err == nil {
+				start := time.Now()
+				var n int
+				n, err = c.Read(make([]byte, 1))
+				durations = append(durations, time.Since(start))
+				if n > 0 {
+					kind = "application_data"
+				} else {
+					kind, a = describeProbeError(err)
+				}
+			}
+			conn.Close()
+
+			if result == nil {
+				state := c.ConnectionState()
+				result = &PaddingOracleResult{
+					Version:     TLSVersion(state.Version),
+					CipherSuite: CipherSuite(state.CipherSuite),
+				}
+				// Keep the server's choice for the remaining probes.
+				config.MinVersion, config.MaxVersion = state.Version, state.Version
+				config.CipherSuites = []uint16{state.CipherSuite}
+			}
+			if i == 0 {
+				response.Response, response.Alert = kind, a
+			} else if kind != response.Response || a != nil && (response.Alert == nil || a.Code != response.Alert.Code) {
+				response.Response, response.Alert = "inconsistent", nil
+			}
+		}
+		if len(durations) > 0 {
+			sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+			response.Median = durations[len(durations)/2]
+		}
+		medians[fault] = response.Median
+		result.Responses = append(result.Responses, response)
+	}
+
+	byFault := make(map[RecordFault]*PaddingOracleResponse)
+	for i := range result.Responses {
+		byFault[result.Responses[i].Fault] = &result.Responses[i]
+	}
+	invalidMAC := byFault[RecordFaultInvalidMAC]
+	poodle := byFault[RecordFaultPOODLE]
+	invalidPadding := byFault[RecordFaultInvalidPadding]
+	result.AlertOracle = probeResponseKey(invalidPadding.Response, invalidPadding.Alert) != probeResponseKey(invalidMAC.Response, invalidMAC.Alert)
+	result.POODLE = poodle.Response == "application_data" ||
+		poodle.Response == "timeout" && invalidMAC.Response != "timeout"
+	if samples >= paddingOracleTimingSamples {
+		for _, fault := range []RecordFault{RecordFaultInvalidPadding, RecordFaultLongPadding} {
+			if timingDiffers(medians[fault], medians[RecordFaultInvalidMAC]) {
+				result.TimingOracle = true
+			}
+		}
+	}
+	return result, nil
+}
+
+// timingDiffers returns true if a and b differ by more than
+// paddingOracleTimingThreshold of the smaller.
+func timingDiffers(a, b time.Duration) bool {
+	if a > b {
+		a, b = b, a
+	}
+	return float64(b-a) > paddingOracleTimingThreshold*float64(a)
+}
@@ -0,0 +1,127 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// decryptFaultyRecord encrypts a record with fault at TLS 1.0, and reports
+// whether it decrypts when the padding is checked as version requires.
+func decryptFaultyRecord(fault RecordFault, version uint16) bool {
+	key, iv, macKey := make([]byte, 16), make([]byte, 16), make([]byte, 20)
+	out := &halfConn{version: VersionTLS10, cipher: cipherAES(key, iv, false), mac: macSHA1(VersionTLS10, macKey)}
+	in := &halfConn{version: version, cipher: cipherAES(key, iv, true), mac: macSHA1(VersionTLS10, macKey)}
+
+	payload := []byte("faulty record")
+	b := out.newBlock()
+	b.resize(tlsRecordHeaderLen + len(payload))
+	b.data[0], b.data[1], b.data[2] = byte(recordTypeApplicationData), 3, 1
+	b.data[3], b.data[4] = 0, byte(len(payload))
+	copy(b.data[tlsRecordHeaderLen:], payload)
+	out.fault = fault
+	out.encrypt(b, 0)
+	if out.fault != RecordFaultNone {
+		return false
+	}
+	ok, _, _ := in.decrypt(b)
+	return ok
+}
+
+func TestRecordFaults(t *testing.T) {
+	tests := []struct {
+		fault      RecordFault
+		tls, ssl30 bool
+	}{
+		{RecordFaultNone, true, true},
+		{RecordFaultInvalidMAC, false, false},
+		{RecordFaultInvalidPadding, false, false},
+		{RecordFaultPOODLE, false, true},
+		{RecordFaultLongPadding, false, false},
+	}
+	for _, test := range tests {
+		if ok := decryptFaultyRecord(test.fault, VersionTLS10); ok != test.tls {
+			t.Errorf("%s: got %t with TLS padding", test.fault, ok)
+		}
+		if ok := decryptFaultyRecord(test.fault, VersionSSL30); ok != test.ssl30 {
+			t.Errorf("%s: got %t with SSL 3.0 padding", test.fault, ok)
+		}
+	}
+
+	_, final := padWithFault(make([]byte, 13), 16, RecordFaultLongPadding)
+	if len(final) != 13+243 || final[len(final)-1] != 242 {
+		t.Errorf("got %d bytes of long padding", len(final)-13)
+	}
+}
+
+// echoDialer returns a dialer for a server that echoes application data.
+func echoDialer(config *Config) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		c, s := net.Pipe()
+		go func() {
+			server := Server(s, config)
+			if server.Handshake() == nil {
+				io.Copy(server, server)
+			}
+			s.Close()
+		}()
+		return c, nil
+	}
+}
+
+func TestPaddingOracle(t *testing.T) {
+	e := &Enumerator{Dial: echoDialer(testConfig), Timeout: time.Second}
+	result, err := e.PaddingOracle(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil {
+		t.Fatal("no CBC cipher suite was negotiated")
+	}
+	if result.Version != VersionTLS12 || result.AlertOracle || result.POODLE || result.TimingOracle {
+		t.Errorf("got result %+v", result)
+	}
+	if len(result.Responses) != len(paddingOracleFaults) {
+		t.Fatalf("got %d responses", len(result.Responses))
+	}
+	for _, r := range result.Responses {
+		if r.Response != "alert" || r.Alert == nil || r.Alert.Code != uint8(alertBadRecordMAC) || r.Samples != 2 || r.Median == 0 {
+			t.Errorf("got response %+v", r)
+		}
+	}
+	if _, err := json.Marshal(result); err != nil {
+		t.Error(err)
+	}
+
+	config := testConfig.Clone()
+	config.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	e.Dial = echoDialer(config)
+	if result, err := e.PaddingOracle(1); err != nil || result != nil {
+		t.Errorf("got %+v, %v without a CBC cipher suite", result, err)
+	}
+
+	e.Dial = func() (net.Conn, error) {
+		c, s := net.Pipe()
+		s.Close()
+		return c, nil
+	}
+	if result, err := e.PaddingOracle(1); err == nil || result != nil {
+		t.Errorf("got %+v, %v from a server that closed the connection", result, err)
+	}
+}
@@ -0,0 +1,403 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+
+	"github.com/zmap/zcrypto/x509"
+)
+
+// passiveStream reads the handshake messages, alerts and ChangeCipherSpecs
+// sent by one side of a captured connection.
+type passiveStream struct {
+	data       []byte // records not yet read
+	hand       []byte // handshake data not yet split into messages
+	fromClient bool
+
+	// changedCipherSpec is set once the side has sent a ChangeCipherSpec,
+	// after which its records can only be read if hc has the keys.
+	changedCipherSpec bool
+	hc                halfConn
+
+	// done is set when the rest of the stream is application data or
+	// records that cannot be decrypted.
+	done bool
+}
+
+// next returns the type and body of the next handshake message, alert or
+// ChangeCipherSpec in the stream. Handshake messages are returned with
+// their header. It returns io.EOF when there is nothing more to read,
+// including when the capture ends in the middle of a record.
+func (s *passiveStream) next() (recordType, []byte, error) {
+	for {
+		if len(s.hand) >= 4 {
+			n := int(s.hand[1])<<16 | int(s.hand[2])<<8 | int(s.hand[3])
+			if n > maxHandshake {
+				return 0, nil, errors.New("tls: captured handshake message too large")
+			}
+			if len(s.hand) >= 4+n {
+				msg := s.hand[:4+n]
+				s.hand = s.hand[4+n:]
+				return recordTypeHandshake, msg, nil
+			}
+		}
+		if s.done || len(s.data) < tlsRecordHeaderLen {
+			return 0, nil, io.EOF
+		}
+		n := int(s.data[3])<<8 | int(s.data[4])
+		if n > maxCiphertext {
+			return 0, nil, errors.New("tls: oversized record in capture")
+		}
+		if len(s.data) < tlsRecordHeaderLen+n {
+			return 0, nil, io.EOF
+		}
+		record := s.data[:tlsRecordHeaderLen+n]
+		s.data = s.data[tlsRecordHeaderLen+n:]
+
+		typ := recordType(record[0])
+		data := record[tlsRecordHeaderLen:]
+		if s.changedCipherSpec {
+			if s.hc.cipher == nil {
+				s.done = true
+				return 0, nil, io.EOF
+			}
+			var err error
+			if data, err = s.hc.openRecord(record); err != nil {
+				return 0, nil, errors.New("tls: captured record " + err.Error())
+			}
+		}
+
+		switch typ {
+		case recordTypeHandshake:
+			s.hand = append(s.hand, data...)
+		case recordTypeAlert:
+			if len(data) != 2 {
+				return 0, nil, errors.New("tls: malformed alert in capture")
+			}
+			return typ, data, nil
+		case recordTypeChangeCipherSpec:
+			if len(data) != 1 || data[0] != 1 {
+				return 0, nil, errors.New("tls: malformed ChangeCipherSpec in capture")
+			}
+			s.changedCipherSpec = true
+			return typ, data, nil
+		case recordTypeApplicationData:
+			s.done = true
+			return 0, nil, io.EOF
+		default:
+			return 0, nil, fmt.Errorf("tls: unexpected record type %d in capture", typ)
+		}
+	}
+}
+
+// passiveClientMessages are the handshake messages only a client sends.
+// Certificate and Finished messages are sent by both sides.
+var passiveClientMessages = map[uint8]bool{
+	typeClientHello:       true,
+	typeClientKeyExchange: true,
+	typeCertificateVerify: true,
+	typeNextProtocol:      true,
+}
+
+// passiveParser builds the log of a captured handshake as an active client
+// would have, from the messages of both sides.
+type passiveParser struct {
+	config *Config
+	keyLog KeyLog
+	log    *ServerHandshake
+	stage  string
+
+	hello       *clientHelloMsg
+	serverHello *serverHelloMsg
+	vers        uint16
+	suite       *cipherSuite
+	ka          keyAgreement
+	serverCert  *x509.Certificate
+
+	// err is set by the first fatal alert, which ends the handshake.
+	err error
+}
+
+// ParseHandshake parses the handshake of a captured connection from the
+// bytes sent by the client and the bytes sent by the server, such as the
+// two directions of a reassembled TCP stream, and returns the log an active
+// client would have produced for it. Both captures must start at the first
+// record of their side.
+//
+// config supplies what the client would have used to verify the server:
+// RootCAs, ServerName (which defaults to the server name the client sent)
+// and Time. Signatures on the ServerKeyExchange are checked and logged
+// without failing the parse. If config.LogFingerprints is set, the
+// fingerprints are logged as well. config may be nil.
+//
+// The Finished messages are encrypted, and are only logged, along with the
+// master secret, if keyLog has the master secret of the connection. Only
+// the first handshake of a connection is parsed. A capture that ends early
+// gives a partial log, and a fatal alert is logged as the handshake error.
+// On error, the log so far is returned as well.
+func ParseHandshake(clientData, serverData []byte, config *Config, keyLog KeyLog) (*ServerHandshake, error) {
+	if config == nil {
+		config = new(Config)
+	}
+	p := &passiveParser{config: config, keyLog: keyLog, log: new(ServerHandshake)}
+	client := &passiveStream{data: clientData, fromClient: true}
+	server := &passiveStream{data: serverData}
+	err := p.parse(client, server)
+	p.finish()
+	return p.log, err
+}
+
+// parse reads the flights in the order they are sent: the ClientHello, the
+// server's first flight through its ServerHelloDone, or through its Finished
+// when a session is resumed, then the client's flight and the rest of the
+// server's.
+func (p *passiveParser) parse(client, server *passiveStream) error {
+	if err := p.readFlight(client, typeClientHello); err != nil {
+		return err
+	}
+	if p.hello == nil {
+		return errors.New("tls: capture does not start with a ClientHello")
+	}
+	flights := []*passiveStream{server, client, server}
+	for _, s := range flights {
+		if p.err != nil {
+			return nil
+		}
+		if err := p.readFlight(s, typeServerHelloDone, typeFinished); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFlight reads from s until it has read a message of one of the types
+// in until, the stream ends or a fatal alert is read.
+func (p *passiveParser) readFlight(s *passiveStream, until ...uint8) error {
+	for p.err == nil {
+		typ, data, err := s.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case recordTypeAlert:
+			p.readAlert(data, s.fromClient)
+		case recordTypeChangeCipherSpec:
+			p.changeCipherSpec(s)
+		case recordTypeHandshake:
+			if err := p.readMessage(data, s.fromClient); err != nil {
+				return err
+			}
+			for _, last := range until {
+				if data[0] == last {
+					return nil
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (p *passiveParser) readAlert(data []byte, fromClient bool) {
+	a := makeAlertLog(fromClient, data[0], alert(data[1]))
+	a.Stage = p.stage
+	p.log.Alerts = append(p.log.Alerts, a)
+	if data[0] == alertLevelError {
+		op := "remote error"
+		if fromClient {
+			op = "local error"
+		}
+		p.err = &net.OpError{Op: op, Err: alert(data[1])}
+	}
+}
+
+// changeCipherSpec sets up s to decrypt the records that follow, if the
+// master secret is in the key log.
+func (p *passiveParser) changeCipherSpec(s *passiveStream) {
+	if p.keyLog == nil || p.hello == nil || p.serverHello == nil {
+		return
+	}
+	d := &recordDecryptor{keyLog: p.keyLog, clientRandom: p.hello.random, serverHello: p.serverHello}
+	if err := d.changeCipherSpec(&s.hc, s.fromClient); err != nil {
+		s.hc.cipher = nil
+		return
+	}
+	if p.log.KeyMaterial == nil {
+		masterSecret := p.keyLog.MasterSecret(p.hello.random)
+		p.log.KeyMaterial = &KeyMaterial{
+			MasterSecret: &MasterSecret{Value: masterSecret, Length: len(masterSecret)},
+		}
+	}
+}
+
+func (p *passiveParser) readMessage(data []byte, fromClient bool) error {
+	name := nameForHandshakeMessageType(data[0])
+	m := newHandshakeMessage(data[0], p.vers)
+	if m == nil || !m.unmarshal(append([]byte(nil), data...)) {
+		return errors.New("tls: malformed " + name + " message in capture")
+	}
+	if data[0] != typeCertificate && data[0] != typeFinished && passiveClientMessages[data[0]] != fromClient {
+		return errors.New("tls: " + name + " message sent by the wrong side")
+	}
+	p.stage = name
+
+	if p.hello == nil {
+		hello, ok := m.(*clientHelloMsg)
+		if !ok {
+			return unexpectedMessageError(hello, m)
+		}
+		p.hello = hello
+		p.log.ClientHello = hello.MakeLog()
+		return nil
+	}
+	if p.serverHello == nil && !fromClient {
+		serverHello, ok := m.(*serverHelloMsg)
+		if !ok {
+			return unexpectedMessageError(serverHello, m)
+		}
+		p.serverHello = serverHello
+		p.vers = serverHello.vers
+		p.log.ServerHello = serverHello.MakeLog()
+		if p.suite = mutualCipherSuite(p.hello.cipherSuites, serverHello.cipherSuite); p.suite != nil {
+			p.ka = p.suite.ka(p.vers)
+		}
+		return nil
+	}
+
+	switch m := m.(type) {
+	case *certificateMsg:
+		if fromClient {
+			p.log.ClientCertificates = m.MakeLog()
+		} else {
+			p.readServerCertificates(m)
+		}
+	case *serverKeyExchangeMsg:
+		if p.suite != nil && p.suite.flags&suiteAnon == 0 && p.serverCert == nil {
+			return errors.New("tls: ServerKeyExchange without a server certificate in capture")
+		}
+		var err error
+		if p.ka != nil {
+			// Keep going when the signature does not verify: the
+			// error is logged with the ServerKeyExchange.
+			config := p.config.Clone()
+			config.InsecureSkipVerify = true
+			err = p.ka.processServerKeyExchange(config, p.hello, p.serverHello, p.serverCert, m)
+		}
+		p.log.ServerKeyExchange = m.MakeLog(p.ka)
+		return err
+	case *certificateRequestMsg:
+		p.log.CertificateRequest = m.MakeLog()
+	case *clientKeyExchangeMsg:
+		if err := readClientPublicKey(p.ka, m); err != nil {
+			return err
+		}
+		p.log.ClientKeyExchange = m.MakeLog(p.ka)
+	case *newSessionTicketMsg:
+		session := &ClientSessionState{sessionTicket: m.ticket, lifetimeHint: m.lifetimeHint}
+		p.log.SessionTicket = session.MakeLog()
+	case *finishedMsg:
+		if fromClient {
+			p.log.ClientFinished = m.MakeLog()
+		} else {
+			p.log.ServerFinished = m.MakeLog()
+		}
+	case *clientHelloMsg, *serverHelloMsg:
+		return errors.New("tls: unexpected " + name + " message in capture")
+	}
+	return nil
+}
+
+// readServerCertificates logs the server's certificates, and validates them
+// as the client would have.
+func (p *passiveParser) readServerCertificates(m *certificateMsg) {
+	p.log.ServerCertificates = m.MakeLog()
+	certs := make([]*x509.Certificate, len(m.certificates))
+	for i, asn1Data := range m.certificates {
+		cert, err := x509.ParseCertificate(asn1Data)
+		if err != nil {
+			return
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return
+	}
+	p.serverCert = certs[0]
+
+	opts := x509.VerifyOptions{
+		Roots:         p.config.RootCAs,
+		CurrentTime:   p.config.time(),
+		DNSName:       p.config.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	if opts.DNSName == "" {
+		opts.DNSName = p.hello.serverName
+	}
+	for _, cert := range certs {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, validation, _ := certs[0].ValidateWithStupidDetail(opts)
+	p.log.ServerCertificates.addParsed(certs, validation)
+	p.log.ServerCertificates.verify(certs, p.config.Verifiers, opts.DNSName, opts.CurrentTime)
+}
+
+// readClientPublicKey sets the client's public key in ka from ckx, so that
+// it is included in the log of the ClientKeyExchange. Unlike an active
+// client's log, which has the client's private key, a passive log only
+// has the public key.
+func readClientPublicKey(ka keyAgreement, ckx *clientKeyExchangeMsg) error {
+	switch ka := ka.(type) {
+	case *rsaKeyAgreement:
+		if len(ckx.ciphertext) < 2 {
+			return errClientKeyExchange
+		}
+	case *ecdheKeyAgreement:
+		if len(ckx.ciphertext) == 0 || int(ckx.ciphertext[0]) != len(ckx.ciphertext)-1 {
+			return errClientKeyExchange
+		}
+		if ka.curve == nil {
+			// The ServerKeyExchange is missing from the capture.
+			return nil
+		}
+		publicKey, ok := ka.curve.Unmarshal(ckx.ciphertext[1:])
+		if !ok {
+			return errClientKeyExchange
+		}
+		ka.clientX, ka.clientY = publicKey.X, publicKey.Y
+	case *dheKeyAgreement:
+		if len(ckx.ciphertext) < 2 || int(ckx.ciphertext[0])<<8|int(ckx.ciphertext[1]) != len(ckx.ciphertext)-2 {
+			return errClientKeyExchange
+		}
+		ka.yClient = new(big.Int).SetBytes(ckx.ciphertext[2:])
+	}
+	return nil
+}
+
+// finish adds the fingerprints and any error of the handshake to the log.
+func (p *passiveParser) finish() {
+	if p.config.LogFingerprints && p.log.ClientHello != nil {
+		p.log.Fingerprints = ComputeFingerprints(p.log.ClientHello, p.log.ServerHello)
+	}
+	if p.err != nil {
+		p.log.Error = newHandshakeError(p.err, p.stage, p.log.Alerts, true, p.log.ServerHello != nil)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// capturedHandshake runs a handshake between a client and a server with
+// the given configs, and returns the client's log and the bytes each side
+// sent.
+func capturedHandshake(t *testing.T, clientConfig, serverConfig *Config) (log *ServerHandshake, clientData, serverData []byte) {
+	conn, err := enumerationDialer(serverConfig)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &capturingConn{Conn: conn}
+	client := Client(recorder, clientConfig)
+	client.Handshake()
+	conn.Close()
+
+	for _, record := range recorder.records {
+		if record.FromClient {
+			clientData = append(clientData, record.Data...)
+		} else {
+			serverData = append(serverData, record.Data...)
+		}
+	}
+	return client.GetHandshakeLog(), clientData, serverData
+}
+
+func sameJSON(t *testing.T, a, b interface{}) bool {
+	aj, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bj, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Equal(aj, bj)
+}
+
+func TestParseHandshake(t *testing.T) {
+	tests := []struct {
+		version uint16
+		suite   uint16
+	}{
+		{VersionTLS10, TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
+		{VersionTLS12, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		{VersionTLS12, TLS_DHE_RSA_WITH_AES_128_CBC_SHA},
+	}
+	for _, test := range tests {
+		serverConfig := testConfig.Clone()
+		serverConfig.CipherSuites = []uint16{test.suite}
+		clientConfig := serverConfig.Clone()
+		clientConfig.MaxVersion = test.version
+		clientConfig.LogFingerprints = true
+
+		active, clientData, serverData := capturedHandshake(t, clientConfig, serverConfig)
+		if active.Error != nil {
+			t.Fatalf("%s: %s", CipherSuite(test.suite), active.Error.Message)
+		}
+		keyLog := make(KeyLog)
+		keyLog.AddHandshakeLog(active)
+		passive, err := ParseHandshake(clientData, serverData, clientConfig, keyLog)
+		if err != nil {
+			t.Fatalf("%s: %s", CipherSuite(test.suite), err)
+		}
+
+		for _, field := range []struct {
+			name            string
+			active, passive interface{}
+		}{
+			{"ClientHello", active.ClientHello, passive.ClientHello},
+			{"ServerHello", active.ServerHello, passive.ServerHello},
+			{"ServerCertificates", active.ServerCertificates, passive.ServerCertificates},
+			{"ServerKeyExchange", active.ServerKeyExchange, passive.ServerKeyExchange},
+			{"ClientFinished", active.ClientFinished, passive.ClientFinished},
+			{"ServerFinished", active.ServerFinished, passive.ServerFinished},
+			{"SessionTicket", active.SessionTicket, passive.SessionTicket},
+			{"MasterSecret", active.KeyMaterial.MasterSecret, passive.KeyMaterial.MasterSecret},
+			{"Fingerprints", active.Fingerprints, passive.Fingerprints},
+		} {
+			if !sameJSON(t, field.active, field.passive) {
+				t.Errorf("%s: passive %s differs from the active log", CipherSuite(test.suite), field.name)
+			}
+		}
+		if ckx := passive.ClientKeyExchange; ckx == nil || len(ckx.Raw) == 0 || !bytes.Contains(clientData, ckx.Raw) || ckx.ECDHParams == nil && ckx.DHParams == nil {
+			t.Errorf("%s: passive log has ClientKeyExchange %v", CipherSuite(test.suite), ckx)
+		}
+		if passive.Error != nil || len(passive.Alerts) != 0 {
+			t.Errorf("%s: passive log has error %v and alerts %v", CipherSuite(test.suite), passive.Error, passive.Alerts)
+		}
+
+		// Without the master secret, the encrypted messages are skipped.
+		passive, err = ParseHandshake(clientData, serverData, clientConfig, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", CipherSuite(test.suite), err)
+		}
+		if passive.ServerKeyExchange == nil || passive.ClientFinished != nil || passive.ServerFinished != nil || passive.KeyMaterial != nil {
+			t.Errorf("%s: unexpected passive log without a key log", CipherSuite(test.suite))
+		}
+	}
+}
+
+func TestParseHandshakeAlert(t *testing.T) {
+	serverConfig := testConfig.Clone()
+	serverConfig.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	clientConfig := testConfig.Clone()
+	clientConfig.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA}
+
+	active, clientData, serverData := capturedHandshake(t, clientConfig, serverConfig)
+	passive, err := ParseHandshake(clientData, serverData, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active.Error == nil || passive.Error == nil {
+		t.Fatalf("got errors %v and %v, want a handshake failure", active.Error, passive.Error)
+	}
+	if !sameJSON(t, active.Alerts, passive.Alerts) || !sameJSON(t, active.Error, passive.Error) {
+		t.Errorf("got passive alerts %v and error %v, want %v and %v", passive.Alerts, passive.Error, active.Alerts, active.Error)
+	}
+}
+
+func TestParseHandshakeMalformed(t *testing.T) {
+	_, clientData, serverData := capturedHandshake(t, testConfig, testConfig)
+	if _, err := ParseHandshake(serverData, clientData, nil, nil); err == nil {
+		t.Error("swapped directions were parsed")
+	}
+	if _, err := ParseHandshake([]byte{0x80, 0x2e, 0x01, 0x03, 0x01}, nil, nil, nil); err == nil {
+		t.Error("SSLv2 ClientHello was parsed")
+	}
+	log, err := ParseHandshake(clientData, serverData[:len(serverData)/2], nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.ClientHello == nil || log.ServerHello == nil || log.ClientFinished != nil {
+		t.Error("unexpected log of a truncated capture")
+	}
+}
@@ -303,9 +303,9 @@ func newFinishedHash(version uint16, cipherSuite *cipherSuite) finishedHash {
 			newHash = sha512.New384
 		}
 
-		return finishedHash{newHash(), newHash(), nil, nil, []byte{}, version, prf12(newHash)}
+		return finishedHash{newHash(), newHash(), nil, nil, []byte{}, version, prf12(newHash), nil}
 	}
-	return finishedHash{sha1.New(), sha1.New(), md5.New(), md5.New(), []byte{}, version, prf10}
+	return finishedHash{sha1.New(), sha1.New(), md5.New(), md5.New(), []byte{}, version, prf10, nil}
 }
 
 // A finishedHash calculates the hash of a set of handshake messages suitable
@@ -324,9 +324,17 @@ type finishedHash struct {
 
 	version uint16
 	prf     func(result, secret, label, seed []byte)
+
+	// dtls is set in DTLS, where messages are hashed with their
+	// message_seq.
+	dtls *dtlsState
 }
 
 func (h *finishedHash) Write(msg []byte) (n int, err error) {
+	n = len(msg)
+	if h.dtls != nil {
+		msg = dtlsHashedMessage(msg, h.dtls.messageSeq(msg))
+	}
 	h.client.Write(msg)
 	h.server.Write(msg)
 
@@ -339,7 +347,7 @@ func (h *finishedHash) Write(msg []byte) (n int, err error) {
 		h.buffer = append(h.buffer, msg...)
 	}
 
-	return len(msg), nil
+	return n, nil
 }
 
 func (h finishedHash) Sum() []byte {
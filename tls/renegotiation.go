@@ -0,0 +1,201 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// RenegotiationSupport sets whether a client accepts a server's requests to
+// renegotiate. A renegotiation is a new handshake on an established
+// connection. The client runs it inside the Read that receives the
+// HelloRequest, and a concurrent Write waits until it is finished.
+type RenegotiationSupport int
+
+const (
+	// RenegotiateNever refuses every renegotiation.
+	RenegotiateNever RenegotiationSupport = iota
+
+	// RenegotiateOnceAsClient allows the server to renegotiate once per
+	// connection.
+	RenegotiateOnceAsClient
+
+	// RenegotiateFreelyAsClient allows the server to renegotiate any
+	// number of times.
+	RenegotiateFreelyAsClient
+)
+
+func (r RenegotiationSupport) String() string {
+	if name, ok := renegotiationSupportNames[int(r)]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (r RenegotiationSupport) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *RenegotiationSupport) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	for value, n := range renegotiationSupportNames {
+		if n == name {
+			*r = RenegotiationSupport(value)
+			return nil
+		}
+	}
+	return errors.New("tls: unknown renegotiation support " + name)
+}
+
+// renegotiationInfo returns the contents of the server's renegotiation_info
+// extension in a secure renegotiation: the verify data of both Finished
+// messages of the previous handshake (RFC 5746, section 3.2).
+func (c *Conn) renegotiationInfo() []byte {
+	info := make([]byte, 0, len(c.clientFinished)+len(c.serverFinished))
+	info = append(info, c.clientFinished...)
+	return append(info, c.serverFinished...)
+}
+
+// handleRenegotiation reads a HelloRequest from the server and runs a new
+// client handshake, if Config.Renegotiation allows it. It is called from Read
+// once c.in is released, and takes handshakeMutex and then c.in, so the whole
+// handshake runs with both held.
+func (c *Conn) handleRenegotiation() error {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	c.in.Lock()
+	defer c.in.Unlock()
+
+	// Another Read may have handled the HelloRequest while c.in was free.
+	if c.hand.Len() == 0 {
+		return nil
+	}
+	msg, err := c.readHandshake()
+	if err != nil {
+		return err
+	}
+	if _, ok := msg.(*helloRequestMsg); !ok {
+		return c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
+	}
+
+	switch c.config.Renegotiation {
+	case RenegotiateOnceAsClient:
+		if c.handshakes > 1 {
+			return c.in.setErrorLocked(c.sendAlert(alertNoRenegotiation))
+		}
+	case RenegotiateFreelyAsClient:
+	default:
+		return c.in.setErrorLocked(c.sendAlert(alertNoRenegotiation))
+	}
+
+	return c.renegotiate(c.clientHandshake)
+}
+
+// Renegotiate asks the client for a new handshake with a HelloRequest, and
+// runs the server handshake on its ClientHello. The initial handshake must
+// have negotiated secure renegotiation (RFC 5746). Renegotiate waits for any
+// Read in progress, makes any concurrent Write wait until it is finished, and
+// fails if the client sends application data before its ClientHello. As with
+// any failed handshake, the connection cannot be used after a failed
+// renegotiation, including one the client refused.
+func (c *Conn) Renegotiate() error {
+	if c.isClient {
+		return errors.New("tls: Renegotiate called on TLS client connection")
+	}
+	if c.isDTLS {
+		return errors.New("tls: renegotiation is not supported over DTLS")
+	}
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	if !c.secureRenegotiation {
+		return errors.New("tls: client does not support secure renegotiation")
+	}
+
+	c.in.Lock()
+	defer c.in.Unlock()
+
+	c.out.Lock()
+	helloRequest, err := c.marshalHandshake(new(helloRequestMsg))
+	if err == nil {
+		_, err = c.writeRecord(recordTypeHandshake, helloRequest)
+	}
+	c.out.setErrorLocked(err)
+	c.renegotiating = err == nil
+	c.out.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.renegotiate(c.serverHandshake)
+}
+
+// renegotiate runs handshake on an established connection and logs it as
+// one of the Renegotiations of the initial handshake.
+// c.handshakeMutex <= L.
+func (c *Conn) renegotiate(handshake func() error) error {
+	c.out.Lock()
+	c.renegotiating = true
+	c.out.Unlock()
+	defer func() {
+		c.out.Lock()
+		c.renegotiating = false
+		if c.renegotiated != nil {
+			c.renegotiated.Broadcast()
+		}
+		c.out.Unlock()
+	}()
+
+	initial, initialClient, heartbleed := c.handshakeLog, c.clientHandshakeLog, c.heartbleedLog
+
+	c.handshakeComplete = false
+	c.handshakeLog = new(ServerHandshake)
+	c.handshakeErr = handshake()
+	c.finishHandshakeLog()
+	if c.handshakeErr == nil {
+		c.handshakes++
+	}
+
+	c.alertLogMutex.Lock()
+	initial.Renegotiations = append(initial.Renegotiations, c.handshakeLog)
+	c.handshakeLog = initial
+	if initialClient != nil && c.clientHandshakeLog != initialClient {
+		initialClient.Renegotiations = append(initialClient.Renegotiations, c.clientHandshakeLog)
+		c.clientHandshakeLog = initialClient
+	}
+	c.alertLogMutex.Unlock()
+	c.heartbleedLog = heartbleed
+
+	return c.handshakeErr
+}
+
+// waitRenegotiation waits until no renegotiation is running. It releases
+// c.out while it waits, so the renegotiation can write its messages.
+// c.out.Mutex <= L.
+func (c *Conn) waitRenegotiation() {
+	for c.renegotiating {
+		if c.renegotiated == nil {
+			c.renegotiated = sync.NewCond(&c.out.Mutex)
+		}
+		c.renegotiated.Wait()
+	}
+}
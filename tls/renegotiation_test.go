@@ -0,0 +1,297 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// renegotiatingServer returns a client connection to a server that
+// renegotiates count times after the initial handshake, then writes
+// "done". The server's connection and the errors of its renegotiations are
+// sent on the channel once it is finished.
+func renegotiatingServer(config *Config, count int) (net.Conn, chan *Conn, chan error) {
+	c, s := net.Pipe()
+	servers := make(chan *Conn, 1)
+	errs := make(chan error, count)
+	go func() {
+		server := Server(s, config)
+		if server.Handshake() == nil {
+			for i := 0; i < count; i++ {
+				err := server.Renegotiate()
+				errs <- err
+				if err != nil {
+					break
+				}
+			}
+			server.Write([]byte("done"))
+		}
+		s.Close()
+		servers <- server
+		close(errs)
+	}()
+	return c, servers, errs
+}
+
+func TestRenegotiation(t *testing.T) {
+	clientConfig := testConfig.Clone()
+	clientConfig.Renegotiation = RenegotiateFreelyAsClient
+
+	conn, servers, errs := renegotiatingServer(testConfig, 2)
+	client := Client(conn, clientConfig)
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "done" {
+		t.Errorf("got %q", buf)
+	}
+	conn.Close()
+	server := <-servers
+	for err := range errs {
+		if err != nil {
+			t.Errorf("server failed to renegotiate: %s", err)
+		}
+	}
+
+	if client.handshakes != 3 || server.handshakes != 3 {
+		t.Errorf("client completed %d handshakes and server %d, want 3", client.handshakes, server.handshakes)
+	}
+	log := client.GetHandshakeLog()
+	if len(log.Renegotiations) != 2 {
+		t.Fatalf("client logged %d renegotiations", len(log.Renegotiations))
+	}
+	for i, r := range log.Renegotiations {
+		if r.Error != nil || r.ServerFinished == nil {
+			t.Errorf("renegotiation %d did not complete: %+v", i, r.Error)
+		}
+		if r.ServerHello == nil || !r.ServerHello.SecureRenegotiation {
+			t.Errorf("renegotiation %d was not secure", i)
+		}
+	}
+	if !bytes.Equal(client.clientFinished, log.Renegotiations[1].ClientFinished.VerifyData) {
+		t.Error("client did not keep the verify data of the last handshake")
+	}
+	if n := len(server.GetHandshakeLog().Renegotiations); n != 2 {
+		t.Errorf("server logged %d renegotiations", n)
+	}
+	if n := len(server.GetClientHandshakeLog().Renegotiations); n != 2 {
+		t.Errorf("server logged %d client renegotiations", n)
+	}
+	if _, err := json.Marshal(log); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRenegotiationConcurrentWrite(t *testing.T) {
+	clientConfig := testConfig.Clone()
+	clientConfig.Renegotiation = RenegotiateFreelyAsClient
+	const writes = 20
+
+	c, s := net.Pipe()
+	serverErrs := make(chan error, writes+1)
+	go func() {
+		server := Server(s, testConfig)
+		if err := server.Handshake(); err != nil {
+			serverErrs <- err
+			s.Close()
+			return
+		}
+		written := make(chan bool)
+		go func() {
+			for i := 0; i < writes; i++ {
+				_, err := server.Write([]byte("data"))
+				serverErrs <- err
+			}
+			close(written)
+		}()
+		serverErrs <- server.Renegotiate()
+		<-written
+		server.Write([]byte("done"))
+		s.Close()
+	}()
+
+	client := Client(c, clientConfig)
+	buf := make([]byte, 4*writes+4)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, append(bytes.Repeat([]byte("data"), writes), "done"...)) {
+		t.Errorf("got %q", buf)
+	}
+	c.Close()
+	for i := 0; i < writes+1; i++ {
+		if err := <-serverErrs; err != nil {
+			t.Errorf("server failed: %s", err)
+		}
+	}
+}
+
+// TestReadDuringBlockedWrite checks that a Write held up by the peer does not
+// block a Read, as full-duplex protocols need.
+func TestReadDuringBlockedWrite(t *testing.T) {
+	clientConfig := testConfig.Clone()
+	clientConfig.Renegotiation = RenegotiateFreelyAsClient
+
+	c, s := net.Pipe()
+	defer c.Close()
+	pinged := make(chan bool)
+	go func() {
+		defer s.Close()
+		server := Server(s, testConfig)
+		if _, err := server.Write([]byte("ping")); err != nil {
+			return
+		}
+		// Read nothing until the client has read the ping.
+		<-pinged
+		io.Copy(ioutil.Discard, server)
+	}()
+
+	client := Client(c, clientConfig)
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	go client.Write(make([]byte, 1<<20))
+	// Let the Write start, and block, before reading.
+	time.Sleep(100 * time.Millisecond)
+
+	read := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(client, buf)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Read blocked behind Write")
+	}
+	close(pinged)
+}
+
+func TestRenegotiationFingerprint(t *testing.T) {
+	for _, p := range []*ClientHelloProfile{ProfileChrome58, ProfileCurl788} {
+		hello, err := p.NewConfiguration()
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConfig := &Config{
+			InsecureSkipVerify:             true,
+			Renegotiation:                  RenegotiateFreelyAsClient,
+			ClientFingerprintConfiguration: hello,
+		}
+
+		conn, servers, errs := renegotiatingServer(testConfig, 1)
+		client := Client(conn, clientConfig)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(client, buf)
+		conn.Close()
+		<-servers
+		if err != nil {
+			t.Errorf("%s: %s", p.ID(), err)
+		}
+		for err := range errs {
+			if err != nil {
+				t.Errorf("%s: server failed to renegotiate: %s", p.ID(), err)
+			}
+		}
+		log := client.GetHandshakeLog()
+		if len(log.Renegotiations) != 1 {
+			t.Fatalf("%s: client logged %d renegotiations", p.ID(), len(log.Renegotiations))
+		}
+		if r := log.Renegotiations[0]; r.ServerHello == nil || !r.ServerHello.SecureRenegotiation {
+			t.Errorf("%s: renegotiation was not secure", p.ID())
+		}
+		for _, suite := range log.Renegotiations[0].ClientHello.CipherSuites {
+			if uint16(suite) == scsvRenegotiation {
+				t.Errorf("%s: renegotiation offered the signaling cipher suite", p.ID())
+			}
+		}
+	}
+}
+
+func TestRenegotiationRefused(t *testing.T) {
+	tests := []struct {
+		support   RenegotiationSupport
+		completed int
+	}{
+		{RenegotiateNever, 0},
+		{RenegotiateOnceAsClient, 1},
+	}
+	for _, test := range tests {
+		clientConfig := testConfig.Clone()
+		clientConfig.Renegotiation = test.support
+
+		conn, servers, errs := renegotiatingServer(testConfig, 2)
+		client := Client(conn, clientConfig)
+		_, err := client.Read(make([]byte, 4))
+		conn.Close()
+		<-servers
+		if err == nil {
+			t.Errorf("%s: client accepted a renegotiation", test.support)
+		}
+		var serverErrs []error
+		for err := range errs {
+			serverErrs = append(serverErrs, err)
+		}
+		if n := len(serverErrs); n != test.completed+1 || serverErrs[n-1] == nil {
+			t.Errorf("%s: server renegotiations returned %v", test.support, serverErrs)
+		}
+		if n := len(client.GetHandshakeLog().Renegotiations); n != test.completed {
+			t.Errorf("%s: client logged %d renegotiations, want %d", test.support, n, test.completed)
+		}
+	}
+}
+
+func TestRenegotiationInfo(t *testing.T) {
+	hello := &serverHelloMsg{
+		vers:                VersionTLS12,
+		random:              make([]byte, 32),
+		secureRenegotiation: true,
+		renegotiationInfo:   bytes.Repeat([]byte{7}, 24),
+	}
+	var parsed serverHelloMsg
+	if !parsed.unmarshal(hello.marshal()) {
+		t.Fatal("failed to parse ServerHello")
+	}
+	if !parsed.secureRenegotiation || !bytes.Equal(parsed.renegotiationInfo, hello.renegotiationInfo) {
+		t.Errorf("got renegotiation_info %x", parsed.renegotiationInfo)
+	}
+
+	// The initial handshake must have an empty renegotiation_info.
+	c, s := net.Pipe()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- Server(s, testConfig).Handshake()
+		s.Close()
+	}()
+	client := Client(c, testConfig)
+	client.handshakes = 1
+	client.clientFinished = make([]byte, 12)
+	client.Handshake()
+	c.Close()
+	if err := <-serverErr; err == nil || err.Error() != "tls: initial handshake had non-empty renegotiation extension" {
+		t.Errorf("server accepted a non-empty renegotiation_info in the initial handshake: %v", err)
+	}
+}
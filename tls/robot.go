@@ -0,0 +1,339 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+)
+
+// ROBOTVariant selects the encrypted premaster secret a client sends in a
+// ROBOT (Return Of Bleichenbacher's Oracle Threat) probe. Every variant but
+// ROBOTCorrect breaks the PKCS #1 v1.5 encoding in a different way.
+type ROBOTVariant int
+
+const (
+	// ROBOTDisabled sends a well-formed ClientKeyExchange and completes
+	// the handshake normally.
+	ROBOTDisabled ROBOTVariant = iota
+
+	// ROBOTCorrect sends a correctly padded premaster secret.
+	ROBOTCorrect
+
+	// ROBOTWrongPrefix replaces the leading 0x00 0x02 with 0x41 0x17.
+	ROBOTWrongPrefix
+
+	// ROBOTMisplacedZero moves the zero byte that ends the padding to the
+	// second to last byte, leaving a one byte premaster secret.
+	ROBOTMisplacedZero
+
+	// ROBOTMissingZero omits the zero byte that ends the padding.
+	ROBOTMissingZero
+
+	// ROBOTWrongVersion sends a premaster secret with version 0x0202.
+	ROBOTWrongVersion
+
+	// ROBOTTruncated sends a correctly padded premaster secret of 24 bytes.
+	ROBOTTruncated
+)
+
+// robotVariants are the variants sent by Enumerator.ROBOT, in order.
+var robotVariants = []ROBOTVariant{
+	ROBOTCorrect,
+	ROBOTWrongPrefix,
+	ROBOTMisplacedZero,
+	ROBOTMissingZero,
+	ROBOTWrongVersion,
+	ROBOTTruncated,
+}
+
+func (v ROBOTVariant) String() string {
+	if name, ok := robotVariantNames[int(v)]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (v ROBOTVariant) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+func (v *ROBOTVariant) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	for value, n := range robotVariantNames {
+		if n == name {
+			*v = ROBOTVariant(value)
+			return nil
+		}
+	}
+	return errors.New("tls: unknown ROBOT variant " + name)
+}
+
+// The oracles a ROBOT probe can find. A weak oracle only distinguishes
+// correctly formatted premaster secrets, and a strong oracle also
+// distinguishes between malformed ones, which makes an attack much faster.
+const (
+	ROBOTOracleNone   = "none"
+	ROBOTOracleWeak   = "weak"
+	ROBOTOracleStrong = "strong"
+)
+
+// ROBOTResponse records how a server answered a ROBOT probe. Response is one
+// of "alert", "eof", "timeout", "connection_error", "unexpected_record",
+// "change_cipher_spec" or "incomplete", the last meaning that the probe did
+// not reach the key exchange.
+type ROBOTResponse struct {
+	Variant  ROBOTVariant `json:"variant"`
+	Finished bool         `json:"finished"`
+	Response string       `json:"response"`
+	Alert    *Alert       `json:"alert,omitempty"`
+}
+
+// ROBOTResult is the result of Enumerator.ROBOT. The server is vulnerable if
+// its responses to the malformed variants differ from each other, or from
+// its response to the correct one.
+type ROBOTResult struct {
+	CipherSuite CipherSuite     `json:"cipher_suite"`
+	Oracle      string          `json:"oracle"`
+	Vulnerable  bool            `json:"vulnerable"`
+	Responses   []ROBOTResponse `json:"responses"`
+}
+
+// probeResponseKey returns a string that is equal for indistinguishable
+// probe responses.
+func probeResponseKey(response string, a *Alert) string {
+	if a != nil {
+		return response + "." + strconv.Itoa(int(a.Code))
+	}
+	return response
+}
+
+// robotEncrypt encrypts preMasterSecret to publicKey with the padding broken
+// as variant describes.
+func robotEncrypt(rand io.Reader, publicKey *rsa.PublicKey, preMasterSecret []byte, variant ROBOTVariant) ([]byte, error) {
+	k := (publicKey.N.BitLen() + 7) / 8
+	msgLen := len(preMasterSecret)
+	if variant == ROBOTTruncated {
+		msgLen = 24
+	}
+	if k < msgLen+11 {
+		return nil, errors.New("tls: RSA key too small for a ROBOT probe")
+	}
+
+	em := make([]byte, k)
+	em[1] = 2
+	padding := em[2 : k-msgLen-1]
+	if _, err := io.ReadFull(rand, padding); err != nil {
+		return nil, err
+	}
+	for i := range padding {
+		if padding[i] == 0 {
+			padding[i] = 0x11
+		}
+	}
+	copy(em[k-msgLen:], preMasterSecret[:msgLen])
+
+	switch variant {
+	case ROBOTCorrect, ROBOTTruncated:
+	case ROBOTWrongPrefix:
+		em[0], em[1] = 0x41, 0x17
+	case ROBOTMisplacedZero, ROBOTMissingZero:
+		em[k-msgLen-1] = 0x11
+		for i := k - msgLen; i < k; i++ {
+			if em[i] == 0 {
+				em[i] = 0x11
+			}
+		}
+		if variant == ROBOTMisplacedZero {
+			em[k-2] = 0
+		}
+	case ROBOTWrongVersion:
+		em[k-msgLen], em[k-msgLen+1] = 0x02, 0x02
+	default:
+		return nil, errors.New("tls: unknown ROBOT variant " + strconv.Itoa(int(variant)))
+	}
+
+	m := new(big.Int).SetBytes(em)
+	c := m.Exp(m, big.NewInt(int64(publicKey.E)), publicKey.N).Bytes()
+	encrypted := make([]byte, k)
+	copy(encrypted[k-len(c):], c)
+	return encrypted, nil
+}
+
+// finishROBOTProbe is called after a ROBOT ClientKeyExchange has been sent.
+// It optionally sends a ChangeCipherSpec and a Finished message, logs the
+// server's response and returns the error that ended the handshake.
+func (hs *clientHandshakeState) finishROBOTProbe() error {
+	c := hs.c
+	if ka, ok := hs.suite.ka(c.vers).(*rsaKeyAgreement); !ok || ka.ephemeral {
+		return errors.New("tls: ROBOT probe requires RSA key exchange")
+	}
+
+	finished := !c.config.ROBOTOmitFinished
+	if finished {
+		// The Finished message is random bytes sent without encryption,
+		// so it fails to decrypt whether or not the server recovered our
+		// premaster secret. Only the server's handling of the
+		// ClientKeyExchange can change its response.
+		garbage := make([]byte, 48)
+		if _, err := io.ReadFull(c.config.rand(), garbage); err != nil {
+			return err
+		}
+		c.write(rawRecord(recordTypeChangeCipherSpec, c.vers, []byte{1}))
+		c.write(rawRecord(recordTypeHandshake, c.vers, garbage))
+	}
+	if _, err := c.flush(); err != nil {
+		return err
+	}
+
+	err := c.readRecord(recordTypeChangeCipherSpec)
+	c.handshakeLog.ROBOT = makeROBOTResponse(c.config.ROBOTVariant, finished, err)
+	if err == nil {
+		err = errors.New("tls: server accepted a ROBOT probe")
+	}
+	return err
+}
+
+// rawRecord returns a record that bypasses the record layer state.
+func rawRecord(typ recordType, vers uint16, data []byte) []byte {
+	record := []byte{byte(typ), byte(vers >> 8), byte(vers), byte(len(data) >> 8), byte(len(data))}
+	return append(record, data...)
+}
+
+func makeROBOTResponse(variant ROBOTVariant, finished bool, err error) *ROBOTResponse {
+	r := &ROBOTResponse{Variant: variant, Finished: finished}
+	if err == nil {
+		r.Response = "change_cipher_spec"
+	} else {
+		r.Response, r.Alert = describeProbeError(err)
+	}
+	return r
+}
+
+// describeProbeError summarizes the error that ended a probe as one of
+// "alert", "unexpected_record", "eof", "timeout" or "connection_error". The
+// alert is returned if the server sent one.
+func describeProbeError(err error) (string, *Alert) {
+	opErr, isOpErr := err.(*net.OpError)
+	netErr, isNetErr := err.(net.Error)
+	switch {
+	case isOpErr && opErr.Op == "remote error":
+		if code, ok := opErr.Err.(alert); ok {
+			a := makeAlertLog(false, alertLevelError, code)
+			return "alert", &a
+		}
+		return "alert", nil
+	case isOpErr && opErr.Op == "local error":
+		return "unexpected_record", nil
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return "eof", nil
+	case isNetErr && netErr.Timeout():
+		return "timeout", nil
+	}
+	return "connection_error", nil
+}
+
+// robotCipherSuites returns the implemented suites with RSA key exchange.
+func robotCipherSuites() []uint16 {
+	var suites []uint16
+	for _, suite := range implementedCipherSuites {
+		if ka, ok := suite.ka(VersionTLS12).(*rsaKeyAgreement); ok && !ka.ephemeral {
+			suites = append(suites, suite.id)
+		}
+	}
+	return suites
+}
+
+// classifyROBOT returns the oracle shown by responses. Responses with and
+// without a Finished message are compared separately.
+func classifyROBOT(responses []ROBOTResponse) string {
+	oracle := ROBOTOracleNone
+	for _, finished := range []bool{true, false} {
+		var correct string
+		var malformed []string
+		for i := range responses {
+			r := &responses[i]
+			if r.Finished != finished {
+				continue
+			}
+			if r.Variant == ROBOTCorrect {
+				correct = probeResponseKey(r.Response, r.Alert)
+			} else {
+				malformed = append(malformed, probeResponseKey(r.Response, r.Alert))
+			}
+		}
+		for _, key := range malformed {
+			if key != malformed[0] {
+				return ROBOTOracleStrong
+			}
+		}
+		if len(malformed) > 0 && malformed[0] != correct {
+			oracle = ROBOTOracleWeak
+		}
+	}
+	return oracle
+}
+
+// ROBOT probes the server for a Bleichenbacher padding oracle in its RSA key
+// exchange, by sending each ROBOTVariant on a separate connection and
+// comparing the responses. Each variant is sent with a ChangeCipherSpec and
+// an invalid Finished message and, if Timeout is set, again without them,
+// since some servers only show the oracle one way. It returns nil if the
+// server does not negotiate RSA key exchange.
+func (e *Enumerator) ROBOT() (*ROBOTResult, error) {
+	config := e.baseConfig()
+	config.CipherSuites = robotCipherSuites()
+	rounds := []bool{true}
+	if e.Timeout > 0 {
+		rounds = append(rounds, false)
+	}
+
+	var result *ROBOTResult
+	for _, finished := range rounds {
+		for _, variant := range robotVariants {
+			config.ROBOTVariant = variant
+			config.ROBOTOmitFinished = !finished
+			log, err := e.probe(config)
+			if err != nil {
+				return nil, err
+			}
+			if result == nil {
+				if log.ROBOT == nil {
+					return nil, nil
+				}
+				// Keep the server's choice for the remaining probes.
+				suite := log.ServerHello.CipherSuite
+				config.CipherSuites = []uint16{uint16(suite)}
+				result = &ROBOTResult{CipherSuite: suite}
+			}
+			response := log.ROBOT
+			if response == nil {
+				response = &ROBOTResponse{Variant: variant, Finished: finished, Response: "incomplete"}
+			}
+			result.Responses = append(result.Responses, *response)
+		}
+	}
+	result.Oracle = classifyROBOT(result.Responses)
+	result.Vulnerable = result.Oracle != ROBOTOracleNone
+	return result, nil
+}
@@ -0,0 +1,126 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestROBOTEncrypt(t *testing.T) {
+	key := testRSAPrivateKey
+	k := (key.N.BitLen() + 7) / 8
+	pms := make([]byte, 48)
+	pms[0], pms[1] = 3, 3
+	for i := 2; i < len(pms); i++ {
+		pms[i] = byte(i)
+	}
+
+	for _, variant := range robotVariants {
+		c, err := robotEncrypt(rand.Reader, &key.PublicKey, pms, variant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c) != k {
+			t.Errorf("%s: got %d bytes of ciphertext", variant, len(c))
+		}
+		m := new(big.Int).Exp(new(big.Int).SetBytes(c), key.D, key.N).Bytes()
+		em := append(make([]byte, k-len(m)), m...)
+		separator := bytes.IndexByte(em[2:], 0) + 2
+
+		var ok bool
+		switch variant {
+		case ROBOTCorrect:
+			ok = em[1] == 2 && separator == k-49 && bytes.Equal(em[separator+1:], pms)
+		case ROBOTWrongPrefix:
+			ok = em[0] == 0x41 && em[1] == 0x17 && bytes.Equal(em[separator+1:], pms)
+		case ROBOTMisplacedZero:
+			ok = em[1] == 2 && separator == k-2
+		case ROBOTMissingZero:
+			ok = em[1] == 2 && separator == 1
+		case ROBOTWrongVersion:
+			ok = em[1] == 2 && separator == k-49 && bytes.Equal(em[separator+1:separator+3], []byte{2, 2})
+		case ROBOTTruncated:
+			ok = em[1] == 2 && separator == k-25 && bytes.Equal(em[separator+1:], pms[:24])
+		}
+		if !ok {
+			t.Errorf("%s: got encoded message %x", variant, em)
+		}
+	}
+}
+
+func TestClassifyROBOT(t *testing.T) {
+	alerts := func(codes ...alert) []ROBOTResponse {
+		var responses []ROBOTResponse
+		for i, code := range codes {
+			a := makeAlertLog(false, alertLevelError, code)
+			responses = append(responses, ROBOTResponse{Variant: robotVariants[i], Finished: true, Response: "alert", Alert: &a})
+		}
+		return responses
+	}
+	mac := alertBadRecordMAC
+	tests := []struct {
+		responses []ROBOTResponse
+		oracle    string
+	}{
+		{alerts(mac, mac, mac, mac, mac, mac), ROBOTOracleNone},
+		{alerts(alertDecryptError, mac, mac, mac, mac, mac), ROBOTOracleWeak},
+		{alerts(mac, alertHandshakeFailure, mac, mac, mac, mac), ROBOTOracleStrong},
+		{append(alerts(mac, mac, mac, mac, mac, mac), ROBOTResponse{Variant: ROBOTCorrect, Response: "timeout"}, ROBOTResponse{Variant: ROBOTWrongPrefix, Response: "eof"}), ROBOTOracleWeak},
+	}
+	for i, test := range tests {
+		if oracle := classifyROBOT(test.responses); oracle != test.oracle {
+			t.Errorf("#%d: got %s, expected %s", i, oracle, test.oracle)
+		}
+	}
+}
+
+func TestROBOTNotVulnerable(t *testing.T) {
+	e := &Enumerator{Dial: enumerationDialer(testConfig), Timeout: 250 * time.Millisecond}
+	result, err := e.ROBOT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil {
+		t.Fatal("RSA key exchange was not detected")
+	}
+	if result.Vulnerable || result.Oracle != ROBOTOracleNone {
+		t.Errorf("got oracle %s", result.Oracle)
+	}
+	if len(result.Responses) != 2*len(robotVariants) {
+		t.Fatalf("got %d responses", len(result.Responses))
+	}
+	for _, r := range result.Responses {
+		if r.Finished && (r.Alert == nil || r.Alert.Code != uint8(alertBadRecordMAC)) || !r.Finished && r.Response != "timeout" {
+			t.Errorf("got response %+v", r)
+		}
+	}
+	if _, err := json.Marshal(result); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestROBOTWithoutRSA(t *testing.T) {
+	config := testConfig.Clone()
+	config.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	result, err := (&Enumerator{Dial: enumerationDialer(config)}).ROBOT()
+	if err != nil || result != nil {
+		t.Errorf("got %+v, %v", result, err)
+	}
+}
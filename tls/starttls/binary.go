@@ -0,0 +1,350 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package starttls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ldapStartTLSOID names the StartTLS extended operation.
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// ldapStartTLSRequest is an LDAPMessage with messageID 1 holding an
+// ExtendedRequest for StartTLS.
+var ldapStartTLSRequest = append([]byte{
+	0x30, 0x1d, // LDAPMessage
+	0x02, 0x01, 0x01, // messageID
+	0x77, 0x18, // [APPLICATION 23] ExtendedRequest
+	0x80, 0x16, // [0] requestName
+}, ldapStartTLSOID...)
+
+// LDAPResult is the LDAPResult of the server's ExtendedResponse to a
+// StartTLS request.
+type LDAPResult struct {
+	ResultCode        int    `json:"result_code"`
+	MatchedDN         string `json:"matched_dn,omitempty"`
+	DiagnosticMessage string `json:"diagnostic_message,omitempty"`
+}
+
+// berLimit bounds the length of a BER element read from the server.
+const berLimit = 1 << 16
+
+// readBER reads a BER element, returning its tag and contents. LDAP
+// servers need not use the shortest length encoding, so neither is it
+// required here.
+func (s *session) readBER() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(s.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return 0, nil, errors.New("starttls: unsupported BER length")
+		}
+		var lengthBytes [4]byte
+		if _, err := io.ReadFull(s.r, lengthBytes[4-n:]); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint32(lengthBytes[:]))
+	}
+	if length > berLimit {
+		return 0, nil, errors.New("starttls: BER element too long")
+	}
+	contents := make([]byte, length)
+	if _, err := io.ReadFull(s.r, contents); err != nil {
+		return 0, nil, err
+	}
+	return header[0], contents, nil
+}
+
+// parseBER splits the first BER element off data.
+func parseBER(data []byte) (tag byte, contents, rest []byte, ok bool) {
+	if len(data) < 2 {
+		return
+	}
+	tag, length, data := data[0], int(data[1]), data[2:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(data) < n {
+			return
+		}
+		length = 0
+		for _, b := range data[:n] {
+			length = length<<8 | int(b)
+		}
+		data = data[n:]
+	}
+	if length < 0 || length > len(data) {
+		return
+	}
+	return tag, data[:length], data[length:], true
+}
+
+func (s *session) ldap() error {
+	if _, err := s.conn.Write(ldapStartTLSRequest); err != nil {
+		return err
+	}
+	tag, message, err := s.readBER()
+	if err != nil {
+		return err
+	}
+	malformed := errors.New("starttls: malformed LDAP response")
+	if tag != 0x30 {
+		return malformed
+	}
+	// LDAPMessage ::= SEQUENCE { messageID, protocolOp, ... }
+	tag, id, message, ok := parseBER(message)
+	if !ok || tag != 0x02 || !bytes.Equal(id, []byte{1}) {
+		return malformed
+	}
+	// ExtendedResponse ::= [APPLICATION 24] SEQUENCE { COMPONENTS OF
+	// LDAPResult, responseName [10] LDAPOID OPTIONAL, ... }
+	tag, response, _, ok := parseBER(message)
+	if !ok || tag != 0x78 {
+		return malformed
+	}
+	tag, resultCode, response, ok := parseBER(response)
+	if !ok || tag != 0x0a || len(resultCode) == 0 || len(resultCode) > 4 {
+		return malformed
+	}
+	tag, matchedDN, response, ok := parseBER(response)
+	if !ok || tag != 0x04 {
+		return malformed
+	}
+	tag, diagnosticMessage, _, ok := parseBER(response)
+	if !ok || tag != 0x04 {
+		return malformed
+	}
+	result := &LDAPResult{
+		MatchedDN:         string(matchedDN),
+		DiagnosticMessage: string(diagnosticMessage),
+	}
+	for _, b := range resultCode {
+		result.ResultCode = result.ResultCode<<8 | int(b)
+	}
+	s.log.LDAP = result
+	s.log.Response = fmt.Sprintf("%d %s", result.ResultCode, result.DiagnosticMessage)
+	if result.ResultCode != 0 {
+		return ErrRefused
+	}
+	return nil
+}
+
+// postgresSSLRequest is the SSLRequest message: its length, and the request
+// code 80877103.
+var postgresSSLRequest = []byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f}
+
+func (s *session) postgres() error {
+	if _, err := s.conn.Write(postgresSSLRequest); err != nil {
+		return err
+	}
+	response, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	// The server answers S to proceed and N to refuse. Servers too old to
+	// know SSLRequest send an ErrorResponse, beginning with E.
+	s.log.Response = string(response)
+	if response != 'S' {
+		return ErrRefused
+	}
+	return nil
+}
+
+// MySQL capability flags.
+const (
+	mysqlClientLongPassword     = 0x00000001
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientSSL              = 0x00000800
+	mysqlClientSecureConnection = 0x00008000
+
+	// mysqlCharsetUTF8 is utf8_general_ci.
+	mysqlCharsetUTF8 = 33
+
+	mysqlMaxPacket = 1 << 24
+)
+
+// MySQLHandshake is the server's initial handshake packet.
+type MySQLHandshake struct {
+	ProtocolVersion byte   `json:"protocol_version"`
+	ServerVersion   string `json:"server_version"`
+	ConnectionID    uint32 `json:"connection_id"`
+	CapabilityFlags uint32 `json:"capability_flags"`
+	CharacterSet    byte   `json:"character_set"`
+	StatusFlags     uint16 `json:"status_flags"`
+}
+
+// readMySQLPacket reads a packet, returning its sequence number and
+// payload.
+func (s *session) readMySQLPacket() (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(s.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(s.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[3], payload, nil
+}
+
+// parseMySQLHandshake parses a HandshakeV10 packet up to the upper half of
+// the capability flags, which is all that an SSLRequest needs.
+func parseMySQLHandshake(data []byte) (*MySQLHandshake, bool) {
+	if len(data) < 1 || data[0] != 10 {
+		return nil, false
+	}
+	h := &MySQLHandshake{ProtocolVersion: data[0]}
+	data = data[1:]
+	end := bytes.IndexByte(data, 0)
+	if end == -1 {
+		return nil, false
+	}
+	h.ServerVersion = string(data[:end])
+	data = data[end+1:]
+	// connection_id, auth-plugin-data-part-1, filler, the lower
+	// capability flags, character_set, status_flags and the upper
+	// capability flags.
+	if len(data) < 4+8+1+2+1+2+2 {
+		return nil, false
+	}
+	h.ConnectionID = binary.LittleEndian.Uint32(data)
+	data = data[4+8+1:]
+	h.CapabilityFlags = uint32(binary.LittleEndian.Uint16(data))
+	h.CharacterSet = data[2]
+	h.StatusFlags = binary.LittleEndian.Uint16(data[3:])
+	h.CapabilityFlags |= uint32(binary.LittleEndian.Uint16(data[5:])) << 16
+	return h, true
+}
+
+func (s *session) mysql() error {
+	sequence, packet, err := s.readMySQLPacket()
+	if err != nil {
+		return err
+	}
+	if len(packet) > 0 && packet[0] == 0xff {
+		// ERR_Packet: the code, and a message which, sent before the
+		// handshake, has no SQL state.
+		if len(packet) < 3 {
+			return errors.New("starttls: malformed MySQL error")
+		}
+		s.log.Banner = string(packet[3:])
+		return fmt.Errorf("starttls: MySQL error %d: %s", binary.LittleEndian.Uint16(packet[1:]), packet[3:])
+	}
+	handshake, ok := parseMySQLHandshake(packet)
+	if !ok {
+		return errors.New("starttls: malformed MySQL handshake")
+	}
+	s.log.MySQL = handshake
+	s.log.Banner = handshake.ServerVersion
+	if handshake.CapabilityFlags&mysqlClientSSL == 0 {
+		return ErrNotOffered
+	}
+
+	// SSLRequest: capability flags, max packet size, character set and
+	// 23 bytes of filler.
+	request := make([]byte, 4+32)
+	request[0] = 32
+	request[3] = sequence + 1
+	binary.LittleEndian.PutUint32(request[4:], mysqlClientLongPassword|mysqlClientProtocol41|mysqlClientSSL|mysqlClientSecureConnection)
+	binary.LittleEndian.PutUint32(request[8:], mysqlMaxPacket)
+	request[12] = mysqlCharsetUTF8
+	_, err = s.conn.Write(request)
+	return err
+}
+
+// RDP security protocols.
+const (
+	RDPProtocolRDP    = 0
+	RDPProtocolSSL    = 1
+	RDPProtocolHybrid = 2
+)
+
+// RDP negotiation message types.
+const (
+	rdpNegotiationRequest  = 1
+	rdpNegotiationResponse = 2
+	rdpNegotiationFailure  = 3
+)
+
+// RDPNegotiation is the negotiation data of the server's X.224 Connection
+// Confirm. SelectedProtocol is set in a response, and FailureCode in a
+// failure.
+type RDPNegotiation struct {
+	Failure          bool   `json:"failure,omitempty"`
+	Flags            byte   `json:"flags"`
+	SelectedProtocol uint32 `json:"selected_protocol"`
+	FailureCode      uint32 `json:"failure_code,omitempty"`
+}
+
+// rdpConnectionRequest is a TPKT holding an X.224 Connection Request with
+// an RDP Negotiation Request for PROTOCOL_SSL.
+var rdpConnectionRequest = []byte{
+	0x03, 0x00, 0x00, 0x13, // TPKT header
+	0x0e, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00, // X.224 Connection Request
+	rdpNegotiationRequest, 0x00, 0x08, 0x00, RDPProtocolSSL, 0x00, 0x00, 0x00,
+}
+
+func (s *session) rdp() error {
+	if _, err := s.conn.Write(rdpConnectionRequest); err != nil {
+		return err
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(s.r, header[:]); err != nil {
+		return err
+	}
+	length := int(binary.BigEndian.Uint16(header[2:]))
+	if header[0] != 3 || length < 4+7 {
+		return errors.New("starttls: malformed TPKT")
+	}
+	tpdu := make([]byte, length-4)
+	if _, err := io.ReadFull(s.r, tpdu); err != nil {
+		return err
+	}
+	// An X.224 Connection Confirm, with the negotiation data following
+	// its fixed part.
+	if tpdu[1] != 0xd0 {
+		return errors.New("starttls: malformed X.224 Connection Confirm")
+	}
+	data := tpdu[7:]
+	if len(data) < 8 {
+		// Servers which only know standard RDP security send no
+		// negotiation data.
+		return ErrNotOffered
+	}
+	negotiation := &RDPNegotiation{Flags: data[1]}
+	s.log.RDP = negotiation
+	value := binary.LittleEndian.Uint32(data[4:])
+	switch data[0] {
+	case rdpNegotiationResponse:
+		negotiation.SelectedProtocol = value
+		if value != RDPProtocolSSL {
+			return ErrRefused
+		}
+		return nil
+	case rdpNegotiationFailure:
+		negotiation.Failure = true
+		negotiation.FailureCode = value
+		return ErrRefused
+	}
+	return errors.New("starttls: malformed RDP negotiation")
+}
@@ -0,0 +1,246 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+// Package starttls upgrades plaintext connections to TLS. It speaks the
+// preamble of each supported protocol up to the point where the server
+// expects a ClientHello, recording the banners and capabilities the server
+// sent on the way, and then runs the handshake with a tls.Client.
+package starttls
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/zmap/zcrypto/tls"
+)
+
+// Protocol names a plaintext protocol with a way to upgrade to TLS.
+type Protocol string
+
+const (
+	SMTP       Protocol = "smtp"       // STARTTLS, RFC 3207
+	LMTP       Protocol = "lmtp"       // STARTTLS after LHLO, RFC 2033
+	IMAP       Protocol = "imap"       // STARTTLS, RFC 3501
+	POP3       Protocol = "pop3"       // STLS, RFC 2595
+	FTP        Protocol = "ftp"        // AUTH TLS, RFC 4217
+	XMPP       Protocol = "xmpp"       // STARTTLS, RFC 6120
+	LDAP       Protocol = "ldap"       // StartTLS extended operation, RFC 4511
+	PostgreSQL Protocol = "postgresql" // SSLRequest
+	MySQL      Protocol = "mysql"      // SSLRequest with CLIENT_SSL
+	RDP        Protocol = "rdp"        // X.224 negotiation of PROTOCOL_SSL
+)
+
+var (
+	// ErrUnsupportedProtocol is returned for a Protocol this package
+	// does not know.
+	ErrUnsupportedProtocol = errors.New("starttls: unsupported protocol")
+
+	// ErrNotOffered is returned when the server's greeting or capability
+	// list shows that it cannot upgrade to TLS, so that no request was
+	// sent.
+	ErrNotOffered = errors.New("starttls: server does not offer TLS")
+
+	// ErrRefused is returned when the server answered the request to
+	// start TLS with anything but consent.
+	ErrRefused = errors.New("starttls: server refused to start TLS")
+
+	// ErrUnexpectedData is returned when the server sent more than its
+	// answer to the request to start TLS. Data sent in the clear at that
+	// point would be read as if it had been sent over TLS, which is the
+	// STARTTLS command injection flaw.
+	ErrUnexpectedData = errors.New("starttls: server sent data after agreeing to start TLS")
+
+	errLineTooLong  = errors.New("starttls: line too long")
+	errTooManyLines = errors.New("starttls: too many lines in reply")
+)
+
+// maxLines bounds the length of a multi-line reply.
+const maxLines = 1024
+
+// Config configures an upgrade.
+type Config struct {
+	// TLS configures the client. If it is nil, or has no ServerName,
+	// Dial fills in the host it connects to.
+	TLS *tls.Config
+
+	// ClientName is the name the client gives in SMTP EHLO and LMTP
+	// LHLO. If empty, "localhost" is used.
+	ClientName string
+
+	// Domain is the domain named in the XMPP stream header. If empty,
+	// the ServerName of TLS is used.
+	Domain string
+}
+
+func (c *Config) clientName() string {
+	if c.ClientName == "" {
+		return "localhost"
+	}
+	return c.ClientName
+}
+
+func (c *Config) domain() string {
+	if c.Domain == "" && c.TLS != nil {
+		return c.TLS.ServerName
+	}
+	return c.Domain
+}
+
+// Log is the plaintext part of a connection. Banner is the server's
+// greeting and Capabilities what it offered in reply to the client's
+// capability query, one entry per line or feature. Response is the server's
+// answer to the request to start TLS. The binary protocols fill in their own
+// fields as well.
+type Log struct {
+	Protocol     Protocol        `json:"protocol"`
+	Banner       string          `json:"banner,omitempty"`
+	Capabilities []string        `json:"capabilities,omitempty"`
+	Response     string          `json:"starttls_response,omitempty"`
+	LDAP         *LDAPResult     `json:"ldap,omitempty"`
+	MySQL        *MySQLHandshake `json:"mysql,omitempty"`
+	RDP          *RDPNegotiation `json:"rdp,omitempty"`
+}
+
+// session is the plaintext part of a connection in progress.
+type session struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	config *Config
+	log    *Log
+}
+
+var preambles = map[Protocol]func(*session) error{
+	SMTP:       (*session).smtp,
+	LMTP:       (*session).lmtp,
+	IMAP:       (*session).imap,
+	POP3:       (*session).pop3,
+	FTP:        (*session).ftp,
+	XMPP:       (*session).xmpp,
+	LDAP:       (*session).ldap,
+	PostgreSQL: (*session).postgres,
+	MySQL:      (*session).mysql,
+	RDP:        (*session).rdp,
+}
+
+// Upgrade speaks the preamble of protocol on conn, and then runs a TLS
+// handshake over it. The returned Log holds what the server sent in the
+// clear, and is returned whenever the preamble was begun. If the handshake
+// fails, the *tls.Conn is returned along with the error so that its
+// handshake log can be read.
+func Upgrade(conn net.Conn, protocol Protocol, config *Config) (*tls.Conn, *Log, error) {
+	preamble, ok := preambles[protocol]
+	if !ok {
+		return nil, nil, ErrUnsupportedProtocol
+	}
+	if config == nil {
+		config = new(Config)
+	}
+	s := &session{
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+		config: config,
+		log:    &Log{Protocol: protocol},
+	}
+	if err := preamble(s); err != nil {
+		return nil, s.log, err
+	}
+	if s.r.Buffered() > 0 {
+		return nil, s.log, ErrUnexpectedData
+	}
+	tlsConfig := config.TLS
+	if tlsConfig == nil {
+		tlsConfig = new(tls.Config)
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return tlsConn, s.log, err
+	}
+	return tlsConn, s.log, nil
+}
+
+// DialWithDialer connects to addr with dialer and upgrades the connection
+// with Upgrade. The dialer's Timeout and Deadline cover the preamble and
+// handshake as well as the connection. The connection is closed if the
+// upgrade fails.
+func DialWithDialer(dialer *net.Dialer, network, addr string, protocol Protocol, config *Config) (*tls.Conn, *Log, error) {
+	deadline := dialer.Deadline
+	if dialer.Timeout != 0 {
+		timeout := time.Now().Add(dialer.Timeout)
+		if deadline.IsZero() || timeout.Before(deadline) {
+			deadline = timeout
+		}
+	}
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+	}
+
+	// Fill in the ServerName from addr, copying the configuration so as
+	// not to change the caller's.
+	c := new(Config)
+	if config != nil {
+		*c = *config
+	}
+	if c.TLS == nil || c.TLS.ServerName == "" {
+		if c.TLS == nil {
+			c.TLS = new(tls.Config)
+		} else {
+			c.TLS = c.TLS.Clone()
+		}
+		hostname := addr
+		if colon := strings.LastIndex(addr, ":"); colon != -1 {
+			hostname = addr[:colon]
+		}
+		c.TLS.ServerName = strings.Trim(hostname, "[]")
+	}
+
+	tlsConn, log, err := Upgrade(conn, protocol, c)
+	if err != nil {
+		conn.Close()
+		return tlsConn, log, err
+	}
+	if !deadline.IsZero() {
+		conn.SetDeadline(time.Time{})
+	}
+	return tlsConn, log, nil
+}
+
+// Dial connects to addr and upgrades the connection with Upgrade.
+func Dial(network, addr string, protocol Protocol, config *Config) (*tls.Conn, *Log, error) {
+	return DialWithDialer(new(net.Dialer), network, addr, protocol, config)
+}
+
+// readLine reads a line, without its line ending.
+func (s *session) readLine() (string, error) {
+	line, err := s.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// writeLine writes line with a CRLF line ending.
+func (s *session) writeLine(line string) error {
+	_, err := s.conn.Write([]byte(line + "\r\n"))
+	return err
+}
@@ -0,0 +1,341 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package starttls
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// readReply reads an SMTP or FTP reply, which continues for as long as its
+// lines have a hyphen after the code, returning its code and raw lines. An
+// FTP reply may also have lines in between which do not begin with the code.
+func (s *session) readReply() (string, []string, error) {
+	line, err := s.readLine()
+	if err != nil {
+		return "", nil, err
+	}
+	if len(line) < 3 {
+		return "", nil, fmt.Errorf("starttls: malformed reply %q", line)
+	}
+	code := line[:3]
+	lines := []string{line}
+	if len(line) == 3 || line[3] != '-' {
+		return code, lines, nil
+	}
+	for {
+		if len(lines) == maxLines {
+			return "", nil, errTooManyLines
+		}
+		if line, err = s.readLine(); err != nil {
+			return "", nil, err
+		}
+		lines = append(lines, line)
+		if strings.HasPrefix(line, code) && (len(line) == 3 || line[3] == ' ') {
+			return code, lines, nil
+		}
+	}
+}
+
+// replyText is the text of a line of an SMTP or FTP reply, without its code.
+func replyText(line, code string) string {
+	if strings.HasPrefix(line, code) && len(line) >= 4 && (line[3] == '-' || line[3] == ' ') {
+		return line[4:]
+	}
+	return strings.TrimSpace(line)
+}
+
+// hasCapability returns true if one of capabilities is name, ignoring case
+// and any parameters after it.
+func hasCapability(capabilities []string, name string) bool {
+	for _, c := range capabilities {
+		if fields := strings.Fields(c); len(fields) > 0 && strings.EqualFold(fields[0], name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *session) smtp() error {
+	return s.smtpLike("EHLO")
+}
+
+func (s *session) lmtp() error {
+	return s.smtpLike("LHLO")
+}
+
+// smtpLike speaks SMTP or LMTP, which differ in the name of the greeting.
+func (s *session) smtpLike(hello string) error {
+	code, lines, err := s.readReply()
+	if err != nil {
+		return err
+	}
+	s.log.Banner = strings.Join(lines, "\r\n")
+	if code != "220" {
+		return fmt.Errorf("starttls: unexpected banner %q", lines[0])
+	}
+	if err = s.writeLine(hello + " " + s.config.clientName()); err != nil {
+		return err
+	}
+	if code, lines, err = s.readReply(); err != nil {
+		return err
+	}
+	if code != "250" {
+		return fmt.Errorf("starttls: %s refused: %q", hello, lines[0])
+	}
+	// The first line of the reply greets the client by name.
+	for _, line := range lines[1:] {
+		s.log.Capabilities = append(s.log.Capabilities, replyText(line, code))
+	}
+	if !hasCapability(s.log.Capabilities, "STARTTLS") {
+		return ErrNotOffered
+	}
+	if err = s.writeLine("STARTTLS"); err != nil {
+		return err
+	}
+	if code, lines, err = s.readReply(); err != nil {
+		return err
+	}
+	s.log.Response = strings.Join(lines, "\r\n")
+	if code != "220" {
+		return ErrRefused
+	}
+	return nil
+}
+
+// imapCommand sends command with tag, and returns the untagged lines
+// before the tagged completion, and the completion.
+func (s *session) imapCommand(tag, command string) ([]string, string, error) {
+	if err := s.writeLine(tag + " " + command); err != nil {
+		return nil, "", err
+	}
+	var untagged []string
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return nil, "", err
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			return untagged, line, nil
+		}
+		if len(untagged) == maxLines {
+			return nil, "", errTooManyLines
+		}
+		untagged = append(untagged, line)
+	}
+}
+
+func (s *session) imap() error {
+	banner, err := s.readLine()
+	if err != nil {
+		return err
+	}
+	s.log.Banner = banner
+	if !strings.HasPrefix(banner, "* OK") && !strings.HasPrefix(banner, "* PREAUTH") {
+		return fmt.Errorf("starttls: unexpected banner %q", banner)
+	}
+	untagged, _, err := s.imapCommand("a001", "CAPABILITY")
+	if err != nil {
+		return err
+	}
+	for _, line := range untagged {
+		if fields := strings.Fields(line); len(fields) > 1 && strings.EqualFold(fields[1], "CAPABILITY") {
+			s.log.Capabilities = append(s.log.Capabilities, fields[2:]...)
+		}
+	}
+	if !hasCapability(s.log.Capabilities, "STARTTLS") {
+		return ErrNotOffered
+	}
+	_, completion, err := s.imapCommand("a002", "STARTTLS")
+	if err != nil {
+		return err
+	}
+	s.log.Response = completion
+	if !strings.HasPrefix(completion, "a002 OK") {
+		return ErrRefused
+	}
+	return nil
+}
+
+func (s *session) pop3() error {
+	banner, err := s.readLine()
+	if err != nil {
+		return err
+	}
+	s.log.Banner = banner
+	if !strings.HasPrefix(banner, "+OK") {
+		return fmt.Errorf("starttls: unexpected banner %q", banner)
+	}
+	if err = s.writeLine("CAPA"); err != nil {
+		return err
+	}
+	line, err := s.readLine()
+	if err != nil {
+		return err
+	}
+	// Servers without CAPA answer -ERR, and the capabilities are unknown.
+	if strings.HasPrefix(line, "+OK") {
+		for {
+			if line, err = s.readLine(); err != nil {
+				return err
+			}
+			if line == "." {
+				break
+			}
+			if len(s.log.Capabilities) == maxLines {
+				return errTooManyLines
+			}
+			s.log.Capabilities = append(s.log.Capabilities, strings.TrimPrefix(line, "."))
+		}
+		if !hasCapability(s.log.Capabilities, "STLS") {
+			return ErrNotOffered
+		}
+	}
+	if err = s.writeLine("STLS"); err != nil {
+		return err
+	}
+	if line, err = s.readLine(); err != nil {
+		return err
+	}
+	s.log.Response = line
+	if !strings.HasPrefix(line, "+OK") {
+		return ErrRefused
+	}
+	return nil
+}
+
+func (s *session) ftp() error {
+	code, lines, err := s.readReply()
+	if err != nil {
+		return err
+	}
+	s.log.Banner = strings.Join(lines, "\r\n")
+	if code != "220" {
+		return fmt.Errorf("starttls: unexpected banner %q", lines[0])
+	}
+	if err = s.writeLine("FEAT"); err != nil {
+		return err
+	}
+	if code, lines, err = s.readReply(); err != nil {
+		return err
+	}
+	// A FEAT reply lists one feature per line between the first and the
+	// last; servers without FEAT answer 500 or 502.
+	if code == "211" && len(lines) > 2 {
+		for _, line := range lines[1 : len(lines)-1] {
+			s.log.Capabilities = append(s.log.Capabilities, replyText(line, code))
+		}
+	}
+	if err = s.writeLine("AUTH TLS"); err != nil {
+		return err
+	}
+	if code, lines, err = s.readReply(); err != nil {
+		return err
+	}
+	s.log.Response = strings.Join(lines, "\r\n")
+	if code != "234" {
+		return ErrRefused
+	}
+	return nil
+}
+
+const (
+	xmppStreamNamespace = "http://etherx.jabber.org/streams"
+	xmppTLSNamespace    = "urn:ietf:params:xml:ns:xmpp-tls"
+
+	// xmppMaxFeatures bounds the length of the stream header and
+	// features.
+	xmppMaxFeatures = 1 << 16
+)
+
+func (s *session) xmpp() error {
+	header := fmt.Sprintf("<?xml version='1.0'?><stream:stream xmlns='jabber:client' xmlns:stream='%s' to='%s' version='1.0'>", xmppStreamNamespace, s.config.domain())
+	if _, err := s.conn.Write([]byte(header)); err != nil {
+		return err
+	}
+
+	// Read the server's stream header and features. The stream element
+	// is not closed, so the decoder is fed the text read up to the end
+	// of the features.
+	var text strings.Builder
+	for !strings.Contains(text.String(), "</stream:features>") {
+		if text.Len() > xmppMaxFeatures {
+			return errors.New("starttls: XMPP stream features too long")
+		}
+		tag, err := s.r.ReadString('>')
+		if err != nil {
+			return err
+		}
+		if strings.Contains(tag, "<stream:error") {
+			return fmt.Errorf("starttls: XMPP stream error %q", text.String()+tag)
+		}
+		text.WriteString(tag)
+	}
+	offered := false
+	decoder := xml.NewDecoder(strings.NewReader(text.String()))
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("starttls: malformed XMPP stream features: %s", err)
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			depth++
+			switch {
+			case depth == 1 && start.Name.Local == "stream":
+				s.log.Banner = streamHeader(text.String())
+			case depth == 3:
+				s.log.Capabilities = append(s.log.Capabilities, start.Name.Local)
+				if start.Name.Space == xmppTLSNamespace && start.Name.Local == "starttls" {
+					offered = true
+				}
+			}
+		}
+		if end, ok := token.(xml.EndElement); ok {
+			depth--
+			if depth == 1 && end.Name.Local == "features" {
+				break
+			}
+		}
+	}
+	if !offered {
+		return ErrNotOffered
+	}
+
+	if _, err := s.conn.Write([]byte("<starttls xmlns='" + xmppTLSNamespace + "'/>")); err != nil {
+		return err
+	}
+	response, err := s.r.ReadString('>')
+	if err != nil {
+		return err
+	}
+	s.log.Response = strings.TrimSpace(response)
+	if !strings.HasPrefix(s.log.Response, "<proceed") {
+		return ErrRefused
+	}
+	return nil
+}
+
+// streamHeader returns the opening tag of the stream element in text.
+func streamHeader(text string) string {
+	start := strings.Index(text, "<stream:stream")
+	if start == -1 {
+		return ""
+	}
+	end := strings.Index(text[start:], ">")
+	return text[start : start+end+1]
+}
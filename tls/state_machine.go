@@ -0,0 +1,679 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/zmap/zcrypto/x509"
+)
+
+// ScriptStep is one action of a scripted handshake. Send steps write a
+// message whether or not the handshake is in a state where it belongs, and
+// read steps check what the server sent back.
+type ScriptStep int
+
+const (
+	// ScriptSendClientHello sends a ClientHello.
+	ScriptSendClientHello ScriptStep = iota
+
+	// ScriptSendCertificate sends an empty Certificate message.
+	ScriptSendCertificate
+
+	// ScriptSendClientKeyExchange sends a ClientKeyExchange for the
+	// server's key exchange parameters and derives the session keys.
+	ScriptSendClientKeyExchange
+
+	// ScriptSendRSAClientKeyExchange sends a ClientKeyExchange with a
+	// premaster secret encrypted to the server's RSA key, as if the server
+	// had skipped its ServerKeyExchange, and derives the session keys.
+	ScriptSendRSAClientKeyExchange
+
+	// ScriptSendChangeCipherSpec sends a ChangeCipherSpec. Records sent
+	// afterwards are encrypted if the session keys have been derived, and
+	// sent in plaintext otherwise.
+	ScriptSendChangeCipherSpec
+
+	// ScriptSendFinished sends a Finished message over the handshake so
+	// far. Before a ClientKeyExchange, it uses an empty master secret.
+	ScriptSendFinished
+
+	// ScriptSendApplicationData sends an HTTP request as application data.
+	ScriptSendApplicationData
+
+	// ScriptReadServerFlight reads the server's messages from the
+	// ServerHello through the ServerHelloDone.
+	ScriptReadServerFlight
+
+	// ScriptReadChangeCipherSpec reads a ChangeCipherSpec and switches to
+	// the server's session keys.
+	ScriptReadChangeCipherSpec
+
+	// ScriptReadFinished reads the server's Finished message and checks
+	// it.
+	ScriptReadFinished
+
+	// ScriptExpectNoAlert waits for the response timeout, and fails if the
+	// server sends an alert or closes the connection in that time.
+	ScriptExpectNoAlert
+)
+
+func (s ScriptStep) String() string {
+	if name, ok := scriptStepNames[int(s)]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (s ScriptStep) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *ScriptStep) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	for value, n := range scriptStepNames {
+		if n == name {
+			*s = ScriptStep(value)
+			return nil
+		}
+	}
+	return errors.New("tls: unknown script step " + name)
+}
+
+func (s ScriptStep) reads() bool {
+	return s >= ScriptReadServerFlight
+}
+
+// HandshakeScript is a sequence of steps for Conn.RunScript. If CipherSuites
+// is not nil, it replaces the configured cipher suites in the ClientHello.
+type HandshakeScript struct {
+	Name         string
+	CipherSuites []uint16
+	Steps        []ScriptStep
+}
+
+// Preset scripts. Except for ScriptFullHandshake, which is a normal
+// handshake to compare against, a server that completes one of them has a
+// state machine bug, or in the case of ScriptExportRSA, supports the export
+// cipher suites a FREAK attack needs. The SMACK presets follow the message
+// sequences of the SMACK paper (Beurdouche et al., 2015). They must not be
+// modified.
+var (
+	ScriptFullHandshake = &HandshakeScript{
+		Name: "full_handshake",
+		Steps: []ScriptStep{
+			ScriptSendClientHello, ScriptReadServerFlight,
+			ScriptSendClientKeyExchange, ScriptSendChangeCipherSpec, ScriptSendFinished,
+			ScriptReadChangeCipherSpec, ScriptReadFinished,
+		},
+	}
+
+	// ScriptEarlyCCS sends a ChangeCipherSpec before the key exchange,
+	// which vulnerable servers accept and later use keys derived from an
+	// empty master secret (CVE-2014-0224).
+	ScriptEarlyCCS = &HandshakeScript{
+		Name: "early_ccs",
+		Steps: []ScriptStep{
+			ScriptSendClientHello, ScriptReadServerFlight,
+			ScriptSendChangeCipherSpec, ScriptExpectNoAlert,
+		},
+	}
+
+	// ScriptEarlyFinished skips the ClientKeyExchange and ChangeCipherSpec.
+	ScriptEarlyFinished = &HandshakeScript{
+		Name: "early_finished",
+		Steps: []ScriptStep{
+			ScriptSendClientHello, ScriptReadServerFlight,
+			ScriptSendFinished, ScriptExpectNoAlert,
+		},
+	}
+
+	// ScriptSkipChangeCipherSpec sends the Finished message unencrypted,
+	// as in the SKIP-TLS attacks.
+	ScriptSkipChangeCipherSpec = &HandshakeScript{
+		Name: "skip_change_cipher_spec",
+		Steps: []ScriptStep{
+			ScriptSendClientHello, ScriptReadServerFlight,
+			ScriptSendClientKeyExchange, ScriptSendFinished, ScriptExpectNoAlert,
+		},
+	}
+
+	// ScriptDuplicateClientHello sends a second ClientHello in place of
+	// the ClientKeyExchange.
+	ScriptDuplicateClientHello = &HandshakeScript{
+		Name: "duplicate_client_hello",
+		Steps: []ScriptStep{
+			ScriptSendClientHello, ScriptReadServerFlight,
+			ScriptSendClientHello, ScriptExpectNoAlert,
+		},
+	}
+
+	// ScriptDuplicateFinished sends a second Finished message after the
+	// handshake.
+	ScriptDuplicateFinished = &HandshakeScript{
+		Name: "duplicate_finished",
+		Steps: []ScriptStep{
+			ScriptSendClientHello, ScriptReadServerFlight,
+			ScriptSendClientKeyExchange, ScriptSendChangeCipherSpec, ScriptSendFinished,
+			ScriptReadChangeCipherSpec, ScriptReadFinished,
+			ScriptSendFinished, ScriptExpectNoAlert,
+		},
+	}
+
+	// ScriptEarlyApplicationData sends unencrypted application data in
+	// place of the ClientKeyExchange.
+	ScriptEarlyApplicationData = &HandshakeScript{
+		Name: "early_application_data",
+		Steps: []ScriptStep{
+			ScriptSendClientHello, ScriptReadServerFlight,
+			ScriptSendApplicationData, ScriptExpectNoAlert,
+		},
+	}
+
+	// ScriptSkipServerKeyExchange offers only ephemeral RSA-signed suites,
+	// then answers with an RSA key exchange as though the server had not
+	// sent its ServerKeyExchange (SMACK's skipped ServerKeyExchange).
+	ScriptSkipServerKeyExchange = &HandshakeScript{
+		Name: "skip_server_key_exchange",
+		CipherSuites: []uint16{
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_DHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_DHE_RSA_WITH_AES_256_CBC_SHA,
+		},
+		Steps: []ScriptStep{
+			ScriptSendClientHello, ScriptReadServerFlight,
+			ScriptSendRSAClientKeyExchange, ScriptSendChangeCipherSpec, ScriptSendFinished,
+			ScriptReadChangeCipherSpec, ScriptReadFinished,
+		},
+	}
+
+	// ScriptUnexpectedCertificate sends a client Certificate the server
+	// did not request (SMACK's unexpected Certificate).
+	ScriptUnexpectedCertificate = &HandshakeScript{
+		Name: "unexpected_certificate",
+		Steps: []ScriptStep{
+			ScriptSendClientHello, ScriptReadServerFlight,
+			ScriptSendCertificate, ScriptSendClientKeyExchange, ScriptSendChangeCipherSpec, ScriptSendFinished,
+			ScriptReadChangeCipherSpec, ScriptReadFinished,
+		},
+	}
+
+	// ScriptExportRSA completes a handshake offering only RSA export
+	// cipher suites.
+	ScriptExportRSA = &HandshakeScript{
+		Name: "export_rsa",
+		CipherSuites: []uint16{
+			TLS_RSA_EXPORT_WITH_RC4_40_MD5,
+			TLS_RSA_EXPORT_WITH_DES40_CBC_SHA,
+			TLS_RSA_EXPORT_WITH_RC2_CBC_40_MD5,
+		},
+		Steps: ScriptFullHandshake.Steps,
+	}
+)
+
+// stateMachineScripts are the presets run by Enumerator.StateMachine after
+// ScriptFullHandshake.
+var stateMachineScripts = []*HandshakeScript{
+	ScriptEarlyCCS,
+	ScriptEarlyFinished,
+	ScriptSkipChangeCipherSpec,
+	ScriptDuplicateClientHello,
+	ScriptDuplicateFinished,
+	ScriptEarlyApplicationData,
+	ScriptSkipServerKeyExchange,
+	ScriptUnexpectedCertificate,
+	ScriptExportRSA,
+}
+
+// scriptResponseTimeout is how long Enumerator waits in a
+// ScriptExpectNoAlert step.
+const scriptResponseTimeout = 500 * time.Millisecond
+
+// scriptApplicationData is sent by ScriptSendApplicationData.
+var scriptApplicationData = []byte("GET / HTTP/1.0\r\n\r\n")
+
+// ScriptStepResult records the outcome of one step. A read step is Accepted
+// if it succeeded, and a send step once a later read step succeeded, since
+// the server only shows what it made of a message in its reply. Messages
+// lists the handshake messages read by ScriptReadServerFlight. If the step
+// failed, Response is as for ROBOTResponse, or "invalid_response" if the
+// server's message could not be used, or "invalid_script" if the step
+// cannot run at this point of the script.
+type ScriptStepResult struct {
+	Step     ScriptStep `json:"step"`
+	Accepted bool       `json:"accepted"`
+	Messages []string   `json:"messages,omitempty"`
+	Response string     `json:"response,omitempty"`
+	Alert    *Alert     `json:"alert,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// ScriptResult is the result of Conn.RunScript. Completed is true if every
+// step ran without an error. Steps stops at the first failed step.
+type ScriptResult struct {
+	Script    string             `json:"script"`
+	Completed bool               `json:"completed"`
+	Steps     []ScriptStepResult `json:"steps"`
+}
+
+// scriptError is an error found by the script engine rather than reported
+// by the connection. response is used as ScriptStepResult.Response.
+type scriptError struct {
+	response string
+	err      error
+}
+
+func (e scriptError) Error() string {
+	return e.err.Error()
+}
+
+func invalidResponse(err error) error {
+	return scriptError{"invalid_response", err}
+}
+
+func invalidScript(msg string) error {
+	return scriptError{"invalid_script", errors.New("tls: " + msg)}
+}
+
+var errScriptedHandshake = errors.New("tls: connection was used for a scripted handshake")
+
+// scriptState is the handshake state built up by the steps of a script.
+type scriptState struct {
+	c               *Conn
+	script          *HandshakeScript
+	responseTimeout time.Duration
+	hello           *clientHelloMsg
+	helloBytes      []byte // the ClientHello as it was last sent
+	hs              *clientHandshakeState
+	serverCert      *x509.Certificate
+	keyAgreement    keyAgreement
+	keysReady       bool
+}
+
+// RunScript runs script on a new client connection instead of a handshake,
+// and returns which steps the server accepted. The server's certificate is
+// not verified. ScriptExpectNoAlert steps wait for responseTimeout, then
+// clear the read deadline. The result is also stored in the handshake log.
+// The connection cannot be used afterwards, and should be closed.
+func (c *Conn) RunScript(script *HandshakeScript, responseTimeout time.Duration) (*ScriptResult, error) {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	if !c.isClient || c.handshakeComplete || c.handshakeErr != nil || c.handshakeLog != nil {
+		return nil, errors.New("tls: RunScript requires a new client connection")
+	}
+	if c.isDTLS {
+		return nil, errors.New("tls: RunScript is not supported over DTLS")
+	}
+	if c.config == nil {
+		c.config = defaultConfig()
+	}
+	c.handshakeLog = new(ServerHandshake)
+	c.heartbleedLog = new(Heartbleed)
+	c.handshakeErr = errScriptedHandshake
+
+	s := &scriptState{c: c, script: script, responseTimeout: responseTimeout}
+	result := &ScriptResult{Script: script.Name}
+	lastRead := -1
+	for i, step := range script.Steps {
+		r := ScriptStepResult{Step: step}
+		if err := s.run(step, &r); err != nil {
+			if se, ok := err.(scriptError); ok {
+				r.Response = se.response
+			} else {
+				r.Response, r.Alert = describeProbeError(err)
+			}
+			r.Error = err.Error()
+			result.Steps = append(result.Steps, r)
+			c.handshakeLog.Script = result
+			return result, nil
+		}
+		result.Steps = append(result.Steps, r)
+		if step.reads() {
+			for j := lastRead + 1; j <= i; j++ {
+				result.Steps[j].Accepted = true
+			}
+			lastRead = i
+		}
+	}
+	result.Completed = true
+	c.handshakeLog.Script = result
+	return result, nil
+}
+
+func (s *scriptState) run(step ScriptStep, r *ScriptStepResult) error {
+	c := s.c
+	switch step {
+	case ScriptSendClientHello:
+		if s.hello == nil {
+			if err := s.makeClientHello(); err != nil {
+				return err
+			}
+		}
+		helloBytes, err := c.marshalHandshake(s.hello)
+		if err != nil {
+			return err
+		}
+		s.helloBytes = helloBytes
+		_, err = c.writeRecord(recordTypeHandshake, helloBytes)
+		return err
+
+	case ScriptSendCertificate:
+		certMsg := new(certificateMsg)
+		certBytes, err := c.marshalHandshake(certMsg)
+		if err != nil {
+			return err
+		}
+		if s.hs != nil {
+			s.hs.finishedHash.Write(certBytes)
+		}
+		c.handshakeLog.ClientCertificates = certMsg.MakeLog()
+		_, err = c.writeRecord(recordTypeHandshake, certBytes)
+		return err
+
+	case ScriptSendClientKeyExchange:
+		return s.sendClientKeyExchange(s.keyAgreement)
+
+	case ScriptSendRSAClientKeyExchange:
+		return s.sendClientKeyExchange(rsaKA(c.vers))
+
+	case ScriptSendChangeCipherSpec:
+		if s.keysReady {
+			_, err := c.writeRecord(recordTypeChangeCipherSpec, []byte{1})
+			return err
+		}
+		c.setHandshakeStage("change_cipher_spec")
+		vers := c.vers
+		if vers == 0 {
+			vers = VersionTLS10
+		}
+		_, err := c.write(rawRecord(recordTypeChangeCipherSpec, vers, []byte{1}))
+		return err
+
+	case ScriptSendFinished:
+		if s.hs == nil {
+			return invalidScript("a scripted Finished message requires a ServerHello")
+		}
+		finished := new(finishedMsg)
+		finished.verifyData = s.hs.finishedHash.clientSum(s.hs.masterSecret)
+		finishedBytes, err := c.marshalHandshake(finished)
+		if err != nil {
+			return err
+		}
+		s.hs.finishedHash.Write(finishedBytes)
+		c.handshakeLog.ClientFinished = finished.MakeLog()
+		_, err = c.writeRecord(recordTypeHandshake, finishedBytes)
+		return err
+
+	case ScriptSendApplicationData:
+		_, err := c.writeRecord(recordTypeApplicationData, scriptApplicationData)
+		return err
+
+	case ScriptReadServerFlight:
+		return s.readServerFlight(r)
+
+	case ScriptReadChangeCipherSpec:
+		if err := c.readRecord(recordTypeChangeCipherSpec); err != nil {
+			return err
+		}
+		return c.in.error()
+
+	case ScriptReadFinished:
+		msg, err := c.readHandshake()
+		if err != nil {
+			return err
+		}
+		serverFinished, ok := msg.(*finishedMsg)
+		if !ok {
+			return invalidResponse(unexpectedMessageError(serverFinished, msg))
+		}
+		c.handshakeLog.ServerFinished = serverFinished.MakeLog()
+		if s.hs == nil {
+			return invalidScript("a scripted Finished message requires a ServerHello")
+		}
+		verify := s.hs.finishedHash.serverSum(s.hs.masterSecret)
+		if len(verify) != len(serverFinished.verifyData) ||
+			subtle.ConstantTimeCompare(verify, serverFinished.verifyData) != 1 {
+			return invalidResponse(errors.New("tls: server's Finished message was incorrect"))
+		}
+		s.hs.finishedHash.Write(serverFinished.marshal())
+		return nil
+
+	case ScriptExpectNoAlert:
+		c.SetReadDeadline(time.Now().Add(s.responseTimeout))
+		err := c.readRecord(recordTypeHandshake)
+		c.SetReadDeadline(time.Time{})
+		if err == nil {
+			r.Response = "handshake"
+			return nil
+		}
+		response, _ := describeProbeError(err)
+		switch response {
+		case "timeout":
+			r.Response = response
+			return nil
+		case "unexpected_record":
+			// The server sent a record that was not an alert.
+			r.Response = response
+			return nil
+		}
+		return err
+	}
+	return invalidScript("unknown script step " + step.String())
+}
+
+// makeClientHello builds the ClientHello sent by the script.
+func (s *scriptState) makeClientHello() error {
+	config := s.c.config
+	suites := s.script.CipherSuites
+	if suites == nil {
+		suites = config.cipherSuites()
+	}
+	hello := &clientHelloMsg{
+		vers:                 config.maxVersion(),
+		random:               make([]byte, 32),
+		cipherSuites:         suites,
+		compressionMethods:   []uint8{compressionNone},
+		serverName:           config.ServerName,
+		supportedCurves:      config.supportedGroups(suites),
+		supportedPoints:      []uint8{pointFormatUncompressed},
+		secureRenegotiation:  true,
+		extendedMasterSecret: config.maxVersion() >= VersionTLS10 && config.ExtendedMasterSecret,
+	}
+	if hello.vers >= VersionTLS12 {
+		hello.signatureAndHashes = config.signatureAndHashesForClient()
+	}
+	if _, err := io.ReadFull(config.rand(), hello.random); err != nil {
+		return err
+	}
+	s.hello = hello
+	s.c.handshakeLog.ClientHello = hello.MakeLog()
+	return nil
+}
+
+// readServerFlight reads the messages from the ServerHello through the
+// ServerHelloDone, and keeps what is needed for the key exchange.
+func (s *scriptState) readServerFlight(r *ScriptStepResult) error {
+	c := s.c
+	if s.hello == nil {
+		return invalidScript("a server flight can only be read after a ClientHello")
+	}
+	for {
+		msg, err := c.readHandshake()
+		if err != nil {
+			return err
+		}
+		c.alertLogMutex.Lock()
+		r.Messages = append(r.Messages, c.handshakeStage)
+		c.alertLogMutex.Unlock()
+
+		if serverHello, ok := msg.(*serverHelloMsg); ok && s.hs == nil {
+			c.handshakeLog.ServerHello = serverHello.MakeLog()
+			vers, ok := c.config.mutualVersion(serverHello.vers)
+			if !ok {
+				return invalidResponse(errors.New("tls: server selected an unsupported protocol version"))
+			}
+			suite := mutualCipherSuite(s.hello.cipherSuites, serverHello.cipherSuite)
+			if suite == nil {
+				return invalidResponse(errors.New("tls: server selected a cipher suite that was not offered"))
+			}
+			c.vers, c.haveVers = vers, true
+			s.hs = &clientHandshakeState{
+				c:            c,
+				hello:        s.hello,
+				serverHello:  serverHello,
+				suite:        suite,
+				finishedHash: newFinishedHash(vers, suite),
+			}
+			s.hs.finishedHash.Write(s.helloBytes)
+			s.hs.finishedHash.Write(serverHello.marshal())
+			s.keyAgreement = suite.ka(vers)
+			continue
+		}
+		if s.hs == nil {
+			return invalidResponse(unexpectedMessageError(new(serverHelloMsg), msg))
+		}
+
+		switch m := msg.(type) {
+		case *certificateMsg:
+			c.handshakeLog.ServerCertificates = m.MakeLog()
+			if len(m.certificates) > 0 {
+				if s.serverCert, err = x509.ParseCertificate(m.certificates[0]); err != nil {
+					return invalidResponse(errors.New("tls: failed to parse certificate from server: " + err.Error()))
+				}
+			}
+		case *certificateStatusMsg:
+		case *serverKeyExchangeMsg:
+			if s.serverCert == nil && s.hs.suite.flags&suiteAnon == 0 {
+				return invalidResponse(errors.New("tls: ServerKeyExchange without a server certificate"))
+			}
+			err := s.keyAgreement.processServerKeyExchange(c.config, s.hello, s.hs.serverHello, s.serverCert, m)
+			c.handshakeLog.ServerKeyExchange = m.MakeLog(s.keyAgreement)
+			if err != nil {
+				return invalidResponse(err)
+			}
+		case *certificateRequestMsg:
+			c.handshakeLog.CertificateRequest = m.MakeLog()
+		case *serverHelloDoneMsg:
+		default:
+			return invalidResponse(unexpectedMessageError(new(serverHelloDoneMsg), msg))
+		}
+		s.hs.finishedHash.Write(msg.(handshakeMessage).marshal())
+		if _, ok := msg.(*serverHelloDoneMsg); ok {
+			return nil
+		}
+	}
+}
+
+// sendClientKeyExchange sends a ClientKeyExchange made with ka and prepares
+// the session keys, which take effect with the next ChangeCipherSpec sent or
+// received.
+func (s *scriptState) sendClientKeyExchange(ka keyAgreement) error {
+	c := s.c
+	hs := s.hs
+	if hs == nil {
+		return invalidScript("a scripted ClientKeyExchange requires a ServerHello")
+	}
+	if s.serverCert == nil {
+		if _, ok := ka.(*rsaKeyAgreement); ok || hs.suite.flags&suiteAnon == 0 {
+			return invalidResponse(errors.New("tls: server sent no certificate to key the ClientKeyExchange with"))
+		}
+	}
+	preMasterSecret, ckx, err := ka.generateClientKeyExchange(c.config, s.hello, s.serverCert)
+	if err != nil {
+		return invalidResponse(err)
+	}
+	c.handshakeLog.ClientKeyExchange = ckx.MakeLog(ka)
+	if ckx != nil {
+		ckxBytes, err := c.marshalHandshake(ckx)
+		if err != nil {
+			return err
+		}
+		hs.finishedHash.Write(ckxBytes)
+		if _, err := c.writeRecord(recordTypeHandshake, ckxBytes); err != nil {
+			return err
+		}
+	}
+
+	if hs.serverHello.extendedMasterSecret && c.vers >= VersionTLS10 {
+		hs.masterSecret = extendedMasterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret, hs.finishedHash)
+		c.extendedMasterSecret = true
+	} else {
+		hs.masterSecret = masterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret, s.hello.random, hs.serverHello.random)
+	}
+	if err := hs.establishKeys(); err != nil {
+		return err
+	}
+	s.keysReady = true
+	return nil
+}
+
+// StateMachineResult is the result of Enumerator.StateMachine. Vulnerable
+// lists the names of the preset scripts the server completed.
+type StateMachineResult struct {
+	Scripts    []ScriptResult `json:"scripts"`
+	Vulnerable []string       `json:"vulnerable,omitempty"`
+}
+
+// RunScript runs script on a new connection.
+func (e *Enumerator) RunScript(script *HandshakeScript) (*ScriptResult, error) {
+	conn, err := e.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if e.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(e.Timeout))
+	}
+	responseTimeout := scriptResponseTimeout
+	if e.Timeout > 0 && e.Timeout < responseTimeout {
+		responseTimeout = e.Timeout
+	}
+	return Client(conn, e.baseConfig()).RunScript(script, responseTimeout)
+}
+
+// StateMachine probes the server for state machine bugs by running each
+// preset script on a separate connection. It returns nil if the server does
+// not complete ScriptFullHandshake, since the presets could not be told
+// apart from an incompatible server.
+func (e *Enumerator) StateMachine() (*StateMachineResult, error) {
+	baseline, err := e.RunScript(ScriptFullHandshake)
+	if err != nil {
+		return nil, err
+	}
+	if !baseline.Completed {
+		return nil, nil
+	}
+	result := &StateMachineResult{Scripts: []ScriptResult{*baseline}}
+	for _, script := range stateMachineScripts {
+		r, err := e.RunScript(script)
+		if err != nil {
+			return nil, err
+		}
+		result.Scripts = append(result.Scripts, *r)
+		if r.Completed {
+			result.Vulnerable = append(result.Vulnerable, script.Name)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,155 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestScriptFullHandshake(t *testing.T) {
+	e := &Enumerator{Dial: enumerationDialer(testConfig), Timeout: time.Second}
+	result, err := e.RunScript(ScriptFullHandshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Completed || len(result.Steps) != len(ScriptFullHandshake.Steps) {
+		t.Fatalf("got result %+v", result)
+	}
+	for _, step := range result.Steps {
+		if !step.Accepted {
+			t.Errorf("step %s was not accepted", step.Step)
+		}
+	}
+	flight := result.Steps[1].Messages
+	if len(flight) < 3 || flight[0] != "server_hello" || flight[len(flight)-1] != "server_hello_done" {
+		t.Errorf("got server flight %v", flight)
+	}
+
+	b, err := json.Marshal(result.Steps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var step ScriptStepResult
+	if err := json.Unmarshal(b, &step); err != nil {
+		t.Fatal(err)
+	}
+	if step.Step != ScriptSendClientHello {
+		t.Errorf("step %s did not round trip through %s", result.Steps[0].Step, b)
+	}
+}
+
+func TestScriptInvalid(t *testing.T) {
+	e := &Enumerator{Dial: enumerationDialer(testConfig), Timeout: time.Second}
+	result, err := e.RunScript(&HandshakeScript{Steps: []ScriptStep{ScriptSendClientKeyExchange}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Completed || len(result.Steps) != 1 || result.Steps[0].Response != "invalid_script" {
+		t.Errorf("got result %+v", result)
+	}
+}
+
+func TestStateMachine(t *testing.T) {
+	e := &Enumerator{Dial: echoDialer(testConfig), Timeout: time.Second}
+	result, err := e.StateMachine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result == nil {
+		t.Fatal("full handshake did not complete")
+	}
+	if len(result.Vulnerable) > 0 {
+		t.Errorf("server accepted %v", result.Vulnerable)
+	}
+	if len(result.Scripts) != len(stateMachineScripts)+1 {
+		t.Fatalf("got %d scripts", len(result.Scripts))
+	}
+	early := result.Scripts[1]
+	if early.Script != ScriptEarlyCCS.Name || len(early.Steps) != len(ScriptEarlyCCS.Steps) {
+		t.Fatalf("got early CCS result %+v", early)
+	}
+	last := early.Steps[len(early.Steps)-1]
+	if last.Response != "alert" || last.Alert == nil || last.Alert.Code != uint8(alertUnexpectedMessage) {
+		t.Errorf("got early CCS response %+v", last)
+	}
+	if early.Steps[2].Accepted {
+		t.Error("early ChangeCipherSpec was accepted")
+	}
+}
+
+func TestScriptRSAClientKeyExchange(t *testing.T) {
+	config := testConfig.Clone()
+	config.CipherSuites = []uint16{TLS_RSA_WITH_AES_128_CBC_SHA}
+	e := &Enumerator{Dial: enumerationDialer(config), Timeout: time.Second}
+	script := &HandshakeScript{Steps: ScriptSkipServerKeyExchange.Steps}
+	result, err := e.RunScript(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Completed {
+		t.Errorf("RSA key exchange was not accepted: %+v", result)
+	}
+}
+
+func TestScriptSMACK(t *testing.T) {
+	e := &Enumerator{Dial: enumerationDialer(testConfig), Timeout: time.Second}
+	for _, script := range []*HandshakeScript{ScriptSkipServerKeyExchange, ScriptUnexpectedCertificate} {
+		result, err := e.RunScript(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Completed || len(result.Steps) < 3 {
+			t.Fatalf("%s: got result %+v", script.Name, result)
+		}
+		if !result.Steps[1].Accepted {
+			t.Errorf("%s: server flight was not read", script.Name)
+		}
+		for _, step := range result.Steps[2:] {
+			if step.Accepted {
+				t.Errorf("%s: step %s was accepted", script.Name, step.Step)
+			}
+		}
+	}
+}
+
+func TestScriptNoServerCertificate(t *testing.T) {
+	for _, suite := range []uint16{TLS_RSA_WITH_AES_128_CBC_SHA, TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA} {
+		config := testConfig.Clone()
+		config.CipherSuites = []uint16{suite}
+		config.HandshakeHook = &recordingHook{
+			send: func(m *HandshakeMessage) error {
+				if m.Type == typeCertificate {
+					m.Raw = []byte{typeCertificate, 0, 0, 3, 0, 0, 0}
+				}
+				return nil
+			},
+		}
+		e := &Enumerator{Dial: enumerationDialer(config), Timeout: time.Second}
+		result, err := e.RunScript(ScriptFullHandshake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Completed {
+			t.Errorf("%04x: completed without a server certificate", suite)
+			continue
+		}
+		last := result.Steps[len(result.Steps)-1]
+		if last.Response != "invalid_response" {
+			t.Errorf("%04x: got response %q at %s", suite, last.Response, last.Step)
+		}
+	}
+}
@@ -24,7 +24,7 @@ import (
 // The configuration config must be non-nil and must have
 // at least one certificate.
 func Server(conn net.Conn, config *Config) *Conn {
-	return &Conn{conn: conn, config: config}
+	return &Conn{conn: conn, config: config, transcript: newTranscriptRecorder(config)}
 }
 
 // Client returns a new TLS client side connection
@@ -32,7 +32,7 @@ func Server(conn net.Conn, config *Config) *Conn {
 // The config cannot be nil: users must set either ServerName or
 // InsecureSkipVerify in the config.
 func Client(conn net.Conn, config *Config) *Conn {
-	return &Conn{conn: conn, config: config, isClient: true}
+	return &Conn{conn: conn, config: config, isClient: true, transcript: newTranscriptRecorder(config)}
 }
 
 // A listener implements a network listener (net.Listener) for TLS connections.
@@ -113,6 +113,7 @@ func DialWithDialer(dialer *net.Dialer, network, addr string, config *Config) (*
 		})
 	}
 
+	dialed := time.Now()
 	rawConn, err := dialer.Dial(network, addr)
 	if err != nil {
 		return nil, err
@@ -137,6 +138,10 @@ func DialWithDialer(dialer *net.Dialer, network, addr string, config *Config) (*
 	}
 
 	conn := Client(rawConn, config)
+	if conn.transcript != nil {
+		// Time the transcript from before the TCP connection.
+		conn.transcript.start = dialed
+	}
 
 	if timeout == 0 {
 		err = conn.Handshake()
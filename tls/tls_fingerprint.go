@@ -0,0 +1,383 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fingerprints holds the JA3, JA3S, JA4 and JA4S fingerprints of a handshake.
+// The JA3 strings are the inputs to the MD5 hashes, kept for debugging.
+type Fingerprints struct {
+	JA3        string `json:"ja3,omitempty"`
+	JA3String  string `json:"ja3_string,omitempty"`
+	JA3S       string `json:"ja3s,omitempty"`
+	JA3SString string `json:"ja3s_string,omitempty"`
+	JA4        string `json:"ja4,omitempty"`
+	JA4S       string `json:"ja4s,omitempty"`
+}
+
+// helloFields holds the values of a raw hello message that fingerprints are
+// computed over, in the order they appeared on the wire.
+type helloFields struct {
+	vers              uint16
+	cipherSuites      []uint16
+	extensions        []uint16
+	supportedCurves   []uint16
+	supportedPoints   []uint8
+	signatureAlgs     []uint16
+	alpnProtocol      string
+	serverName        bool
+	supportedVersions []uint16
+}
+
+// isGREASE returns true for the reserved values of RFC 8701, which clients
+// insert at random and which are ignored by every fingerprint.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// parseHelloFields parses a raw ClientHello or ServerHello, including the
+// handshake message header. GREASE values are dropped from every list.
+func parseHelloFields(raw []byte, client bool) (*helloFields, bool) {
+	if len(raw) < 4+2+32+1 {
+		return nil, false
+	}
+	if client && raw[0] != typeClientHello || !client && raw[0] != typeServerHello {
+		return nil, false
+	}
+	data := raw[4:]
+	f := &helloFields{vers: uint16(data[0])<<8 | uint16(data[1])}
+	data = data[2+32:]
+	sessionIDLen := int(data[0])
+	if len(data) < 1+sessionIDLen {
+		return nil, false
+	}
+	data = data[1+sessionIDLen:]
+
+	if client {
+		if len(data) < 2 {
+			return nil, false
+		}
+		cipherSuiteLen := int(data[0])<<8 | int(data[1])
+		if cipherSuiteLen%2 == 1 || len(data) < 2+cipherSuiteLen {
+			return nil, false
+		}
+		f.cipherSuites = readUint16List(data[2 : 2+cipherSuiteLen])
+		data = data[2+cipherSuiteLen:]
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return nil, false
+		}
+		data = data[1+int(data[0]):]
+	} else {
+		if len(data) < 3 {
+			return nil, false
+		}
+		f.cipherSuites = []uint16{uint16(data[0])<<8 | uint16(data[1])}
+		data = data[3:]
+	}
+
+	if len(data) == 0 {
+		return f, true
+	}
+	if len(data) < 2 {
+		return nil, false
+	}
+	extensionsLength := int(data[0])<<8 | int(data[1])
+	data = data[2:]
+	if extensionsLength != len(data) {
+		return nil, false
+	}
+	for len(data) != 0 {
+		if len(data) < 4 {
+			return nil, false
+		}
+		extension := uint16(data[0])<<8 | uint16(data[1])
+		length := int(data[2])<<8 | int(data[3])
+		data = data[4:]
+		if len(data) < length {
+			return nil, false
+		}
+		body := data[:length]
+		data = data[length:]
+		if isGREASE(extension) {
+			continue
+		}
+		f.extensions = append(f.extensions, extension)
+
+		switch extension {
+		case extensionServerName:
+			f.serverName = true
+		case extensionSupportedCurves:
+			if len(body) >= 2 {
+				f.supportedCurves = readUint16List(body[2:])
+			}
+		case extensionSupportedPoints:
+			if len(body) >= 1 && len(body) >= 1+int(body[0]) {
+				f.supportedPoints = body[1 : 1+int(body[0])]
+			}
+		case extensionSignatureAlgorithms:
+			if len(body) >= 2 {
+				f.signatureAlgs = readUint16List(body[2:])
+			}
+		case extensionALPN:
+			if len(body) >= 3 && len(body) >= 3+int(body[2]) {
+				f.alpnProtocol = string(body[3 : 3+int(body[2])])
+			}
+		case extensionSupportedVersions:
+			if client && len(body) >= 1 {
+				f.supportedVersions = readUint16List(body[1:])
+			} else if !client {
+				f.supportedVersions = readUint16List(body)
+			}
+		}
+	}
+	return f, true
+}
+
+// readUint16List reads big-endian uint16s from b, skipping GREASE values and
+// any trailing odd byte.
+func readUint16List(b []byte) []uint16 {
+	out := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		v := uint16(b[i])<<8 | uint16(b[i+1])
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinDecimal(values []uint16) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(s, "-")
+}
+
+func hexList(values []uint16) []string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = fmt.Sprintf("%04x", v)
+	}
+	return s
+}
+
+// truncatedSHA256 returns the first 12 hex characters of the SHA-256 of s, or
+// twelve zeros if s is empty.
+func truncatedSHA256(s string) string {
+	if len(s) == 0 {
+		return "000000000000"
+	}
+	digest := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(digest[:])[:12]
+}
+
+func md5Hex(s string) string {
+	digest := md5.Sum([]byte(s))
+	return hex.EncodeToString(digest[:])
+}
+
+// JA3String returns the unhashed JA3 fingerprint of hello:
+// "SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats".
+// It returns the empty string if the raw message is unavailable, as it is for
+// a ClientHello decoded from JSON.
+func JA3String(hello *ClientHello) string {
+	if hello == nil {
+		return ""
+	}
+	f, ok := parseHelloFields(hello.Raw, true)
+	if !ok {
+		return ""
+	}
+	points := make([]uint16, len(f.supportedPoints))
+	for i, p := range f.supportedPoints {
+		points[i] = uint16(p)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(f.vers)),
+		joinDecimal(f.cipherSuites),
+		joinDecimal(f.extensions),
+		joinDecimal(f.supportedCurves),
+		joinDecimal(points),
+	}, ",")
+}
+
+// JA3 returns the hex-encoded MD5 of JA3String(hello), or the empty string if
+// the raw message is unavailable.
+func JA3(hello *ClientHello) string {
+	s := JA3String(hello)
+	if len(s) == 0 {
+		return ""
+	}
+	return md5Hex(s)
+}
+
+// JA3SString returns the unhashed JA3S fingerprint of hello:
+// "SSLVersion,Cipher,Extensions".
+func JA3SString(hello *ServerHello) string {
+	if hello == nil {
+		return ""
+	}
+	f, ok := parseHelloFields(hello.Raw, false)
+	if !ok {
+		return ""
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(f.vers)),
+		joinDecimal(f.cipherSuites),
+		joinDecimal(f.extensions),
+	}, ",")
+}
+
+// JA3S returns the hex-encoded MD5 of JA3SString(hello), or the empty string
+// if the raw message is unavailable.
+func JA3S(hello *ServerHello) string {
+	s := JA3SString(hello)
+	if len(s) == 0 {
+		return ""
+	}
+	return md5Hex(s)
+}
+
+// ja4Version returns the two character JA4 code for the highest version in
+// supportedVersions, or for vers if the list is empty.
+func ja4Version(vers uint16, supportedVersions []uint16) string {
+	for _, v := range supportedVersions {
+		if v > vers {
+			vers = v
+		}
+	}
+	switch vers {
+	case VersionTLS13:
+		return "13"
+	case VersionTLS12:
+		return "12"
+	case VersionTLS11:
+		return "11"
+	case VersionTLS10:
+		return "10"
+	case VersionSSL30:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	case 0xfeff:
+		return "d1"
+	case 0xfefd:
+		return "d2"
+	case 0xfefc:
+		return "d3"
+	}
+	return "00"
+}
+
+// ja4ALPN returns the first and last characters of protocol, or of its hex
+// encoding if either is not an ASCII letter or digit.
+func ja4ALPN(protocol string) string {
+	if len(protocol) == 0 {
+		return "00"
+	}
+	first, last := protocol[0], protocol[len(protocol)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		h := hex.EncodeToString([]byte(protocol))
+		return h[:1] + h[len(h)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func ja4Count(n int) string {
+	if n > 99 {
+		n = 99
+	}
+	return fmt.Sprintf("%02d", n)
+}
+
+// JA4 returns the JA4 fingerprint of hello, for example
+// "t13d1516h2_8daaf6152771_e5627efa2ab1". The cipher suites and extensions
+// are sorted before hashing, and the server_name and ALPN extensions are
+// counted but not hashed. It returns the empty string if the raw message is
+// unavailable.
+func JA4(hello *ClientHello) string {
+	if hello == nil {
+		return ""
+	}
+	f, ok := parseHelloFields(hello.Raw, true)
+	if !ok {
+		return ""
+	}
+	sni := "i"
+	if f.serverName {
+		sni = "d"
+	}
+	a := "t" + ja4Version(f.vers, f.supportedVersions) + sni +
+		ja4Count(len(f.cipherSuites)) + ja4Count(len(f.extensions)) + ja4ALPN(f.alpnProtocol)
+
+	ciphers := hexList(f.cipherSuites)
+	sort.Strings(ciphers)
+
+	var extensions []uint16
+	for _, e := range f.extensions {
+		if e != extensionServerName && e != extensionALPN {
+			extensions = append(extensions, e)
+		}
+	}
+	sortedExtensions := hexList(extensions)
+	sort.Strings(sortedExtensions)
+	c := strings.Join(sortedExtensions, ",")
+	if len(c) > 0 && len(f.signatureAlgs) > 0 {
+		c += "_" + strings.Join(hexList(f.signatureAlgs), ",")
+	}
+
+	return a + "_" + truncatedSHA256(strings.Join(ciphers, ",")) + "_" + truncatedSHA256(c)
+}
+
+// JA4S returns the JA4S fingerprint of hello, for example
+// "t120400_c030_4e8089b08790". It returns the empty string if the raw message
+// is unavailable.
+func JA4S(hello *ServerHello) string {
+	if hello == nil {
+		return ""
+	}
+	f, ok := parseHelloFields(hello.Raw, false)
+	if !ok {
+		return ""
+	}
+	a := "t" + ja4Version(f.vers, f.supportedVersions) + ja4Count(len(f.extensions)) + ja4ALPN(f.alpnProtocol)
+	return a + "_" + fmt.Sprintf("%04x", f.cipherSuites[0]) + "_" + truncatedSHA256(strings.Join(hexList(f.extensions), ","))
+}
+
+// ComputeFingerprints returns the fingerprints of a handshake. Either hello
+// may be nil, in which case its fingerprints are left empty.
+func ComputeFingerprints(clientHello *ClientHello, serverHello *ServerHello) *Fingerprints {
+	return &Fingerprints{
+		JA3:        JA3(clientHello),
+		JA3String:  JA3String(clientHello),
+		JA3S:       JA3S(serverHello),
+		JA3SString: JA3SString(serverHello),
+		JA4:        JA4(clientHello),
+		JA4S:       JA4S(serverHello),
+	}
+}
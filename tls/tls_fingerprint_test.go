@@ -0,0 +1,132 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"net"
+	"testing"
+)
+
+// rawHello builds a handshake message from its body parts and a list of
+// extensions, each given as type followed by body.
+func rawHello(msgType uint8, body []byte, extensions ...[]byte) []byte {
+	var exts []byte
+	for _, e := range extensions {
+		exts = append(exts, e[0], e[1], byte((len(e)-2)>>8), byte(len(e)-2))
+		exts = append(exts, e[2:]...)
+	}
+	body = append(body, byte(len(exts)>>8), byte(len(exts)))
+	body = append(body, exts...)
+	return append([]byte{msgType, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func testFingerprintHellos() (*ClientHello, *ServerHello) {
+	random := make([]byte, 32)
+	clientBody := append([]byte{0x03, 0x03}, random...)
+	clientBody = append(clientBody,
+		0x00,                                                       // session ID
+		0x00, 0x08, 0x0a, 0x0a, 0x13, 0x01, 0xc0, 0x2f, 0x00, 0x2f, // cipher suites
+		0x01, 0x00, // compression methods
+	)
+	client := rawHello(typeClientHello, clientBody,
+		[]byte{0x0a, 0x0a},
+		[]byte{0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x03, 'a', '.', 'b'},
+		[]byte{0x00, 0x0a, 0x00, 0x06, 0x2a, 0x2a, 0x00, 0x1d, 0x00, 0x17},
+		[]byte{0x00, 0x0b, 0x01, 0x00},
+		[]byte{0x00, 0x0d, 0x00, 0x04, 0x04, 0x03, 0x08, 0x04},
+		[]byte{0x00, 0x10, 0x00, 0x03, 0x02, 'h', '2'},
+		[]byte{0x00, 0x2b, 0x06, 0x3a, 0x3a, 0x03, 0x04, 0x03, 0x03},
+	)
+
+	serverBody := append([]byte{0x03, 0x03}, random...)
+	serverBody = append(serverBody, 0x00, 0xc0, 0x2f, 0x00)
+	server := rawHello(typeServerHello, serverBody,
+		[]byte{0xff, 0x01, 0x00},
+		[]byte{0x00, 0x10, 0x00, 0x03, 0x02, 'h', '2'},
+	)
+	return &ClientHello{Raw: client}, &ServerHello{Raw: server}
+}
+
+func TestFingerprints(t *testing.T) {
+	client, server := testFingerprintHellos()
+	expected := Fingerprints{
+		JA3:        "6bfe35123df20afcf42aa008b0081ebf",
+		JA3String:  "771,4865-49199-47,0-10-11-13-16-43,29-23,0",
+		JA3S:       "7bee5c1d424b7e5f943b06983bb11422",
+		JA3SString: "771,49199,65281-16",
+		JA4:        "t13d0306h2_54093f43ad55_fb71836bce29",
+		JA4S:       "t1202h2_c02f_87b1562aab70",
+	}
+	if got := ComputeFingerprints(client, server); *got != expected {
+		t.Errorf("got fingerprints %+v, expected %+v", *got, expected)
+	}
+
+	if got := ComputeFingerprints(&ClientHello{}, nil); *got != (Fingerprints{}) {
+		t.Errorf("got fingerprints %+v for hellos without raw messages", *got)
+	}
+	client.Raw = client.Raw[:len(client.Raw)-1]
+	if got := JA3(client); got != "" {
+		t.Errorf("got fingerprint %s for a truncated hello", got)
+	}
+}
+
+func TestALPNFingerprint(t *testing.T) {
+	tests := map[string]string{
+		"":          "00",
+		"h2":        "h2",
+		"http/1.1":  "h1",
+		"\xabx\xcd": "ad",
+	}
+	for protocol, expected := range tests {
+		if got := ja4ALPN(protocol); got != expected {
+			t.Errorf("ja4ALPN(%q) = %s, expected %s", protocol, got, expected)
+		}
+	}
+}
+
+func TestHandshakeFingerprints(t *testing.T) {
+	serverConfig := testConfig.Clone()
+	serverConfig.LogFingerprints = true
+	clientConfig := &Config{
+		InsecureSkipVerify: true,
+		LogFingerprints:    true,
+	}
+
+	c, s := net.Pipe()
+	done := make(chan *ServerHandshake)
+	go func() {
+		cli := Client(c, clientConfig)
+		cli.Handshake()
+		c.Close()
+		done <- cli.GetHandshakeLog()
+	}()
+	server := Server(s, serverConfig)
+	if err := server.Handshake(); err != nil {
+		t.Fatalf("handshake failed: %s", err)
+	}
+	s.Close()
+	clientLog := <-done
+	serverLog := server.GetHandshakeLog()
+
+	if clientLog.Fingerprints == nil || serverLog.Fingerprints == nil {
+		t.Fatal("handshake log has no fingerprints")
+	}
+	if *clientLog.Fingerprints != *serverLog.Fingerprints {
+		t.Errorf("client computed %+v, server computed %+v", *clientLog.Fingerprints, *serverLog.Fingerprints)
+	}
+	if len(clientLog.Fingerprints.JA3) != 32 || len(clientLog.Fingerprints.JA4S) == 0 {
+		t.Errorf("incomplete fingerprints %+v", *clientLog.Fingerprints)
+	}
+}
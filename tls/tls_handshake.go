@@ -6,15 +6,20 @@ package tls
 
 import (
 	"bytes"
+	"encoding/asn1"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/zmap/zcrypto/verifier"
 	"github.com/zmap/zcrypto/x509/ct"
 	jsonKeys "github.com/zmap/zcrypto/json"
 	"github.com/zmap/zcrypto/x509"
+	"github.com/zmap/zcrypto/x509/pkix"
 )
 
 var ErrUnimplementedCipher error = errors.New("unimplemented cipher suite")
@@ -25,9 +30,11 @@ type TLSVersion uint16
 type CipherSuite uint16
 
 type ClientHello struct {
+	Raw                  []byte              `json:"-"`
 	Version              TLSVersion          `json:"version"`
 	Random               []byte              `json:"random"`
 	SessionID            []byte              `json:"session_id,omitempty"`
+	Cookie               []byte              `json:"cookie,omitempty"`
 	CipherSuites         []CipherSuite       `json:"cipher_suites"`
 	CompressionMethods   []CompressionMethod `json:"compression_methods"`
 	OcspStapling         bool                `json:"ocsp_stapling"`
@@ -36,6 +43,7 @@ type ClientHello struct {
 	HeartbeatSupported   bool                `json:"heartbeat"`
 	ExtendedRandom       []byte              `json:"extended_random,omitempty"`
 	ExtendedMasterSecret bool                `json:"extended_master_secret"`
+	EncryptThenMAC       bool                `json:"encrypt_then_mac"`
 	NextProtoNeg         bool                `json:"next_protocol_negotiation"`
 	ServerName           string              `json:"server_name,omitempty"`
 	Scts                 bool                `json:"scts"`
@@ -54,6 +62,7 @@ type ParsedAndRawSCT struct {
 }
 
 type ServerHello struct {
+	Raw                         []byte            `json:"-"`
 	Version                     TLSVersion        `json:"version"`
 	Random                      []byte            `json:"random"`
 	SessionID                   []byte            `json:"session_id"`
@@ -65,7 +74,9 @@ type ServerHello struct {
 	HeartbeatSupported          bool              `json:"heartbeat"`
 	ExtendedRandom              []byte            `json:"extended_random,omitempty"`
 	ExtendedMasterSecret        bool              `json:"extended_master_secret"`
+	EncryptThenMAC              bool              `json:"encrypt_then_mac"`
 	SignedCertificateTimestamps []ParsedAndRawSCT `json:"scts,omitempty"`
+	SupportedVersion            TLSVersion        `json:"supported_version,omitempty"`
 }
 
 // SimpleCertificate holds a *x509.Certificate and a []byte for the certificate
@@ -80,6 +91,10 @@ type Certificates struct {
 	Certificate SimpleCertificate   `json:"certificate,omitempty"`
 	Chain       []SimpleCertificate `json:"chain,omitempty"`
 	Validation  *x509.Validation    `json:"validation,omitempty"`
+
+	// Validations holds the result of verifying Certificate against each
+	// of Config.Verifiers, by name.
+	Validations map[string]*verifier.VerificationResult `json:"validations,omitempty"`
 }
 
 // ServerKeyExchange represents the raw key data sent by the server in TLS key exchange message
@@ -93,6 +108,17 @@ type ServerKeyExchange struct {
 	SignatureError string                 `json:"signature_error,omitempty"`
 }
 
+// CertificateRequest represents a server's request for a client certificate.
+// CertificateAuthorities holds the parsed form of each distinguished name in
+// RawCertificateAuthorities, and an empty name for any that could not be
+// parsed.
+type CertificateRequest struct {
+	CertificateTypes          []ClientCertificateType `json:"certificate_types,omitempty"`
+	SignatureAndHashes        []SignatureAndHash      `json:"signature_and_hashes,omitempty"`
+	CertificateAuthorities    []pkix.Name             `json:"certificate_authorities,omitempty"`
+	RawCertificateAuthorities [][]byte                `json:"raw_certificate_authorities,omitempty"`
+}
+
 // ClientKeyExchange represents the raw key data sent by the client in TLS key exchange message
 type ClientKeyExchange struct {
 	Raw        []byte                    `json:"-"`
@@ -106,6 +132,13 @@ type Finished struct {
 	VerifyData []byte `json:"verify_data"`
 }
 
+// HelloVerifyRequest represents the cookie a DTLS server asks a client to
+// repeat in its ClientHello
+type HelloVerifyRequest struct {
+	Version TLSVersion `json:"version"`
+	Cookie  []byte     `json:"cookie"`
+}
+
 // SessionTicket represents the new session ticket sent by the server to the
 // client
 type SessionTicket struct {
@@ -134,15 +167,74 @@ type KeyMaterial struct {
 // ServerHandshake stores all of the messages sent by the server during a standard TLS Handshake.
 // It implements zgrab.EventData interface
 type ServerHandshake struct {
-	ClientHello        *ClientHello       `json:"client_hello,omitempty" zgrab:"debug"`
+	ClientHello        *ClientHello        `json:"client_hello,omitempty" zgrab:"debug"`
+	HelloVerifyRequest *HelloVerifyRequest `json:"hello_verify_request,omitempty"`
+	ServerHello        *ServerHello        `json:"server_hello,omitempty"`
+	ServerCertificates *Certificates       `json:"server_certificates,omitempty"`
+	ServerKeyExchange  *ServerKeyExchange  `json:"server_key_exchange,omitempty"`
+	CertificateRequest *CertificateRequest `json:"certificate_request,omitempty"`
+	ClientCertificates *Certificates       `json:"client_certificates,omitempty"`
+	ClientKeyExchange  *ClientKeyExchange  `json:"client_key_exchange,omitempty"`
+	ClientFinished     *Finished           `json:"client_finished,omitempty"`
+	SessionTicket      *SessionTicket      `json:"session_ticket,omitempty"`
+	ServerFinished     *Finished           `json:"server_finished,omitempty"`
+	KeyMaterial        *KeyMaterial        `json:"key_material,omitempty"`
+	Alerts             []Alert             `json:"alerts,omitempty"`
+	Error              *HandshakeError     `json:"error,omitempty"`
+	ROBOT              *ROBOTResponse      `json:"robot,omitempty"`
+	Script             *ScriptResult       `json:"script,omitempty"`
+	Fingerprints       *Fingerprints       `json:"fingerprints,omitempty"`
+	Renegotiations     []*ServerHandshake  `json:"renegotiations,omitempty"`
+	Transcript         *Transcript         `json:"transcript,omitempty" zgrab:"debug"`
+}
+
+// ClientHandshake stores all of the messages sent by a client during a
+// handshake, as seen by a Server, along with the alerts exchanged and the
+// outcome of any attempt to resume a session.
+type ClientHandshake struct {
+	ClientHello        *ClientHello       `json:"client_hello,omitempty"`
+	RawClientHello     []byte             `json:"raw_client_hello,omitempty"`
 	ServerHello        *ServerHello       `json:"server_hello,omitempty"`
-	ServerCertificates *Certificates      `json:"server_certificates,omitempty"`
-	ServerKeyExchange  *ServerKeyExchange `json:"server_key_exchange,omitempty"`
+	ClientCertificates *Certificates      `json:"client_certificates,omitempty"`
 	ClientKeyExchange  *ClientKeyExchange `json:"client_key_exchange,omitempty"`
 	ClientFinished     *Finished          `json:"client_finished,omitempty"`
-	SessionTicket      *SessionTicket     `json:"session_ticket,omitempty"`
-	ServerFinished     *Finished          `json:"server_finished,omitempty"`
-	KeyMaterial        *KeyMaterial       `json:"key_material,omitempty"`
+	Resumption         *Resumption        `json:"resumption,omitempty"`
+	Alerts             []Alert            `json:"alerts,omitempty"`
+	Error              *HandshakeError    `json:"error,omitempty"`
+	Fingerprints       *Fingerprints      `json:"fingerprints,omitempty"`
+	Renegotiations     []*ClientHandshake `json:"renegotiations,omitempty"`
+}
+
+// Resumption records a client's attempt to resume a session with a ticket.
+// Reason explains why the server fell back to a full handshake.
+type Resumption struct {
+	SessionID     []byte `json:"session_id,omitempty"`
+	SessionTicket []byte `json:"session_ticket,omitempty"`
+	Resumed       bool   `json:"resumed"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// Alert is a TLS alert sent or received on a connection. Stage is the last
+// handshake message sent or received before the alert.
+type Alert struct {
+	Sent        bool   `json:"sent"`
+	Level       string `json:"level"`
+	Code        uint8  `json:"code"`
+	Description string `json:"description"`
+	Stage       string `json:"stage,omitempty"`
+}
+
+func makeAlertLog(sent bool, level uint8, code alert) Alert {
+	a := Alert{Sent: sent, Code: uint8(code), Description: code.String()}
+	switch level {
+	case alertLevelWarning:
+		a.Level = "warning"
+	case alertLevelError:
+		a.Level = "fatal"
+	default:
+		a.Level = "unknown." + strconv.Itoa(int(level))
+	}
+	return a
 }
 
 // MarshalJSON implements the json.Marshler interface
@@ -243,10 +335,61 @@ func (cm *CompressionMethod) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+type ClientCertificateType uint8
+
+func (certType *ClientCertificateType) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 1)
+	buf[0] = byte(*certType)
+	enc := strings.ToUpper(hex.EncodeToString(buf))
+	aux := struct {
+		Hex   string `json:"hex"`
+		Name  string `json:"name"`
+		Value uint8  `json:"value"`
+	}{
+		Hex:   fmt.Sprintf("0x%s", enc),
+		Name:  certType.String(),
+		Value: uint8(*certType),
+	}
+
+	return json.Marshal(aux)
+}
+
+func (certType *ClientCertificateType) UnmarshalJSON(b []byte) error {
+	aux := struct {
+		Hex   string `json:"hex"`
+		Name  string `json:"name"`
+		Value uint8  `json:"value"`
+	}{}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	if expectedName := ClientCertificateType(aux.Value).String(); expectedName != aux.Name {
+		return fmt.Errorf("mismatched client certificate type and name, type: %d, name: %s, expected name: %s", aux.Value, aux.Name, expectedName)
+	}
+	*certType = ClientCertificateType(aux.Value)
+	return nil
+}
+
 func (c *Conn) GetHandshakeLog() *ServerHandshake {
 	return c.handshakeLog
 }
 
+// GetClientHandshakeLog returns the log of the client's side of the
+// handshake. It is only kept by a Server. Alerts may still be logged while
+// the connection is in use, so the result is a copy taken under
+// alertLogMutex.
+func (c *Conn) GetClientHandshakeLog() *ClientHandshake {
+	c.alertLogMutex.Lock()
+	defer c.alertLogMutex.Unlock()
+	if c.clientHandshakeLog == nil {
+		return nil
+	}
+	log := *c.clientHandshakeLog
+	log.Alerts = append([]Alert(nil), log.Alerts...)
+	log.Renegotiations = append([]*ClientHandshake(nil), log.Renegotiations...)
+	return &log
+}
+
 func (c *Conn) InCipher() (cipher interface{}) {
 	return c.in.cipher
 }
@@ -266,6 +409,9 @@ func (c *Conn) OutSeq() []byte {
 func (m *clientHelloMsg) MakeLog() *ClientHello {
 	ch := new(ClientHello)
 
+	ch.Raw = make([]byte, len(m.raw))
+	copy(ch.Raw, m.raw)
+
 	ch.Version = TLSVersion(m.vers)
 
 	ch.Random = make([]byte, len(m.random))
@@ -274,6 +420,11 @@ func (m *clientHelloMsg) MakeLog() *ClientHello {
 	ch.SessionID = make([]byte, len(m.sessionId))
 	copy(ch.SessionID, m.sessionId)
 
+	if len(m.cookie) > 0 {
+		ch.Cookie = make([]byte, len(m.cookie))
+		copy(ch.Cookie, m.cookie)
+	}
+
 	ch.CipherSuites = make([]CipherSuite, len(m.cipherSuites))
 	for i, aCipher := range m.cipherSuites {
 		ch.CipherSuites[i] = CipherSuite(aCipher)
@@ -288,6 +439,7 @@ func (m *clientHelloMsg) MakeLog() *ClientHello {
 	ch.TicketSupported = m.ticketSupported
 	ch.SecureRenegotiation = m.secureRenegotiation
 	ch.HeartbeatSupported = m.heartbeatEnabled
+	ch.EncryptThenMAC = m.encryptThenMAC
 
 	if len(m.extendedRandom) > 0 {
 		ch.ExtendedRandom = make([]byte, len(m.extendedRandom))
@@ -308,6 +460,7 @@ func (m *clientHelloMsg) MakeLog() *ClientHello {
 
 	if len(m.sessionTicket) > 0 {
 		ch.SessionTicket = new(SessionTicket)
+		ch.SessionTicket.Value = make([]byte, len(m.sessionTicket))
 		copy(ch.SessionTicket.Value, m.sessionTicket)
 		ch.SessionTicket.Length = len(m.sessionTicket)
 		ch.SessionTicket.LifetimeHint = 0 // Clients don't send
@@ -334,6 +487,8 @@ func (m *clientHelloMsg) MakeLog() *ClientHello {
 
 func (m *serverHelloMsg) MakeLog() *ServerHello {
 	sh := new(ServerHello)
+	sh.Raw = make([]byte, len(m.raw))
+	copy(sh.Raw, m.raw)
 	sh.Version = TLSVersion(m.vers)
 	sh.Random = make([]byte, len(m.random))
 	copy(sh.Random, m.random)
@@ -349,6 +504,7 @@ func (m *serverHelloMsg) MakeLog() *ServerHello {
 		sh.ExtendedRandom = make([]byte, len(m.extendedRandom))
 		copy(sh.ExtendedRandom, m.extendedRandom)
 	}
+	sh.SupportedVersion = TLSVersion(m.supportedVersion)
 	if len(m.scts) > 0 {
 		for _, rawSCT := range m.scts {
 			var out ParsedAndRawSCT
@@ -362,6 +518,7 @@ func (m *serverHelloMsg) MakeLog() *ServerHello {
 		}
 	}
 	sh.ExtendedMasterSecret = m.extendedMasterSecret
+	sh.EncryptThenMAC = m.encryptThenMAC
 	return sh
 }
 
@@ -398,6 +555,23 @@ func (c *Certificates) addParsed(certs []*x509.Certificate, validation *x509.Val
 	c.Validation = validation
 }
 
+// verify verifies certs[0] against each of verifiers, with certs as the
+// presented chain, and records the results in Validations.
+func (c *Certificates) verify(certs []*x509.Certificate, verifiers map[string]*verifier.Verifier, name string, now time.Time) {
+	if len(certs) == 0 || len(verifiers) == 0 {
+		return
+	}
+	opts := verifier.VerificationOptions{
+		VerifyTime: now,
+		Name:       name,
+		Presented:  certs,
+	}
+	c.Validations = make(map[string]*verifier.VerificationResult, len(verifiers))
+	for storeName, v := range verifiers {
+		c.Validations[storeName] = v.Verify(certs[0], opts)
+	}
+}
+
 func (m *serverKeyExchangeMsg) MakeLog(ka keyAgreement) *ServerKeyExchange {
 	skx := new(ServerKeyExchange)
 	skx.Raw = make([]byte, len(m.key))
@@ -440,6 +614,33 @@ func (m *serverKeyExchangeMsg) MakeLog(ka keyAgreement) *ServerKeyExchange {
 	return skx
 }
 
+func (m *certificateRequestMsg) MakeLog() *CertificateRequest {
+	cr := new(CertificateRequest)
+	cr.CertificateTypes = make([]ClientCertificateType, len(m.certificateTypes))
+	for i, certType := range m.certificateTypes {
+		cr.CertificateTypes[i] = ClientCertificateType(certType)
+	}
+	if m.hasSignatureAndHash {
+		cr.SignatureAndHashes = make([]SignatureAndHash, len(m.signatureAndHashes))
+		for i, sh := range m.signatureAndHashes {
+			cr.SignatureAndHashes[i] = SignatureAndHash(sh)
+		}
+	}
+	if len(m.certificateAuthorities) > 0 {
+		cr.CertificateAuthorities = make([]pkix.Name, len(m.certificateAuthorities))
+		cr.RawCertificateAuthorities = make([][]byte, len(m.certificateAuthorities))
+	}
+	for i, ca := range m.certificateAuthorities {
+		cr.RawCertificateAuthorities[i] = make([]byte, len(ca))
+		copy(cr.RawCertificateAuthorities[i], ca)
+		var rdns pkix.RDNSequence
+		if rest, err := asn1.Unmarshal(ca, &rdns); err == nil && len(rest) == 0 {
+			cr.CertificateAuthorities[i].FillFromRDNSequence(&rdns)
+		}
+	}
+	return cr
+}
+
 func (m *finishedMsg) MakeLog() *Finished {
 	sf := new(Finished)
 	sf.VerifyData = make([]byte, len(m.verifyData))
@@ -447,6 +648,14 @@ func (m *finishedMsg) MakeLog() *Finished {
 	return sf
 }
 
+func (m *helloVerifyRequestMsg) MakeLog() *HelloVerifyRequest {
+	hvr := new(HelloVerifyRequest)
+	hvr.Version = TLSVersion(m.vers)
+	hvr.Cookie = make([]byte, len(m.cookie))
+	copy(hvr.Cookie, m.cookie)
+	return hvr
+}
+
 func (m *ClientSessionState) MakeLog() *SessionTicket {
 	st := new(SessionTicket)
 	st.Length = len(m.sessionTicket)
@@ -5,9 +5,13 @@
 package tls
 
 import (
+	"bytes"
 	"encoding/json"
+	"net"
 	"reflect"
 	"testing"
+
+	"github.com/zmap/zcrypto/x509"
 )
 
 type ZTLSHandshakeSuite struct{}
@@ -48,3 +52,179 @@ func TestCipherSuiteEncodeDecode(t *testing.T) {
 		t.Errorf("decoded wrong name, got %s, expected %s", decodedName, expectedName)
 	}
 }
+
+// serverHandshakeLog runs a handshake and returns the server's log of the
+// client.
+func serverHandshakeLog(clientConfig, serverConfig *Config) *ClientHandshake {
+	c, s := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		Client(c, clientConfig).Handshake()
+		c.Close()
+		close(done)
+	}()
+	server := Server(s, serverConfig)
+	server.Handshake()
+	s.Close()
+	<-done
+	return server.GetClientHandshakeLog()
+}
+
+func TestClientHandshakeLog(t *testing.T) {
+	serverConfig := testConfig.Clone()
+	serverConfig.ClientAuth = RequireAnyClientCert
+	clientConfig := &Config{
+		InsecureSkipVerify: true,
+		Certificates: []Certificate{{
+			Certificate: [][]byte{testECDSACertificate},
+			PrivateKey:  testECDSAPrivateKey,
+		}},
+		ClientSessionCache: NewLRUClientSessionCache(1),
+	}
+
+	log := serverHandshakeLog(clientConfig, serverConfig)
+	if log.ClientHello == nil || !bytes.Equal(log.RawClientHello, log.ClientHello.Raw) || len(log.RawClientHello) == 0 {
+		t.Error("ClientHello was not logged")
+	}
+	if log.ServerHello == nil || log.ClientKeyExchange == nil || log.ClientFinished == nil {
+		t.Errorf("incomplete log %+v", log)
+	}
+	if certs := log.ClientCertificates; certs == nil || certs.Certificate.Parsed == nil || !bytes.Equal(certs.Certificate.Raw, testECDSACertificate) {
+		t.Error("client certificate was not logged")
+	}
+	if log.Resumption != nil {
+		t.Errorf("got resumption %+v for a new session", log.Resumption)
+	}
+	if _, err := json.Marshal(log); err != nil {
+		t.Error(err)
+	}
+
+	log = serverHandshakeLog(clientConfig, serverConfig)
+	if log.Resumption == nil || !log.Resumption.Resumed || len(log.Resumption.SessionTicket) == 0 {
+		t.Errorf("got resumption %+v, expected a resumed session", log.Resumption)
+	}
+
+	serverConfig = serverConfig.Clone()
+	serverConfig.SessionTicketKey = [32]byte{1}
+	log = serverHandshakeLog(clientConfig, serverConfig)
+	if r := log.Resumption; r == nil || r.Resumed || r.Reason != "session ticket could not be decrypted" {
+		t.Errorf("got resumption %+v, expected an undecryptable ticket", r)
+	}
+}
+
+func TestClientHandshakeLogCopy(t *testing.T) {
+	c, s := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		client := Client(c, &Config{InsecureSkipVerify: true})
+		client.Handshake()
+		client.Read(make([]byte, 1))
+		c.Close()
+		close(done)
+	}()
+	server := Server(s, testConfig.Clone())
+	if err := server.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	log := server.GetClientHandshakeLog()
+	server.Close()
+	<-done
+	if len(log.Alerts) != 0 {
+		t.Errorf("alert logged after the log was returned: %+v", log.Alerts)
+	}
+	if alerts := server.GetClientHandshakeLog().Alerts; len(alerts) != 1 || !alerts[0].Sent {
+		t.Errorf("got alerts %+v, expected close_notify", alerts)
+	}
+}
+
+func TestClientHandshakeLogAlerts(t *testing.T) {
+	serverConfig := testConfig.Clone()
+	serverConfig.MinVersion = VersionTLS12
+	log := serverHandshakeLog(&Config{InsecureSkipVerify: true, MaxVersion: VersionTLS10}, serverConfig)
+	expected := []Alert{{Sent: true, Level: "fatal", Code: 70, Description: "protocol version not supported", Stage: "client_hello"}}
+	if !reflect.DeepEqual(log.Alerts, expected) {
+		t.Errorf("got alerts %+v, expected %+v", log.Alerts, expected)
+	}
+	if he := log.Error; he == nil || he.Type != HandshakeErrorVersionMismatch || he.Alert == nil || *he.Alert != expected[0] {
+		t.Errorf("got error %+v", log.Error)
+	}
+
+	log = serverHandshakeLog(&Config{ServerName: "example.golang", RootCAs: x509.NewCertPool()}, testConfig)
+	expected = []Alert{{Sent: false, Level: "fatal", Code: 42, Description: "bad certificate", Stage: "server_hello_done"}}
+	if !reflect.DeepEqual(log.Alerts, expected) {
+		t.Errorf("got alerts %+v, expected %+v", log.Alerts, expected)
+	}
+}
+
+func TestCertificateRequestLog(t *testing.T) {
+	ca, err := x509.ParseCertificate(testECDSACertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := testConfig.Clone()
+	serverConfig.MinVersion = VersionTLS12
+	serverConfig.ClientAuth = RequestClientCert
+	serverConfig.ClientCAs = x509.NewCertPool()
+	serverConfig.ClientCAs.AddCert(ca)
+
+	for _, test := range []struct {
+		mode     ClientCertificateMode
+		certs    []Certificate
+		expected []byte
+	}{
+		{ClientCertificateMatching, nil, nil},
+		{ClientCertificateConfigured, []Certificate{{
+			Certificate: [][]byte{testECDSACertificate},
+			PrivateKey:  testECDSAPrivateKey,
+		}}, testECDSACertificate},
+		{ClientCertificateThrowaway, nil, nil},
+	} {
+		c, s := net.Pipe()
+		client := Client(c, &Config{
+			InsecureSkipVerify:    true,
+			Certificates:          test.certs,
+			ClientCertificateMode: test.mode,
+		})
+		done := make(chan error)
+		go func() {
+			done <- client.Handshake()
+			c.Close()
+		}()
+		server := Server(s, serverConfig)
+		serverErr := server.Handshake()
+		s.Close()
+		if err := <-done; err != nil || serverErr != nil {
+			t.Fatalf("%s: handshake failed: client %v, server %v", test.mode, err, serverErr)
+		}
+
+		req := client.GetHandshakeLog().CertificateRequest
+		if req == nil {
+			t.Fatalf("%s: CertificateRequest was not logged", test.mode)
+		}
+		if len(req.CertificateTypes) == 0 || req.CertificateTypes[0].String() != "rsa_sign" {
+			t.Errorf("%s: got certificate types %v", test.mode, req.CertificateTypes)
+		}
+		if len(req.SignatureAndHashes) == 0 {
+			t.Errorf("%s: signature algorithms were not logged", test.mode)
+		}
+		if len(req.CertificateAuthorities) != 1 || req.CertificateAuthorities[0].String() != ca.Subject.String() {
+			t.Errorf("%s: got certificate authorities %v, expected %s", test.mode, req.CertificateAuthorities, ca.Subject)
+		}
+		if _, err := json.Marshal(client.GetHandshakeLog()); err != nil {
+			t.Error(err)
+		}
+
+		sent := client.GetHandshakeLog().ClientCertificates
+		received := server.GetClientHandshakeLog().ClientCertificates
+		switch {
+		case test.mode == ClientCertificateMatching:
+			if received != nil && received.Certificate.Raw != nil {
+				t.Errorf("%s: client sent an unmatched certificate", test.mode)
+			}
+		case sent == nil || received == nil || !bytes.Equal(sent.Certificate.Raw, received.Certificate.Raw):
+			t.Errorf("%s: client certificate was not sent", test.mode)
+		case test.expected != nil && !bytes.Equal(received.Certificate.Raw, test.expected):
+			t.Errorf("%s: client sent the wrong certificate", test.mode)
+		}
+	}
+}
@@ -5,7 +5,9 @@
 package tls
 
 import (
+	"bytes"
 	"errors"
+	"io"
 )
 
 const (
@@ -24,64 +26,214 @@ const (
 	heartbeatTypeResponse uint8 = 2
 )
 
+// heartbeatMinPadding is the minimum padding of a heartbeat message, and
+// heartbeatPayloadOffset the length of its type and payload_length fields.
+const (
+	heartbeatMinPadding    = 16
+	heartbeatPayloadOffset = 3
+)
+
 var (
 	HeartbleedError = errors.New("Error after Heartbleed")
 )
 
 type Heartbleed struct {
-	HeartbeatEnabled bool `json:"heartbeat_enabled"`
-	Vulnerable       bool `json:"heartbleed_vulnerable"`
+	HeartbeatEnabled bool              `json:"heartbeat_enabled"`
+	Vulnerable       bool              `json:"heartbleed_vulnerable"`
+	Probes           []*HeartbeatProbe `json:"probes,omitempty"`
+	RequestsAnswered int               `json:"requests_answered,omitempty"`
 }
 
-type heartbleedMessage struct {
-	raw []byte
+// HeartbeatRequest describes a heartbeat request to send. PayloadLength
+// random payload bytes are sent, followed by PaddingLength random padding
+// bytes. RFC 6520 requires at least 16 bytes of padding. ClaimedLength is
+// sent as the payload_length; it is raised to PayloadLength if smaller, and
+// a larger value asks a peer with the Heartbleed bug to return more data
+// than was sent.
+type HeartbeatRequest struct {
+	PayloadLength int `json:"payload_length"`
+	ClaimedLength int `json:"claimed_length,omitempty"`
+	PaddingLength int `json:"padding_length"`
 }
 
-func (m *heartbleedMessage) marshal() []byte {
-	x := make([]byte, 3)
-	x[0] = 1
-	x[1] = byte(0x00)
-	x[2] = byte(0x00)
-	m.raw = x
-	return x
+// HeartbeatProbe records a heartbeat request and the response to it, if
+// any. ResponseLength is the payload_length of the response, and
+// OverreadLength the number of payload bytes returned beyond those sent.
+// The returned bytes themselves are only logged in Overread if
+// Config.HeartbeatLogOverread is set. PayloadEchoed is true if the response
+// started with the payload that was sent.
+type HeartbeatProbe struct {
+	DuringHandshake bool   `json:"during_handshake"`
+	PayloadLength   int    `json:"payload_length"`
+	ClaimedLength   int    `json:"claimed_length"`
+	PaddingLength   int    `json:"padding_length"`
+	Responded       bool   `json:"responded"`
+	ResponseLength  int    `json:"response_length,omitempty"`
+	PayloadEchoed   bool   `json:"payload_echoed,omitempty"`
+	OverreadLength  int    `json:"overread_length,omitempty"`
+	Overread        []byte `json:"overread,omitempty"`
+
+	payload  []byte
+	response []byte
 }
 
-func (c *Conn) CheckHeartbleed(b []byte) (n int, err error) {
-	if err = c.Handshake(); err != nil {
-		return
+// lengthCheckFails returns true if a peer implementing RFC 6520 discards
+// the request, so that any response shows the Heartbleed bug.
+func (p *HeartbeatProbe) lengthCheckFails() bool {
+	return p.ClaimedLength != p.PayloadLength || p.PaddingLength < heartbeatMinPadding
+}
+
+// marshalHeartbeat returns a heartbeat message of the given type.
+func marshalHeartbeat(typ uint8, claimedLength int, payload, padding []byte) []byte {
+	x := make([]byte, heartbeatPayloadOffset, heartbeatPayloadOffset+len(payload)+len(padding))
+	x[0] = typ
+	x[1] = byte(claimedLength >> 8)
+	x[2] = byte(claimedLength)
+	x = append(x, payload...)
+	return append(x, padding...)
+}
+
+// writeHeartbeatRequest sends req and makes it the request a response is
+// expected for. Since only one request may be in flight, an earlier
+// unanswered request is forgotten.
+// L < c.out.Mutex.
+func (c *Conn) writeHeartbeatRequest(req *HeartbeatRequest, duringHandshake bool) (*HeartbeatProbe, error) {
+	probe := &HeartbeatProbe{
+		DuringHandshake: duringHandshake,
+		PayloadLength:   req.PayloadLength,
+		ClaimedLength:   req.ClaimedLength,
+		PaddingLength:   req.PaddingLength,
 	}
-	if !c.heartbeat {
-		return
+	if probe.ClaimedLength < probe.PayloadLength {
+		probe.ClaimedLength = probe.PayloadLength
 	}
-	c.in.Lock()
-	defer c.in.Unlock()
-
-	hb := heartbleedMessage{}
-	hb.marshal()
+	if probe.PayloadLength < 0 || probe.PaddingLength < 0 || probe.ClaimedLength > 0xffff ||
+		heartbeatPayloadOffset+probe.PayloadLength+probe.PaddingLength > maxPlaintext {
+		return nil, errors.New("tls: invalid heartbeat request lengths")
+	}
+	random := make([]byte, probe.PayloadLength+probe.PaddingLength)
+	if _, err := io.ReadFull(c.config.rand(), random); err != nil {
+		return nil, err
+	}
+	probe.payload = random[:probe.PayloadLength]
 
-	if _, err = c.writeRecord(recordTypeHeartbeat, hb.raw); err != nil {
-		return 0, err
+	c.out.Lock()
+	defer c.out.Unlock()
+	msg := marshalHeartbeat(heartbeatTypeRequest, probe.ClaimedLength, probe.payload, random[probe.PayloadLength:])
+	if _, err := c.writeRecord(recordTypeHeartbeat, msg); err != nil {
+		return nil, err
+	}
+	if c.heartbleedLog == nil {
+		c.heartbleedLog = new(Heartbleed)
 	}
+	c.heartbleedLog.Probes = append(c.heartbleedLog.Probes, probe)
+	c.pendingHeartbeat = probe
+	return probe, nil
+}
 
-	if err = c.readRecord(recordTypeHeartbeat); err != nil {
-		return 0, HeartbleedError
+// handleHeartbeat processes a heartbeat message received in a record. A
+// request is answered as RFC 6520 describes, and a response is logged
+// against the pending request.
+// c.in.Mutex <= L.
+func (c *Conn) handleHeartbeat(data []byte) error {
+	if len(data) < heartbeatPayloadOffset {
+		return nil
 	}
-	if c.in.err != nil {
-		return 0, HeartbleedError
+	if c.heartbleedLog == nil {
+		c.heartbleedLog = new(Heartbleed)
 	}
-	n, err = c.input.Read(b)
-	if c.input.off >= len(c.input.data) {
-		c.in.freeBlock(c.input)
-		c.input = nil
+	length := int(data[1])<<8 | int(data[2])
+	switch data[0] {
+	case heartbeatTypeRequest:
+		if !c.heartbeat {
+			return c.sendAlert(alertUnexpectedMessage)
+		}
+		if heartbeatPayloadOffset+length+heartbeatMinPadding > len(data) {
+			// Requests that would be over-read are silently discarded.
+			return nil
+		}
+		padding := make([]byte, heartbeatMinPadding)
+		if _, err := io.ReadFull(c.config.rand(), padding); err != nil {
+			return err
+		}
+		payload := data[heartbeatPayloadOffset : heartbeatPayloadOffset+length]
+		c.out.Lock()
+		_, err := c.writeRecord(recordTypeHeartbeat, marshalHeartbeat(heartbeatTypeResponse, length, payload, padding))
+		c.out.Unlock()
+		if err != nil {
+			return err
+		}
+		c.heartbleedLog.RequestsAnswered++
+
+	case heartbeatTypeResponse:
+		probe := c.pendingHeartbeat
+		if probe == nil {
+			return nil
+		}
+		c.pendingHeartbeat = nil
+		probe.Responded = true
+		probe.ResponseLength = length
+		probe.response = append([]byte(nil), data...)
+		payload := data[heartbeatPayloadOffset:]
+		if len(payload) > length {
+			payload = payload[:length]
+		}
+		probe.PayloadEchoed = bytes.HasPrefix(payload, probe.payload)
+		if len(payload) > probe.PayloadLength {
+			probe.OverreadLength = len(payload) - probe.PayloadLength
+			if c.config.HeartbeatLogOverread {
+				probe.Overread = append([]byte(nil), payload[probe.PayloadLength:]...)
+			}
+		}
+		if probe.lengthCheckFails() || probe.OverreadLength > 0 {
+			c.heartbleedLog.Vulnerable = true
+		}
 	}
+	return nil
+}
 
-	if n != 0 {
-		return n, HeartbleedError
+// SendHeartbeat sends a heartbeat request after completing the handshake,
+// if needed, and waits for the response. The request is sent even if the
+// peer did not negotiate heartbeats, which GetHeartbleedLog reports. The
+// probe is also added to the Heartbleed log. A peer that answers a request
+// that fails the RFC 6520 length checks, or returns more payload than was
+// sent, is marked vulnerable to Heartbleed. Other records must not arrive
+// while waiting, so a deadline should be set in case the peer does not
+// answer.
+func (c *Conn) SendHeartbeat(req *HeartbeatRequest) (*HeartbeatProbe, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
 	}
+	c.in.Lock()
+	defer c.in.Unlock()
+
+	probe, err := c.writeHeartbeatRequest(req, false)
 	if err != nil {
+		return nil, err
+	}
+	for c.pendingHeartbeat == probe {
+		if err := c.readRecord(recordTypeHeartbeat); err != nil {
+			return probe, err
+		}
+	}
+	return probe, nil
+}
+
+// CheckHeartbleed sends a heartbeat request with no payload or padding,
+// which servers with the Heartbleed bug answer, and copies the response
+// into b. It always returns HeartbleedError once a request was sent.
+func (c *Conn) CheckHeartbleed(b []byte) (n int, err error) {
+	if err = c.Handshake(); err != nil {
+		return
+	}
+	if !c.heartbeat {
+		return
+	}
+	probe, err := c.SendHeartbeat(new(HeartbeatRequest))
+	if err != nil || !probe.Responded {
 		return 0, HeartbleedError
 	}
-	return 0, HeartbleedError
+	return copy(b, probe.response), HeartbleedError
 }
 
 func (c *Conn) GetHeartbleedLog() *Heartbleed {
@@ -0,0 +1,151 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// heartbeatConfigs returns client and server configs that negotiate
+// heartbeats.
+func heartbeatConfigs() (client, server *Config) {
+	server = testConfig.Clone()
+	server.HeartbeatEnabled = true
+	client = testConfig.Clone()
+	client.HeartbeatEnabled = true
+	return
+}
+
+func TestSendHeartbeat(t *testing.T) {
+	clientConfig, serverConfig := heartbeatConfigs()
+	c, s := net.Pipe()
+	defer c.Close()
+	serverErr := make(chan error, 1)
+	server := Server(s, serverConfig)
+	go func() {
+		defer s.Close()
+		if err := server.Handshake(); err != nil {
+			serverErr <- err
+			return
+		}
+		// Answer the client's request, then send one of our own.
+		if _, err := server.Read(make([]byte, 1)); err != nil {
+			serverErr <- err
+			return
+		}
+		probe, err := server.SendHeartbeat(&HeartbeatRequest{PayloadLength: 8, PaddingLength: 16})
+		if err == nil && !probe.Responded {
+			err = HeartbleedError
+		}
+		if err == nil {
+			_, err = server.Write([]byte("x"))
+		}
+		serverErr <- err
+	}()
+
+	client := Client(c, clientConfig)
+	probe, err := client.SendHeartbeat(&HeartbeatRequest{PayloadLength: 32, PaddingLength: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !probe.Responded || probe.ResponseLength != 32 || !probe.PayloadEchoed || probe.OverreadLength != 0 || probe.DuringHandshake {
+		t.Errorf("got probe %+v", probe)
+	}
+	log := client.GetHeartbleedLog()
+	if !log.HeartbeatEnabled || log.Vulnerable || len(log.Probes) != 1 {
+		t.Errorf("got client log %+v", log)
+	}
+
+	// The client answers the server's request while waiting for data.
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if log.RequestsAnswered != 1 {
+		t.Errorf("client answered %d requests", log.RequestsAnswered)
+	}
+	if log := server.GetHeartbleedLog(); !log.HeartbeatEnabled || log.RequestsAnswered != 1 || len(log.Probes) != 1 {
+		t.Errorf("got server log %+v", log)
+	}
+}
+
+func TestHeartbleedRequestDiscarded(t *testing.T) {
+	clientConfig, serverConfig := heartbeatConfigs()
+	conn, err := echoDialer(serverConfig)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := Client(conn, clientConfig)
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	probe, err := client.SendHeartbeat(&HeartbeatRequest{PayloadLength: 4, ClaimedLength: 1000, PaddingLength: 16})
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	if probe.Responded || probe.ClaimedLength != 1000 || client.GetHeartbleedLog().Vulnerable {
+		t.Errorf("got probe %+v", probe)
+	}
+}
+
+func TestHeartbeatDuringHandshake(t *testing.T) {
+	clientConfig, serverConfig := heartbeatConfigs()
+	clientConfig.HeartbeatDuringHandshake = &HeartbeatRequest{PayloadLength: 16, PaddingLength: 16}
+	conn, err := enumerationDialer(serverConfig)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := Client(conn, clientConfig)
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	log := client.GetHeartbleedLog()
+	if len(log.Probes) != 1 {
+		t.Fatalf("got %d probes", len(log.Probes))
+	}
+	if probe := log.Probes[0]; !probe.DuringHandshake || !probe.Responded || !probe.PayloadEchoed {
+		t.Errorf("got probe %+v", probe)
+	}
+}
+
+func TestHeartbeatOverread(t *testing.T) {
+	for _, logOverread := range []bool{false, true} {
+		c := Client(nil, &Config{HeartbeatLogOverread: logOverread})
+		probe := &HeartbeatProbe{PayloadLength: 2, ClaimedLength: 6, PaddingLength: 16, payload: []byte{1, 2}}
+		c.pendingHeartbeat = probe
+		if err := c.handleHeartbeat([]byte{heartbeatTypeResponse, 0, 6, 1, 2, 3, 4, 5, 6, 0, 0}); err != nil {
+			t.Fatal(err)
+		}
+		if !probe.Responded || probe.ResponseLength != 6 || !probe.PayloadEchoed || probe.OverreadLength != 4 {
+			t.Errorf("got probe %+v", probe)
+		}
+		if logOverread != (len(probe.Overread) == 4) {
+			t.Errorf("logged over-read bytes %v with HeartbeatLogOverread %t", probe.Overread, logOverread)
+		}
+		if !c.GetHeartbleedLog().Vulnerable || c.pendingHeartbeat != nil {
+			t.Error("over-read was not reported as Heartbleed")
+		}
+	}
+}
@@ -96,12 +96,19 @@ func (ka *ecdheKeyAgreement) ClientECDHParams() *jsonKeys.ECDHParams {
 
 func (ka *dheKeyAgreement) DHParams() *jsonKeys.DHParams {
 	out := new(jsonKeys.DHParams)
+	out.NamedGroup = jsonKeys.TLSCurveID(ka.groupID)
 	if ka.p != nil {
 		out.Prime = new(big.Int).Set(ka.p)
 	}
 	if ka.g != nil {
 		out.Generator = new(big.Int).Set(ka.g)
 	}
+	if out.Prime != nil {
+		if ka.analysis == nil {
+			ka.analysis = jsonKeys.AnalyzeDHGroup(ka.p, ka.g)
+		}
+		out.Analysis = ka.analysis
+	}
 	if ka.yServer != nil {
 		out.ServerPublic = new(big.Int).Set(ka.yServer)
 		if ka.yOurs != nil && ka.xOurs != nil && ka.yServer.Cmp(ka.yOurs) == 0 {
@@ -113,6 +120,7 @@ func (ka *dheKeyAgreement) DHParams() *jsonKeys.DHParams {
 
 func (ka *dheKeyAgreement) ClientDHParams() *jsonKeys.DHParams {
 	out := new(jsonKeys.DHParams)
+	out.NamedGroup = jsonKeys.TLSCurveID(ka.groupID)
 	if ka.p != nil {
 		out.Prime = new(big.Int).Set(ka.p)
 	}
@@ -13,7 +13,16 @@ var compressionNames map[uint8]string
 var curveNames map[uint16]string
 var pointFormatNames map[uint8]string
 var clientAuthTypeNames map[int]string
+var clientCertificateModeNames map[int]string
+var clientCertificateTypeNames map[uint8]string
 var signatureSchemeNames map[uint16]string
+var handshakeMessageTypeNames map[uint8]string
+var handshakeErrorTypeNames map[int]string
+var robotVariantNames map[int]string
+var recordFaultNames map[int]string
+var scriptStepNames map[int]string
+var renegotiationSupportNames map[int]string
+var recordTypeNames map[uint8]string
 
 func init() {
 	signatureNames = make(map[uint8]string, 8)
@@ -446,6 +455,24 @@ func init() {
 	clientAuthTypeNames[3] = "VerifyClientCertIfGiven"
 	clientAuthTypeNames[4] = "RequireAndVerifyClientCert"
 
+	clientCertificateModeNames = make(map[int]string)
+	clientCertificateModeNames[0] = "ClientCertificateMatching"
+	clientCertificateModeNames[1] = "ClientCertificateConfigured"
+	clientCertificateModeNames[2] = "ClientCertificateThrowaway"
+
+	// https://www.iana.org/assignments/tls-parameters/tls-parameters.xhtml#tls-parameters-2
+	clientCertificateTypeNames = make(map[uint8]string)
+	clientCertificateTypeNames[1] = "rsa_sign"
+	clientCertificateTypeNames[2] = "dss_sign"
+	clientCertificateTypeNames[3] = "rsa_fixed_dh"
+	clientCertificateTypeNames[4] = "dss_fixed_dh"
+	clientCertificateTypeNames[5] = "rsa_ephemeral_dh_RESERVED"
+	clientCertificateTypeNames[6] = "dss_ephemeral_dh_RESERVED"
+	clientCertificateTypeNames[20] = "fortezza_dms_RESERVED"
+	clientCertificateTypeNames[64] = "ecdsa_sign"
+	clientCertificateTypeNames[65] = "rsa_fixed_ecdh"
+	clientCertificateTypeNames[66] = "ecdsa_fixed_ecdh"
+
 	// https://tools.ietf.org/html/draft-ietf-tls-tls13-18#section-4.2.3
 	signatureSchemeNames = make(map[uint16]string)
 	signatureSchemeNames[uint16(PKCS1WithSHA1)] = "rsa_pkcs1_sha1"
@@ -460,6 +487,84 @@ func init() {
 	signatureSchemeNames[uint16(ECDSAWithP521AndSHA512)] = "ecdsa_secp521r1_sha512"
 	signatureSchemeNames[uint16(EdDSAWithEd25519)] = "ed25519"
 	signatureSchemeNames[uint16(EdDSAWithEd448)] = "ed448"
+
+	// https://www.iana.org/assignments/tls-parameters/tls-parameters.xhtml#tls-parameters-7
+	handshakeMessageTypeNames = make(map[uint8]string)
+	handshakeMessageTypeNames[typeHelloRequest] = "hello_request"
+	handshakeMessageTypeNames[typeClientHello] = "client_hello"
+	handshakeMessageTypeNames[typeServerHello] = "server_hello"
+	handshakeMessageTypeNames[typeHelloVerifyRequest] = "hello_verify_request"
+	handshakeMessageTypeNames[typeNewSessionTicket] = "new_session_ticket"
+	handshakeMessageTypeNames[typeCertificate] = "certificate"
+	handshakeMessageTypeNames[typeServerKeyExchange] = "server_key_exchange"
+	handshakeMessageTypeNames[typeCertificateRequest] = "certificate_request"
+	handshakeMessageTypeNames[typeServerHelloDone] = "server_hello_done"
+	handshakeMessageTypeNames[typeCertificateVerify] = "certificate_verify"
+	handshakeMessageTypeNames[typeClientKeyExchange] = "client_key_exchange"
+	handshakeMessageTypeNames[typeFinished] = "finished"
+	handshakeMessageTypeNames[typeCertificateStatus] = "certificate_status"
+	handshakeMessageTypeNames[typeNextProtocol] = "next_protocol"
+	handshakeMessageTypeNames[typeEncryptedExtensions] = "encrypted_extensions"
+
+	handshakeErrorTypeNames = make(map[int]string)
+	handshakeErrorTypeNames[int(HandshakeErrorUnknown)] = "unknown"
+	handshakeErrorTypeNames[int(HandshakeErrorEOFBeforeServerHello)] = "eof_before_server_hello"
+	handshakeErrorTypeNames[int(HandshakeErrorEOF)] = "eof"
+	handshakeErrorTypeNames[int(HandshakeErrorTimeout)] = "timeout"
+	handshakeErrorTypeNames[int(HandshakeErrorConnection)] = "connection_error"
+	handshakeErrorTypeNames[int(HandshakeErrorNotTLS)] = "not_tls"
+	handshakeErrorTypeNames[int(HandshakeErrorVersionMismatch)] = "version_mismatch"
+	handshakeErrorTypeNames[int(HandshakeErrorNoSharedCipher)] = "no_shared_cipher"
+	handshakeErrorTypeNames[int(HandshakeErrorHandshakeFailure)] = "handshake_failure"
+	handshakeErrorTypeNames[int(HandshakeErrorBadCertificate)] = "bad_certificate"
+	handshakeErrorTypeNames[int(HandshakeErrorUnexpectedMessage)] = "unexpected_message"
+	handshakeErrorTypeNames[int(HandshakeErrorDecodeError)] = "decode_error"
+	handshakeErrorTypeNames[int(HandshakeErrorDecryptError)] = "decrypt_error"
+	handshakeErrorTypeNames[int(HandshakeErrorBadRecordMAC)] = "bad_record_mac"
+	handshakeErrorTypeNames[int(HandshakeErrorRemoteAlert)] = "remote_alert"
+	handshakeErrorTypeNames[int(HandshakeErrorLocalAlert)] = "local_alert"
+	handshakeErrorTypeNames[int(HandshakeErrorCertsOnly)] = "certs_only"
+
+	robotVariantNames = make(map[int]string)
+	robotVariantNames[int(ROBOTDisabled)] = "disabled"
+	robotVariantNames[int(ROBOTCorrect)] = "correct"
+	robotVariantNames[int(ROBOTWrongPrefix)] = "wrong_prefix"
+	robotVariantNames[int(ROBOTMisplacedZero)] = "misplaced_zero"
+	robotVariantNames[int(ROBOTMissingZero)] = "missing_zero"
+	robotVariantNames[int(ROBOTWrongVersion)] = "wrong_version"
+	robotVariantNames[int(ROBOTTruncated)] = "truncated"
+
+	recordFaultNames = make(map[int]string)
+	recordFaultNames[int(RecordFaultNone)] = "none"
+	recordFaultNames[int(RecordFaultInvalidMAC)] = "invalid_mac"
+	recordFaultNames[int(RecordFaultInvalidPadding)] = "invalid_padding"
+	recordFaultNames[int(RecordFaultPOODLE)] = "poodle"
+	recordFaultNames[int(RecordFaultLongPadding)] = "long_padding"
+
+	scriptStepNames = make(map[int]string)
+	scriptStepNames[int(ScriptSendClientHello)] = "send_client_hello"
+	scriptStepNames[int(ScriptSendCertificate)] = "send_certificate"
+	scriptStepNames[int(ScriptSendClientKeyExchange)] = "send_client_key_exchange"
+	scriptStepNames[int(ScriptSendRSAClientKeyExchange)] = "send_rsa_client_key_exchange"
+	scriptStepNames[int(ScriptSendChangeCipherSpec)] = "send_change_cipher_spec"
+	scriptStepNames[int(ScriptSendFinished)] = "send_finished"
+	scriptStepNames[int(ScriptSendApplicationData)] = "send_application_data"
+	scriptStepNames[int(ScriptReadServerFlight)] = "read_server_flight"
+	scriptStepNames[int(ScriptReadChangeCipherSpec)] = "read_change_cipher_spec"
+	scriptStepNames[int(ScriptReadFinished)] = "read_finished"
+	scriptStepNames[int(ScriptExpectNoAlert)] = "expect_no_alert"
+
+	renegotiationSupportNames = make(map[int]string)
+	renegotiationSupportNames[int(RenegotiateNever)] = "never"
+	renegotiationSupportNames[int(RenegotiateOnceAsClient)] = "once"
+	renegotiationSupportNames[int(RenegotiateFreelyAsClient)] = "freely"
+
+	recordTypeNames = make(map[uint8]string)
+	recordTypeNames[uint8(recordTypeChangeCipherSpec)] = "change_cipher_spec"
+	recordTypeNames[uint8(recordTypeAlert)] = "alert"
+	recordTypeNames[uint8(recordTypeHandshake)] = "handshake"
+	recordTypeNames[uint8(recordTypeApplicationData)] = "application_data"
+	recordTypeNames[uint8(recordTypeHeartbeat)] = "heartbeat"
 }
 
 func nameForSignature(s uint8) string {
@@ -514,6 +619,31 @@ func (pFormat PointFormat) String() string {
 	return "unknown"
 }
 
+func (certType ClientCertificateType) String() string {
+	if name, ok := clientCertificateTypeNames[uint8(certType)]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// nameForHandshakeMessageType returns the name of a handshake message type,
+// or "unknown.N" for an unrecognized type N.
+func nameForHandshakeMessageType(typ uint8) string {
+	if name, ok := handshakeMessageTypeNames[typ]; ok {
+		return name
+	}
+	return "unknown." + strconv.Itoa(int(typ))
+}
+
+// nameForRecordType returns the name of a record content type, or
+// "unknown.N" for an unrecognized type N.
+func nameForRecordType(typ uint8) string {
+	if name, ok := recordTypeNames[typ]; ok {
+		return name
+	}
+	return "unknown." + strconv.Itoa(int(typ))
+}
+
 func nameForCompressionMethod(cm uint8) string {
 	compressionMethod := CompressionMethod(cm)
 	return compressionMethod.String()
@@ -543,6 +673,12 @@ func (v TLSVersion) String() string {
 		return "TLSv1.1"
 	case 0x0303:
 		return "TLSv1.2"
+	case 0x0304:
+		return "TLSv1.3"
+	case 0xfeff:
+		return "DTLSv1.0"
+	case 0xfefd:
+		return "DTLSv1.2"
 	default:
 		return "unknown"
 	}
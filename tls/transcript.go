@@ -0,0 +1,166 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"sync"
+	"time"
+)
+
+// TranscriptRecord is a record sent or received on a connection. Raw is the
+// record as it was on the wire, header included, and Length the length of
+// its payload. The Raw of an application data record is only its header,
+// unless Config.LogTranscriptApplicationData is set. Time is when the record
+// was written to the connection, or when the last of it was read.
+type TranscriptRecord struct {
+	Sent    bool          `json:"sent"`
+	Type    string        `json:"type"`
+	Version TLSVersion    `json:"version"`
+	Length  int           `json:"length"`
+	Raw     []byte        `json:"raw"`
+	Time    time.Duration `json:"time_ns"`
+}
+
+// TranscriptMessage records when a handshake message was sent or received.
+// A message is sent when it is passed to the record layer, which may buffer
+// it with the rest of its flight.
+type TranscriptMessage struct {
+	Sent bool          `json:"sent"`
+	Type string        `json:"type"`
+	Time time.Duration `json:"time_ns"`
+}
+
+// maxTranscriptRecords is the most records a transcript keeps. Later records
+// are only counted, so that a long-lived connection does not grow its
+// transcript without bound.
+const maxTranscriptRecords = 4096
+
+// Transcript is the record of a connection kept when Config.LogTranscript
+// is set. Times are relative to when the connection was dialed by Dial or
+// DialWithDialer, or to when the Conn was created otherwise. DroppedRecords
+// counts the records after the first maxTranscriptRecords, which are not
+// kept.
+type Transcript struct {
+	Records        []TranscriptRecord  `json:"records,omitempty"`
+	Messages       []TranscriptMessage `json:"messages,omitempty"`
+	DroppedRecords int                 `json:"dropped_records,omitempty"`
+}
+
+// transcriptRecorder keeps the transcript of a connection. Its methods do
+// nothing on a nil recorder, so that connections without a transcript need
+// no checks. It has its own lock, since both halves of a connection record
+// to it.
+type transcriptRecorder struct {
+	sync.Mutex
+	start      time.Time
+	transcript Transcript
+	sent       []byte // the part of a record written so far
+	headerLen  int    // the length of record headers, which differs in DTLS
+	appData    bool   // whether application data payloads are kept
+}
+
+func newTranscriptRecorder(config *Config) *transcriptRecorder {
+	if config == nil || !config.LogTranscript {
+		return nil
+	}
+	return &transcriptRecorder{
+		start:     time.Now(),
+		headerLen: tlsRecordHeaderLen,
+		appData:   config.LogTranscriptApplicationData,
+	}
+}
+
+// recordSent adds the records in data, which was written to the connection.
+// Records may be split across calls.
+func (t *transcriptRecorder) recordSent(data []byte) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	now := time.Since(t.start)
+	t.sent = append(t.sent, data...)
+	for len(t.sent) >= t.headerLen {
+		n := t.headerLen + (int(t.sent[t.headerLen-2])<<8 | int(t.sent[t.headerLen-1]))
+		if len(t.sent) < n {
+			break
+		}
+		t.add(true, t.sent[:n], now)
+		t.sent = t.sent[n:]
+	}
+}
+
+// recordReceived adds a record read from the connection.
+func (t *transcriptRecorder) recordReceived(record []byte) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.add(false, record, time.Since(t.start))
+}
+
+func (t *transcriptRecorder) add(sent bool, record []byte, now time.Duration) {
+	if len(t.transcript.Records) >= maxTranscriptRecords {
+		t.transcript.DroppedRecords++
+		return
+	}
+	length := len(record) - t.headerLen
+	if recordType(record[0]) == recordTypeApplicationData && !t.appData {
+		record = record[:t.headerLen]
+	}
+	t.transcript.Records = append(t.transcript.Records, TranscriptRecord{
+		Sent:    sent,
+		Type:    nameForRecordType(record[0]),
+		Version: TLSVersion(uint16(record[1])<<8 | uint16(record[2])),
+		Length:  length,
+		Raw:     append([]byte(nil), record...),
+		Time:    now,
+	})
+}
+
+// message adds a handshake message of type typ.
+func (t *transcriptRecorder) message(sent bool, typ uint8) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.transcript.Messages = append(t.transcript.Messages, TranscriptMessage{
+		Sent: sent,
+		Type: nameForHandshakeMessageType(typ),
+		Time: time.Since(t.start),
+	})
+}
+
+// snapshot returns a copy of the transcript so far.
+func (t *transcriptRecorder) snapshot() *Transcript {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	return &Transcript{
+		Records:        append([]TranscriptRecord(nil), t.transcript.Records...),
+		Messages:       append([]TranscriptMessage(nil), t.transcript.Messages...),
+		DroppedRecords: t.transcript.DroppedRecords,
+	}
+}
+
+// Transcript returns the records sent and received and the handshake
+// messages so far, or nil if Config.LogTranscript was not set.
+func (c *Conn) Transcript() *Transcript {
+	return c.transcript.snapshot()
+}
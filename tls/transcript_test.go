@@ -0,0 +1,140 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package tls
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestTranscript(t *testing.T) {
+	serverConfig := testConfig.Clone()
+	serverConfig.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	clientConfig := serverConfig.Clone()
+	clientConfig.LogTranscript = true
+
+	conn, err := enumerationDialer(serverConfig)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &capturingConn{Conn: conn}
+	client := Client(recorder, clientConfig)
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	transcript := client.GetHandshakeLog().Transcript
+	if transcript == nil {
+		t.Fatal("no transcript in the handshake log")
+	}
+	if len(transcript.Records) != len(recorder.records) {
+		t.Fatalf("got %d records, want %d", len(transcript.Records), len(recorder.records))
+	}
+	for i, record := range transcript.Records {
+		want := recorder.records[i]
+		if record.Sent != want.FromClient || !bytes.Equal(record.Raw, want.Data) {
+			t.Errorf("record %d: got %v, want %v", i, record, want)
+		}
+		if record.Length != len(record.Raw)-tlsRecordHeaderLen {
+			t.Errorf("record %d: got length %d for %d bytes", i, record.Length, len(record.Raw))
+		}
+		if i > 0 && record.Time < transcript.Records[i-1].Time {
+			t.Errorf("record %d: time went backwards", i)
+		}
+	}
+	if r := transcript.Records[0]; r.Type != "handshake" || r.Version != VersionTLS10 {
+		t.Errorf("got first record of type %s and version %s", r.Type, r.Version)
+	}
+
+	var messages []string
+	for _, m := range transcript.Messages {
+		direction := "<"
+		if m.Sent {
+			direction = ">"
+		}
+		messages = append(messages, direction+m.Type)
+	}
+	want := []string{">client_hello", "<server_hello", "<certificate", "<server_key_exchange", "<server_hello_done", ">client_key_exchange", ">finished", "<finished"}
+	if !reflect.DeepEqual(messages, want) {
+		t.Errorf("got messages %v, want %v", messages, want)
+	}
+
+	if client.Transcript() == nil || len(client.Transcript().Records) < len(transcript.Records) {
+		t.Error("Conn.Transcript lost records")
+	}
+	if Client(conn, serverConfig).Transcript() != nil {
+		t.Error("got a transcript without LogTranscript")
+	}
+}
+
+func TestTranscriptApplicationData(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		clientConfig := testConfig.Clone()
+		clientConfig.LogTranscript = true
+		clientConfig.LogTranscriptApplicationData = keep
+
+		c, s := net.Pipe()
+		go func() {
+			server := Server(s, testConfig)
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(server, buf); err == nil {
+				server.Write(buf)
+			}
+			s.Close()
+		}()
+		client := Client(c, clientConfig)
+		if _, err := client.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(client, make([]byte, 5)); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+
+		var appData int
+		for _, record := range client.Transcript().Records {
+			if record.Type != "application_data" {
+				continue
+			}
+			appData++
+			want := tlsRecordHeaderLen
+			if keep {
+				want += record.Length
+			}
+			if record.Length <= 5 || len(record.Raw) != want {
+				t.Errorf("keep %t: got %d bytes of a record of length %d", keep, len(record.Raw), record.Length)
+			}
+		}
+		if appData < 2 {
+			t.Errorf("keep %t: got %d application data records", keep, appData)
+		}
+	}
+}
+
+func TestTranscriptLimit(t *testing.T) {
+	recorder := newTranscriptRecorder(&Config{LogTranscript: true})
+	record := []byte{byte(recordTypeAlert), 3, 3, 0, 2, 1, 0}
+	for i := 0; i < maxTranscriptRecords+3; i++ {
+		recorder.recordReceived(record)
+	}
+	transcript := recorder.snapshot()
+	if len(transcript.Records) != maxTranscriptRecords || transcript.DroppedRecords != 3 {
+		t.Errorf("got %d records, %d dropped", len(transcript.Records), transcript.DroppedRecords)
+	}
+}
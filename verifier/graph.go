@@ -36,6 +36,7 @@ type Graph struct {
 	edges                *GraphEdgeSet
 	nodesBySubjectAndKey map[subjectAndKeyFingerprint]*GraphNode
 	nodesBySubject       map[string][]*GraphNode  // indexed by RawSubject
+	edgesBySubject       map[string][]*GraphEdge  // indexed by RawSubject
 	missingIssuerNode    map[string]*GraphEdgeSet // indexed by RawIssuer
 }
 
@@ -66,6 +67,7 @@ func NewGraph() (g *Graph) {
 	g.edges = NewGraphEdgeSet()
 	g.nodesBySubjectAndKey = make(map[subjectAndKeyFingerprint]*GraphNode)
 	g.nodesBySubject = make(map[string][]*GraphNode)
+	g.edgesBySubject = make(map[string][]*GraphEdge)
 	g.missingIssuerNode = make(map[string]*GraphEdgeSet)
 	return
 }
@@ -113,6 +115,7 @@ func (g *Graph) AddCert(c *x509.Certificate) {
 	edge := new(GraphEdge)
 	edge.Certificate = c
 	g.edges.addOrPanic(edge)
+	g.edgesBySubject[string(c.RawSubject)] = append(g.edgesBySubject[string(c.RawSubject)], edge)
 
 	// Make the node based on this certificates subject (or find it). Connect the
 	// node to the edge as the successor / head.
@@ -253,6 +256,59 @@ func (g *Graph) IsRoot(c *x509.Certificate) bool {
 	return edge.root
 }
 
+// withIntermediates returns a new graph holding the certificates of g that c
+// may chain through, and any of intermediates that c may chain through, added
+// as non-roots. If rootsOnly is set, only the roots of g are used. Only the
+// certificates reachable from c are visited, so its cost does not grow with
+// the size of g. Unlike adding intermediates to g, it is safe to call while
+// other goroutines walk g.
+func (g *Graph) withIntermediates(c *x509.Certificate, intermediates []*x509.Certificate, rootsOnly bool) *Graph {
+	extra := make(map[string][]*x509.Certificate)
+	added := make(map[string]bool)
+	for _, cert := range intermediates {
+		fp := string(cert.FingerprintSHA256)
+		if added[fp] {
+			continue
+		}
+		added[fp] = true
+		if edge := g.FindEdge(cert.FingerprintSHA256); edge != nil && (edge.root || !rootsOnly) {
+			continue
+		}
+		s := string(cert.RawSubject)
+		extra[s] = append(extra[s], cert)
+	}
+
+	out := NewGraph()
+	if g.IsRoot(c) {
+		out.AddRoot(c)
+	}
+	visited := make(map[string]bool)
+	issuers := []string{string(c.RawIssuer)}
+	for len(issuers) > 0 {
+		issuer := issuers[0]
+		issuers = issuers[1:]
+		if visited[issuer] {
+			continue
+		}
+		visited[issuer] = true
+		for _, edge := range g.edgesBySubject[issuer] {
+			if edge.root {
+				out.AddRoot(edge.Certificate)
+			} else if !rootsOnly {
+				out.AddCert(edge.Certificate)
+			} else {
+				continue
+			}
+			issuers = append(issuers, string(edge.Certificate.RawIssuer))
+		}
+		for _, cert := range extra[issuer] {
+			out.AddCert(cert)
+			issuers = append(issuers, string(cert.RawIssuer))
+		}
+	}
+	return out
+}
+
 // AppendFromPEM adds any certificates encoded as PEM from r to the graph. If
 // root is true, it marks them as roots. It returns the number of certificates
 // parsed.
@@ -410,3 +410,31 @@ func TestAppendFromPEM(t *testing.T) {
 		}
 	}
 }
+
+func TestGraphWithIntermediates(t *testing.T) {
+	leaf := loadPEM(data.PEMDoDRootCA3SignedByDoDInteropCA2Serial655)
+	intermediate := loadPEM(data.PEMDoDInteropCA2SignedByFederalBridgeCA2016)
+	root := loadPEM(data.PEMFederalBridgeCA2016SignedByFederalCommonPolicyCA)
+	unrelated := loadPEM(data.PEMDAdrianIOSignedByLEX3)
+
+	g := NewGraph()
+	g.AddRoot(root)
+	g.AddCert(unrelated)
+
+	out := g.withIntermediates(leaf, []*x509.Certificate{intermediate}, false)
+	if edge := out.FindEdge(intermediate.FingerprintSHA256); edge == nil || edge.root {
+		t.Error("expected the intermediate as a non-root")
+	}
+	if !out.IsRoot(root) {
+		t.Error("expected the root to be copied as a root")
+	}
+	if out.FindEdge(unrelated.FingerprintSHA256) != nil {
+		t.Error("expected the unreachable certificate to be left out")
+	}
+	if g.FindEdge(intermediate.FingerprintSHA256) != nil {
+		t.Error("expected the base graph to be unchanged")
+	}
+	if len(g.Edges()) != 2 {
+		t.Errorf("expected 2 edges in the base graph, got %d", len(g.Edges()))
+	}
+}
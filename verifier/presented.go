@@ -0,0 +1,214 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package verifier
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/zmap/zcrypto/x509"
+)
+
+// maxPresentedChainLength is the most presented certificates that are used.
+// Analyzing the chain compares each pair of certificates, so any beyond it are
+// ignored.
+const maxPresentedChainLength = 16
+
+// PresentedChainResult is the analysis of the chain presented along with a
+// certificate, such as the certificates sent by a TLS server. RFC 5246
+// requires a server to send its certificate first, followed by the
+// certificates needed to chain it to a trusted root, each certifying the one
+// before it. Servers often do not.
+type PresentedChainResult struct {
+	// Valid is true if the presented certificates alone, without the
+	// intermediates in the PKI, chain the certificate to a root in the PKI
+	// at VerifyTime.
+	Valid bool
+
+	// OutOfOrder is true if the certificate being verified is not first,
+	// or if a certificate comes before one that it issued.
+	OutOfOrder bool
+
+	// MissingIntermediates are the intermediates in the PKI that a
+	// currently valid chain goes through, but which were not presented. It
+	// is empty if the chain is Valid.
+	MissingIntermediates []*x509.Certificate
+
+	// UnnecessaryRoots are presented certificates which are roots in the
+	// PKI, or self-signed, and so cannot help to build a chain.
+	UnnecessaryRoots []*x509.Certificate
+
+	// Duplicates are certificates that were presented more than once.
+	Duplicates []*x509.Certificate
+
+	// Unrelated are presented certificates that did not issue the
+	// certificate being verified, nor any of its presented issuers.
+	Unrelated []*x509.Certificate
+
+	// Truncated is true if more than maxPresentedChainLength certificates
+	// were presented. Only the first maxPresentedChainLength are used.
+	Truncated bool
+}
+
+// issued returns true if child names parent as its issuer, and parent's key
+// signed it.
+func issued(parent, child *x509.Certificate) bool {
+	if !bytes.Equal(child.RawIssuer, parent.RawSubject) {
+		return false
+	}
+	return x509.CheckSignatureFromKey(parent.PublicKey, child.SignatureAlgorithm, child.RawTBSCertificate, child.Signature) == nil
+}
+
+func (v *Verifier) analyzePresentedChain(c *x509.Certificate, res *VerificationResult, opts VerificationOptions) *PresentedChainResult {
+	presented := opts.Presented
+	out := new(PresentedChainResult)
+
+	// Build chains through the presented certificates and the roots alone.
+	alone := v.PKI.withIntermediates(c, presented, true)
+	out.Valid = len(currentChains(alone.WalkChains(c), opts)) > 0
+
+	// Deduplicate, keeping the first of each certificate. position maps
+	// each presented certificate to its index in unique.
+	index := make(map[string]int)
+	var unique []*x509.Certificate
+	position := make([]int, len(presented))
+	for i, cert := range presented {
+		fp := string(cert.FingerprintSHA256)
+		if j, ok := index[fp]; ok {
+			out.Duplicates = appendUnique(out.Duplicates, cert)
+			position[i] = j
+			continue
+		}
+		index[fp] = len(unique)
+		position[i] = len(unique)
+		unique = append(unique, cert)
+	}
+
+	// Check each signature once. nodes is unique, followed by c if it was
+	// not presented, and issuedBy[i][j] is true if nodes[i] issued nodes[j].
+	nodes := unique
+	leaf, ok := index[string(c.FingerprintSHA256)]
+	if !ok {
+		leaf = len(nodes)
+		nodes = append(nodes[:len(nodes):len(nodes)], c)
+	}
+	issuedBy := make([][]bool, len(nodes))
+	for i, parent := range nodes {
+		issuedBy[i] = make([]bool, len(nodes))
+		for j, child := range nodes {
+			issuedBy[i][j] = issued(parent, child)
+		}
+	}
+
+	if !presented[0].FingerprintSHA256.Equal(c.FingerprintSHA256) {
+		out.OutOfOrder = true
+	}
+	for i := range presented {
+		for _, j := range position[i+1:] {
+			if position[i] != j && issuedBy[position[i]][j] {
+				out.OutOfOrder = true
+			}
+		}
+	}
+
+	for i, cert := range unique {
+		if i == leaf {
+			continue
+		}
+		if v.PKI.IsRoot(cert) || issuedBy[i][i] {
+			out.UnnecessaryRoots = append(out.UnnecessaryRoots, cert)
+		}
+	}
+
+	// A certificate is related to c if it issued c, or issued a certificate
+	// related to c.
+	related := make([]bool, len(nodes))
+	related[leaf] = true
+	for changed := true; changed; {
+		changed = false
+		for i := range nodes {
+			if related[i] {
+				continue
+			}
+			for j := range nodes {
+				if related[j] && issuedBy[i][j] {
+					related[i] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	for i, cert := range unique {
+		if !related[i] {
+			out.Unrelated = append(out.Unrelated, cert)
+		}
+	}
+
+	if !out.Valid {
+		for _, chain := range res.CurrentChains {
+			if len(chain) < 3 {
+				continue
+			}
+			for _, cert := range chain[1 : len(chain)-1] {
+				if _, ok := index[string(cert.FingerprintSHA256)]; !ok {
+					out.MissingIntermediates = appendUnique(out.MissingIntermediates, cert)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// currentChains returns the chains that are valid at opts.VerifyTime.
+func currentChains(chains []x509.CertificateChain, opts VerificationOptions) []x509.CertificateChain {
+	current, _, _ := x509.FilterByDate(chains, opts.VerifyTime)
+	return current
+}
+
+// appendUnique appends c to certs, unless it is already there.
+func appendUnique(certs []*x509.Certificate, c *x509.Certificate) []*x509.Certificate {
+	for _, cert := range certs {
+		if cert.FingerprintSHA256.Equal(c.FingerprintSHA256) {
+			return certs
+		}
+	}
+	return append(certs, c)
+}
+
+// presentedChainResultJSON is the JSON form of a PresentedChainResult, with
+// certificates given as their SHA-256 fingerprints.
+type presentedChainResultJSON struct {
+	Valid                bool                          `json:"valid"`
+	OutOfOrder           bool                          `json:"out_of_order"`
+	MissingIntermediates []x509.CertificateFingerprint `json:"missing_intermediates,omitempty"`
+	UnnecessaryRoots     []x509.CertificateFingerprint `json:"unnecessary_roots,omitempty"`
+	Duplicates           []x509.CertificateFingerprint `json:"duplicates,omitempty"`
+	Unrelated            []x509.CertificateFingerprint `json:"unrelated,omitempty"`
+	Truncated            bool                          `json:"truncated,omitempty"`
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (r *PresentedChainResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&presentedChainResultJSON{
+		Valid:                r.Valid,
+		OutOfOrder:           r.OutOfOrder,
+		MissingIntermediates: fingerprints(r.MissingIntermediates),
+		UnnecessaryRoots:     fingerprints(r.UnnecessaryRoots),
+		Duplicates:           fingerprints(r.Duplicates),
+		Unrelated:            fingerprints(r.Unrelated),
+		Truncated:            r.Truncated,
+	})
+}
@@ -0,0 +1,227 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package verifier
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/zmap/zcrypto/x509"
+
+	data "github.com/zmap/zcrypto/data/test/certificates"
+)
+
+// presentedTests index into the certificates leaf, intermediate, root and
+// unrelated, in that order.
+var presentedTests = []struct {
+	name          string
+	presented     []int
+	intermediates []int
+
+	valid                bool
+	outOfOrder           bool
+	missingIntermediates []int
+	unnecessaryRoots     []int
+	duplicates           []int
+	unrelated            []int
+}{
+	{
+		name:      "complete",
+		presented: []int{0, 1},
+		valid:     true,
+	},
+	{
+		name:             "with-root",
+		presented:        []int{0, 1, 2},
+		valid:            true,
+		unnecessaryRoots: []int{2},
+	},
+	{
+		name:       "leaf-not-first",
+		presented:  []int{1, 0},
+		valid:      true,
+		outOfOrder: true,
+	},
+	{
+		name:             "root-before-intermediate",
+		presented:        []int{0, 2, 1},
+		valid:            true,
+		outOfOrder:       true,
+		unnecessaryRoots: []int{2},
+	},
+	{
+		name:                 "missing-intermediate",
+		presented:            []int{0},
+		intermediates:        []int{1},
+		missingIntermediates: []int{1},
+	},
+	{
+		name:      "missing-intermediate-not-in-pki",
+		presented: []int{0},
+	},
+	{
+		name:       "duplicate",
+		presented:  []int{0, 1, 1},
+		valid:      true,
+		duplicates: []int{1},
+	},
+	{
+		name:       "leaf-not-presented",
+		presented:  []int{1},
+		valid:      true,
+		outOfOrder: true,
+	},
+	{
+		name:      "unrelated",
+		presented: []int{0, 3, 1},
+		valid:     true,
+		unrelated: []int{3},
+	},
+}
+
+func TestPresentedChain(t *testing.T) {
+	certs := loadPEMs([]string{
+		data.PEMGoogleSignedByGIAG2,
+		data.PEMGIAG2SignedByGeoTrust,
+		data.PEMGeoTrustSignedBySelf,
+		data.PEMLEX3SignedByDSTRootCAX3,
+	})
+	pick := func(indices []int) (out []*x509.Certificate) {
+		for _, i := range indices {
+			out = append(out, certs[i])
+		}
+		return
+	}
+	equal := func(got []*x509.Certificate, want []int) bool {
+		if len(got) != len(want) {
+			return false
+		}
+		for i, c := range pick(want) {
+			if !got[i].FingerprintSHA256.Equal(c.FingerprintSHA256) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, test := range presentedTests {
+		pki := NewGraph()
+		pki.AddRoot(certs[2])
+		for _, c := range pick(test.intermediates) {
+			pki.AddCert(c)
+		}
+		res := NewNSS(pki).Verify(certs[0], VerificationOptions{
+			VerifyTime: time.Unix(1395785200, 0),
+			Presented:  pick(test.presented),
+		})
+		pc := res.PresentedChain
+		if pc == nil {
+			t.Errorf("%s: no presented chain result", test.name)
+			continue
+		}
+		if pc.Valid != test.valid {
+			t.Errorf("%s: got valid %t, want %t", test.name, pc.Valid, test.valid)
+		}
+		if pc.OutOfOrder != test.outOfOrder {
+			t.Errorf("%s: got out of order %t, want %t", test.name, pc.OutOfOrder, test.outOfOrder)
+		}
+		if !equal(pc.MissingIntermediates, test.missingIntermediates) {
+			t.Errorf("%s: got %d missing intermediates, want %v", test.name, len(pc.MissingIntermediates), test.missingIntermediates)
+		}
+		if !equal(pc.UnnecessaryRoots, test.unnecessaryRoots) {
+			t.Errorf("%s: got %d unnecessary roots, want %v", test.name, len(pc.UnnecessaryRoots), test.unnecessaryRoots)
+		}
+		if !equal(pc.Duplicates, test.duplicates) {
+			t.Errorf("%s: got %d duplicates, want %v", test.name, len(pc.Duplicates), test.duplicates)
+		}
+		if !equal(pc.Unrelated, test.unrelated) {
+			t.Errorf("%s: got %d unrelated, want %v", test.name, len(pc.Unrelated), test.unrelated)
+		}
+		if wantTrusted := test.valid || len(test.intermediates) > 0; res.HasTrustedChain() != wantTrusted {
+			t.Errorf("%s: got trusted chain %t, want %t", test.name, res.HasTrustedChain(), wantTrusted)
+		}
+	}
+}
+
+func TestPresentedChainTruncated(t *testing.T) {
+	leaf := loadPEM(data.PEMGoogleSignedByGIAG2)
+	intermediate := loadPEM(data.PEMGIAG2SignedByGeoTrust)
+	root := loadPEM(data.PEMGeoTrustSignedBySelf)
+	unrelated := loadPEM(data.PEMLEX3SignedByDSTRootCAX3)
+	pki := NewGraph()
+	pki.AddRoot(root)
+	v := NewNSS(pki)
+
+	presented := x509.CertificateChain{leaf}
+	for len(presented) < maxPresentedChainLength-1 {
+		presented = append(presented, unrelated)
+	}
+	presented = append(presented, intermediate)
+	res := v.Verify(leaf, VerificationOptions{
+		VerifyTime: time.Unix(1395785200, 0),
+		Presented:  presented,
+	})
+	if pc := res.PresentedChain; !pc.Valid || pc.Truncated {
+		t.Errorf("got valid %t, truncated %t at the limit", pc.Valid, pc.Truncated)
+	}
+
+	// Push the intermediate past the limit.
+	presented = append(presented[:len(presented)-1], unrelated, intermediate)
+	res = v.Verify(leaf, VerificationOptions{
+		VerifyTime: time.Unix(1395785200, 0),
+		Presented:  presented,
+	})
+	pc := res.PresentedChain
+	if pc.Valid || !pc.Truncated {
+		t.Errorf("got valid %t, truncated %t past the limit", pc.Valid, pc.Truncated)
+	}
+	if res.HasTrustedChain() {
+		t.Error("built a chain through a certificate past the limit")
+	}
+	if len(pc.Duplicates) != 1 || len(pc.Unrelated) != 1 {
+		t.Errorf("got %d duplicates and %d unrelated, want 1 and 1", len(pc.Duplicates), len(pc.Unrelated))
+	}
+}
+
+func TestPresentedChainMarshalJSON(t *testing.T) {
+	leaf := loadPEM(data.PEMGoogleSignedByGIAG2)
+	root := loadPEM(data.PEMGeoTrustSignedBySelf)
+	pki := NewGraph()
+	pki.AddRoot(root)
+	res := NewNSS(pki).Verify(leaf, VerificationOptions{
+		VerifyTime: time.Unix(1395785200, 0),
+		Presented:  x509.CertificateChain{leaf, root},
+	})
+	b, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		PresentedChain *struct {
+			Valid            bool     `json:"valid"`
+			UnnecessaryRoots []string `json:"unnecessary_roots"`
+		} `json:"presented_chain"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.PresentedChain == nil || out.PresentedChain.Valid {
+		t.Fatalf("got %s", b)
+	}
+	if roots := out.PresentedChain.UnnecessaryRoots; len(roots) != 1 || roots[0] != root.FingerprintSHA256.Hex() {
+		t.Errorf("got unnecessary roots %v", roots)
+	}
+}
@@ -15,6 +15,7 @@
 package verifier
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/zmap/zcrypto/x509"
@@ -87,6 +88,10 @@ type VerificationResult struct {
 	// ParentSPKISubjectFingerprint is the SHA256 of the (SPKI, Subject) for
 	// parents of this certificate.
 	ParentSPKISubjectFingerprint x509.CertificateFingerprint
+
+	// PresentedChain is the analysis of the Presented chain in the
+	// VerificationOptions, if one was given.
+	PresentedChain *PresentedChainResult
 }
 
 // MatchesDomain returns true if NameError == nil and Name != "".
@@ -107,6 +112,77 @@ func (res *VerificationResult) HadTrustedChain() bool {
 	return res.HasTrustedChain() || len(res.ValidAtExpirationChains) > 0
 }
 
+// verificationResultJSON is the JSON form of a VerificationResult. Errors are
+// given as strings, and certificates as their SHA-256 fingerprints.
+type verificationResultJSON struct {
+	Name                         string                          `json:"name,omitempty"`
+	Whitelisted                  bool                            `json:"whitelisted"`
+	Blacklisted                  bool                            `json:"blacklisted"`
+	InRevocationSet              bool                            `json:"in_revocation_set"`
+	ValidationError              string                          `json:"validation_error,omitempty"`
+	NameError                    string                          `json:"name_error,omitempty"`
+	MatchesDomain                bool                            `json:"matches_domain"`
+	HasTrustedChain              bool                            `json:"has_trusted_chain"`
+	HadTrustedChain              bool                            `json:"had_trusted_chain"`
+	Parents                      []x509.CertificateFingerprint   `json:"parents,omitempty"`
+	CurrentChains                [][]x509.CertificateFingerprint `json:"current_chains,omitempty"`
+	ExpiredChains                [][]x509.CertificateFingerprint `json:"expired_chains,omitempty"`
+	NeverValidChains             [][]x509.CertificateFingerprint `json:"never_valid_chains,omitempty"`
+	ValidAtExpirationChains      [][]x509.CertificateFingerprint `json:"valid_at_expiration_chains,omitempty"`
+	CertificateType              x509.CertificateType            `json:"certificate_type"`
+	VerifyTime                   time.Time                       `json:"verify_time"`
+	Expired                      bool                            `json:"expired"`
+	ParentSPKISubjectFingerprint x509.CertificateFingerprint     `json:"parent_spki_subject_fingerprint,omitempty"`
+	PresentedChain               *PresentedChainResult           `json:"presented_chain,omitempty"`
+}
+
+func fingerprintChains(chains []x509.CertificateChain) (out [][]x509.CertificateFingerprint) {
+	for _, chain := range chains {
+		out = append(out, fingerprints(chain))
+	}
+	return
+}
+
+func fingerprints(certs []*x509.Certificate) (out []x509.CertificateFingerprint) {
+	for _, c := range certs {
+		out = append(out, c.FingerprintSHA256)
+	}
+	return
+}
+
+// MarshalJSON implements the json.Marshaler interface. Without it, the errors
+// would encode as empty objects, and every certificate in every chain would be
+// encoded in full, repeating the same certificates many times over in each
+// handshake log that records a VerificationResult.
+func (res *VerificationResult) MarshalJSON() ([]byte, error) {
+	aux := &verificationResultJSON{
+		Name:                         res.Name,
+		Whitelisted:                  res.Whitelisted,
+		Blacklisted:                  res.Blacklisted,
+		InRevocationSet:              res.InRevocationSet,
+		MatchesDomain:                res.MatchesDomain(),
+		HasTrustedChain:              res.HasTrustedChain(),
+		HadTrustedChain:              res.HadTrustedChain(),
+		Parents:                      fingerprints(res.Parents),
+		CurrentChains:                fingerprintChains(res.CurrentChains),
+		ExpiredChains:                fingerprintChains(res.ExpiredChains),
+		NeverValidChains:             fingerprintChains(res.NeverValidChains),
+		ValidAtExpirationChains:      fingerprintChains(res.ValidAtExpirationChains),
+		CertificateType:              res.CertificateType,
+		VerifyTime:                   res.VerifyTime,
+		Expired:                      res.Expired,
+		ParentSPKISubjectFingerprint: res.ParentSPKISubjectFingerprint,
+		PresentedChain:               res.PresentedChain,
+	}
+	if res.ValidationError != nil {
+		aux.ValidationError = res.ValidationError.Error()
+	}
+	if res.NameError != nil {
+		aux.NameError = res.NameError.Error()
+	}
+	return json.Marshal(aux)
+}
+
 // VerifyProcedure is an interface to implement additional browser specific logic at
 // the start and end of verification.
 type VerifyProcedure interface {
@@ -116,9 +192,25 @@ type VerifyProcedure interface {
 // VerificationOptions contains settings for Verifier.Verify().
 // VerificationOptions should be safely copyable.
 type VerificationOptions struct {
-	VerifyTime     time.Time
-	Name           string
-	PresentedChain *Graph // XXX: Unused
+	VerifyTime time.Time
+	Name       string
+
+	// PresentedChain is unused.
+	//
+	// Deprecated: Use Presented.
+	PresentedChain *Graph
+
+	// Presented is the chain presented along with the certificate, such as
+	// the certificates sent by a TLS server, in the order they were sent.
+	// Chains may be built through it, and it is analyzed in
+	// VerificationResult.PresentedChain. Only the first
+	// maxPresentedChainLength certificates are used.
+	Presented x509.CertificateChain
+
+	// Intermediates are certificates which chains may be built through in
+	// addition to those in the PKI and the Presented chain. They are never
+	// treated as roots.
+	Intermediates []*x509.Certificate
 }
 
 func (opt *VerificationOptions) clean() {
@@ -172,10 +264,21 @@ func (v *Verifier) Verify(c *x509.Certificate, opts VerificationOptions) (res *V
 
 	res = new(VerificationResult)
 	res.Name = opts.Name
+	res.VerifyTime = opts.VerifyTime
 	res.Expired = !c.TimeInValidityPeriod(opts.VerifyTime)
 
+	truncated := len(opts.Presented) > maxPresentedChainLength
+	if truncated {
+		opts.Presented = opts.Presented[:maxPresentedChainLength]
+	}
+
 	// Build chains back to the roots.
-	graphChains := v.PKI.WalkChains(c)
+	pki := v.PKI
+	intermediates := append(opts.Intermediates[:len(opts.Intermediates):len(opts.Intermediates)], opts.Presented...)
+	if len(intermediates) > 0 {
+		pki = pki.withIntermediates(c, intermediates, false)
+	}
+	graphChains := pki.WalkChains(c)
 	res.CurrentChains, res.ExpiredChains, res.NeverValidChains = x509.FilterByDate(graphChains, opts.VerifyTime)
 
 	// If we have a DNSName, verify the leaf certificate matches.
@@ -224,5 +327,10 @@ func (v *Verifier) Verify(c *x509.Certificate, opts VerificationOptions) (res *V
 		copy(res.ParentSPKISubjectFingerprint, fp)
 	}
 
+	if len(opts.Presented) > 0 {
+		res.PresentedChain = v.analyzePresentedChain(c, res, opts)
+		res.PresentedChain.Truncated = truncated
+	}
+
 	return
 }
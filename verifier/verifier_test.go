@@ -17,7 +17,9 @@ package verifier
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
@@ -587,6 +589,38 @@ var verifyTests = []verifyTest{
 	},
 }
 
+// presentedVerifyTests build chains through certificates which are only in the
+// presented chain, not in the PKI.
+var presentedVerifyTests = []verifyTest{
+	{
+		Name: "google-presented-intermediate",
+		Leaf: data.PEMGoogleSignedByGIAG2,
+		Presented: []string{
+			data.PEMGIAG2SignedByGeoTrust,
+		},
+		Roots: []string{
+			data.PEMGeoTrustSignedBySelf,
+		},
+		CurrentTime: 1395785200,
+		DNSName:     "www.google.com",
+		ExpectedChains: [][]int{
+			[]int{0, 1, 2},
+		},
+		ExpectedParents: []int{1},
+	},
+	{
+		Name: "google-presented-root-not-trusted",
+		Leaf: data.PEMGoogleSignedByGIAG2,
+		Presented: []string{
+			data.PEMGIAG2SignedByGeoTrust,
+			data.PEMGeoTrustSignedBySelf,
+		},
+		CurrentTime:     1395785200,
+		ExpectedChains:  nil,
+		ExpectedParents: nil,
+	},
+}
+
 func TestVerify(t *testing.T) {
 	for _, test := range verifyTests {
 		test.parseSelf()
@@ -598,3 +632,124 @@ func TestVerify(t *testing.T) {
 		}
 	}
 }
+
+func TestVerifyPresented(t *testing.T) {
+	for _, test := range presentedVerifyTests {
+		test.parseSelf()
+		v := test.makeVerifier()
+		opts := test.makeVerifyOptions()
+		opts.Presented = append(x509.CertificateChain{test.parsedLeaf()}, test.presented...)
+		verifyResult := v.Verify(test.parsedLeaf(), *opts)
+		if err := test.checkVerifyResult(verifyResult); err != nil {
+			t.Errorf("%s: %s", test.Name, err)
+		}
+	}
+}
+
+func TestVerificationResultMarshalJSON(t *testing.T) {
+	leaf := loadPEM(data.PEMGoogleSignedByGIAG2)
+	intermediate := loadPEM(data.PEMGIAG2SignedByGeoTrust)
+	root := loadPEM(data.PEMGeoTrustSignedBySelf)
+	pki := NewGraph()
+	pki.AddRoot(root)
+	v := NewNSS(pki)
+	res := v.Verify(leaf, VerificationOptions{
+		VerifyTime:    time.Unix(1395785200, 0),
+		Name:          "www.example.com",
+		Intermediates: []*x509.Certificate{intermediate},
+	})
+	b, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		NameError       string     `json:"name_error"`
+		MatchesDomain   bool       `json:"matches_domain"`
+		HasTrustedChain bool       `json:"has_trusted_chain"`
+		Parents         []string   `json:"parents"`
+		CurrentChains   [][]string `json:"current_chains"`
+		VerifyTime      time.Time  `json:"verify_time"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.NameError == "" || out.MatchesDomain {
+		t.Errorf("name matched: %s", b)
+	}
+	if !out.HasTrustedChain {
+		t.Errorf("no trusted chain: %s", b)
+	}
+	if len(out.Parents) != 1 || out.Parents[0] != intermediate.FingerprintSHA256.Hex() {
+		t.Errorf("got parents %v", out.Parents)
+	}
+	want := []string{leaf.FingerprintSHA256.Hex(), intermediate.FingerprintSHA256.Hex(), root.FingerprintSHA256.Hex()}
+	if len(out.CurrentChains) != 1 || strings.Join(out.CurrentChains[0], "|") != strings.Join(want, "|") {
+		t.Errorf("got chains %v, want [%v]", out.CurrentChains, want)
+	}
+	if !out.VerifyTime.Equal(time.Unix(1395785200, 0)) {
+		t.Errorf("got verify time %v", out.VerifyTime)
+	}
+}
+
+func TestVerificationResultMarshalJSONExpired(t *testing.T) {
+	leaf := loadPEM(data.PEMGoogleSignedByGIAG2)
+	intermediate := loadPEM(data.PEMGIAG2SignedByGeoTrust)
+	root := loadPEM(data.PEMGeoTrustSignedBySelf)
+	pki := NewGraph()
+	pki.AddRoot(root)
+	pki.AddCert(intermediate)
+	v := NewNSS(pki)
+	res := v.Verify(leaf, VerificationOptions{
+		VerifyTime: time.Unix(1451606400, 0), // 2016-01-01T00:00:00
+		Presented:  x509.CertificateChain{leaf, intermediate},
+	})
+	b, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"current_chains", "name", "name_error", "validation_error"} {
+		if _, ok := out[key]; ok {
+			t.Errorf("unexpected %s: %s", key, b)
+		}
+	}
+	for key, want := range map[string]bool{"expired": true, "has_trusted_chain": false, "had_trusted_chain": true} {
+		if got, ok := out[key].(bool); !ok || got != want {
+			t.Errorf("got %s %v, want %t", key, out[key], want)
+		}
+	}
+	chains, ok := out["expired_chains"].([]interface{})
+	if !ok || len(chains) != 1 {
+		t.Fatalf("got expired chains %v", out["expired_chains"])
+	}
+	if chain, ok := chains[0].([]interface{}); !ok || len(chain) != 3 || chain[0] != leaf.FingerprintSHA256.Hex() {
+		t.Errorf("got expired chain %v", chains[0])
+	}
+	if _, ok := out["presented_chain"].(map[string]interface{}); !ok {
+		t.Errorf("missing presented chain: %s", b)
+	}
+}
+
+func TestVerificationResultMarshalJSONErrors(t *testing.T) {
+	res := &VerificationResult{
+		ValidationError: errors.New("no chain"),
+		NameError:       errors.New("bad name"),
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		ValidationError string `json:"validation_error"`
+		NameError       string `json:"name_error"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.ValidationError != "no chain" || out.NameError != "bad name" {
+		t.Errorf("got errors %q and %q", out.ValidationError, out.NameError)
+	}
+}
@@ -40,3 +40,22 @@ func TestWalk(t *testing.T) {
 		}
 	}
 }
+
+func TestWalkPresented(t *testing.T) {
+	for _, test := range presentedVerifyTests {
+		g := NewGraph()
+		test.parseSelf()
+
+		for _, c := range test.presented {
+			g.AddCert(c)
+		}
+		for _, c := range test.parsedRoots() {
+			g.AddRoot(c)
+		}
+
+		actualChains := g.WalkChains(test.parsedLeaf())
+		if err := test.compareChains(test.unionAllExpected(), actualChains); err != nil {
+			t.Errorf("%s: %s", test.Name, err)
+		}
+	}
+}
@@ -316,6 +316,7 @@ func (c *Certificate) MarshalJSON() ([]byte, error) {
 	case *rsa.PublicKey:
 		rsaKey := new(jsonKeys.RSAPublicKey)
 		rsaKey.PublicKey = key
+		rsaKey.Analysis = c.RSAKeyAnalysis()
 		jc.SubjectKeyInfo.RSAPublicKey = rsaKey
 	case *dsa.PublicKey:
 		AddDSAPublicKeyToKeyMap(keyMap, key)
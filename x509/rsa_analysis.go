@@ -0,0 +1,71 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package x509
+
+import (
+	"crypto/rsa"
+	"math/big"
+
+	jsonKeys "github.com/zmap/zcrypto/json"
+)
+
+// AnalyzeRSAKey checks the certificate's RSA key for weaknesses and records
+// the result, which is then included in the JSON output. It returns nil if the
+// key is not RSA. The checks are costly, so they are only run when asked for.
+func (c *Certificate) AnalyzeRSAKey(opts jsonKeys.RSAAnalysisOptions) *jsonKeys.RSAAnalysis {
+	key, ok := c.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil
+	}
+	c.rsaKeyAnalysis = jsonKeys.AnalyzeRSAKey(key, opts)
+	if c.rsaKeyAnalysis != nil && c.rsaSharedFactor != nil {
+		c.rsaKeyAnalysis.RecordSharedFactor(c.rsaSharedFactor)
+	}
+	return c.rsaKeyAnalysis
+}
+
+// RSAKeyAnalysis returns the analysis recorded by AnalyzeRSAKey, or nil if
+// the key has not been analyzed.
+func (c *Certificate) RSAKeyAnalysis() *jsonKeys.RSAAnalysis {
+	return c.rsaKeyAnalysis
+}
+
+// FindSharedRSAFactors runs a batch GCD over the RSA moduli of certs. Each
+// certificate whose modulus shares a prime with another in the corpus has the
+// factor recorded in its key analysis, whether the key is analyzed before or
+// after. It returns the number of certificates affected.
+func FindSharedRSAFactors(certs []*Certificate) int {
+	var moduli []*big.Int
+	var owners []*Certificate
+	for _, c := range certs {
+		key, ok := c.PublicKey.(*rsa.PublicKey)
+		if !ok || key.N == nil || key.N.Cmp(big.NewInt(1)) <= 0 {
+			continue
+		}
+		moduli = append(moduli, key.N)
+		owners = append(owners, c)
+	}
+	found := 0
+	for i, factor := range jsonKeys.BatchGCD(moduli) {
+		if factor != nil {
+			owners[i].rsaSharedFactor = factor
+			if owners[i].rsaKeyAnalysis != nil {
+				owners[i].rsaKeyAnalysis.RecordSharedFactor(factor)
+			}
+			found++
+		}
+	}
+	return found
+}
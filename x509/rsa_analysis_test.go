@@ -0,0 +1,102 @@
+/*
+ * ZCrypto Copyright 2017 Regents of the University of Michigan
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not
+ * use this file except in compliance with the License. You may obtain a copy
+ * of the License at http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+ * implied. See the License for the specific language governing
+ * permissions and limitations under the License.
+ */
+
+package x509
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"testing"
+
+	jsonKeys "github.com/zmap/zcrypto/json"
+)
+
+func TestFindSharedRSAFactors(t *testing.T) {
+	primes := make([]*big.Int, 3)
+	for i := range primes {
+		var err error
+		if primes[i], err = rand.Prime(rand.Reader, 256); err != nil {
+			t.Fatal(err)
+		}
+	}
+	certs := []*Certificate{
+		{PublicKey: &rsa.PublicKey{N: new(big.Int).Mul(primes[0], primes[1]), E: 65537}},
+		{PublicKey: &rsa.PublicKey{N: new(big.Int).Mul(primes[0], primes[2]), E: 65537}},
+		{PublicKey: &rsa.PublicKey{N: new(big.Int).Mul(primes[1], primes[1]), E: 65537}},
+		{PublicKey: "not an RSA key"},
+	}
+	if found := FindSharedRSAFactors(certs); found != 3 {
+		t.Errorf("found %d certificates with shared factors, expected 3", found)
+	}
+	for i, c := range certs[:3] {
+		analysis := c.AnalyzeRSAKey(jsonKeys.RSAAnalysisOptions{})
+		if analysis == nil || !analysis.SharedFactor || !analysis.Weak {
+			t.Errorf("certificate %d was not marked as sharing a factor", i)
+		}
+	}
+	if certs[3].AnalyzeRSAKey(jsonKeys.RSAAnalysisOptions{}) != nil {
+		t.Error("non-RSA certificate has an RSA analysis")
+	}
+}
+
+func TestRSAKeyAnalysisJSON(t *testing.T) {
+	b, err := ioutil.ReadFile(testdataPrefix + "davidadrian.org.cert")
+	if err != nil {
+		t.Fatalf("could not open file: %s", err)
+	}
+	p, _ := pem.Decode(b)
+	if p == nil {
+		t.Fatalf("bad pem")
+	}
+	c, err := ParseCertificate(p.Bytes)
+	if err != nil {
+		t.Fatalf("could not parse: %s", err)
+	}
+	out, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte(`"analysis"`)) {
+		t.Fatal("the key was analyzed without being asked to")
+	}
+	c.AnalyzeRSAKey(jsonKeys.RSAAnalysisOptions{})
+	if out, err = json.Marshal(c); err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		SubjectKeyInfo struct {
+			RSAPublicKey struct {
+				Analysis *struct {
+					ExponentClass string `json:"exponent_class"`
+					Weak          bool   `json:"weak"`
+				} `json:"analysis"`
+			} `json:"rsa_public_key"`
+		} `json:"subject_key_info"`
+	}
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	analysis := parsed.SubjectKeyInfo.RSAPublicKey.Analysis
+	if analysis == nil {
+		t.Fatal("certificate JSON has no RSA key analysis")
+	}
+	if analysis.ExponentClass != "standard" || analysis.Weak {
+		t.Errorf("unexpected analysis %+v", *analysis)
+	}
+}
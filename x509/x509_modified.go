@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/weppos/publicsuffix-go/publicsuffix"
+	jsonKeys "github.com/zmap/zcrypto/json"
 	"github.com/zmap/zcrypto/x509/ct"
 	"github.com/zmap/zcrypto/x509/pkix"
 )
@@ -337,6 +338,10 @@ type Certificate struct {
 	// Internal
 	validSignature bool
 
+	// Set by FindSharedRSAFactors and AnalyzeRSAKey
+	rsaSharedFactor *big.Int
+	rsaKeyAnalysis  *jsonKeys.RSAAnalysis
+
 	// CT
 	SignedCertificateTimestampList []*ct.SignedCertificateTimestamp
 